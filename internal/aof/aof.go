@@ -2,38 +2,121 @@ package aof
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
 	"os"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/Novip1906/my-redis/internal/resp"
 )
 
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+// ErrRewriteInProgress is returned when a rewrite is started while another
+// one is running.
+var ErrRewriteInProgress = errors.New("Background append only file rewriting already in progress")
+
+// FsyncPolicy tells when the log is flushed to disk.
+type FsyncPolicy int
+
+const (
+	// FsyncEverySec flushes the log to disk once a second, so an outage
+	// loses up to a second of writes.
+	FsyncEverySec FsyncPolicy = iota
+	// FsyncAlways flushes each write to disk before Write returns.
+	FsyncAlways
+	// FsyncNo hands the log to the OS once a second and lets it decide when
+	// to flush it to disk.
+	FsyncNo
+)
+
+// ParseFsyncPolicy parses the appendfsync setting: always, everysec or no.
+func ParseFsyncPolicy(name string) (FsyncPolicy, error) {
+	switch strings.ToLower(name) {
+	case "everysec":
+		return FsyncEverySec, nil
+	case "always":
+		return FsyncAlways, nil
+	case "no":
+		return FsyncNo, nil
+	}
+	return 0, fmt.Errorf("invalid appendfsync policy %q", name)
+}
+
 type AOF struct {
+	path   string
+	policy FsyncPolicy
 	file   *os.File
 	writer *bufio.Writer
+	buf    []byte
 	mu     sync.Mutex
 	quit   chan struct{}
 	closed bool
+
+	// syncMu serializes fsyncs, which run without mu so that commands are
+	// still appended meanwhile. An fsync covers everything written before it
+	// started, so the writers waiting for it under FsyncAlways share the next
+	// one. synced is how much of the file is known to be on disk.
+	syncMu sync.Mutex
+	synced int64
+
+	// size is the size of the file, and baseSize its size after it was last
+	// rewritten or opened, which automatic rewrites compare it with. crc is
+	// the CRC64 of the file, which tells whether a snapshot taken at some
+	// point of the log still matches it.
+	size     int64
+	baseSize int64
+	crc      uint64
+	// rewriting is set from BeginRewrite to the end of CommitRewrite, and
+	// rewriteBuf then collects the commands written meanwhile, that the
+	// snapshot being written out does not have.
+	rewriting  bool
+	rewriteBuf []byte
 }
 
-func NewAOF(path string) (*AOF, error) {
+func NewAOF(path string, policy FsyncPolicy) (*AOF, error) {
 	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
 		return nil, err
 	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	crc, err := Checksum(path, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
 
 	a := &AOF{
-		file:   file,
-		writer: bufio.NewWriter(file),
-		quit:   make(chan struct{}),
+		path:     path,
+		policy:   policy,
+		file:     file,
+		writer:   bufio.NewWriter(file),
+		quit:     make(chan struct{}),
+		size:     info.Size(),
+		baseSize: info.Size(),
+		synced:   info.Size(),
+		crc:      crc,
 	}
 
-	go a.syncLoop()
+	if policy != FsyncAlways {
+		go a.syncLoop()
+	}
 
 	return a, nil
 }
 
 func (a *AOF) Close() error {
+	a.syncMu.Lock()
+	defer a.syncMu.Unlock()
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
@@ -48,22 +131,184 @@ func (a *AOF) Close() error {
 	return a.file.Close()
 }
 
-func (a *AOF) Write(command string) error {
+// Write appends a command to the log. Commands are stored in the RESP format,
+// so arguments may contain any bytes including newlines. Under FsyncAlways it
+// returns once the command is on disk.
+func (a *AOF) Write(args [][]byte) error {
 	a.mu.Lock()
-	defer a.mu.Unlock()
 
 	if a.closed {
+		a.mu.Unlock()
 		return os.ErrClosed
 	}
 
-	if !strings.HasSuffix(command, "\n") {
-		command += "\n"
+	a.buf = resp.AppendCommand(a.buf[:0], args)
+	if a.rewriting {
+		a.rewriteBuf = append(a.rewriteBuf, a.buf...)
 	}
 
-	_, err := a.writer.WriteString(command)
-	return err
+	n, err := a.writer.Write(a.buf)
+	a.size += int64(n)
+	a.crc = crc64.Update(a.crc, crcTable, a.buf[:n])
+	written := a.size
+	a.mu.Unlock()
+
+	if err != nil || a.policy != FsyncAlways {
+		return err
+	}
+	return a.sync(written)
 }
 
+// sync makes sure the file is on disk up to offset, unless an fsync already
+// did it while the caller waited for its turn.
+func (a *AOF) sync(offset int64) error {
+	a.syncMu.Lock()
+	defer a.syncMu.Unlock()
+
+	if a.synced >= offset {
+		return nil
+	}
+
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return os.ErrClosed
+	}
+	err := a.writer.Flush()
+	file, size := a.file, a.size
+	a.mu.Unlock()
+
+	if err != nil || size == a.synced {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	a.synced = size
+	return nil
+}
+
+// Sync flushes everything written so far to disk.
+func (a *AOF) Sync() error {
+	return a.sync(math.MaxInt64)
+}
+
+// Position returns the size of the file and the CRC64 of its content, with
+// which Checksum tells whether the file still starts with the same commands.
+func (a *AOF) Position() (offset int64, crc uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.size, a.crc
+}
+
+// Size returns the size of the file and its size when it was last rewritten
+// or opened.
+func (a *AOF) Size() (size, baseSize int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.size, a.baseSize
+}
+
+// BeginRewrite starts collecting the commands written from now on, that a
+// snapshot of the dataset taken at the same time lacks. The caller has to
+// make sure no command is written meanwhile, and then write the snapshot out
+// with CommitRewrite.
+func (a *AOF) BeginRewrite() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch {
+	case a.closed:
+		return os.ErrClosed
+	case a.rewriting:
+		return ErrRewriteInProgress
+	}
+	a.rewriting = true
+	a.rewriteBuf = nil
+	return nil
+}
+
+// CommitRewrite replaces the log with the commands passed to write by
+// snapshot, followed by those written since BeginRewrite. The new log is
+// written to a temporary file renamed over the old one, so that the old log
+// stays complete until then. Commands are still appended to it meanwhile and
+// only wait for the collected commands to be copied to the new file.
+func (a *AOF) CommitRewrite(snapshot func(write func(args [][]byte) error) error) (err error) {
+	defer func() {
+		a.mu.Lock()
+		a.rewriting = false
+		a.rewriteBuf = nil
+		a.mu.Unlock()
+	}()
+
+	tmpPath := a.path + ".rewrite"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	writer := bufio.NewWriter(file)
+	var (
+		buf []byte
+		crc uint64
+	)
+	err = snapshot(func(args [][]byte) error {
+		buf = resp.AppendCommand(buf[:0], args)
+		crc = crc64.Update(crc, crcTable, buf)
+		_, err := writer.Write(buf)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	// Fsyncs of the old file must not run into it being closed.
+	a.syncMu.Lock()
+	defer a.syncMu.Unlock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return os.ErrClosed
+	}
+	if _, err := writer.Write(a.rewriteBuf); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, a.path); err != nil {
+		return err
+	}
+
+	// Whatever is buffered for the old file is in the new one already.
+	a.file.Close()
+	a.file, a.writer = file, writer
+	a.size, a.baseSize, a.synced = info.Size(), info.Size(), info.Size()
+	a.crc = crc64.Update(crc, crcTable, a.rewriteBuf)
+	return nil
+}
+
+// syncLoop hands the log to the OS once a second and, under FsyncEverySec,
+// flushes it to disk.
 func (a *AOF) syncLoop() {
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
@@ -71,10 +316,13 @@ func (a *AOF) syncLoop() {
 	for {
 		select {
 		case <-ticker.C:
+			if a.policy == FsyncEverySec {
+				a.sync(math.MaxInt64)
+				continue
+			}
 			a.mu.Lock()
 			if !a.closed {
 				a.writer.Flush()
-				a.file.Sync()
 			}
 			a.mu.Unlock()
 		case <-a.quit:
@@ -83,7 +331,14 @@ func (a *AOF) syncLoop() {
 	}
 }
 
-func ReadAll(path string, callback func(line string)) error {
+// ReadAll replays every command stored in the file. Files written by older
+// versions contain one inline command per line and are read as well.
+func ReadAll(path string, callback func(args [][]byte)) error {
+	return ReadFrom(path, 0, callback)
+}
+
+// ReadFrom replays the commands stored in the file from offset on.
+func ReadFrom(path string, offset int64, callback func(args [][]byte)) error {
 	file, err := os.Open(path)
 	if os.IsNotExist(err) {
 		return nil
@@ -93,10 +348,35 @@ func ReadAll(path string, callback func(line string)) error {
 	}
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		callback(scanner.Text())
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
 	}
 
-	return scanner.Err()
+	reader := resp.NewReader(file)
+	for {
+		args, err := reader.ReadCommand()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		callback(args)
+	}
+}
+
+// Checksum returns the CRC64 of the first n bytes of the file, which is what
+// Position returned when the file had that size.
+func Checksum(path string, n int64) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	crc := crc64.New(crcTable)
+	if _, err := io.CopyN(crc, file, n); err != nil {
+		return 0, err
+	}
+	return crc.Sum64(), nil
 }
@@ -1,24 +1,37 @@
 package aof
 
 import (
+	"errors"
+	"os"
 	"path/filepath"
+	"reflect"
 	"sync"
 	"testing"
 )
 
+func toArgs(parts ...string) [][]byte {
+	args := make([][]byte, len(parts))
+	for i, part := range parts {
+		args[i] = []byte(part)
+	}
+	return args
+}
+
 func TestAOF_WritexRead(t *testing.T) {
 	dir := t.TempDir()
 	dbPath := filepath.Join(dir, "database_test.aof")
 
-	aof, err := NewAOF(dbPath)
+	aof, err := NewAOF(dbPath, FsyncEverySec)
 	if err != nil {
 		t.Fatalf("Failed to create AOF: %v", err)
 	}
 
-	commands := []string{
-		"SET key1 value1",
-		"SET key2 value2\n",
-		"DEL key1",
+	commands := [][][]byte{
+		toArgs("SET", "key1", "value1"),
+		toArgs("SET", "key 2", "multi\r\nline\tvalue  with spaces"),
+		toArgs("SET", "bin", "\x00\xff\x1f\x8b"),
+		toArgs("SET", "empty", ""),
+		toArgs("DEL", "key1"),
 	}
 
 	for _, cmd := range commands {
@@ -31,31 +44,52 @@ func TestAOF_WritexRead(t *testing.T) {
 		t.Fatalf("Failed to close AOF: %v", err)
 	}
 
-	var recoveredCommands []string
-	err = ReadAll(dbPath, func(line string) {
-		recoveredCommands = append(recoveredCommands, line)
+	var recoveredCommands [][][]byte
+	err = ReadAll(dbPath, func(args [][]byte) {
+		recoveredCommands = append(recoveredCommands, args)
 	})
 	if err != nil {
 		t.Fatalf("Failed to read AOF: %v", err)
 	}
 
 	if len(recoveredCommands) != len(commands) {
-		t.Errorf("Expected %d commands, got %d", len(commands), len(recoveredCommands))
+		t.Fatalf("Expected %d commands, got %d", len(commands), len(recoveredCommands))
 	}
 
-	expected := []string{"SET key1 value1", "SET key2 value2", "DEL key1"}
 	for i, cmd := range recoveredCommands {
-		if cmd != expected[i] {
-			t.Errorf("Line %d: expected %q, got %q", i, expected[i], cmd)
+		if !reflect.DeepEqual(cmd, commands[i]) {
+			t.Errorf("Command %d: expected %q, got %q", i, commands[i], cmd)
 		}
 	}
 }
 
+func TestReadAll_LegacyTextFormat(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "legacy.aof")
+
+	if err := os.WriteFile(dbPath, []byte("SET key1 value1\nINCR counter\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	var recovered [][][]byte
+	err := ReadAll(dbPath, func(args [][]byte) {
+		recovered = append(recovered, args)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][][]byte{toArgs("SET", "key1", "value1"), toArgs("INCR", "counter")}
+	if !reflect.DeepEqual(recovered, expected) {
+		t.Errorf("Expected %q, got %q", expected, recovered)
+	}
+}
+
 func TestAOF_ConcurrentWrite(t *testing.T) {
 	dir := t.TempDir()
 	dbPath := filepath.Join(dir, "database_test.aof")
 
-	aof, err := NewAOF(dbPath)
+	aof, err := NewAOF(dbPath, FsyncEverySec)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -68,7 +102,7 @@ func TestAOF_ConcurrentWrite(t *testing.T) {
 	for i := 0; i < n; i++ {
 		go func(val int) {
 			defer wg.Done()
-			err := aof.Write("SET key value")
+			err := aof.Write(toArgs("SET", "key", "value"))
 			if err != nil {
 				t.Errorf("Concurrent write failed: %v", err)
 			}
@@ -79,10 +113,10 @@ func TestAOF_ConcurrentWrite(t *testing.T) {
 	aof.Close()
 
 	linesCount := 0
-	err = ReadAll(dbPath, func(line string) {
+	err = ReadAll(dbPath, func(args [][]byte) {
 		linesCount++
-		if line != "SET key value" {
-			t.Errorf("Corrupted line detected: %q", line)
+		if !reflect.DeepEqual(args, toArgs("SET", "key", "value")) {
+			t.Errorf("Corrupted command detected: %q", args)
 		}
 	})
 
@@ -91,15 +125,209 @@ func TestAOF_ConcurrentWrite(t *testing.T) {
 	}
 
 	if linesCount != n {
-		t.Errorf("Expected %d lines, got %d. Mutex might be failing.", n, linesCount)
+		t.Errorf("Expected %d commands, got %d. Mutex might be failing.", n, linesCount)
 	}
 }
 
 func TestReadAll_NoFile(t *testing.T) {
-	err := ReadAll("aopdapodspd.aof", func(line string) {
+	err := ReadAll("aopdapodspd.aof", func(args [][]byte) {
 		t.Error("Callback should not be called for non-existent file")
 	})
 	if err != nil {
 		t.Errorf("Expected no error for missing file, got: %v", err)
 	}
 }
+
+func TestAOF_Rewrite(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "database_test.aof")
+
+	aof, err := NewAOF(dbPath, FsyncEverySec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aof.Close()
+
+	for range 10 {
+		aof.Write(toArgs("INCR", "counter"))
+	}
+
+	if err := aof.BeginRewrite(); err != nil {
+		t.Fatal(err)
+	}
+	if err := aof.BeginRewrite(); err != ErrRewriteInProgress {
+		t.Errorf("Expected ErrRewriteInProgress, got %v", err)
+	}
+
+	// Written while the snapshot is written out.
+	aof.Write(toArgs("INCR", "counter"))
+	err = aof.CommitRewrite(func(write func(args [][]byte) error) error {
+		aof.Write(toArgs("DEL", "other"))
+		return write(toArgs("SET", "counter", "10"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	aof.Write(toArgs("INCR", "counter"))
+	aof.Close()
+
+	var recovered [][][]byte
+	if err := ReadAll(dbPath, func(args [][]byte) { recovered = append(recovered, args) }); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][][]byte{
+		toArgs("SET", "counter", "10"),
+		toArgs("INCR", "counter"),
+		toArgs("DEL", "other"),
+		toArgs("INCR", "counter"),
+	}
+	if !reflect.DeepEqual(recovered, expected) {
+		t.Errorf("Expected %q, got %q", expected, recovered)
+	}
+
+	info, err := os.Stat(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, baseSize := aof.Size(); size != info.Size() || baseSize >= size {
+		t.Errorf("Size() = %d, %d with a file of %d bytes", size, baseSize, info.Size())
+	}
+	if _, err := os.Stat(dbPath + ".rewrite"); !os.IsNotExist(err) {
+		t.Errorf("Temporary file left behind: %v", err)
+	}
+}
+
+func TestAOF_RewriteFailureKeepsLog(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "database_test.aof")
+
+	aof, err := NewAOF(dbPath, FsyncEverySec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aof.Close()
+
+	aof.Write(toArgs("SET", "a", "1"))
+	aof.BeginRewrite()
+	aof.Write(toArgs("SET", "b", "2"))
+	failure := errors.New("snapshot failed")
+	err = aof.CommitRewrite(func(write func(args [][]byte) error) error {
+		return failure
+	})
+	if err != failure {
+		t.Errorf("Expected the snapshot error, got %v", err)
+	}
+	if err := aof.BeginRewrite(); err != nil {
+		t.Errorf("Failed rewrite left the AOF rewriting: %v", err)
+	}
+	aof.Close()
+
+	var recovered [][][]byte
+	if err := ReadAll(dbPath, func(args [][]byte) { recovered = append(recovered, args) }); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][][]byte{toArgs("SET", "a", "1"), toArgs("SET", "b", "2")}
+	if !reflect.DeepEqual(recovered, expected) {
+		t.Errorf("Expected %q, got %q", expected, recovered)
+	}
+}
+
+func TestAOF_FsyncAlways(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "database_test.aof")
+
+	aof, err := NewAOF(dbPath, FsyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aof.Close()
+
+	n := 50
+	var wg sync.WaitGroup
+	for range n {
+		wg.Go(func() {
+			if err := aof.Write(toArgs("INCR", "counter")); err != nil {
+				t.Errorf("Write failed: %v", err)
+			}
+		})
+	}
+	wg.Wait()
+
+	// Everything written is in the file before Write returns.
+	count := 0
+	if err := ReadAll(dbPath, func(args [][]byte) { count++ }); err != nil {
+		t.Fatal(err)
+	}
+	if count != n {
+		t.Errorf("Expected %d commands in the file, got %d", n, count)
+	}
+}
+
+func TestAOF_PositionMatchesChecksum(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "database_test.aof")
+
+	aof, err := NewAOF(dbPath, FsyncEverySec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aof.Write(toArgs("SET", "a", "1"))
+	aof.Close()
+
+	// The CRC carries over when the file is opened again.
+	aof, err = NewAOF(dbPath, FsyncEverySec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aof.Close()
+	aof.Write(toArgs("SET", "b", "2"))
+	offset, crc := aof.Position()
+	aof.Write(toArgs("SET", "c", "3"))
+	if err := aof.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := Checksum(dbPath, offset); err != nil || got != crc {
+		t.Errorf("Checksum = %x, %v, want %x", got, err, crc)
+	}
+	var tail [][][]byte
+	if err := ReadFrom(dbPath, offset, func(args [][]byte) { tail = append(tail, args) }); err != nil {
+		t.Fatal(err)
+	}
+	if want := [][][]byte{toArgs("SET", "c", "3")}; !reflect.DeepEqual(tail, want) {
+		t.Errorf("ReadFrom = %q, want %q", tail, want)
+	}
+
+	// A rewrite starts over, and the old position no longer matches.
+	aof.BeginRewrite()
+	aof.Write(toArgs("SET", "d", "4"))
+	err = aof.CommitRewrite(func(write func(args [][]byte) error) error {
+		return write(toArgs("SET", "a", "1"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := Checksum(dbPath, offset); got == crc {
+		t.Error("Checksum matches the position from before the rewrite")
+	}
+	offset, crc = aof.Position()
+	if got, err := Checksum(dbPath, offset); err != nil || got != crc {
+		t.Errorf("Checksum after rewrite = %x, %v, want %x", got, err, crc)
+	}
+}
+
+func TestParseFsyncPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy FsyncPolicy
+		valid  bool
+	}{
+		{"always", FsyncAlways, true},
+		{"everysec", FsyncEverySec, true},
+		{"No", FsyncNo, true},
+		{"sometimes", 0, false},
+	}
+
+	for _, tt := range tests {
+		policy, err := ParseFsyncPolicy(tt.name)
+		if (err == nil) != tt.valid || policy != tt.policy {
+			t.Errorf("ParseFsyncPolicy(%q) = %v, %v", tt.name, policy, err)
+		}
+	}
+}
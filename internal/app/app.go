@@ -1,54 +1,153 @@
 package app
 
 import (
+	"errors"
 	"log/slog"
+	"sync"
+	"time"
 
 	"github.com/Novip1906/my-redis/internal/aof"
 	"github.com/Novip1906/my-redis/internal/compute"
 	"github.com/Novip1906/my-redis/internal/config"
 	"github.com/Novip1906/my-redis/internal/network"
+	"github.com/Novip1906/my-redis/internal/storage"
 )
 
 type App struct {
 	server     *network.TCPServer
 	parser     *compute.Parser
+	storage    *storage.MemoryStorage
 	cfg        *config.Config
 	aofService *aof.AOF
 	log        *slog.Logger
+	quit       chan struct{}
+
+	saveRules []saveRule
+	// saveMu guards the state of snapshots: whether one is being saved, and
+	// when the last one was taken, and how many changes were made by then.
+	saveMu          sync.Mutex
+	saving          bool
+	lastSave        time.Time
+	lastSaveDirty   int64
+	lastSaveAttempt time.Time
+	lastSaveFailed  bool
 }
 
-func NewApp(log *slog.Logger, cfg *config.Config, storage compute.Storage) (*App, error) {
+func NewApp(log *slog.Logger, cfg *config.Config, storage *storage.MemoryStorage) (*App, error) {
 	parser := compute.NewParser(storage)
 
-	aofService, err := aof.NewAOF(cfg.AOFPath)
+	policy, err := aof.ParseFsyncPolicy(cfg.AppendFsync)
+	if err != nil {
+		return nil, err
+	}
+	saveRules, err := parseSaveRules(cfg.Save)
+	if err != nil {
+		return nil, err
+	}
+
+	aofService, err := aof.NewAOF(cfg.AOFPath, policy)
 	if err != nil {
 		log.Error("Failed to init AOF", "error", err)
 	}
 
 	server := network.NewTCPServer(cfg.Address, parser, aofService, log)
 
-	return &App{
+	app := &App{
 		server:     server,
 		log:        log,
 		parser:     parser,
+		storage:    storage,
 		aofService: aofService,
 		cfg:        cfg,
-	}, nil
+		quit:       make(chan struct{}),
+		saveRules:  saveRules,
+		lastSave:   time.Now(),
+	}
+	parser.SetPersistence(app)
+	return app, nil
 }
 
 func (a *App) Run() error {
-	a.log.Info("Restoring data from AOF...")
-	err := aof.ReadAll(a.cfg.AOFPath, func(line string) {
-		a.parser.ProcessCommand(line)
-	})
-	if err != nil {
-		a.log.Error("Failed to restore AOF", "error", err)
-	}
-	a.log.Info("Data restored")
+	a.restore()
+
+	a.storage.StartActiveExpire(a.cfg.ActiveExpireHz)
+	go a.cron()
+
 	return a.server.Start()
 }
 
 func (a *App) Stop() {
-	a.aofService.Close()
+	close(a.quit)
 	a.server.Stop()
+	a.storage.StopActiveExpire()
+	a.aofService.Close()
+}
+
+// RewriteAOF starts replacing the AOF with the commands that rebuild the
+// dataset, in the background. The snapshot of the dataset is taken while no
+// command is between changing it and being appended to the AOF, so each
+// command is either in the snapshot or among those appended after it. Taking
+// it copies nothing, like for SAVE, so commands are not held up for long.
+func (a *App) RewriteAOF() error {
+	if a.aofService == nil {
+		return errors.New("AOF is disabled")
+	}
+
+	var (
+		snapshot *storage.Snapshot
+		err      error
+	)
+	a.parser.PauseWrites(func() {
+		if err = a.aofService.BeginRewrite(); err == nil {
+			snapshot = a.storage.Snapshot()
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		a.log.Info("Rewriting AOF...")
+		err := a.aofService.CommitRewrite(snapshot.Rewrite)
+		snapshot.Release()
+		if err != nil {
+			a.log.Error("Failed to rewrite AOF", "error", err)
+			return
+		}
+		a.log.Info("AOF rewritten")
+	}()
+	return nil
+}
+
+// cron runs the automatic AOF rewrites and saves once a second.
+func (a *App) cron() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.autoRewriteAOF()
+			a.autoSave()
+		case <-a.quit:
+			return
+		}
+	}
+}
+
+// autoRewriteAOF rewrites the AOF when it has grown by the configured
+// percentage since it was last rewritten and reached the minimum size.
+func (a *App) autoRewriteAOF() {
+	if a.aofService == nil || a.cfg.AutoAOFRewritePercentage <= 0 {
+		return
+	}
+
+	size, baseSize := a.aofService.Size()
+	growth := (size - baseSize) * 100 / max(baseSize, 1)
+	if size < a.cfg.AutoAOFRewriteMinSize || growth < int64(a.cfg.AutoAOFRewritePercentage) {
+		return
+	}
+	if err := a.RewriteAOF(); err != nil && !errors.Is(err, aof.ErrRewriteInProgress) {
+		a.log.Error("Failed to start AOF rewrite", "error", err)
+	}
 }
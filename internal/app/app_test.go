@@ -0,0 +1,223 @@
+package app
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Novip1906/my-redis/internal/compute"
+	"github.com/Novip1906/my-redis/internal/config"
+	"github.com/Novip1906/my-redis/internal/resp"
+	"github.com/Novip1906/my-redis/internal/storage"
+)
+
+// startApp restores an App from the files in dir like Run does, without
+// listening for clients.
+func startApp(t *testing.T, dir, save string) *App {
+	t.Helper()
+	cfg := &config.Config{
+		AOFPath:      filepath.Join(dir, "database.aof"),
+		SnapshotPath: filepath.Join(dir, "dump.rdb"),
+		AppendFsync:  "everysec",
+		Save:         save,
+	}
+	app, err := NewApp(slog.New(slog.DiscardHandler), cfg, storage.NewMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.aofService.Close() })
+
+	app.restore()
+	return app
+}
+
+// run executes commands like a client of the App does.
+func run(t *testing.T, app *App, commands ...string) resp.Value {
+	t.Helper()
+	var response resp.Value
+	for _, command := range commands {
+		var args [][]byte
+		for _, field := range strings.Fields(command) {
+			args = append(args, []byte(field))
+		}
+		response, _ = app.parser.ExecuteAndAppend(compute.NewSession(1), args, app.aofService)
+		if response.IsError() {
+			t.Fatalf("Command: %q, got: %+v", command, response)
+		}
+	}
+	return response
+}
+
+func expect(t *testing.T, app *App, command string, want resp.Value) {
+	t.Helper()
+	if got := run(t, app, command); !reflect.DeepEqual(got, want) {
+		t.Errorf("Command: %q, got: %+v, want: %+v", command, got, want)
+	}
+}
+
+func TestApp_RestoreSnapshotAndAOFTail(t *testing.T) {
+	dir := t.TempDir()
+
+	app := startApp(t, dir, "")
+	run(t, app, "INCR counter", "INCR counter", "INCR counter", "SET gone v")
+	expect(t, app, "SAVE", resp.OK)
+	run(t, app, "INCR counter", "INCR counter", "DEL gone")
+	app.aofService.Close()
+
+	// Replaying the whole AOF on top of the snapshot would count twice.
+	app = startApp(t, dir, "")
+	expect(t, app, "GET counter", resp.BulkString("5"))
+	expect(t, app, "EXISTS gone", resp.Integer(0))
+	app.aofService.Close()
+
+	// A corrupt snapshot is ignored in favour of the whole AOF.
+	data, err := os.ReadFile(app.cfg.SnapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	os.WriteFile(app.cfg.SnapshotPath, data, 0666)
+
+	app = startApp(t, dir, "")
+	expect(t, app, "GET counter", resp.BulkString("5"))
+}
+
+func TestApp_RestoreAfterAOFRewrite(t *testing.T) {
+	dir := t.TempDir()
+
+	app := startApp(t, dir, "")
+	run(t, app, "INCR counter", "INCR counter", "INCR counter")
+	expect(t, app, "SAVE", resp.OK)
+	run(t, app, "SET other v")
+	expect(t, app, "BGREWRITEAOF", resp.SimpleString("Background append only file rewriting started"))
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if _, baseSize := app.aofService.Size(); baseSize > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("AOF was not rewritten")
+		}
+	}
+	run(t, app, "INCR counter")
+	app.aofService.Close()
+
+	// The snapshot no longer matches the start of the AOF.
+	app = startApp(t, dir, "")
+	expect(t, app, "GET counter", resp.BulkString("4"))
+	expect(t, app, "GET other", resp.BulkString("v"))
+	expect(t, app, "DBSIZE", resp.Integer(2))
+}
+
+func TestApp_AOFRewriteWhileWriting(t *testing.T) {
+	dir := t.TempDir()
+
+	app := startApp(t, dir, "")
+	for i := range 10000 {
+		run(t, app, fmt.Sprintf("SET key:%d %d", i, i), fmt.Sprintf("SADD set:%d %d", i%100, i))
+	}
+	expect(t, app, "BGREWRITEAOF", resp.SimpleString("Background append only file rewriting started"))
+
+	// The commands run while the snapshot is written out are appended after it.
+	writes := 0
+	for deadline := time.Now().Add(5 * time.Second); ; writes++ {
+		if _, baseSize := app.aofService.Size(); baseSize > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("AOF was not rewritten")
+		}
+		key := writes % 10000
+		run(t, app, "INCR counter", fmt.Sprintf("APPEND key:%d x", key), fmt.Sprintf("SREM set:%d %d", key%100, key))
+	}
+	app.aofService.Close()
+
+	restarted := startApp(t, dir, "")
+	expect(t, restarted, "GET counter", resp.BulkString(strconv.Itoa(writes)))
+	for i := range 10000 {
+		command := fmt.Sprintf("GET key:%d", i)
+		expect(t, restarted, command, run(t, app, command))
+	}
+	for i := range 100 {
+		command := fmt.Sprintf("SCARD set:%d", i)
+		expect(t, restarted, command, run(t, app, command))
+	}
+}
+
+func TestApp_RestoreSnapshotWithoutAOF(t *testing.T) {
+	dir := t.TempDir()
+
+	app := startApp(t, dir, "")
+	run(t, app, "INCR counter", "INCR counter", "RPUSH list a b")
+	expect(t, app, "SAVE", resp.OK)
+	app.aofService.Close()
+	os.Remove(app.cfg.AOFPath)
+
+	app = startApp(t, dir, "")
+	expect(t, app, "GET counter", resp.BulkString("2"))
+	run(t, app, "INCR counter")
+	app.aofService.Close()
+
+	// The AOF was rebuilt from the snapshot, and restores the data alone.
+	os.Remove(app.cfg.SnapshotPath)
+	app = startApp(t, dir, "")
+	expect(t, app, "GET counter", resp.BulkString("3"))
+	expect(t, app, "LRANGE list 0 -1", resp.Array(resp.BulkString("a"), resp.BulkString("b")))
+}
+
+func TestApp_AutoSave(t *testing.T) {
+	dir := t.TempDir()
+
+	app := startApp(t, dir, "3600 1 0 2")
+	run(t, app, "SET a 1")
+	app.autoSave()
+	if _, err := os.Stat(app.cfg.SnapshotPath); !os.IsNotExist(err) {
+		t.Fatalf("Saved a snapshot after a single change: %v", err)
+	}
+
+	run(t, app, "SET b 2")
+	app.autoSave()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		app.saveMu.Lock()
+		saved := app.lastSaveDirty == 2
+		app.saveMu.Unlock()
+		if saved {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("No snapshot saved after two changes")
+		}
+	}
+	app.aofService.Close()
+
+	os.Remove(app.cfg.AOFPath)
+	app = startApp(t, dir, "")
+	expect(t, app, "DBSIZE", resp.Integer(2))
+}
+
+func TestParseSaveRules(t *testing.T) {
+	rules, err := parseSaveRules(" 3600 1\n300 100 ")
+	want := []saveRule{{time.Hour, 1}, {5 * time.Minute, 100}}
+	if err != nil || !reflect.DeepEqual(rules, want) {
+		t.Errorf("parseSaveRules = %v, %v, want %v", rules, err, want)
+	}
+	if rules, err := parseSaveRules(""); err != nil || len(rules) != 0 {
+		t.Errorf("parseSaveRules of no rules = %v, %v", rules, err)
+	}
+
+	for _, bad := range []string{"3600", "3600 1 300", "hour 1", "3600 one", "-1 1", "1 -1", "1.5 1"} {
+		if _, err := parseSaveRules(bad); err == nil {
+			t.Errorf("parseSaveRules(%q) accepted", bad)
+		}
+	}
+
+	cfg := &config.Config{AOFPath: filepath.Join(t.TempDir(), "database.aof"), AppendFsync: "everysec", Save: "60"}
+	if _, err := NewApp(slog.New(slog.DiscardHandler), cfg, storage.NewMemoryStorage()); err == nil {
+		t.Error("NewApp accepted invalid save rules")
+	}
+}
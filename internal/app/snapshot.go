@@ -0,0 +1,254 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Novip1906/my-redis/internal/aof"
+	"github.com/Novip1906/my-redis/internal/compute"
+	"github.com/Novip1906/my-redis/internal/storage"
+)
+
+var errSaveInProgress = errors.New("Background save already in progress")
+
+// The auxiliary fields of a snapshot that tell where in the AOF it was taken:
+// the size of the AOF and its CRC64 at that point.
+const (
+	auxAOFOffset = "aof-offset"
+	auxAOFCRC    = "aof-crc"
+)
+
+// saveRetryDelay is how long automatic saves wait after a failed one.
+const saveRetryDelay = 5 * time.Second
+
+// saveRule asks for a snapshot once changes writes were made in the given
+// time since the last one.
+type saveRule struct {
+	after   time.Duration
+	changes int64
+}
+
+// parseSaveRules parses "<seconds> <changes>" pairs.
+func parseSaveRules(rules string) ([]saveRule, error) {
+	fields := strings.Fields(rules)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid save rules %q: want <seconds> <changes> pairs", rules)
+	}
+
+	parsed := make([]saveRule, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err1 := strconv.ParseInt(fields[i], 10, 64)
+		changes, err2 := strconv.ParseInt(fields[i+1], 10, 64)
+		if err1 != nil || err2 != nil || seconds < 0 || changes < 0 {
+			return nil, fmt.Errorf("invalid save rule %q", fields[i]+" "+fields[i+1])
+		}
+		parsed = append(parsed, saveRule{after: time.Duration(seconds) * time.Second, changes: changes})
+	}
+	return parsed, nil
+}
+
+// pendingSave is a snapshot being saved, with what it is saved along with.
+type pendingSave struct {
+	snapshot *storage.Snapshot
+	aux      map[string]string
+	dirty    int64
+	at       time.Time
+}
+
+// Save writes a snapshot of the dataset and returns once it is on disk.
+// Other commands do not wait for it, see storage.Snapshot.
+func (a *App) Save() error {
+	save, err := a.beginSave()
+	if err != nil {
+		return err
+	}
+	return a.finishSave(save)
+}
+
+// BGSave starts writing a snapshot of the dataset in the background.
+func (a *App) BGSave() error {
+	save, err := a.beginSave()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := a.finishSave(save); err != nil {
+			a.log.Error("Failed to save snapshot", "error", err)
+			return
+		}
+		a.log.Info("Snapshot saved")
+	}()
+	return nil
+}
+
+// beginSave takes a snapshot of the dataset along with the position of the
+// AOF it matches, so that the commands appended later can be replayed after
+// loading it. Writes are paused meanwhile, which takes constant time as the
+// snapshot is only collected while it is written out.
+func (a *App) beginSave() (*pendingSave, error) {
+	a.saveMu.Lock()
+	if a.saving {
+		a.saveMu.Unlock()
+		return nil, errSaveInProgress
+	}
+	a.saving = true
+	a.saveMu.Unlock()
+
+	save := &pendingSave{aux: make(map[string]string)}
+	a.parser.PauseWrites(func() {
+		save.snapshot = a.storage.Snapshot()
+		save.dirty = a.parser.Dirty()
+		save.at = time.Now()
+		if a.aofService != nil {
+			offset, crc := a.aofService.Position()
+			save.aux[auxAOFOffset] = strconv.FormatInt(offset, 10)
+			save.aux[auxAOFCRC] = strconv.FormatUint(crc, 10)
+		}
+	})
+	return save, nil
+}
+
+func (a *App) finishSave(save *pendingSave) error {
+	err := a.writeSnapshot(save)
+	save.snapshot.Release()
+
+	a.saveMu.Lock()
+	defer a.saveMu.Unlock()
+
+	a.saving = false
+	a.lastSaveAttempt = save.at
+	a.lastSaveFailed = err != nil
+	if err == nil {
+		a.lastSave = save.at
+		a.lastSaveDirty = save.dirty
+	}
+	return err
+}
+
+// writeSnapshot writes the snapshot to a temporary file renamed over the
+// previous one, once the AOF it continues with is on disk too.
+func (a *App) writeSnapshot(save *pendingSave) (err error) {
+	tmpPath := a.cfg.SnapshotPath + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if err := save.snapshot.WriteRDB(file, save.aux); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if a.aofService != nil {
+		if err := a.aofService.Sync(); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmpPath, a.cfg.SnapshotPath)
+}
+
+// autoSave saves a snapshot in the background when a save rule asks for it.
+func (a *App) autoSave() {
+	a.saveMu.Lock()
+	changes := a.parser.Dirty() - a.lastSaveDirty
+	since := time.Since(a.lastSave)
+	due := false
+	for _, rule := range a.saveRules {
+		due = due || (changes >= rule.changes && since >= rule.after)
+	}
+	if a.saving || (a.lastSaveFailed && time.Since(a.lastSaveAttempt) < saveRetryDelay) {
+		due = false
+	}
+	a.saveMu.Unlock()
+
+	if !due {
+		return
+	}
+	a.log.Info("Saving snapshot", "changes", changes, "seconds", int64(since.Seconds()))
+	if err := a.BGSave(); err != nil && !errors.Is(err, errSaveInProgress) {
+		a.log.Error("Failed to start snapshot", "error", err)
+	}
+}
+
+// restore loads the snapshot and replays the AOF appended after it, or the
+// whole AOF if there is no snapshot or it does not match the AOF anymore.
+func (a *App) restore() {
+	a.log.Info("Restoring data...")
+	offset, rebuildAOF := a.loadSnapshot()
+
+	sess := compute.NewSession(0)
+	err := aof.ReadFrom(a.cfg.AOFPath, offset, func(args [][]byte) {
+		a.parser.Execute(sess, args)
+	})
+	if err != nil {
+		a.log.Error("Failed to restore AOF", "error", err)
+	}
+
+	// The AOF alone has to restore the data as well, in case the snapshot
+	// is gone or replaced later on.
+	if rebuildAOF && a.aofService != nil {
+		err := a.aofService.BeginRewrite()
+		if err == nil {
+			snapshot := a.storage.Snapshot()
+			err = a.aofService.CommitRewrite(snapshot.Rewrite)
+			snapshot.Release()
+		}
+		if err != nil {
+			a.log.Error("Failed to rewrite AOF", "error", err)
+		}
+	}
+	a.log.Info("Data restored")
+}
+
+// loadSnapshot loads the snapshot and returns the offset of the AOF to replay
+// from. A snapshot is ignored if the AOF does not start with what it had when
+// the snapshot was taken, as it was rewritten or replaced since, unless the
+// AOF is empty: the AOF has to be rebuilt from the dataset then.
+func (a *App) loadSnapshot() (offset int64, rebuildAOF bool) {
+	file, err := os.Open(a.cfg.SnapshotPath)
+	if os.IsNotExist(err) {
+		return 0, false
+	}
+	if err != nil {
+		a.log.Error("Failed to open snapshot", "error", err)
+		return 0, false
+	}
+	defer file.Close()
+
+	aux, err := a.storage.LoadRDB(file)
+	if err != nil {
+		a.log.Error("Failed to load snapshot", "error", err)
+		return 0, false
+	}
+
+	if info, err := os.Stat(a.cfg.AOFPath); err != nil || info.Size() == 0 {
+		a.log.Info("Snapshot loaded, there is no AOF")
+		return 0, true
+	}
+
+	offset, err1 := strconv.ParseInt(aux[auxAOFOffset], 10, 64)
+	crc, err2 := strconv.ParseUint(aux[auxAOFCRC], 10, 64)
+	checksum, err := aof.Checksum(a.cfg.AOFPath, offset)
+	if err1 != nil || err2 != nil || err != nil || checksum != crc {
+		a.log.Warn("Snapshot does not match the AOF, replaying the whole AOF")
+		a.storage.Flush()
+		return 0, false
+	}
+	a.log.Info("Snapshot loaded", "aof-offset", offset)
+	return offset, false
+}
@@ -0,0 +1,285 @@
+package compute
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Novip1906/my-redis/internal/resp"
+	"github.com/Novip1906/my-redis/internal/storage"
+)
+
+var errBitOffset = resp.Error("ERR bit offset is not an integer or out of range")
+
+func parseBitOffset(arg []byte) (int64, bool) {
+	offset, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil || offset < 0 || offset > storage.MaxBitOffset {
+		return 0, false
+	}
+	return offset, true
+}
+
+func (p *Parser) setbit(sess *Session, args [][]byte) resp.Value {
+	offset, ok := parseBitOffset(args[2])
+	if !ok {
+		return errBitOffset
+	}
+	if value := string(args[3]); value != "0" && value != "1" {
+		return resp.Error("ERR bit is not an integer or out of range")
+	}
+
+	old, err := p.storage.SetBit(string(args[1]), offset, string(args[3]) == "1")
+	if err != nil {
+		return errorReply(err)
+	}
+	return boolInteger(old)
+}
+
+func (p *Parser) getbit(sess *Session, args [][]byte) resp.Value {
+	offset, ok := parseBitOffset(args[2])
+	if !ok {
+		return errBitOffset
+	}
+
+	bit, err := p.storage.GetBit(string(args[1]), offset)
+	if err != nil {
+		return errorReply(err)
+	}
+	return boolInteger(bit)
+}
+
+// parseBitRange parses "start end [BYTE|BIT]".
+func parseBitRange(args [][]byte) (start, end int64, bitUnit bool, errReply resp.Value, ok bool) {
+	start, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return 0, 0, false, errNotInteger, false
+	}
+	end, err = strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return 0, 0, false, errNotInteger, false
+	}
+
+	if len(args) == 3 {
+		switch strings.ToUpper(string(args[2])) {
+		case "BIT":
+			bitUnit = true
+		case "BYTE":
+		default:
+			return 0, 0, false, errSyntax, false
+		}
+	}
+	return start, end, bitUnit, resp.Value{}, true
+}
+
+// bitcount implements BITCOUNT key [start end [BYTE|BIT]].
+func (p *Parser) bitcount(sess *Session, args [][]byte) resp.Value {
+	start, end := int64(0), int64(-1)
+	var bitUnit bool
+
+	switch len(args) {
+	case 2:
+	case 4, 5:
+		var errReply resp.Value
+		var ok bool
+		if start, end, bitUnit, errReply, ok = parseBitRange(args[2:]); !ok {
+			return errReply
+		}
+	default:
+		return errSyntax
+	}
+
+	count, err := p.storage.BitCount(string(args[1]), start, end, bitUnit)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(count)
+}
+
+// bitpos implements BITPOS key bit [start [end [BYTE|BIT]]].
+func (p *Parser) bitpos(sess *Session, args [][]byte) resp.Value {
+	if bit := string(args[2]); bit != "0" && bit != "1" {
+		return resp.Error("ERR The bit argument must be 1 or 0.")
+	}
+
+	start, end := int64(0), int64(-1)
+	var bitUnit bool
+
+	switch len(args) {
+	case 3:
+	case 4:
+		var err error
+		if start, err = strconv.ParseInt(string(args[3]), 10, 64); err != nil {
+			return errNotInteger
+		}
+	case 5, 6:
+		var errReply resp.Value
+		var ok bool
+		if start, end, bitUnit, errReply, ok = parseBitRange(args[3:]); !ok {
+			return errReply
+		}
+	default:
+		return errSyntax
+	}
+
+	pos, err := p.storage.BitPos(string(args[1]), string(args[2]) == "1", start, end, len(args) > 4, bitUnit)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(pos)
+}
+
+// bitop implements BITOP AND|OR|XOR|NOT destkey key [key ...].
+func (p *Parser) bitop(sess *Session, args [][]byte) resp.Value {
+	var op storage.BitOperation
+	switch strings.ToUpper(string(args[1])) {
+	case "AND":
+		op = storage.BitAnd
+	case "OR":
+		op = storage.BitOr
+	case "XOR":
+		op = storage.BitXor
+	case "NOT":
+		op = storage.BitNot
+		if len(args) != 4 {
+			return resp.Error("ERR BITOP NOT must be called with a single source key.")
+		}
+	default:
+		return errSyntax
+	}
+
+	length, err := p.storage.BitOp(op, string(args[2]), keyStrings(args[3:]))
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(length)
+}
+
+func (p *Parser) bitfield(sess *Session, args [][]byte) resp.Value {
+	return p.bitfieldGeneric(sess, args, false)
+}
+
+func (p *Parser) bitfieldRO(sess *Session, args [][]byte) resp.Value {
+	return p.bitfieldGeneric(sess, args, true)
+}
+
+// bitfieldGeneric implements BITFIELD key [GET encoding offset | SET encoding
+// offset value | INCRBY encoding offset increment | OVERFLOW WRAP|SAT|FAIL]
+// ... and BITFIELD_RO, which only allows GET. It is logged only when it
+// contains writes, which replay the same way.
+func (p *Parser) bitfieldGeneric(sess *Session, args [][]byte, readOnly bool) resp.Value {
+	var (
+		ops      []storage.BitFieldOp
+		overflow storage.BitFieldOverflow
+		writes   bool
+	)
+
+	for i := 2; i < len(args); i++ {
+		subcommand := strings.ToUpper(string(args[i]))
+
+		if subcommand == "OVERFLOW" && i+1 < len(args) {
+			switch strings.ToUpper(string(args[i+1])) {
+			case "WRAP":
+				overflow = storage.OverflowWrap
+			case "SAT":
+				overflow = storage.OverflowSat
+			case "FAIL":
+				overflow = storage.OverflowFail
+			default:
+				return resp.Error("ERR Invalid OVERFLOW type specified")
+			}
+			i++
+			continue
+		}
+
+		op := storage.BitFieldOp{Overflow: overflow}
+		switch {
+		case subcommand == "GET" && i+2 < len(args):
+			op.Kind = storage.BitFieldGet
+		case subcommand == "SET" && i+3 < len(args):
+			op.Kind = storage.BitFieldSet
+		case subcommand == "INCRBY" && i+3 < len(args):
+			op.Kind = storage.BitFieldIncrBy
+		default:
+			return errSyntax
+		}
+		if readOnly && op.Kind != storage.BitFieldGet {
+			return resp.Error("ERR BITFIELD_RO only supports the GET subcommand")
+		}
+
+		var ok bool
+		if op.Signed, op.Bits, ok = parseBitFieldType(args[i+1]); !ok {
+			return resp.Error("ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+		}
+		if op.Offset, ok = parseBitFieldOffset(args[i+2], op.Bits); !ok {
+			return errBitOffset
+		}
+		i += 2
+
+		if op.Kind != storage.BitFieldGet {
+			value, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return errNotInteger
+			}
+			op.Value = value
+			writes = true
+			i++
+		}
+		ops = append(ops, op)
+	}
+
+	results, err := p.storage.BitField(string(args[1]), ops)
+	if err != nil {
+		return errorReply(err)
+	}
+	if !writes {
+		sess.propagate = nil
+	}
+
+	reply := make([]resp.Value, len(results))
+	for i, result := range results {
+		if result.Failed {
+			reply[i] = resp.NullBulk
+		} else {
+			reply[i] = resp.Integer(result.Value)
+		}
+	}
+	return resp.Array(reply...)
+}
+
+// parseBitFieldType parses an encoding like i16 or u8. Signed integers may
+// have up to 64 bits, unsigned ones up to 63.
+func parseBitFieldType(arg []byte) (signed bool, width int, ok bool) {
+	if len(arg) < 2 || (arg[0] != 'i' && arg[0] != 'u') {
+		return false, 0, false
+	}
+	signed = arg[0] == 'i'
+
+	width, err := strconv.Atoi(string(arg[1:]))
+	if err != nil || width < 1 || (signed && width > 64) || (!signed && width > 63) {
+		return false, 0, false
+	}
+	return signed, width, true
+}
+
+// parseBitFieldOffset parses a bit offset, or a multiple of the field width
+// when prefixed with "#".
+func parseBitFieldOffset(arg []byte, width int) (int64, bool) {
+	multiply := len(arg) > 0 && arg[0] == '#'
+	if multiply {
+		arg = arg[1:]
+	}
+
+	offset, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil || offset < 0 {
+		return 0, false
+	}
+	if multiply {
+		if offset > storage.MaxBitOffset/int64(width) {
+			return 0, false
+		}
+		offset *= int64(width)
+	}
+	if offset+int64(width)-1 > storage.MaxBitOffset {
+		return 0, false
+	}
+	return offset, true
+}
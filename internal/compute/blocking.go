@@ -0,0 +1,78 @@
+package compute
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/Novip1906/my-redis/internal/resp"
+)
+
+// parseTimeout parses the timeout of a blocking command, given in seconds
+// with an optional fraction. Zero means to wait forever.
+func parseTimeout(arg []byte) (time.Duration, resp.Value, bool) {
+	seconds, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) || seconds > math.MaxInt64/float64(time.Second) {
+		return 0, resp.Error("ERR timeout is not a float or out of range"), false
+	}
+	if seconds < 0 {
+		return 0, resp.Error("ERR timeout is negative"), false
+	}
+	return time.Duration(seconds * float64(time.Second)), resp.Value{}, true
+}
+
+// block calls serve until it succeeds, waiting for a write to one of the keys
+// between attempts. It gives up when the timeout elapses or the client
+// disconnects, and then reports false.
+func (p *Parser) block(sess *Session, keys []string, timeout time.Duration, serve func() (resp.Value, bool)) (resp.Value, bool) {
+	var (
+		expired <-chan time.Time
+		gone    <-chan struct{}
+		release func()
+	)
+
+	for {
+		ready, cancel := p.storage.WatchKeys(keys)
+		reply, ok := serve()
+		if ok {
+			cancel()
+			return reply, true
+		}
+
+		if release == nil {
+			if timeout > 0 {
+				timer := time.NewTimer(timeout)
+				defer timer.Stop()
+				expired = timer.C
+			}
+			gone, release = sess.watchDisconnect()
+			defer release()
+		}
+
+		if !p.wait(sess, ready, expired, gone) {
+			cancel()
+			sess.propagate = nil
+			return resp.Value{}, false
+		}
+		cancel()
+	}
+}
+
+// wait waits for the keys to be ready, and reports false if the timeout
+// elapses or the client goes away first. Nothing is changed while waiting,
+// so snapshots need not wait for it.
+func (p *Parser) wait(sess *Session, ready <-chan struct{}, expired <-chan time.Time, gone <-chan struct{}) bool {
+	if sess.holdsWrites {
+		p.writes.RUnlock()
+		defer p.writes.RLock()
+	}
+
+	select {
+	case <-ready:
+		return true
+	case <-expired:
+		return false
+	case <-gone:
+		return false
+	}
+}
@@ -0,0 +1,280 @@
+package compute
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/Novip1906/my-redis/internal/resp"
+	"github.com/Novip1906/my-redis/internal/storage"
+)
+
+type command struct {
+	name string
+	// arity follows the Redis convention: a positive value is the exact number
+	// of arguments including the command name, a negative one is the minimum.
+	arity   int
+	write   bool
+	handler func(p *Parser, sess *Session, args [][]byte) resp.Value
+}
+
+var commands = map[string]command{
+	"SET":            {name: "set", arity: -3, write: true, handler: (*Parser).set},
+	"GET":            {name: "get", arity: 2, handler: (*Parser).get},
+	"GETSET":         {name: "getset", arity: 3, write: true, handler: (*Parser).getset},
+	"GETDEL":         {name: "getdel", arity: 2, write: true, handler: (*Parser).getdel},
+	"GETEX":          {name: "getex", arity: -2, write: true, handler: (*Parser).getex},
+	"APPEND":         {name: "append", arity: 3, write: true, handler: (*Parser).append},
+	"STRLEN":         {name: "strlen", arity: 2, handler: (*Parser).strlen},
+	"GETRANGE":       {name: "getrange", arity: 4, handler: (*Parser).getrange},
+	"SETRANGE":       {name: "setrange", arity: 4, write: true, handler: (*Parser).setrange},
+	"DEL":            {name: "del", arity: -2, write: true, handler: (*Parser).del},
+	"UNLINK":         {name: "unlink", arity: -2, write: true, handler: (*Parser).del},
+	"EXISTS":         {name: "exists", arity: -2, handler: (*Parser).exists},
+	"TYPE":           {name: "type", arity: 2, handler: (*Parser).typeCmd},
+	"RENAME":         {name: "rename", arity: 3, write: true, handler: (*Parser).rename},
+	"RENAMENX":       {name: "renamenx", arity: 3, write: true, handler: (*Parser).renamenx},
+	"COPY":           {name: "copy", arity: -3, write: true, handler: (*Parser).copyCmd},
+	"RANDOMKEY":      {name: "randomkey", arity: 1, handler: (*Parser).randomkey},
+	"DBSIZE":         {name: "dbsize", arity: 1, handler: (*Parser).dbsize},
+	"TOUCH":          {name: "touch", arity: -2, handler: (*Parser).touch},
+	"SCAN":           {name: "scan", arity: -2, handler: (*Parser).scan},
+	"MGET":           {name: "mget", arity: -2, handler: (*Parser).mget},
+	"MSET":           {name: "mset", arity: -3, write: true, handler: (*Parser).mset},
+	"MSETNX":         {name: "msetnx", arity: -3, write: true, handler: (*Parser).msetnx},
+	"EXPIRE":         {name: "expire", arity: -3, write: true, handler: (*Parser).expire},
+	"PEXPIRE":        {name: "pexpire", arity: -3, write: true, handler: (*Parser).pexpire},
+	"EXPIREAT":       {name: "expireat", arity: -3, write: true, handler: (*Parser).expireat},
+	"PEXPIREAT":      {name: "pexpireat", arity: -3, write: true, handler: (*Parser).pexpireat},
+	"PERSIST":        {name: "persist", arity: 2, write: true, handler: (*Parser).persist},
+	"TTL":            {name: "ttl", arity: 2, handler: (*Parser).ttl},
+	"PTTL":           {name: "pttl", arity: 2, handler: (*Parser).pttl},
+	"EXPIRETIME":     {name: "expiretime", arity: 2, handler: (*Parser).expiretime},
+	"PEXPIRETIME":    {name: "pexpiretime", arity: 2, handler: (*Parser).pexpiretime},
+	"INCR":           {name: "incr", arity: 2, write: true, handler: (*Parser).incr},
+	"INCRBY":         {name: "incrby", arity: 3, write: true, handler: (*Parser).incrby},
+	"DECR":           {name: "decr", arity: 2, write: true, handler: (*Parser).decr},
+	"DECRBY":         {name: "decrby", arity: 3, write: true, handler: (*Parser).decrby},
+	"INCRBYFLOAT":    {name: "incrbyfloat", arity: 3, write: true, handler: (*Parser).incrbyfloat},
+	"SETBIT":         {name: "setbit", arity: 4, write: true, handler: (*Parser).setbit},
+	"GETBIT":         {name: "getbit", arity: 3, handler: (*Parser).getbit},
+	"BITCOUNT":       {name: "bitcount", arity: -2, handler: (*Parser).bitcount},
+	"BITPOS":         {name: "bitpos", arity: -3, handler: (*Parser).bitpos},
+	"BITOP":          {name: "bitop", arity: -4, write: true, handler: (*Parser).bitop},
+	"BITFIELD":       {name: "bitfield", arity: -2, write: true, handler: (*Parser).bitfield},
+	"BITFIELD_RO":    {name: "bitfield_ro", arity: -2, handler: (*Parser).bitfieldRO},
+	"PFADD":          {name: "pfadd", arity: -2, write: true, handler: (*Parser).pfadd},
+	"PFCOUNT":        {name: "pfcount", arity: -2, handler: (*Parser).pfcount},
+	"PFMERGE":        {name: "pfmerge", arity: -2, write: true, handler: (*Parser).pfmerge},
+	"HSET":           {name: "hset", arity: -4, write: true, handler: (*Parser).hset},
+	"HMSET":          {name: "hmset", arity: -4, write: true, handler: (*Parser).hmset},
+	"HSETNX":         {name: "hsetnx", arity: 4, write: true, handler: (*Parser).hsetnx},
+	"HGET":           {name: "hget", arity: 3, handler: (*Parser).hget},
+	"HMGET":          {name: "hmget", arity: -3, handler: (*Parser).hmget},
+	"HDEL":           {name: "hdel", arity: -3, write: true, handler: (*Parser).hdel},
+	"HEXISTS":        {name: "hexists", arity: 3, handler: (*Parser).hexists},
+	"HLEN":           {name: "hlen", arity: 2, handler: (*Parser).hlen},
+	"HSTRLEN":        {name: "hstrlen", arity: 3, handler: (*Parser).hstrlen},
+	"HKEYS":          {name: "hkeys", arity: 2, handler: (*Parser).hkeys},
+	"HVALS":          {name: "hvals", arity: 2, handler: (*Parser).hvals},
+	"HGETALL":        {name: "hgetall", arity: 2, handler: (*Parser).hgetall},
+	"HSCAN":          {name: "hscan", arity: -3, handler: (*Parser).hscan},
+	"HINCRBY":        {name: "hincrby", arity: 4, write: true, handler: (*Parser).hincrby},
+	"HINCRBYFLOAT":   {name: "hincrbyfloat", arity: 4, write: true, handler: (*Parser).hincrbyfloat},
+	"LPUSH":          {name: "lpush", arity: -3, write: true, handler: (*Parser).lpush},
+	"RPUSH":          {name: "rpush", arity: -3, write: true, handler: (*Parser).rpush},
+	"LPOP":           {name: "lpop", arity: -2, write: true, handler: (*Parser).lpop},
+	"RPOP":           {name: "rpop", arity: -2, write: true, handler: (*Parser).rpop},
+	"LLEN":           {name: "llen", arity: 2, handler: (*Parser).llen},
+	"LRANGE":         {name: "lrange", arity: 4, handler: (*Parser).lrange},
+	"LINDEX":         {name: "lindex", arity: 3, handler: (*Parser).lindex},
+	"LSET":           {name: "lset", arity: 4, write: true, handler: (*Parser).lset},
+	"LREM":           {name: "lrem", arity: 4, write: true, handler: (*Parser).lrem},
+	"LTRIM":          {name: "ltrim", arity: 4, write: true, handler: (*Parser).ltrim},
+	"LINSERT":        {name: "linsert", arity: 5, write: true, handler: (*Parser).linsert},
+	"LMOVE":          {name: "lmove", arity: 5, write: true, handler: (*Parser).lmove},
+	"BLPOP":          {name: "blpop", arity: -3, write: true, handler: (*Parser).blpop},
+	"BRPOP":          {name: "brpop", arity: -3, write: true, handler: (*Parser).brpop},
+	"BLMOVE":         {name: "blmove", arity: 6, write: true, handler: (*Parser).blmove},
+	"SADD":           {name: "sadd", arity: -3, write: true, handler: (*Parser).sadd},
+	"SREM":           {name: "srem", arity: -3, write: true, handler: (*Parser).srem},
+	"SISMEMBER":      {name: "sismember", arity: 3, handler: (*Parser).sismember},
+	"SMISMEMBER":     {name: "smismember", arity: -3, handler: (*Parser).smismember},
+	"SMEMBERS":       {name: "smembers", arity: 2, handler: (*Parser).smembers},
+	"SSCAN":          {name: "sscan", arity: -3, handler: (*Parser).sscan},
+	"SCARD":          {name: "scard", arity: 2, handler: (*Parser).scard},
+	"SPOP":           {name: "spop", arity: -2, write: true, handler: (*Parser).spop},
+	"SRANDMEMBER":    {name: "srandmember", arity: -2, handler: (*Parser).srandmember},
+	"SMOVE":          {name: "smove", arity: 4, write: true, handler: (*Parser).smove},
+	"SINTER":         {name: "sinter", arity: -2, handler: (*Parser).sinter},
+	"SUNION":         {name: "sunion", arity: -2, handler: (*Parser).sunion},
+	"SDIFF":          {name: "sdiff", arity: -2, handler: (*Parser).sdiff},
+	"SINTERSTORE":    {name: "sinterstore", arity: -3, write: true, handler: (*Parser).sinterstore},
+	"SUNIONSTORE":    {name: "sunionstore", arity: -3, write: true, handler: (*Parser).sunionstore},
+	"SDIFFSTORE":     {name: "sdiffstore", arity: -3, write: true, handler: (*Parser).sdiffstore},
+	"SINTERCARD":     {name: "sintercard", arity: -3, handler: (*Parser).sintercard},
+	"ZADD":           {name: "zadd", arity: -4, write: true, handler: (*Parser).zadd},
+	"ZINCRBY":        {name: "zincrby", arity: 4, write: true, handler: (*Parser).zincrby},
+	"ZREM":           {name: "zrem", arity: -3, write: true, handler: (*Parser).zrem},
+	"ZSCORE":         {name: "zscore", arity: 3, handler: (*Parser).zscore},
+	"ZCARD":          {name: "zcard", arity: 2, handler: (*Parser).zcard},
+	"ZRANK":          {name: "zrank", arity: -3, handler: (*Parser).zrank},
+	"ZREVRANK":       {name: "zrevrank", arity: -3, handler: (*Parser).zrevrank},
+	"ZCOUNT":         {name: "zcount", arity: 4, handler: (*Parser).zcount},
+	"ZRANGE":         {name: "zrange", arity: -4, handler: (*Parser).zrange},
+	"ZSCAN":          {name: "zscan", arity: -3, handler: (*Parser).zscan},
+	"ZRANGESTORE":    {name: "zrangestore", arity: -5, write: true, handler: (*Parser).zrangestore},
+	"ZPOPMIN":        {name: "zpopmin", arity: -2, write: true, handler: (*Parser).zpopmin},
+	"ZPOPMAX":        {name: "zpopmax", arity: -2, write: true, handler: (*Parser).zpopmax},
+	"BZPOPMIN":       {name: "bzpopmin", arity: -3, write: true, handler: (*Parser).bzpopmin},
+	"BZPOPMAX":       {name: "bzpopmax", arity: -3, write: true, handler: (*Parser).bzpopmax},
+	"ZUNIONSTORE":    {name: "zunionstore", arity: -4, write: true, handler: (*Parser).zunionstore},
+	"ZINTERSTORE":    {name: "zinterstore", arity: -4, write: true, handler: (*Parser).zinterstore},
+	"GEOADD":         {name: "geoadd", arity: -5, write: true, handler: (*Parser).geoadd},
+	"GEOPOS":         {name: "geopos", arity: -2, handler: (*Parser).geopos},
+	"GEODIST":        {name: "geodist", arity: -4, handler: (*Parser).geodist},
+	"GEOHASH":        {name: "geohash", arity: -2, handler: (*Parser).geohash},
+	"GEOSEARCH":      {name: "geosearch", arity: -7, handler: (*Parser).geosearch},
+	"GEOSEARCHSTORE": {name: "geosearchstore", arity: -8, write: true, handler: (*Parser).geosearchstore},
+	"XADD":           {name: "xadd", arity: -5, write: true, handler: (*Parser).xadd},
+	"XLEN":           {name: "xlen", arity: 2, handler: (*Parser).xlen},
+	"XSETID":         {name: "xsetid", arity: 3, write: true, handler: (*Parser).xsetid},
+	"XRANGE":         {name: "xrange", arity: -4, handler: (*Parser).xrange},
+	"XREVRANGE":      {name: "xrevrange", arity: -4, handler: (*Parser).xrevrange},
+	"XREAD":          {name: "xread", arity: -4, handler: (*Parser).xread},
+	"XREADGROUP":     {name: "xreadgroup", arity: -7, write: true, handler: (*Parser).xreadgroup},
+	"XGROUP":         {name: "xgroup", arity: -2, write: true, handler: (*Parser).xgroup},
+	"XACK":           {name: "xack", arity: -4, write: true, handler: (*Parser).xack},
+	"XPENDING":       {name: "xpending", arity: -3, handler: (*Parser).xpending},
+	"XCLAIM":         {name: "xclaim", arity: -6, write: true, handler: (*Parser).xclaim},
+	"XAUTOCLAIM":     {name: "xautoclaim", arity: -6, write: true, handler: (*Parser).xautoclaim},
+	"FLUSH":          {name: "flush", arity: 1, write: true, handler: (*Parser).flush},
+	"BGREWRITEAOF":   {name: "bgrewriteaof", arity: 1, handler: (*Parser).bgrewriteaof},
+	"SAVE":           {name: "save", arity: 1, handler: (*Parser).save},
+	"BGSAVE":         {name: "bgsave", arity: 1, handler: (*Parser).bgsave},
+	"PING":           {name: "ping", arity: -1, handler: (*Parser).ping},
+	"ECHO":           {name: "echo", arity: 2, handler: (*Parser).echo},
+	"QUIT":           {name: "quit", arity: -1, handler: (*Parser).quit},
+	"HELLO":          {name: "hello", arity: -1, handler: (*Parser).hello},
+}
+
+const (
+	serverName = "my-redis"
+	// redisVersion is the Redis release whose behaviour the server follows.
+	// Client libraries use it for feature detection.
+	redisVersion = "7.2.0"
+)
+
+var (
+	errNotInteger = resp.Error("ERR value is not an integer or out of range")
+	errSyntax     = resp.Error("ERR syntax error")
+)
+
+func errWrongArgs(name string) resp.Value {
+	return resp.Errorf("ERR wrong number of arguments for '%s' command", name)
+}
+
+var codedErrors = []error{
+	storage.ErrWrongType,
+	storage.ErrBusyGroup,
+	storage.ErrNoGroup,
+	storage.ErrNotHLL,
+	storage.ErrCorruptHLL,
+}
+
+// errorReply turns a storage error into a reply. Errors carry no prefix except
+// for WRONGTYPE and the like, which clients tell apart from generic errors.
+func errorReply(err error) resp.Value {
+	for _, coded := range codedErrors {
+		if errors.Is(err, coded) {
+			return resp.Error(err.Error())
+		}
+	}
+	return resp.Error("ERR " + err.Error())
+}
+
+func (p *Parser) del(sess *Session, args [][]byte) resp.Value {
+	deleted := p.storage.Delete(keyStrings(args[1:])...)
+	if deleted == 0 {
+		sess.propagate = nil
+	}
+	return resp.Integer(deleted)
+}
+
+func (p *Parser) exists(sess *Session, args [][]byte) resp.Value {
+	return resp.Integer(p.storage.Exists(keyStrings(args[1:])...))
+}
+
+func keyStrings(args [][]byte) []string {
+	keys := make([]string, len(args))
+	for i, arg := range args {
+		keys[i] = string(arg)
+	}
+	return keys
+}
+
+func (p *Parser) flush(sess *Session, args [][]byte) resp.Value {
+	p.storage.Flush()
+	return resp.OK
+}
+
+func (p *Parser) ping(sess *Session, args [][]byte) resp.Value {
+	switch len(args) {
+	case 1:
+		return resp.SimpleString("PONG")
+	case 2:
+		return resp.BulkBytes(args[1])
+	default:
+		return errWrongArgs("ping")
+	}
+}
+
+func (p *Parser) echo(sess *Session, args [][]byte) resp.Value {
+	return resp.BulkBytes(args[1])
+}
+
+func (p *Parser) hello(sess *Session, args [][]byte) resp.Value {
+	protocol := sess.Protocol
+	if len(args) > 1 {
+		version, err := strconv.Atoi(string(args[1]))
+		if err != nil {
+			return resp.Error("ERR Protocol version is not an integer or out of range")
+		}
+		if version != 2 && version != 3 {
+			return resp.Error("NOPROTO unsupported protocol version")
+		}
+		protocol = version
+	}
+
+	name := sess.Name
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch {
+		case opt == "AUTH" && i+2 < len(args):
+			// There is no authentication, the default user accepts any password.
+			i += 2
+		case opt == "SETNAME" && i+1 < len(args):
+			name = string(args[i+1])
+			i++
+		default:
+			return resp.Errorf("ERR Syntax error in HELLO option '%s'", args[i])
+		}
+	}
+
+	sess.Protocol = protocol
+	sess.Name = name
+
+	return resp.Map(
+		resp.BulkString("server"), resp.BulkString(serverName),
+		resp.BulkString("version"), resp.BulkString(redisVersion),
+		resp.BulkString("proto"), resp.Integer(int64(sess.Protocol)),
+		resp.BulkString("id"), resp.Integer(sess.ID),
+		resp.BulkString("mode"), resp.BulkString("standalone"),
+		resp.BulkString("role"), resp.BulkString("master"),
+		resp.BulkString("modules"), resp.Array(),
+	)
+}
+
+func (p *Parser) quit(sess *Session, args [][]byte) resp.Value {
+	return resp.OK
+}
@@ -0,0 +1,126 @@
+package compute
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Novip1906/my-redis/internal/resp"
+	"github.com/Novip1906/my-redis/internal/storage"
+)
+
+func (p *Parser) expire(sess *Session, args [][]byte) resp.Value {
+	return p.expireGeneric(sess, args, time.Now().UnixMilli(), time.Second)
+}
+
+func (p *Parser) pexpire(sess *Session, args [][]byte) resp.Value {
+	return p.expireGeneric(sess, args, time.Now().UnixMilli(), time.Millisecond)
+}
+
+func (p *Parser) expireat(sess *Session, args [][]byte) resp.Value {
+	return p.expireGeneric(sess, args, 0, time.Second)
+}
+
+func (p *Parser) pexpireat(sess *Session, args [][]byte) resp.Value {
+	return p.expireGeneric(sess, args, 0, time.Millisecond)
+}
+
+// expireGeneric implements the whole EXPIRE family: the deadline is basetime
+// plus the given amount of units, both in milliseconds. The result is logged
+// as PEXPIREAT with an absolute deadline, so replaying the AOF never extends
+// the lifetime of a key.
+func (p *Parser) expireGeneric(sess *Session, args [][]byte, basetime int64, unit time.Duration) resp.Value {
+	amount, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+
+	cond, err := parseExpireCondition(args[3:])
+	if err != nil {
+		return resp.Error(err.Error())
+	}
+
+	scale := int64(unit / time.Millisecond)
+	if amount > math.MaxInt64/scale || amount < math.MinInt64/scale {
+		return invalidExpireTime(args[0])
+	}
+	deadline := amount * scale
+	if (deadline > 0 && basetime > math.MaxInt64-deadline) || (deadline < 0 && basetime < math.MinInt64-deadline) {
+		return invalidExpireTime(args[0])
+	}
+	deadline += basetime
+
+	if !p.storage.ExpireAt(string(args[1]), time.UnixMilli(deadline), cond) {
+		sess.propagate = nil
+		return resp.Integer(0)
+	}
+
+	sess.propagate = [][]byte{[]byte("PEXPIREAT"), args[1], strconv.AppendInt(nil, deadline, 10)}
+	return resp.Integer(1)
+}
+
+func parseExpireCondition(opts [][]byte) (storage.ExpireCondition, error) {
+	var cond storage.ExpireCondition
+	for _, opt := range opts {
+		switch strings.ToUpper(string(opt)) {
+		case "NX":
+			cond |= storage.ExpireNX
+		case "XX":
+			cond |= storage.ExpireXX
+		case "GT":
+			cond |= storage.ExpireGT
+		case "LT":
+			cond |= storage.ExpireLT
+		default:
+			return 0, fmt.Errorf("ERR Unsupported option %s", opt)
+		}
+	}
+
+	if cond&storage.ExpireNX != 0 && cond != storage.ExpireNX {
+		return 0, errors.New("ERR NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if cond&storage.ExpireGT != 0 && cond&storage.ExpireLT != 0 {
+		return 0, errors.New("ERR GT and LT options at the same time are not compatible")
+	}
+
+	return cond, nil
+}
+
+func invalidExpireTime(name []byte) resp.Value {
+	return resp.Errorf("ERR invalid expire time in '%s' command", strings.ToLower(string(name)))
+}
+
+func (p *Parser) persist(sess *Session, args [][]byte) resp.Value {
+	if !p.storage.Persist(string(args[1])) {
+		sess.propagate = nil
+		return resp.Integer(0)
+	}
+	return resp.Integer(1)
+}
+
+func (p *Parser) ttl(sess *Session, args [][]byte) resp.Value {
+	ttl := p.storage.GetPTTL(string(args[1]))
+	if ttl < 0 {
+		return resp.Integer(ttl)
+	}
+	return resp.Integer((ttl + 500) / 1000)
+}
+
+func (p *Parser) pttl(sess *Session, args [][]byte) resp.Value {
+	return resp.Integer(p.storage.GetPTTL(string(args[1])))
+}
+
+func (p *Parser) expiretime(sess *Session, args [][]byte) resp.Value {
+	at := p.storage.GetExpireTime(string(args[1]))
+	if at < 0 {
+		return resp.Integer(at)
+	}
+	return resp.Integer(at / 1000)
+}
+
+func (p *Parser) pexpiretime(sess *Session, args [][]byte) resp.Value {
+	return resp.Integer(p.storage.GetExpireTime(string(args[1])))
+}
@@ -0,0 +1,326 @@
+package compute
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Novip1906/my-redis/internal/resp"
+	"github.com/Novip1906/my-redis/internal/storage"
+)
+
+var errGeoUnit = resp.Error("ERR unsupported unit provided. please use M, KM, FT, MI")
+
+// geoUnits are the sizes in meters of the distance units.
+var geoUnits = map[string]float64{
+	"M":  1,
+	"KM": 1000,
+	"FT": 0.3048,
+	"MI": 1609.34,
+}
+
+// parseGeoPosition parses a longitude and a latitude.
+func parseGeoPosition(lonArg, latArg []byte) (lon, lat float64, errReply resp.Value, ok bool) {
+	lon, okLon := parseScore(lonArg)
+	lat, okLat := parseScore(latArg)
+	if !okLon || !okLat {
+		return 0, 0, errNotFloat, false
+	}
+	if !storage.ValidGeoPosition(lon, lat) {
+		return 0, 0, resp.Errorf("ERR invalid longitude,latitude pair %f,%f", lon, lat), false
+	}
+	return lon, lat, resp.Value{}, true
+}
+
+func formatGeoDistance(dist float64) resp.Value {
+	return resp.BulkString(strconv.FormatFloat(dist, 'f', 4, 64))
+}
+
+func geoPositionReply(score float64) resp.Value {
+	lon, lat := storage.GeoDecode(score)
+	return resp.Array(resp.Double(lon), resp.Double(lat))
+}
+
+// geoadd implements GEOADD key [NX|XX] [CH] longitude latitude member
+// [longitude latitude member ...] on top of ZADD.
+func (p *Parser) geoadd(sess *Session, args [][]byte) resp.Value {
+	var (
+		flags   storage.ZAddFlags
+		ch      bool
+		options = 2
+	)
+
+loop:
+	for ; options < len(args); options++ {
+		switch strings.ToUpper(string(args[options])) {
+		case "NX":
+			flags |= storage.ZAddNX
+		case "XX":
+			flags |= storage.ZAddXX
+		case "CH":
+			ch = true
+		default:
+			break loop
+		}
+	}
+
+	elements := args[options:]
+	if len(elements) == 0 || len(elements)%3 != 0 {
+		return errSyntax
+	}
+	if flags&storage.ZAddNX != 0 && flags&storage.ZAddXX != 0 {
+		return resp.Error("ERR XX and NX options at the same time are not compatible")
+	}
+
+	scores := make([]float64, 0, len(elements)/3)
+	members := make([][]byte, 0, len(elements)/3)
+	for i := 0; i < len(elements); i += 3 {
+		lon, lat, errReply, ok := parseGeoPosition(elements[i], elements[i+1])
+		if !ok {
+			return errReply
+		}
+		scores = append(scores, storage.GeoEncode(lon, lat))
+		members = append(members, elements[i+2])
+	}
+
+	added, updated, err := p.storage.ZAdd(string(args[1]), flags, scores, members)
+	if err != nil {
+		return errorReply(err)
+	}
+	if added+updated == 0 {
+		sess.propagate = nil
+	}
+	if ch {
+		return resp.Integer(added + updated)
+	}
+	return resp.Integer(added)
+}
+
+func (p *Parser) geopos(sess *Session, args [][]byte) resp.Value {
+	scores, found, err := p.storage.ZMScore(string(args[1]), args[2:])
+	if err != nil {
+		return errorReply(err)
+	}
+
+	reply := make([]resp.Value, len(scores))
+	for i, score := range scores {
+		if found[i] {
+			reply[i] = geoPositionReply(score)
+		} else {
+			reply[i] = resp.NullArray
+		}
+	}
+	return resp.Array(reply...)
+}
+
+// geodist implements GEODIST key member1 member2 [M|KM|FT|MI].
+func (p *Parser) geodist(sess *Session, args [][]byte) resp.Value {
+	unit := 1.0
+	switch len(args) {
+	case 4:
+	case 5:
+		var ok bool
+		if unit, ok = geoUnits[strings.ToUpper(string(args[4]))]; !ok {
+			return errGeoUnit
+		}
+	default:
+		return errSyntax
+	}
+
+	scores, found, err := p.storage.ZMScore(string(args[1]), args[2:4])
+	if err != nil {
+		return errorReply(err)
+	}
+	if !found[0] || !found[1] {
+		return resp.NullBulk
+	}
+
+	lon1, lat1 := storage.GeoDecode(scores[0])
+	lon2, lat2 := storage.GeoDecode(scores[1])
+	return formatGeoDistance(storage.GeoDistance(lon1, lat1, lon2, lat2) / unit)
+}
+
+func (p *Parser) geohash(sess *Session, args [][]byte) resp.Value {
+	scores, found, err := p.storage.ZMScore(string(args[1]), args[2:])
+	if err != nil {
+		return errorReply(err)
+	}
+
+	reply := make([]resp.Value, len(scores))
+	for i, score := range scores {
+		if found[i] {
+			reply[i] = resp.BulkString(storage.GeoHashString(score))
+		} else {
+			reply[i] = resp.NullBulk
+		}
+	}
+	return resp.Array(reply...)
+}
+
+// geoSearchOptions are the options of GEOSEARCH that only shape the reply.
+type geoSearchOptions struct {
+	withCoord, withDist, withHash bool
+	storeDist                     bool
+}
+
+// parseGeoSearch parses the arguments of GEOSEARCH and GEOSEARCHSTORE after
+// the keys: FROMMEMBER member | FROMLONLAT longitude latitude, BYRADIUS radius
+// unit | BYBOX width height unit, [ASC|DESC] [COUNT count [ANY]] and either
+// [WITHCOORD] [WITHDIST] [WITHHASH] or, when storing, [STOREDIST].
+func parseGeoSearch(name string, args [][]byte, store bool) (spec storage.GeoSearchSpec, opts geoSearchOptions, errReply resp.Value, ok bool) {
+	var from, by bool
+
+	for i := 0; i < len(args); i++ {
+		remaining := len(args) - i - 1
+		switch option := strings.ToUpper(string(args[i])); {
+		case option == "FROMMEMBER" && remaining >= 1:
+			if from {
+				return spec, opts, resp.Errorf("ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for %s", name), false
+			}
+			spec.FromMember = args[i+1]
+			from = true
+			i++
+
+		case option == "FROMLONLAT" && remaining >= 2:
+			if from {
+				return spec, opts, resp.Errorf("ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for %s", name), false
+			}
+			if spec.Lon, spec.Lat, errReply, ok = parseGeoPosition(args[i+1], args[i+2]); !ok {
+				return spec, opts, errReply, false
+			}
+			from = true
+			i += 2
+
+		case option == "BYRADIUS" && remaining >= 2:
+			if by {
+				return spec, opts, resp.Errorf("ERR exactly one of BYRADIUS and BYBOX can be specified for %s", name), false
+			}
+			radius, ok := parseScore(args[i+1])
+			if !ok {
+				return spec, opts, resp.Error("ERR need numeric radius"), false
+			}
+			if radius < 0 {
+				return spec, opts, resp.Error("ERR radius cannot be negative"), false
+			}
+			if spec.Unit, ok = geoUnits[strings.ToUpper(string(args[i+2]))]; !ok {
+				return spec, opts, errGeoUnit, false
+			}
+			spec.Radius = radius
+			by = true
+			i += 2
+
+		case option == "BYBOX" && remaining >= 3:
+			if by {
+				return spec, opts, resp.Errorf("ERR exactly one of BYRADIUS and BYBOX can be specified for %s", name), false
+			}
+			width, okWidth := parseScore(args[i+1])
+			height, okHeight := parseScore(args[i+2])
+			if !okWidth || !okHeight {
+				return spec, opts, resp.Error("ERR need numeric width and height"), false
+			}
+			if width < 0 || height < 0 {
+				return spec, opts, resp.Error("ERR height or width cannot be negative"), false
+			}
+			var ok bool
+			if spec.Unit, ok = geoUnits[strings.ToUpper(string(args[i+3]))]; !ok {
+				return spec, opts, errGeoUnit, false
+			}
+			spec.ByBox, spec.Width, spec.Height = true, width, height
+			by = true
+			i += 3
+
+		case option == "ASC":
+			spec.Sort = storage.GeoAsc
+		case option == "DESC":
+			spec.Sort = storage.GeoDesc
+
+		case option == "COUNT" && remaining >= 1:
+			count, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return spec, opts, errNotInteger, false
+			}
+			if count <= 0 {
+				return spec, opts, resp.Error("ERR COUNT must be > 0"), false
+			}
+			spec.Count = count
+			i++
+			if i+1 < len(args) && strings.ToUpper(string(args[i+1])) == "ANY" {
+				spec.Any = true
+				i++
+			}
+
+		case option == "WITHCOORD" && !store:
+			opts.withCoord = true
+		case option == "WITHDIST" && !store:
+			opts.withDist = true
+		case option == "WITHHASH" && !store:
+			opts.withHash = true
+		case option == "WITHCOORD", option == "WITHDIST", option == "WITHHASH":
+			return spec, opts, resp.Errorf("ERR %s is not compatible with WITHDIST, WITHHASH and WITHCOORD options", name), false
+		case option == "STOREDIST" && store:
+			opts.storeDist = true
+
+		default:
+			return spec, opts, errSyntax, false
+		}
+	}
+
+	if !from {
+		return spec, opts, resp.Errorf("ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for %s", name), false
+	}
+	if !by {
+		return spec, opts, resp.Errorf("ERR exactly one of BYRADIUS and BYBOX can be specified for %s", name), false
+	}
+	return spec, opts, resp.Value{}, true
+}
+
+// geosearch implements GEOSEARCH key <from> <by> [ASC|DESC] [COUNT count
+// [ANY]] [WITHCOORD] [WITHDIST] [WITHHASH]. Members are replied alone or,
+// with any of the WITH options, as arrays of the member followed by its
+// distance, score and position in that order.
+func (p *Parser) geosearch(sess *Session, args [][]byte) resp.Value {
+	spec, opts, errReply, ok := parseGeoSearch("geosearch", args[2:], false)
+	if !ok {
+		return errReply
+	}
+
+	results, err := p.storage.GeoSearch(string(args[1]), spec)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	reply := make([]resp.Value, len(results))
+	for i, r := range results {
+		if !opts.withDist && !opts.withHash && !opts.withCoord {
+			reply[i] = resp.BulkBytes(r.Member)
+			continue
+		}
+
+		item := []resp.Value{resp.BulkBytes(r.Member)}
+		if opts.withDist {
+			item = append(item, formatGeoDistance(r.Dist))
+		}
+		if opts.withHash {
+			item = append(item, resp.Integer(int64(r.Score)))
+		}
+		if opts.withCoord {
+			item = append(item, resp.Array(resp.Double(r.Lon), resp.Double(r.Lat)))
+		}
+		reply[i] = resp.Array(item...)
+	}
+	return resp.Array(reply...)
+}
+
+// geosearchstore implements GEOSEARCHSTORE destination source <from> <by>
+// [ASC|DESC] [COUNT count [ANY]] [STOREDIST].
+func (p *Parser) geosearchstore(sess *Session, args [][]byte) resp.Value {
+	spec, opts, errReply, ok := parseGeoSearch("geosearchstore", args[3:], true)
+	if !ok {
+		return errReply
+	}
+
+	n, err := p.storage.GeoSearchStore(string(args[1]), string(args[2]), spec, opts.storeDist)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(n)
+}
@@ -0,0 +1,177 @@
+package compute
+
+import (
+	"strconv"
+
+	"github.com/Novip1906/my-redis/internal/resp"
+	"github.com/Novip1906/my-redis/internal/storage"
+)
+
+func (p *Parser) hset(sess *Session, args [][]byte) resp.Value {
+	fields, values, ok := splitPairs(args[2:])
+	if !ok {
+		return errWrongArgs("hset")
+	}
+
+	added, err := p.storage.HSet(string(args[1]), fields, values)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(added)
+}
+
+// hmset is the deprecated form of HSET that replies OK.
+func (p *Parser) hmset(sess *Session, args [][]byte) resp.Value {
+	fields, values, ok := splitPairs(args[2:])
+	if !ok {
+		return errWrongArgs("hmset")
+	}
+
+	if _, err := p.storage.HSet(string(args[1]), fields, values); err != nil {
+		return errorReply(err)
+	}
+	return resp.OK
+}
+
+func (p *Parser) hsetnx(sess *Session, args [][]byte) resp.Value {
+	set, err := p.storage.HSetNX(string(args[1]), string(args[2]), args[3])
+	if err != nil {
+		return errorReply(err)
+	}
+	if !set {
+		sess.propagate = nil
+		return resp.Integer(0)
+	}
+	return resp.Integer(1)
+}
+
+func (p *Parser) hget(sess *Session, args [][]byte) resp.Value {
+	val, ok, err := p.storage.HGet(string(args[1]), string(args[2]))
+	if err != nil {
+		return errorReply(err)
+	}
+	if !ok {
+		return resp.NullBulk
+	}
+	return resp.BulkBytes(val)
+}
+
+func (p *Parser) hmget(sess *Session, args [][]byte) resp.Value {
+	values, err := p.storage.HMGet(string(args[1]), keyStrings(args[2:])...)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	reply := make([]resp.Value, len(values))
+	for i, val := range values {
+		if val == nil {
+			reply[i] = resp.NullBulk
+		} else {
+			reply[i] = resp.BulkBytes(val)
+		}
+	}
+	return resp.Array(reply...)
+}
+
+func (p *Parser) hdel(sess *Session, args [][]byte) resp.Value {
+	deleted, err := p.storage.HDel(string(args[1]), keyStrings(args[2:])...)
+	if err != nil {
+		return errorReply(err)
+	}
+	if deleted == 0 {
+		sess.propagate = nil
+	}
+	return resp.Integer(deleted)
+}
+
+func (p *Parser) hexists(sess *Session, args [][]byte) resp.Value {
+	ok, err := p.storage.HExists(string(args[1]), string(args[2]))
+	if err != nil {
+		return errorReply(err)
+	}
+	return boolInteger(ok)
+}
+
+func (p *Parser) hlen(sess *Session, args [][]byte) resp.Value {
+	n, err := p.storage.HLen(string(args[1]))
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(n)
+}
+
+func (p *Parser) hstrlen(sess *Session, args [][]byte) resp.Value {
+	n, err := p.storage.HStrLen(string(args[1]), string(args[2]))
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(n)
+}
+
+func (p *Parser) hkeys(sess *Session, args [][]byte) resp.Value {
+	fields, _, err := p.storage.HGetAll(string(args[1]))
+	if err != nil {
+		return errorReply(err)
+	}
+
+	reply := make([]resp.Value, len(fields))
+	for i, field := range fields {
+		reply[i] = resp.BulkString(field)
+	}
+	return resp.Array(reply...)
+}
+
+func (p *Parser) hvals(sess *Session, args [][]byte) resp.Value {
+	_, values, err := p.storage.HGetAll(string(args[1]))
+	if err != nil {
+		return errorReply(err)
+	}
+
+	reply := make([]resp.Value, len(values))
+	for i, val := range values {
+		reply[i] = resp.BulkBytes(val)
+	}
+	return resp.Array(reply...)
+}
+
+func (p *Parser) hgetall(sess *Session, args [][]byte) resp.Value {
+	fields, values, err := p.storage.HGetAll(string(args[1]))
+	if err != nil {
+		return errorReply(err)
+	}
+
+	pairs := make([]resp.Value, 0, 2*len(fields))
+	for i, field := range fields {
+		pairs = append(pairs, resp.BulkString(field), resp.BulkBytes(values[i]))
+	}
+	return resp.Map(pairs...)
+}
+
+func (p *Parser) hincrby(sess *Session, args [][]byte) resp.Value {
+	delta, err := strconv.ParseInt(string(args[3]), 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+
+	val, err := p.storage.HIncrBy(string(args[1]), string(args[2]), delta)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(val)
+}
+
+// hincrbyfloat is logged as HSET of the computed value, like INCRBYFLOAT.
+func (p *Parser) hincrbyfloat(sess *Session, args [][]byte) resp.Value {
+	delta, err := storage.ParseLongDouble(args[3])
+	if err != nil {
+		return errorReply(err)
+	}
+
+	val, err := p.storage.HIncrByFloat(string(args[1]), string(args[2]), delta)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	sess.propagate = [][]byte{[]byte("HSET"), args[1], args[2], val}
+	return resp.BulkBytes(val)
+}
@@ -0,0 +1,31 @@
+package compute
+
+import "github.com/Novip1906/my-redis/internal/resp"
+
+func (p *Parser) pfadd(sess *Session, args [][]byte) resp.Value {
+	changed, err := p.storage.PFAdd(string(args[1]), args[2:])
+	if err != nil {
+		return errorReply(err)
+	}
+	if !changed {
+		sess.propagate = nil
+	}
+	return boolInteger(changed)
+}
+
+// pfcount implements PFCOUNT key [key ...]. Caching the estimate of a single
+// key changes its value but not what it counts, so it is not logged.
+func (p *Parser) pfcount(sess *Session, args [][]byte) resp.Value {
+	count, err := p.storage.PFCount(keyStrings(args[1:]))
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(count)
+}
+
+func (p *Parser) pfmerge(sess *Session, args [][]byte) resp.Value {
+	if err := p.storage.PFMerge(string(args[1]), keyStrings(args[2:])); err != nil {
+		return errorReply(err)
+	}
+	return resp.OK
+}
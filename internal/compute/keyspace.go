@@ -0,0 +1,100 @@
+package compute
+
+import (
+	"strings"
+
+	"github.com/Novip1906/my-redis/internal/resp"
+)
+
+func (p *Parser) typeCmd(sess *Session, args [][]byte) resp.Value {
+	return resp.SimpleString(p.storage.Type(string(args[1])).String())
+}
+
+func (p *Parser) rename(sess *Session, args [][]byte) resp.Value {
+	if _, err := p.renameGeneric(sess, args, false); err != nil {
+		return errorReply(err)
+	}
+	return resp.OK
+}
+
+func (p *Parser) renamenx(sess *Session, args [][]byte) resp.Value {
+	renamed, err := p.renameGeneric(sess, args, true)
+	if err != nil {
+		return errorReply(err)
+	}
+	if !renamed {
+		sess.propagate = nil
+	}
+	return boolInteger(renamed)
+}
+
+// renameGeneric renames args[1] to args[2]. A key with a TTL may have expired
+// by the time the AOF is replayed, so the replaced destination is deleted
+// explicitly first, as it would be gone by then anyway.
+func (p *Parser) renameGeneric(sess *Session, args [][]byte, nx bool) (bool, error) {
+	src, dst := string(args[1]), string(args[2])
+	renamed, volatile, err := p.storage.Rename(src, dst, nx)
+	switch {
+	case err != nil || !renamed:
+		return renamed, err
+	case src == dst:
+		sess.propagate = nil
+	case volatile && !nx:
+		sess.propagate = [][]byte{[]byte("DEL"), args[2]}
+		sess.addPropagate(args...)
+	}
+	return true, nil
+}
+
+// copyCmd implements COPY source destination [DB destination-db] [REPLACE].
+// There is a single database, so DB only accepts 0.
+func (p *Parser) copyCmd(sess *Session, args [][]byte) resp.Value {
+	var replace bool
+	for i := 3; i < len(args); i++ {
+		switch option := strings.ToUpper(string(args[i])); {
+		case option == "REPLACE":
+			replace = true
+		case option == "DB" && i+1 < len(args):
+			if string(args[i+1]) != "0" {
+				return resp.Error("ERR DB index is out of range")
+			}
+			i++
+		default:
+			return errSyntax
+		}
+	}
+
+	src, dst := string(args[1]), string(args[2])
+	if src == dst {
+		return resp.Error("ERR source and destination objects are the same")
+	}
+
+	copied, volatile := p.storage.Copy(src, dst, replace)
+	switch {
+	case !copied:
+		sess.propagate = nil
+	case volatile && replace:
+		// Like RENAME, a replayed COPY may find the source expired.
+		sess.propagate = [][]byte{[]byte("DEL"), args[2]}
+		sess.addPropagate(args...)
+	}
+	return boolInteger(copied)
+}
+
+func (p *Parser) randomkey(sess *Session, args [][]byte) resp.Value {
+	key, ok := p.storage.RandomKey()
+	if !ok {
+		return resp.NullBulk
+	}
+	return resp.BulkString(key)
+}
+
+func (p *Parser) dbsize(sess *Session, args [][]byte) resp.Value {
+	return resp.Integer(p.storage.DBSize())
+}
+
+// touch returns how many of the keys exist. There is no LRU clock to update,
+// so it is the same as EXISTS.
+func (p *Parser) touch(sess *Session, args [][]byte) resp.Value {
+	return resp.Integer(p.storage.Exists(keyStrings(args[1:])...))
+}
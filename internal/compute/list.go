@@ -0,0 +1,286 @@
+package compute
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Novip1906/my-redis/internal/resp"
+)
+
+func (p *Parser) lpush(sess *Session, args [][]byte) resp.Value {
+	return p.push(args, true)
+}
+
+func (p *Parser) rpush(sess *Session, args [][]byte) resp.Value {
+	return p.push(args, false)
+}
+
+func (p *Parser) push(args [][]byte, left bool) resp.Value {
+	n, err := p.storage.Push(string(args[1]), args[2:], left)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(n)
+}
+
+func (p *Parser) lpop(sess *Session, args [][]byte) resp.Value {
+	return p.pop(sess, args, true)
+}
+
+func (p *Parser) rpop(sess *Session, args [][]byte) resp.Value {
+	return p.pop(sess, args, false)
+}
+
+// pop implements LPOP and RPOP key [count]. Without a count the reply is a
+// single element, with a count it is an array.
+func (p *Parser) pop(sess *Session, args [][]byte, left bool) resp.Value {
+	if len(args) > 3 {
+		return errWrongArgs(strings.ToLower(string(args[0])))
+	}
+
+	count := int64(1)
+	if len(args) == 3 {
+		var err error
+		count, err = strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil || count < 0 {
+			return resp.Error("ERR value is out of range, must be positive")
+		}
+	}
+
+	values, ok, err := p.storage.Pop(string(args[1]), count, left)
+	if err != nil {
+		return errorReply(err)
+	}
+	if len(values) == 0 {
+		sess.propagate = nil
+	}
+
+	switch {
+	case !ok && len(args) == 3:
+		return resp.NullArray
+	case !ok:
+		return resp.NullBulk
+	case len(args) == 3:
+		return bulkArray(values)
+	default:
+		return resp.BulkBytes(values[0])
+	}
+}
+
+func (p *Parser) llen(sess *Session, args [][]byte) resp.Value {
+	n, err := p.storage.LLen(string(args[1]))
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(n)
+}
+
+func (p *Parser) lrange(sess *Session, args [][]byte) resp.Value {
+	start, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	stop, err := strconv.ParseInt(string(args[3]), 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+
+	values, err := p.storage.LRange(string(args[1]), start, stop)
+	if err != nil {
+		return errorReply(err)
+	}
+	return bulkArray(values)
+}
+
+func (p *Parser) lindex(sess *Session, args [][]byte) resp.Value {
+	index, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+
+	val, ok, err := p.storage.LIndex(string(args[1]), index)
+	if err != nil {
+		return errorReply(err)
+	}
+	if !ok {
+		return resp.NullBulk
+	}
+	return resp.BulkBytes(val)
+}
+
+func (p *Parser) lset(sess *Session, args [][]byte) resp.Value {
+	index, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+
+	if err := p.storage.LSet(string(args[1]), index, args[3]); err != nil {
+		return errorReply(err)
+	}
+	return resp.OK
+}
+
+func (p *Parser) lrem(sess *Session, args [][]byte) resp.Value {
+	count, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+
+	removed, err := p.storage.LRem(string(args[1]), count, args[3])
+	if err != nil {
+		return errorReply(err)
+	}
+	if removed == 0 {
+		sess.propagate = nil
+	}
+	return resp.Integer(removed)
+}
+
+func (p *Parser) ltrim(sess *Session, args [][]byte) resp.Value {
+	start, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	stop, err := strconv.ParseInt(string(args[3]), 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+
+	if err := p.storage.LTrim(string(args[1]), start, stop); err != nil {
+		return errorReply(err)
+	}
+	return resp.OK
+}
+
+func (p *Parser) linsert(sess *Session, args [][]byte) resp.Value {
+	var before bool
+	switch strings.ToUpper(string(args[2])) {
+	case "BEFORE":
+		before = true
+	case "AFTER":
+	default:
+		return errSyntax
+	}
+
+	n, err := p.storage.LInsert(string(args[1]), before, args[3], args[4])
+	if err != nil {
+		return errorReply(err)
+	}
+	if n <= 0 {
+		sess.propagate = nil
+	}
+	return resp.Integer(n)
+}
+
+func (p *Parser) lmove(sess *Session, args [][]byte) resp.Value {
+	srcLeft, dstLeft, ok := parseMoveDirections(args[3], args[4])
+	if !ok {
+		return errSyntax
+	}
+
+	val, ok, err := p.storage.LMove(string(args[1]), string(args[2]), srcLeft, dstLeft)
+	if err != nil {
+		return errorReply(err)
+	}
+	if !ok {
+		sess.propagate = nil
+		return resp.NullBulk
+	}
+	return resp.BulkBytes(val)
+}
+
+func (p *Parser) blpop(sess *Session, args [][]byte) resp.Value {
+	return p.bpop(sess, args, true)
+}
+
+func (p *Parser) brpop(sess *Session, args [][]byte) resp.Value {
+	return p.bpop(sess, args, false)
+}
+
+// bpop implements BLPOP and BRPOP key [key ...] timeout. The element that was
+// served is logged as a plain LPOP or RPOP of its key.
+func (p *Parser) bpop(sess *Session, args [][]byte, left bool) resp.Value {
+	timeout, errReply, ok := parseTimeout(args[len(args)-1])
+	if !ok {
+		return errReply
+	}
+	keys := keyStrings(args[1 : len(args)-1])
+
+	popCommand := []byte("RPOP")
+	if left {
+		popCommand = []byte("LPOP")
+	}
+
+	reply, ok := p.block(sess, keys, timeout, func() (resp.Value, bool) {
+		key, val, ok, err := p.storage.PopFirst(keys, left)
+		if err != nil {
+			return errorReply(err), true
+		}
+		if !ok {
+			return resp.Value{}, false
+		}
+		sess.propagate = [][]byte{popCommand, []byte(key)}
+		return resp.Array(resp.BulkString(key), resp.BulkBytes(val)), true
+	})
+	if !ok {
+		return resp.NullArray
+	}
+	return reply
+}
+
+// blmove implements BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout,
+// logged as LMOVE once an element is moved.
+func (p *Parser) blmove(sess *Session, args [][]byte) resp.Value {
+	srcLeft, dstLeft, ok := parseMoveDirections(args[3], args[4])
+	if !ok {
+		return errSyntax
+	}
+	timeout, errReply, ok := parseTimeout(args[5])
+	if !ok {
+		return errReply
+	}
+
+	reply, ok := p.block(sess, []string{string(args[1])}, timeout, func() (resp.Value, bool) {
+		val, ok, err := p.storage.LMove(string(args[1]), string(args[2]), srcLeft, dstLeft)
+		if err != nil {
+			return errorReply(err), true
+		}
+		if !ok {
+			return resp.Value{}, false
+		}
+		sess.propagate = [][]byte{[]byte("LMOVE"), args[1], args[2], args[3], args[4]}
+		return resp.BulkBytes(val), true
+	})
+	if !ok {
+		return resp.NullBulk
+	}
+	return reply
+}
+
+func parseMoveDirections(from, to []byte) (srcLeft, dstLeft bool, ok bool) {
+	srcLeft, ok = parseDirection(from)
+	if !ok {
+		return false, false, false
+	}
+	dstLeft, ok = parseDirection(to)
+	return srcLeft, dstLeft, ok
+}
+
+func parseDirection(arg []byte) (left bool, ok bool) {
+	switch strings.ToUpper(string(arg)) {
+	case "LEFT":
+		return true, true
+	case "RIGHT":
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+func bulkArray(values [][]byte) resp.Value {
+	reply := make([]resp.Value, len(values))
+	for i, val := range values {
+		reply[i] = resp.BulkBytes(val)
+	}
+	return resp.Array(reply...)
+}
@@ -1,23 +1,151 @@
 package compute
 
 import (
-	"fmt"
-	"strconv"
+	"errors"
+	"math/big"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Novip1906/my-redis/internal/resp"
+	"github.com/Novip1906/my-redis/internal/storage"
 )
 
 type Storage interface {
-	Set(key, value string)
-	Get(key string) (string, bool)
-	Delete(key string)
-	SetTTL(key string, seconds int64) bool
-	GetTTL(key string) int64
-	Increment(key string) (int64, error)
+	Set(key string, value []byte)
+	SetWithOptions(key string, value []byte, opts storage.SetOptions) (old []byte, existed bool, written bool, err error)
+	GetSet(key string, value []byte) ([]byte, bool, error)
+	Get(key string) ([]byte, bool, error)
+	GetDel(key string) ([]byte, bool, error)
+	GetEx(key string, expiresAt int64, persist bool) ([]byte, bool, error)
+	Append(key string, value []byte) (int64, error)
+	Strlen(key string) (int64, error)
+	GetRange(key string, start, end int64) ([]byte, error)
+	SetRange(key string, offset int64, value []byte) (int64, error)
+	Delete(keys ...string) int64
+	Exists(keys ...string) int64
+	Type(key string) storage.ValueType
+	Rename(src, dst string, nx bool) (renamed, volatile bool, err error)
+	Copy(src, dst string, replace bool) (copied, volatile bool)
+	RandomKey() (string, bool)
+	DBSize() int64
+	Scan(cursor uint64, opts storage.ScanOptions) (uint64, []string)
+	HScan(key string, cursor uint64, opts storage.ScanOptions) (uint64, [][]byte, error)
+	SScan(key string, cursor uint64, opts storage.ScanOptions) (uint64, [][]byte, error)
+	ZScan(key string, cursor uint64, opts storage.ScanOptions) (uint64, []storage.ZMember, error)
+	MGet(keys ...string) [][]byte
+	MSet(keys []string, values [][]byte)
+	MSetNX(keys []string, values [][]byte) bool
+	ExpireAt(key string, at time.Time, cond storage.ExpireCondition) bool
+	Persist(key string) bool
+	GetPTTL(key string) int64
+	GetExpireTime(key string) int64
+	Increment(key string, delta int64) (int64, error)
+	IncrementFloat(key string, delta *big.Float) ([]byte, error)
+	SetBit(key string, offset int64, value bool) (bool, error)
+	GetBit(key string, offset int64) (bool, error)
+	BitCount(key string, start, end int64, bitUnit bool) (int64, error)
+	BitPos(key string, bit bool, start, end int64, endGiven, bitUnit bool) (int64, error)
+	BitOp(op storage.BitOperation, dst string, keys []string) (int64, error)
+	BitField(key string, ops []storage.BitFieldOp) ([]storage.BitFieldResult, error)
+	PFAdd(key string, elements [][]byte) (bool, error)
+	PFCount(keys []string) (int64, error)
+	PFMerge(dst string, keys []string) error
+	HSet(key string, fields []string, values [][]byte) (int64, error)
+	HSetNX(key, field string, value []byte) (bool, error)
+	HGet(key, field string) ([]byte, bool, error)
+	HMGet(key string, fields ...string) ([][]byte, error)
+	HDel(key string, fields ...string) (int64, error)
+	HExists(key, field string) (bool, error)
+	HLen(key string) (int64, error)
+	HStrLen(key, field string) (int64, error)
+	HGetAll(key string) ([]string, [][]byte, error)
+	HIncrBy(key, field string, delta int64) (int64, error)
+	HIncrByFloat(key, field string, delta *big.Float) ([]byte, error)
+	Push(key string, values [][]byte, left bool) (int64, error)
+	Pop(key string, count int64, left bool) ([][]byte, bool, error)
+	PopFirst(keys []string, left bool) (string, []byte, bool, error)
+	LLen(key string) (int64, error)
+	LRange(key string, start, stop int64) ([][]byte, error)
+	LIndex(key string, index int64) ([]byte, bool, error)
+	LSet(key string, index int64, value []byte) error
+	LRem(key string, count int64, value []byte) (int64, error)
+	LTrim(key string, start, stop int64) error
+	LInsert(key string, before bool, pivot, value []byte) (int64, error)
+	LMove(src, dst string, srcLeft, dstLeft bool) ([]byte, bool, error)
+	WatchKeys(keys []string) (ready <-chan struct{}, cancel func())
+	SAdd(key string, members [][]byte) (int64, error)
+	SRem(key string, members [][]byte) (int64, error)
+	SIsMember(key string, member []byte) (bool, error)
+	SMIsMember(key string, members [][]byte) ([]bool, error)
+	SMembers(key string) ([][]byte, error)
+	SCard(key string) (int64, error)
+	SPop(key string, count int64) ([][]byte, error)
+	SRandMember(key string, count int64) ([][]byte, error)
+	SMove(src, dst string, member []byte) (bool, error)
+	SetOp(op storage.SetOperation, keys []string) ([][]byte, error)
+	SetOpStore(op storage.SetOperation, dst string, keys []string) (int64, error)
+	SInterCard(keys []string, limit int64) (int64, error)
+	ZAdd(key string, flags storage.ZAddFlags, scores []float64, members [][]byte) (added, updated int64, err error)
+	ZIncrBy(key string, member []byte, delta float64, flags storage.ZAddFlags) (float64, bool, error)
+	ZRem(key string, members [][]byte) (int64, error)
+	ZScore(key string, member []byte) (float64, bool, error)
+	ZCard(key string) (int64, error)
+	ZRank(key string, member []byte, rev bool) (int64, float64, bool, error)
+	ZCount(key string, r storage.ScoreRange) (int64, error)
+	ZRange(key string, spec storage.ZRangeSpec) ([]storage.ZMember, error)
+	ZRangeStore(dst, src string, spec storage.ZRangeSpec) (int64, error)
+	ZPop(key string, count int64, max bool) ([]storage.ZMember, error)
+	ZPopFirst(keys []string, max bool) (string, storage.ZMember, bool, error)
+	ZStore(dst string, keys []string, weights []float64, aggregate storage.Aggregate, inter bool) (int64, error)
+	ZMScore(key string, members [][]byte) (scores []float64, found []bool, err error)
+	GeoSearch(key string, spec storage.GeoSearchSpec) ([]storage.GeoResult, error)
+	GeoSearchStore(dst, src string, spec storage.GeoSearchSpec, storeDist bool) (int64, error)
+	XAdd(key string, opts storage.XAddOptions, fields [][]byte) (storage.StreamID, bool, error)
+	XLen(key string) (int64, error)
+	XLastID(key string) (storage.StreamID, error)
+	XRange(key string, start, end storage.StreamID, count int64, rev bool) ([]storage.StreamEntry, error)
+	XRead(keys []string, ids []storage.StreamID, count int64) ([]storage.StreamRead, error)
+	XGroupCreate(key, group string, id storage.StreamID, useLast, mkStream bool) (storage.StreamID, error)
+	XGroupSetID(key, group string, id storage.StreamID, useLast bool) (storage.StreamID, error)
+	XGroupDestroy(key, group string) (bool, error)
+	XGroupCreateConsumer(key, group, consumer string) (bool, error)
+	XGroupDelConsumer(key, group, consumer string) (int64, error)
+	XReadGroup(group, consumer string, reads []storage.GroupRead, count int64, noAck bool, now int64) ([]storage.GroupDelivery, error)
+	XAck(key, group string, ids []storage.StreamID) (int64, error)
+	XPendingSummary(key, group string) (storage.PendingSummary, error)
+	XPending(key, group string, start, end storage.StreamID, count int64, consumer string, minIdle, now int64) ([]storage.PendingEntry, error)
+	XClaim(key, group, consumer string, minIdle int64, ids []storage.StreamID, opts storage.XClaimOptions, now int64) ([]storage.StreamEntry, []storage.StreamID, error)
+	XAutoClaim(key, group, consumer string, minIdle int64, start storage.StreamID, count int64, justID bool, now int64) (storage.StreamID, []storage.StreamEntry, []storage.StreamID, error)
+	XSetID(key string, id storage.StreamID) error
 	Flush()
 }
 
+// Appender is where the commands propagated by write commands are appended,
+// the AOF.
+type Appender interface {
+	Write(args [][]byte) error
+}
+
+// Persistence runs the persistence commands. Save writes a snapshot before
+// returning, the others start working in the background.
+type Persistence interface {
+	RewriteAOF() error
+	Save() error
+	BGSave() error
+}
+
 type Parser struct {
-	storage Storage
+	storage     Storage
+	persistence Persistence
+	// writes is held shared by commands run with ExecuteAndAppend until what
+	// they propagate is appended, and exclusively by PauseWrites, so that a
+	// snapshot has either both a change and its command or neither.
+	writes sync.RWMutex
+	// dirty counts the commands propagated by ExecuteAndAppend, the changes
+	// the save rules count.
+	dirty atomic.Int64
 }
 
 func NewParser(storage Storage) *Parser {
@@ -26,89 +154,96 @@ func NewParser(storage Storage) *Parser {
 	}
 }
 
-func (p *Parser) ProcessCommand(commandLine string) (response string, saveToAOF bool) {
-	parts := strings.Fields(commandLine)
-	if len(parts) == 0 {
-		return "", false
-	}
+// SetPersistence sets what runs BGREWRITEAOF, SAVE and BGSAVE. Without it
+// these commands fail.
+func (p *Parser) SetPersistence(persistence Persistence) {
+	p.persistence = persistence
+}
 
-	cmd := strings.ToUpper(parts[0])
+// PauseWrites calls fn while no command run with ExecuteAndAppend is between
+// changing the dataset and appending its command.
+func (p *Parser) PauseWrites(fn func()) {
+	p.writes.Lock()
+	defer p.writes.Unlock()
 
-	switch cmd {
-	case "SET":
-		if len(parts) < 3 {
-			return "(error) ERR wrong number of arguments for 'set'", false
-		}
-		key := parts[1]
-		val := strings.Join(parts[2:], " ")
-		p.storage.Set(key, val)
-		return "OK", true
-
-	case "GET":
-		if len(parts) != 2 {
-			return "(error) ERR wrong number of arguments for 'get'", false
-		}
-		key := parts[1]
-		val, ok := p.storage.Get(key)
-		if !ok {
-			return "(nil)", false
-		} else {
-			return val, false
-		}
+	fn()
+}
 
-	case "DEL":
-		if len(parts) != 2 {
-			return "(error) ERR wrong number of arguments for 'del'", false
-		}
-		key := parts[1]
-		p.storage.Delete(key)
-		return "OK", true
+// Dirty returns how many changes were made with ExecuteAndAppend.
+func (p *Parser) Dirty() int64 {
+	return p.dirty.Load()
+}
 
-	case "EXPIRE":
-		if len(parts) != 3 {
-			return "(error) ERR wrong number of arguments for 'expire'", false
-		}
-		key := parts[1]
-		seconds, err := strconv.Atoi(parts[2])
-		if err != nil {
-			return "(error) ERR value is not an integer or out of range", false
-		}
+// ExecuteAndAppend runs a command like Execute and appends the commands it
+// propagates to aof. Blocking commands let PauseWrites through while they
+// wait. The reply is valid even if appending fails.
+func (p *Parser) ExecuteAndAppend(sess *Session, args [][]byte, aof Appender) (resp.Value, error) {
+	// Other commands change nothing, and may pause writes themselves.
+	if len(args) > 0 && commands[strings.ToUpper(string(args[0]))].write {
+		p.writes.RLock()
+		sess.holdsWrites = true
+		defer func() {
+			sess.holdsWrites = false
+			p.writes.RUnlock()
+		}()
+	}
 
-		ok := p.storage.SetTTL(key, int64(seconds))
-		if ok {
-			return "1", true
-		} else {
-			return "0", false
-		}
+	response, propagate := p.Execute(sess, args)
+	p.dirty.Add(int64(len(propagate)))
 
-	case "TTL":
-		if len(parts) != 2 {
-			return "(error) ERR wrong number of arguments for 'ttl'", false
+	var errs []error
+	for _, command := range propagate {
+		if err := aof.Write(command); err != nil {
+			errs = append(errs, err)
 		}
-		key := parts[1]
-		seconds := p.storage.GetTTL(key)
-		return fmt.Sprintf("%d", seconds), false
+	}
+	return response, errors.Join(errs...)
+}
 
-	case "INCR":
-		if len(parts) != 2 {
-			return "(error) ERR wrong number of arguments for 'incr'", false
-		}
-		key := parts[1]
-		val, err := p.storage.Increment(key)
-		if err != nil {
-			return "(error) ERR value is not an integer or out of range", false
-		}
-		return fmt.Sprintf("%d", val), true
+// ProcessCommand executes a command written in the inline (telnet) form.
+func (p *Parser) ProcessCommand(sess *Session, commandLine string) (response resp.Value, propagate [][][]byte) {
+	args, err := resp.SplitInline([]byte(commandLine))
+	if err != nil {
+		return resp.Error("ERR " + err.Error()), nil
+	}
+	if len(args) == 0 {
+		return resp.Value{}, nil
+	}
+	return p.Execute(sess, args)
+}
 
-	case "FLUSH":
-		p.storage.Flush()
-		return "OK", true
+// Execute runs a command given as a list of arguments, the first one being the command name.
+// Besides the reply it returns the commands that have to be appended to the AOF, or nil
+// when the command did not change the dataset. The logged commands may differ from args,
+// e.g. relative expirations are logged with absolute deadlines so that replay is exact.
+func (p *Parser) Execute(sess *Session, args [][]byte) (response resp.Value, propagate [][][]byte) {
+	if len(args) == 0 {
+		return resp.Error("ERR empty command"), nil
+	}
+
+	name := strings.ToUpper(string(args[0]))
 
-	case "QUIT":
-		return "Bye!", false
+	cmd, ok := commands[name]
+	if !ok {
+		return resp.Errorf("ERR unknown command '%s'", args[0]), nil
+	}
 
-	default:
-		return fmt.Sprintf("(error) ERR unknown command '%s'\n", cmd), false
+	if (cmd.arity > 0 && len(args) != cmd.arity) || len(args) < -cmd.arity {
+		return errWrongArgs(cmd.name), nil
 	}
 
+	sess.propagate = nil
+	sess.alsoPropagate = nil
+	if cmd.write {
+		sess.propagate = args
+	}
+
+	response = cmd.handler(p, sess, args)
+	if response.IsError() {
+		return response, nil
+	}
+	if sess.propagate != nil {
+		propagate = append(propagate, sess.propagate)
+	}
+	return response, append(propagate, sess.alsoPropagate...)
 }
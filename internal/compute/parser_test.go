@@ -1,8 +1,18 @@
 package compute
 
 import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/Novip1906/my-redis/internal/resp"
 	"github.com/Novip1906/my-redis/internal/storage"
 )
 
@@ -10,33 +20,1741 @@ func TestParser(t *testing.T) {
 	storage := storage.NewMemoryStorage()
 
 	parser := NewParser(storage)
+	sess := NewSession(1)
+
+	tests := []struct {
+		command  string
+		expected resp.Value
+	}{
+		{"SET mykey myvalue", resp.OK},
+		{"GET mykey", resp.BulkString("myvalue")},
+		{"GET unknown", resp.NullBulk},
+		{"DEL mykey", resp.Integer(1)},
+		{"GET mykey", resp.NullBulk},
+		{"SET with ttl", resp.OK},
+		{"EXPIRE with 2", resp.Integer(1)},
+		{"TTL with", resp.Integer(2)},
+		{"SET without ttl", resp.OK},
+		{"TTL without", resp.Integer(-1)},
+		{"INCR testIncr", resp.Integer(1)},
+		{"SET testIncr 2", resp.OK},
+		{"INCR testIncr", resp.Integer(3)},
+		{"SET testIncr", resp.Error("ERR wrong number of arguments for 'set' command")},
+		{"EXPIRE with ten", resp.Error("ERR value is not an integer or out of range")},
+		{"unknown", resp.Error("ERR unknown command 'unknown'")},
+		{"PING", resp.SimpleString("PONG")},
+		{"echo hello", resp.BulkString("hello")},
+		{`SET greeting "hello   world"`, resp.OK},
+		{"GET greeting", resp.BulkString("hello   world")},
+		{`SET empty ""`, resp.OK},
+		{"GET empty", resp.BulkString("")},
+		{`SET bad "unbalanced`, resp.Error("ERR Protocol error: unbalanced quotes in request")},
+		{"FLUSH", resp.OK},
+	}
+
+	for _, tt := range tests {
+
+		response, _ := parser.ProcessCommand(sess, tt.command)
+
+		if !reflect.DeepEqual(response, tt.expected) {
+			t.Errorf("Command: %q, got: %+v, want: %+v", tt.command, response, tt.expected)
+		}
+	}
+}
+
+func TestParser_Hello(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(7)
+
+	response, _ := parser.ProcessCommand(sess, "HELLO 4")
+	if response.Str != "NOPROTO unsupported protocol version" {
+		t.Errorf("HELLO 4 = %+v, want NOPROTO error", response)
+	}
+
+	response, _ = parser.ProcessCommand(sess, "HELLO 3 SETNAME worker")
+	if response.Type != resp.TypeMap {
+		t.Fatalf("HELLO 3 reply type = %q, want map", response.Type)
+	}
+	if sess.Protocol != 3 || sess.Name != "worker" {
+		t.Errorf("session = %+v, want protocol 3 and name worker", sess)
+	}
+
+	fields := make(map[string]resp.Value)
+	for i := 0; i+1 < len(response.Array); i += 2 {
+		fields[response.Array[i].Str] = response.Array[i+1]
+	}
+	if fields["proto"].Int != 3 || fields["id"].Int != 7 {
+		t.Errorf("HELLO fields = %+v", fields)
+	}
+
+	parser.ProcessCommand(sess, "HELLO 2")
+	if sess.Protocol != 2 {
+		t.Errorf("protocol = %d, want 2", sess.Protocol)
+	}
+}
+
+func TestParser_ExpirePropagatesAbsoluteDeadline(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	parser.ProcessCommand(sess, "SET key value")
+
+	before := time.Now().Add(10 * time.Second).UnixMilli()
+	_, commands := parser.ProcessCommand(sess, "EXPIRE key 10")
+	after := time.Now().Add(10 * time.Second).UnixMilli()
+
+	if len(commands) != 1 {
+		t.Fatalf("propagated %d commands, want 1", len(commands))
+	}
+	propagate := commands[0]
+
+	if len(propagate) != 3 || string(propagate[0]) != "PEXPIREAT" || string(propagate[1]) != "key" {
+		t.Fatalf("propagate = %q, want PEXPIREAT key <ms>", propagate)
+	}
+	deadline, err := strconv.ParseInt(string(propagate[2]), 10, 64)
+	if err != nil || deadline < before || deadline > after {
+		t.Errorf("deadline = %s, want between %d and %d", propagate[2], before, after)
+	}
+
+	_, commands = parser.ProcessCommand(sess, "EXPIRE missing 10")
+	if commands != nil {
+		t.Errorf("propagated %q for a missing key, want nil", commands)
+	}
+}
+
+func TestParser_ReplayExpiredDeadline(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(0)
+
+	past := time.Now().Add(-time.Hour).UnixMilli()
+	future := time.Now().Add(time.Hour).UnixMilli()
+
+	parser.ProcessCommand(sess, "SET dead value")
+	parser.ProcessCommand(sess, fmt.Sprintf("PEXPIREAT dead %d", past))
+	parser.ProcessCommand(sess, "SET alive value")
+	parser.ProcessCommand(sess, fmt.Sprintf("PEXPIREAT alive %d", future))
+
+	if response, _ := parser.ProcessCommand(sess, "GET dead"); !reflect.DeepEqual(response, resp.NullBulk) {
+		t.Errorf("GET dead = %+v, want nil", response)
+	}
+	if response, _ := parser.ProcessCommand(sess, "TTL alive"); response.Int < 3598 || response.Int > 3600 {
+		t.Errorf("TTL alive = %+v, want about 3600", response)
+	}
+}
+
+func TestParser_ExpireFamily(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	inHour := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		command  string
+		expected resp.Value
+	}{
+		{"SET key value", resp.OK},
+		{"PTTL key", resp.Integer(-1)},
+		{"EXPIRETIME key", resp.Integer(-1)},
+		{"EXPIRE key 100 XX", resp.Integer(0)},
+		{"EXPIRE key 100 NX", resp.Integer(1)},
+		{"EXPIRE key 50 GT", resp.Integer(0)},
+		{"PEXPIRE key 200000 GT", resp.Integer(1)},
+		{"TTL key", resp.Integer(200)},
+		{fmt.Sprintf("EXPIREAT key %d", inHour), resp.Integer(1)},
+		{"EXPIRETIME key", resp.Integer(inHour)},
+		{"PEXPIRETIME key", resp.Integer(inHour * 1000)},
+		{"EXPIRE key 10 NX XX", resp.Error("ERR NX and XX, GT or LT options at the same time are not compatible")},
+		{"EXPIRE key 10 GT LT", resp.Error("ERR GT and LT options at the same time are not compatible")},
+		{"EXPIRE key 10 SOON", resp.Error("ERR Unsupported option SOON")},
+		{"EXPIRE key 9223372036854775807", resp.Error("ERR invalid expire time in 'expire' command")},
+		{"PTTL missing", resp.Integer(-2)},
+		{"EXPIRETIME missing", resp.Integer(-2)},
+		{"PEXPIRE key -1", resp.Integer(1)},
+		{"GET key", resp.NullBulk},
+	}
+
+	for _, tt := range tests {
+		response, _ := parser.ProcessCommand(sess, tt.command)
+
+		if !reflect.DeepEqual(response, tt.expected) {
+			t.Errorf("Command: %q, got: %+v, want: %+v", tt.command, response, tt.expected)
+		}
+	}
+}
+
+func TestParser_SetOptions(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	tests := []struct {
+		command  string
+		expected resp.Value
+	}{
+		{"SET lock token1 NX PX 30000", resp.OK},
+		{"SET lock token2 NX PX 30000", resp.NullBulk},
+		{"GET lock", resp.BulkString("token1")},
+		{"TTL lock", resp.Integer(30)},
+		{"SET lock token3 XX KEEPTTL GET", resp.BulkString("token1")},
+		{"TTL lock", resp.Integer(30)},
+		{"SET lock token4", resp.OK},
+		{"TTL lock", resp.Integer(-1)},
+		{"SET missing v XX", resp.NullBulk},
+		{"SET missing v XX GET", resp.NullBulk},
+		{"SET fresh v NX GET", resp.NullBulk},
+		{"GET fresh", resp.BulkString("v")},
+		{"SET session v EX 100", resp.OK},
+		{"TTL session", resp.Integer(100)},
+		{"SET k v NX XX", resp.Error("ERR syntax error")},
+		{"SET k v EX 10 PX 100", resp.Error("ERR syntax error")},
+		{"SET k v EX 10 KEEPTTL", resp.Error("ERR syntax error")},
+		{"SET k v EX", resp.Error("ERR syntax error")},
+		{"SET k v EX 0", resp.Error("ERR invalid expire time in 'set' command")},
+		{"SET k v PX ten", resp.Error("ERR value is not an integer or out of range")},
+		{"SET k v FOREVER", resp.Error("ERR syntax error")},
+	}
+
+	for _, tt := range tests {
+		response, _ := parser.ProcessCommand(sess, tt.command)
+
+		if !reflect.DeepEqual(response, tt.expected) {
+			t.Errorf("Command: %q, got: %+v, want: %+v", tt.command, response, tt.expected)
+		}
+	}
+}
+
+func TestParser_SetPropagation(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	before := time.Now().UnixMilli() + 30000
+	_, commands := parser.ProcessCommand(sess, "SET lock token NX GET EX 30")
+	after := time.Now().UnixMilli() + 30000
+
+	if len(commands) != 1 {
+		t.Fatalf("propagated %d commands, want 1", len(commands))
+	}
+	propagate := commands[0]
+
+	if len(propagate) != 5 || string(propagate[0]) != "SET" || string(propagate[3]) != "PXAT" {
+		t.Fatalf("propagate = %q, want SET lock token PXAT <ms>", propagate)
+	}
+	if deadline, _ := strconv.ParseInt(string(propagate[4]), 10, 64); deadline < before || deadline > after {
+		t.Errorf("deadline = %d, want between %d and %d", deadline, before, after)
+	}
+
+	if _, commands = parser.ProcessCommand(sess, "SET lock other NX"); commands != nil {
+		t.Errorf("propagated %q for a failed NX, want nil", commands)
+	}
+
+	_, commands = parser.ProcessCommand(sess, "SET lock other XX KEEPTTL")
+	want := [][][]byte{{[]byte("SET"), []byte("lock"), []byte("other"), []byte("KEEPTTL")}}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("propagated %q, want %q", commands, want)
+	}
+}
+
+func TestParser_PersistAndGetSet(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	tests := []struct {
+		command  string
+		expected resp.Value
+	}{
+		{"SET key 1 EX 100", resp.OK},
+		{"PERSIST key", resp.Integer(1)},
+		{"PERSIST key", resp.Integer(0)},
+		{"TTL key", resp.Integer(-1)},
+		{"PERSIST missing", resp.Integer(0)},
+		{"EXPIRE key 100", resp.Integer(1)},
+		{"INCR key", resp.Integer(2)},
+		{"TTL key", resp.Integer(100)},
+		{"GETSET key 10", resp.BulkString("2")},
+		{"TTL key", resp.Integer(-1)},
+		{"GETSET fresh v", resp.NullBulk},
+		{"GET fresh", resp.BulkString("v")},
+	}
+
+	for _, tt := range tests {
+		response, _ := parser.ProcessCommand(sess, tt.command)
+
+		if !reflect.DeepEqual(response, tt.expected) {
+			t.Errorf("Command: %q, got: %+v, want: %+v", tt.command, response, tt.expected)
+		}
+	}
+}
+
+func TestParser_StringCommands(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	tests := []struct {
+		command  string
+		expected resp.Value
+	}{
+		{"APPEND log first", resp.Integer(5)},
+		{`APPEND log " second"`, resp.Integer(12)},
+		{"GET log", resp.BulkString("first second")},
+		{"STRLEN log", resp.Integer(12)},
+		{"STRLEN missing", resp.Integer(0)},
+		{"GETRANGE log 0 4", resp.BulkString("first")},
+		{"GETRANGE log -6 -1", resp.BulkString("second")},
+		{"GETRANGE log 5 2", resp.BulkString("")},
+		{"GETRANGE log 0 100", resp.BulkString("first second")},
+		{"GETRANGE missing 0 -1", resp.BulkString("")},
+		{"SETRANGE log 6 SECOND", resp.Integer(12)},
+		{"GET log", resp.BulkString("first SECOND")},
+		{"SETRANGE padded 3 abc", resp.Integer(6)},
+		{"GET padded", resp.BulkString("\x00\x00\x00abc")},
+		{`SETRANGE empty 5 ""`, resp.Integer(0)},
+		{"GET empty", resp.NullBulk},
+		{"SETRANGE log -1 x", resp.Error("ERR offset is out of range")},
+		{"SETRANGE log 536870911 xx", resp.Error("ERR string exceeds maximum allowed size (proto-max-bulk-len)")},
+		{"SETRANGE log 9223372036854775807 xx", resp.Error("ERR string exceeds maximum allowed size (proto-max-bulk-len)")},
+		{"SET token secret", resp.OK},
+		{"GETDEL token", resp.BulkString("secret")},
+		{"GETDEL token", resp.NullBulk},
+		{"SET session data", resp.OK},
+		{"GETEX session EX 100", resp.BulkString("data")},
+		{"TTL session", resp.Integer(100)},
+		{"GETEX session", resp.BulkString("data")},
+		{"TTL session", resp.Integer(100)},
+		{"GETEX session PERSIST", resp.BulkString("data")},
+		{"TTL session", resp.Integer(-1)},
+		{"GETEX session EX 10 PERSIST", resp.Error("ERR syntax error")},
+		{"GETEX session PX 0", resp.Error("ERR invalid expire time in 'getex' command")},
+		{"GETEX missing EX 10", resp.NullBulk},
+	}
+
+	for _, tt := range tests {
+		response, _ := parser.ProcessCommand(sess, tt.command)
+
+		if !reflect.DeepEqual(response, tt.expected) {
+			t.Errorf("Command: %q, got: %+v, want: %+v", tt.command, response, tt.expected)
+		}
+	}
+}
+
+func TestParser_StringPropagation(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	parser.ProcessCommand(sess, "SET key value")
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"GETEX key", ""},
+		{"GETEX key PERSIST", "PERSIST key"},
+		{"APPEND key more", "APPEND key more"},
+		{"GETDEL key", "DEL key"},
+		{"GETDEL key", ""},
+	}
+
+	for _, tt := range tests {
+		_, propagate := parser.ProcessCommand(sess, tt.command)
+
+		got := propagated(propagate)
+		if got != tt.want {
+			t.Errorf("Command: %q, propagated: %q, want: %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestParser_NumericCommands(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	tests := []struct {
+		command  string
+		expected resp.Value
+	}{
+		{"INCRBY counter 10", resp.Integer(10)},
+		{"INCRBY counter -3", resp.Integer(7)},
+		{"DECR counter", resp.Integer(6)},
+		{"DECRBY counter 10", resp.Integer(-4)},
+		{"DECR fresh", resp.Integer(-1)},
+		{"INCRBY counter ten", resp.Error("ERR value is not an integer or out of range")},
+		{"SET big 9223372036854775806", resp.OK},
+		{"INCR big", resp.Integer(9223372036854775807)},
+		{"INCR big", resp.Error("ERR increment or decrement would overflow")},
+		{"SET small -9223372036854775807", resp.OK},
+		{"DECRBY small 2", resp.Error("ERR increment or decrement would overflow")},
+		{"DECRBY small -9223372036854775808", resp.Error("ERR decrement would overflow")},
+		{"SET padded 007", resp.OK},
+		{"INCR padded", resp.Error("ERR value is not an integer or out of range")},
+		{"SET price 10.50", resp.OK},
+		{"INCRBYFLOAT price 0.1", resp.BulkString("10.6")},
+		{"INCRBYFLOAT price -5", resp.BulkString("5.6")},
+		{"GET price", resp.BulkString("5.6")},
+		{"INCRBYFLOAT sum 1.1", resp.BulkString("1.1")},
+		{"INCRBYFLOAT sum 2.2", resp.BulkString("3.3")},
+		{"INCRBYFLOAT sci 5.0e3", resp.BulkString("5000")},
+		{"INCRBYFLOAT sci -5000", resp.BulkString("0")},
+		{"INCRBYFLOAT sum abc", resp.Error("ERR value is not a valid float")},
+		{"INCRBYFLOAT sum inf", resp.Error("ERR increment would produce NaN or Infinity")},
+		{"SET infinite inf", resp.OK},
+		{"INCRBYFLOAT infinite 1", resp.Error("ERR increment would produce NaN or Infinity")},
+		{"INCRBYFLOAT sum 1e5000", resp.Error("ERR increment would produce NaN or Infinity")},
+		{"SET huge 1e4932", resp.OK},
+		{"INCRBYFLOAT huge 1e4932", resp.Error("ERR increment would produce NaN or Infinity")},
+		{"HSET h inf inf", resp.Integer(1)},
+		{"HINCRBYFLOAT h inf 1", resp.Error("ERR increment would produce NaN or Infinity")},
+		{"SET word hello", resp.OK},
+		{"INCRBYFLOAT word 1", resp.Error("ERR value is not a valid float")},
+	}
+
+	for _, tt := range tests {
+		response, _ := parser.ProcessCommand(sess, tt.command)
+
+		if !reflect.DeepEqual(response, tt.expected) {
+			t.Errorf("Command: %q, got: %+v, want: %+v", tt.command, response, tt.expected)
+		}
+	}
+
+	_, propagate := parser.ProcessCommand(sess, "INCRBYFLOAT price 0.4")
+	want := "SET price 6 KEEPTTL"
+	if got := propagated(propagate); got != want {
+		t.Errorf("INCRBYFLOAT propagated %q, want %q", got, want)
+	}
+}
+
+func TestParser_MultiKeyCommands(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	tests := []struct {
+		command  string
+		expected resp.Value
+	}{
+		{"MSET a 1 b 2 c 3", resp.OK},
+		{"MGET a missing c", resp.Array(resp.BulkString("1"), resp.NullBulk, resp.BulkString("3"))},
+		{"MSET a 1 b", resp.Error("ERR wrong number of arguments for 'mset' command")},
+		{"EXISTS a b missing a", resp.Integer(3)},
+		{"MSETNX c 30 d 40", resp.Integer(0)},
+		{"EXISTS d", resp.Integer(0)},
+		{"MSETNX d 4 e 5", resp.Integer(1)},
+		{"MGET d e", resp.Array(resp.BulkString("4"), resp.BulkString("5"))},
+		{`APPEND empty ""`, resp.Integer(0)},
+		{"MGET empty", resp.Array(resp.BulkString(""))},
+		{"EXISTS empty", resp.Integer(1)},
+		{"DEL empty", resp.Integer(1)},
+		{"DEL a b missing", resp.Integer(2)},
+		{"UNLINK c d", resp.Integer(2)},
+		{"DEL missing", resp.Integer(0)},
+		{"EXISTS a b c d e", resp.Integer(1)},
+		{"SET volatile v EX 100", resp.OK},
+		{"MSET volatile w", resp.OK},
+		{"TTL volatile", resp.Integer(-1)},
+	}
+
+	for _, tt := range tests {
+		response, _ := parser.ProcessCommand(sess, tt.command)
+
+		if !reflect.DeepEqual(response, tt.expected) {
+			t.Errorf("Command: %q, got: %+v, want: %+v", tt.command, response, tt.expected)
+		}
+	}
+
+	if _, propagate := parser.ProcessCommand(sess, "DEL missing"); propagate != nil {
+		t.Errorf("DEL of missing keys propagated %q, want nil", propagate)
+	}
+}
+
+func TestParser_HashCommands(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	tests := []struct {
+		command  string
+		expected resp.Value
+	}{
+		{"HSET user name alice age 30", resp.Integer(2)},
+		{"HSET user name bob city paris", resp.Integer(1)},
+		{"HSET user name", resp.Error("ERR wrong number of arguments for 'hset' command")},
+		{"HGET user name", resp.BulkString("bob")},
+		{"HGET user missing", resp.NullBulk},
+		{"HGET missing name", resp.NullBulk},
+		{"HMGET user age missing city", resp.Array(resp.BulkString("30"), resp.NullBulk, resp.BulkString("paris"))},
+		{"HLEN user", resp.Integer(3)},
+		{"HEXISTS user age", resp.Integer(1)},
+		{"HEXISTS user missing", resp.Integer(0)},
+		{"HSTRLEN user city", resp.Integer(5)},
+		{"HSETNX user name carol", resp.Integer(0)},
+		{"HSETNX user email bob@example.com", resp.Integer(1)},
+		{"HINCRBY user age 5", resp.Integer(35)},
+		{"HINCRBY user visits -2", resp.Integer(-2)},
+		{"HINCRBY user name 1", resp.Error("ERR hash value is not an integer")},
+		{"HINCRBY user age x", resp.Error("ERR value is not an integer or out of range")},
+		{"HINCRBYFLOAT user score 1.1", resp.BulkString("1.1")},
+		{"HINCRBYFLOAT user score 2.2", resp.BulkString("3.3")},
+		{"HINCRBYFLOAT user name 1", resp.Error("ERR hash value is not a float")},
+		{"HDEL user name age missing", resp.Integer(2)},
+		{"HMSET user a 1", resp.OK},
+		{"HDEL user city email visits score a", resp.Integer(5)},
+		{"EXISTS user", resp.Integer(0)},
+		{"HLEN user", resp.Integer(0)},
+		{"HGETALL user", resp.Map()},
+	}
+
+	for _, tt := range tests {
+		response, _ := parser.ProcessCommand(sess, tt.command)
+
+		if !reflect.DeepEqual(response, tt.expected) {
+			t.Errorf("Command: %q, got: %+v, want: %+v", tt.command, response, tt.expected)
+		}
+	}
+
+	parser.ProcessCommand(sess, "HSET obj f1 v1 f2 v2")
+
+	got := map[string]string{}
+	pairs, _ := parser.ProcessCommand(sess, "HGETALL obj")
+	for i := 0; i < len(pairs.Array); i += 2 {
+		got[pairs.Array[i].Str] = pairs.Array[i+1].Str
+	}
+	if pairs.Type != resp.TypeMap || !reflect.DeepEqual(got, map[string]string{"f1": "v1", "f2": "v2"}) {
+		t.Errorf("HGETALL obj = %+v, want map f1=v1 f2=v2", pairs)
+	}
+	if keys, _ := parser.ProcessCommand(sess, "HKEYS obj"); len(keys.Array) != 2 {
+		t.Errorf("HKEYS obj = %+v, want 2 fields", keys)
+	}
+}
+
+func TestParser_WrongType(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	parser.ProcessCommand(sess, "SET str value")
+	parser.ProcessCommand(sess, "HSET hash field value")
+
+	wrongType := resp.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	for _, command := range []string{
+		"GET hash", "APPEND hash x", "STRLEN hash", "GETRANGE hash 0 -1", "SETRANGE hash 0 x",
+		"INCR hash", "INCRBYFLOAT hash 1", "GETDEL hash", "GETEX hash", "GETSET hash x", "SET hash x GET",
+		"HSET str f v", "HGET str f", "HGETALL str", "HDEL str f", "HINCRBY str f 1", "HLEN str",
+	} {
+		response, propagate := parser.ProcessCommand(sess, command)
+		if !reflect.DeepEqual(response, wrongType) || propagate != nil {
+			t.Errorf("Command: %q, got: %+v, propagated: %q, want WRONGTYPE", command, response, propagate)
+		}
+	}
+
+	tests := []struct {
+		command  string
+		expected resp.Value
+	}{
+		{"MGET str hash", resp.Array(resp.BulkString("value"), resp.NullBulk)},
+		{"SET hash plain", resp.OK},
+		{"GET hash", resp.BulkString("plain")},
+	}
+
+	for _, tt := range tests {
+		response, _ := parser.ProcessCommand(sess, tt.command)
+
+		if !reflect.DeepEqual(response, tt.expected) {
+			t.Errorf("Command: %q, got: %+v, want: %+v", tt.command, response, tt.expected)
+		}
+	}
+}
+
+func TestParser_HashPropagation(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"HSET h a 1", "HSET h a 1"},
+		{"HSETNX h a 2", ""},
+		{"HINCRBY h a 2", "HINCRBY h a 2"},
+		{"HINCRBYFLOAT h f 0.5", "HSET h f 0.5"},
+		{"HDEL h missing", ""},
+		{"HDEL h a", "HDEL h a"},
+	}
+
+	replay := NewParser(storage.NewMemoryStorage())
+	for _, tt := range tests {
+		_, propagate := parser.ProcessCommand(sess, tt.command)
+		for _, command := range propagate {
+			replay.Execute(NewSession(0), command)
+		}
+
+		got := propagated(propagate)
+		if got != tt.want {
+			t.Errorf("Command: %q, propagated: %q, want: %q", tt.command, got, tt.want)
+		}
+	}
+
+	want, _ := parser.ProcessCommand(sess, "HGETALL h")
+	if got, _ := replay.ProcessCommand(sess, "HGETALL h"); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed HGETALL h = %+v, want %+v", got, want)
+	}
+}
+
+func TestParser_ListCommands(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	tests := []struct {
+		command  string
+		expected resp.Value
+	}{
+		{"RPUSH queue a b c", resp.Integer(3)},
+		{"LPUSH queue z y", resp.Integer(5)},
+		{"LRANGE queue 0 -1", bulkStrings("y", "z", "a", "b", "c")},
+		{"LRANGE queue -2 100", bulkStrings("b", "c")},
+		{"LRANGE queue 3 1", resp.Array()},
+		{"LRANGE missing 0 -1", resp.Array()},
+		{"LLEN queue", resp.Integer(5)},
+		{"LINDEX queue 0", resp.BulkString("y")},
+		{"LINDEX queue -1", resp.BulkString("c")},
+		{"LINDEX queue 5", resp.NullBulk},
+		{"LSET queue 1 Z", resp.OK},
+		{"LSET queue 10 x", resp.Error("ERR index out of range")},
+		{"LSET missing 0 x", resp.Error("ERR no such key")},
+		{"LPOP queue", resp.BulkString("y")},
+		{"RPOP queue 2", bulkStrings("c", "b")},
+		{"LPOP queue 0", resp.Array()},
+		{"LPOP queue -1", resp.Error("ERR value is out of range, must be positive")},
+		{"LPOP missing", resp.NullBulk},
+		{"LPOP missing 1", resp.NullArray},
+		{"LINSERT queue BEFORE a x", resp.Integer(3)},
+		{"LINSERT queue AFTER a x", resp.Integer(4)},
+		{"LINSERT queue AFTER nope x", resp.Integer(-1)},
+		{"LINSERT missing AFTER a x", resp.Integer(0)},
+		{"LINSERT queue NEAR a x", resp.Error("ERR syntax error")},
+		{"LRANGE queue 0 -1", bulkStrings("Z", "x", "a", "x")},
+		{"RPUSH queue x", resp.Integer(5)},
+		{"LREM queue -2 x", resp.Integer(2)},
+		{"LRANGE queue 0 -1", bulkStrings("Z", "x", "a")},
+		{"LREM queue 0 x", resp.Integer(1)},
+		{"LREM queue 0 missing", resp.Integer(0)},
+		{"RPUSH queue b c d", resp.Integer(5)},
+		{"LTRIM queue 1 -2", resp.OK},
+		{"LRANGE queue 0 -1", bulkStrings("a", "b", "c")},
+		{"LMOVE queue other RIGHT LEFT", resp.BulkString("c")},
+		{"LMOVE queue queue LEFT RIGHT", resp.BulkString("a")},
+		{"LRANGE queue 0 -1", bulkStrings("b", "a")},
+		{"LMOVE missing other LEFT LEFT", resp.NullBulk},
+		{"LMOVE queue other UP LEFT", resp.Error("ERR syntax error")},
+		{"LTRIM queue 5 10", resp.OK},
+		{"EXISTS queue", resp.Integer(0)},
+		{"SET str v", resp.OK},
+		{"LPUSH str a", resp.Error("WRONGTYPE Operation against a key holding the wrong kind of value")},
+		{"LMOVE other str LEFT LEFT", resp.Error("WRONGTYPE Operation against a key holding the wrong kind of value")},
+		{"LRANGE other 0 -1", bulkStrings("c")},
+	}
+
+	for _, tt := range tests {
+		response, _ := parser.ProcessCommand(sess, tt.command)
+
+		if !reflect.DeepEqual(response, tt.expected) {
+			t.Errorf("Command: %q, got: %+v, want: %+v", tt.command, response, tt.expected)
+		}
+	}
+}
+
+func TestParser_ListPropagation(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"RPUSH q a b c", "RPUSH q a b c"},
+		{"LPOP q 0", ""},
+		{"LPOP missing", ""},
+		{"LREM q 0 missing", ""},
+		{"LINSERT q BEFORE missing x", ""},
+		{"BLPOP empty q 0", "LPOP q"},
+		{"BRPOP q 0", "RPOP q"},
+		{"BLMOVE q dst LEFT RIGHT 0", "LMOVE q dst LEFT RIGHT"},
+		{"BLPOP q 0.01", ""},
+		{"LMOVE missing dst LEFT LEFT", ""},
+	}
+
+	for _, tt := range tests {
+		_, propagate := parser.ProcessCommand(sess, tt.command)
+
+		got := propagated(propagate)
+		if got != tt.want {
+			t.Errorf("Command: %q, propagated: %q, want: %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestParser_BlockingPop(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+
+	tests := []struct {
+		command  string
+		expected resp.Value
+	}{
+		{"BLPOP q 0.05", resp.NullArray},
+		{"BLMOVE q dst LEFT LEFT 0.05", resp.NullBulk},
+		{"BLPOP q -1", resp.Error("ERR timeout is negative")},
+		{"BLPOP q abc", resp.Error("ERR timeout is not a float or out of range")},
+	}
+
+	for _, tt := range tests {
+		response, _ := parser.ProcessCommand(NewSession(1), tt.command)
+
+		if !reflect.DeepEqual(response, tt.expected) {
+			t.Errorf("Command: %q, got: %+v, want: %+v", tt.command, response, tt.expected)
+		}
+	}
+
+	replies := make(chan resp.Value)
+	for _, command := range []string{"BLPOP a q 5", "BRPOP q 5"} {
+		go func() {
+			response, _ := parser.ProcessCommand(NewSession(2), command)
+			replies <- response
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	parser.ProcessCommand(NewSession(3), "RPUSH q x y")
+
+	got := map[string]bool{}
+	for range 2 {
+		response := <-replies
+		if len(response.Array) != 2 || response.Array[0].Str != "q" {
+			t.Fatalf("blocked pop got %+v, want an element of q", response)
+		}
+		got[response.Array[1].Str] = true
+	}
+	if !got["x"] || !got["y"] {
+		t.Errorf("blocked pops served %v, want both x and y", got)
+	}
+
+	gone := make(chan struct{})
+	sess := NewSession(4)
+	sess.WatchDisconnect = func() (<-chan struct{}, func()) { return gone, func() {} }
+	go func() {
+		response, _ := parser.ProcessCommand(sess, "BLPOP q 0")
+		replies <- response
+	}()
+	close(gone)
+
+	select {
+	case response := <-replies:
+		if !reflect.DeepEqual(response, resp.NullArray) {
+			t.Errorf("BLPOP after disconnect = %+v, want a null array", response)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("BLPOP kept waiting after the client disconnected")
+	}
+}
+
+func bulkStrings(values ...string) resp.Value {
+	reply := make([]resp.Value, len(values))
+	for i, val := range values {
+		reply[i] = resp.BulkString(val)
+	}
+	return resp.Array(reply...)
+}
+
+func TestParser_SetCommands(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	tests := []struct {
+		command  string
+		expected resp.Value
+	}{
+		{"SADD tags go redis go", resp.Integer(2)},
+		{"SADD tags db", resp.Integer(1)},
+		{"SADD tags go", resp.Integer(0)},
+		{"SCARD tags", resp.Integer(3)},
+		{"SCARD missing", resp.Integer(0)},
+		{"SISMEMBER tags go", resp.Integer(1)},
+		{"SISMEMBER tags java", resp.Integer(0)},
+		{"SMISMEMBER tags java go", resp.Array(resp.Integer(0), resp.Integer(1))},
+		{"SREM tags db java", resp.Integer(1)},
+		{"SADD other redis cache", resp.Integer(2)},
+		{"SINTERCARD 2 tags other", resp.Integer(1)},
+		{"SINTERCARD 2 tags other LIMIT 0", resp.Integer(1)},
+		{"SINTERCARD 0 tags", resp.Error("ERR numkeys should be greater than 0")},
+		{"SINTERCARD 3 tags other", resp.Error("ERR Number of keys can't be greater than number of args")},
+		{"SINTERCARD 1 tags LIMIT -1", resp.Error("ERR LIMIT can't be negative")},
+		{"SINTERSTORE both tags other", resp.Integer(1)},
+		{"SMEMBERS both", resp.Set(resp.BulkString("redis"))},
+		{"SUNIONSTORE all tags other", resp.Integer(3)},
+		{"SDIFFSTORE diff tags other", resp.Integer(1)},
+		{"SMEMBERS diff", resp.Set(resp.BulkString("go"))},
+		{"SDIFF tags missing other", resp.Set(resp.BulkString("go"))},
+		{"SINTER tags missing", resp.Set()},
+		{"SINTERSTORE both tags missing", resp.Integer(0)},
+		{"EXISTS both", resp.Integer(0)},
+		{"SMOVE tags other go", resp.Integer(1)},
+		{"SMOVE tags other go", resp.Integer(0)},
+		{"SISMEMBER other go", resp.Integer(1)},
+		{"SMOVE tags other redis", resp.Integer(1)},
+		{"EXISTS tags", resp.Integer(0)},
+		{"SRANDMEMBER missing", resp.NullBulk},
+		{"SRANDMEMBER missing 3", resp.Array()},
+		{"SRANDMEMBER other -9223372036854775808", resp.Error("ERR value is out of range")},
+		{"SRANDMEMBER other -4611686018427387904", resp.Error("ERR value is out of range")},
+		{"SPOP missing", resp.NullBulk},
+		{"SPOP other -1", resp.Error("ERR value is out of range, must be positive")},
+		{"SET str v", resp.OK},
+		{"SADD str a", resp.Error("WRONGTYPE Operation against a key holding the wrong kind of value")},
+		{"SUNION other str", resp.Error("WRONGTYPE Operation against a key holding the wrong kind of value")},
+		{"SMOVE other str go", resp.Error("WRONGTYPE Operation against a key holding the wrong kind of value")},
+	}
+
+	for _, tt := range tests {
+		response, _ := parser.ProcessCommand(sess, tt.command)
+
+		if !reflect.DeepEqual(response, tt.expected) {
+			t.Errorf("Command: %q, got: %+v, want: %+v", tt.command, response, tt.expected)
+		}
+	}
+
+	if got := sortedStrings(parser.ProcessCommand(sess, "SUNION other all")); fmt.Sprint(got) != "[cache go redis]" {
+		t.Errorf("SUNION other all = %v, want [cache go redis]", got)
+	}
+	if got := sortedStrings(parser.ProcessCommand(sess, "SRANDMEMBER other 10")); fmt.Sprint(got) != "[cache go redis]" {
+		t.Errorf("SRANDMEMBER other 10 = %v, want every member once", got)
+	}
+	if got := sortedStrings(parser.ProcessCommand(sess, "SRANDMEMBER other -2")); len(got) != 2 {
+		t.Errorf("SRANDMEMBER other -2 = %v, want 2 members", got)
+	}
+	// Longer replies are written out as they are generated.
+	response, _ := parser.ProcessCommand(sess, "SRANDMEMBER other -4611686018427387903")
+	if response.Type != resp.TypeArray || response.Int != 4611686018427387903 || response.Elements == nil {
+		t.Errorf("SRANDMEMBER other -4611686018427387903 = %+v, want a lazy array", response)
+	}
+	response, _ = parser.ProcessCommand(sess, "SRANDMEMBER other -1000")
+	picked := make(map[string]int)
+	for member := range response.Elements {
+		picked[member.Str]++
+	}
+	if response.Int != 1000 || len(picked) != 3 || picked["go"]+picked["redis"]+picked["cache"] != 1000 {
+		t.Errorf("SRANDMEMBER other -1000 = %d members, picked %v", response.Int, picked)
+	}
+	if got := sortedStrings(parser.ProcessCommand(sess, "SPOP other 2")); len(got) != 2 {
+		t.Errorf("SPOP other 2 = %v, want 2 members", got)
+	}
+	if response, _ := parser.ProcessCommand(sess, "SCARD other"); response.Int != 1 {
+		t.Errorf("SCARD other = %+v after SPOP, want 1", response)
+	}
+}
+
+func TestParser_SpopPropagatesRemovedMembers(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	replay := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	for _, command := range []string{"SADD s a b c d e", "SPOP s", "SPOP s 2", "SPOP missing", "SADD s a"} {
+		_, propagate := parser.ProcessCommand(sess, command)
+		for _, command := range propagate {
+			replay.Execute(NewSession(0), command)
+		}
+	}
+
+	want := sortedStrings(parser.ProcessCommand(sess, "SMEMBERS s"))
+	if got := sortedStrings(replay.ProcessCommand(sess, "SMEMBERS s")); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("replayed SMEMBERS s = %v, want %v", got, want)
+	}
+}
+
+// propagated renders the commands logged to the AOF on a line, separated by "; ".
+func propagated(commands [][][]byte) string {
+	lines := make([]string, len(commands))
+	for i, command := range commands {
+		lines[i] = string(bytes.Join(command, []byte(" ")))
+	}
+	return strings.Join(lines, "; ")
+}
+
+func sortedStrings(response resp.Value, _ [][][]byte) []string {
+	values := make([]string, len(response.Array))
+	for i, val := range response.Array {
+		values[i] = val.Str
+	}
+	slices.Sort(values)
+	return values
+}
+
+func TestParser_SortedSetCommands(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	tests := []struct {
+		command  string
+		expected resp.Value
+	}{
+		{"ZADD board 10 alice 20 bob 30 carol", resp.Integer(3)},
+		{"ZADD board 15 alice 40 dave", resp.Integer(1)},
+		{"ZADD board CH 16 alice 40 dave", resp.Integer(1)},
+		{"ZADD board NX 1 alice 50 erin", resp.Integer(1)},
+		{"ZADD board XX 1 frank", resp.Integer(0)},
+		{"ZADD board GT CH 10 alice 25 bob", resp.Integer(1)},
+		{"ZADD board LT CH 5 carol", resp.Integer(1)},
+		{"ZADD board NX XX 1 a", resp.Error("ERR XX and NX options at the same time are not compatible")},
+		{"ZADD board NX GT 1 a", resp.Error("ERR GT, LT, and/or NX options at the same time are not compatible")},
+		{"ZADD board INCR 1 a 2 b", resp.Error("ERR INCR option supports a single increment-element pair")},
+		{"ZADD board NX 1", resp.Error("ERR syntax error")},
+		{"ZADD board nan a", resp.Error("ERR value is not a valid float")},
+		{"ZADD board INCR 4 alice", resp.Double(20)},
+		{"ZADD board INCR NX 4 alice", resp.NullBulk},
+		{"ZINCRBY board 0.5 carol", resp.Double(5.5)},
+		{"ZINCRBY board x carol", resp.Error("ERR value is not a valid float")},
+		{"ZADD board inf top -inf bottom", resp.Integer(2)},
+		{"ZINCRBY board -inf top", resp.Error("ERR resulting score is not a number (NaN)")},
+		{"ZCARD board", resp.Integer(7)},
+		{"ZSCORE board bob", resp.Double(25)},
+		{"ZSCORE board nobody", resp.NullBulk},
+		{"ZRANK board bottom", resp.Integer(0)},
+		{"ZRANK board bob WITHSCORE", resp.Array(resp.Integer(3), resp.Double(25))},
+		{"ZREVRANK board top", resp.Integer(0)},
+		{"ZRANK board nobody", resp.NullBulk},
+		{"ZRANK board nobody WITHSCORE", resp.NullArray},
+		{"ZRANGE board 0 -1", bulkStrings("bottom", "carol", "alice", "bob", "dave", "erin", "top")},
+		{"ZRANGE board 1 2 WITHSCORES", resp.Array(resp.BulkString("carol"), resp.Double(5.5), resp.BulkString("alice"), resp.Double(20))},
+		{"ZRANGE board 0 1 REV", bulkStrings("top", "erin")},
+		{"ZRANGE board -2 -1 REV", bulkStrings("carol", "bottom")},
+		{"ZRANGE board 20 40 BYSCORE", bulkStrings("alice", "bob", "dave")},
+		{"ZRANGE board (20 +inf BYSCORE LIMIT 1 2", bulkStrings("dave", "erin")},
+		{"ZRANGE board 40 (20 BYSCORE REV", bulkStrings("dave", "bob")},
+		{"ZRANGE board 0 -1 LIMIT 0 1", resp.Error("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")},
+		{"ZRANGE board x 1 BYSCORE", resp.Error("ERR min or max is not a float")},
+		{"ZCOUNT board -inf +inf", resp.Integer(7)},
+		{"ZCOUNT board (5.5 25", resp.Integer(2)},
+		{"ZCOUNT board 100 1", resp.Integer(0)},
+		{"ZRANGESTORE top3 board 0 2 REV", resp.Integer(3)},
+		{"ZRANGE top3 0 -1", bulkStrings("dave", "erin", "top")},
+		{"ZREM board top bottom nobody", resp.Integer(2)},
+		{"ZPOPMIN board", resp.Array(resp.BulkString("carol"), resp.Double(5.5))},
+		{"ZPOPMAX board 2", resp.Array(resp.BulkString("erin"), resp.Double(50), resp.BulkString("dave"), resp.Double(40))},
+		{"ZPOPMIN missing", resp.Array()},
+		{"ZPOPMIN board -1", resp.Error("ERR value is out of range, must be positive")},
+		{"ZADD lex 0 a 0 b 0 c 0 d", resp.Integer(4)},
+		{"ZRANGE lex [b (d BYLEX", bulkStrings("b", "c")},
+		{"ZRANGE lex + (b BYLEX REV LIMIT 0 2", bulkStrings("d", "c")},
+		{"ZRANGE lex - + BYLEX WITHSCORES", resp.Error("ERR syntax error, WITHSCORES not supported in combination with BYLEX")},
+		{"ZRANGE lex a c BYLEX", resp.Error("ERR min or max not valid string range item")},
+		{"SET str v", resp.OK},
+		{"ZADD str 1 a", resp.Error("WRONGTYPE Operation against a key holding the wrong kind of value")},
+	}
+
+	for _, tt := range tests {
+		response, _ := parser.ProcessCommand(sess, tt.command)
+
+		if !reflect.DeepEqual(response, tt.expected) {
+			t.Errorf("Command: %q, got: %+v, want: %+v", tt.command, response, tt.expected)
+		}
+	}
+}
+
+func TestParser_SortedSetStore(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	tests := []struct {
+		command  string
+		expected resp.Value
+	}{
+		{"ZADD a 1 x 2 y 3 z", resp.Integer(3)},
+		{"ZADD b 10 y 20 z 30 w", resp.Integer(3)},
+		{"SADD s x w", resp.Integer(2)},
+		{"ZUNIONSTORE out 2 a b", resp.Integer(4)},
+		{"ZRANGE out 0 -1 WITHSCORES", resp.Array(
+			resp.BulkString("x"), resp.Double(1), resp.BulkString("y"), resp.Double(12),
+			resp.BulkString("z"), resp.Double(23), resp.BulkString("w"), resp.Double(30))},
+		{"ZINTERSTORE out 2 a b WEIGHTS 2 0.5 AGGREGATE MAX", resp.Integer(2)},
+		{"ZRANGE out 0 -1 WITHSCORES", resp.Array(resp.BulkString("y"), resp.Double(5), resp.BulkString("z"), resp.Double(10))},
+		{"ZINTERSTORE out 2 a s AGGREGATE MIN", resp.Integer(1)},
+		{"ZRANGE out 0 -1 WITHSCORES", resp.Array(resp.BulkString("x"), resp.Double(1))},
+		{"ZINTERSTORE out 2 a missing", resp.Integer(0)},
+		{"EXISTS out", resp.Integer(0)},
+		{"ZUNIONSTORE out 0 a", resp.Error("ERR at least 1 input key is needed for 'zunionstore' command")},
+		{"ZUNIONSTORE out 3 a b", resp.Error("ERR syntax error")},
+		{"ZUNIONSTORE out 2 a b WEIGHTS 1", resp.Error("ERR syntax error")},
+		{"ZUNIONSTORE out 2 a b WEIGHTS 1 x", resp.Error("ERR weight value is not a float")},
+		{"ZUNIONSTORE out 1 a AGGREGATE AVG", resp.Error("ERR syntax error")},
+		{"SET str v", resp.OK},
+		{"ZUNIONSTORE out 2 a str", resp.Error("WRONGTYPE Operation against a key holding the wrong kind of value")},
+	}
+
+	for _, tt := range tests {
+		response, _ := parser.ProcessCommand(sess, tt.command)
+
+		if !reflect.DeepEqual(response, tt.expected) {
+			t.Errorf("Command: %q, got: %+v, want: %+v", tt.command, response, tt.expected)
+		}
+	}
+
+	sess.Protocol = 3
+	want := resp.Array(resp.Array(resp.BulkString("x"), resp.Double(1)), resp.Array(resp.BulkString("y"), resp.Double(2)))
+	if response, _ := parser.ProcessCommand(sess, "ZRANGE a 0 1 WITHSCORES"); !reflect.DeepEqual(response, want) {
+		t.Errorf("ZRANGE WITHSCORES in RESP3 = %+v, want %+v", response, want)
+	}
+}
+
+func TestParser_BlockingZPop(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+
+	if response, _ := parser.ProcessCommand(NewSession(1), "BZPOPMIN jobs 0.05"); !reflect.DeepEqual(response, resp.NullArray) {
+		t.Errorf("BZPOPMIN on an empty key = %+v, want a null array", response)
+	}
+
+	type result struct {
+		response  resp.Value
+		propagate [][][]byte
+	}
+	results := make(chan result)
+	go func() {
+		response, propagate := parser.ProcessCommand(NewSession(2), "BZPOPMIN jobs 5")
+		results <- result{response, propagate}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	parser.ProcessCommand(NewSession(3), "ZADD jobs 2 later 1 sooner")
+
+	got := <-results
+	want := resp.Array(resp.BulkString("jobs"), resp.BulkString("sooner"), resp.Double(1))
+	if !reflect.DeepEqual(got.response, want) {
+		t.Errorf("BZPOPMIN = %+v, want %+v", got.response, want)
+	}
+	if propagated := propagated(got.propagate); propagated != "ZPOPMIN jobs" {
+		t.Errorf("BZPOPMIN propagated %q, want %q", propagated, "ZPOPMIN jobs")
+	}
+}
+
+func streamEntry(id string, fields ...string) resp.Value {
+	return resp.Array(resp.BulkString(id), bulkStrings(fields...))
+}
+
+func TestParser_StreamCommands(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	tests := []struct {
+		command  string
+		expected resp.Value
+	}{
+		{"XADD s 1-1 a 1", resp.BulkString("1-1")},
+		{"XADD s 1-* b 2", resp.BulkString("1-2")},
+		{"XADD s 2 c 3", resp.BulkString("2-0")},
+		{"XADD s 2-0 d 4", resp.Error("ERR The ID specified in XADD is equal or smaller than the target stream top item")},
+		{"XADD s 0-0 d 4", resp.Error("ERR The ID specified in XADD must be greater than 0-0")},
+		{"XADD s 3-0 d", resp.Error("ERR wrong number of arguments for 'xadd' command")},
+		{"XADD s x-1 d 4", resp.Error("ERR Invalid stream ID specified as stream command argument")},
+		{"XADD s MAXLEN 5 LIMIT 10 3-0 d 4", resp.Error("ERR syntax error, LIMIT cannot be used without the special ~ option")},
+		{"XADD s MAXLEN -1 3-0 d 4", resp.Error("ERR The MAXLEN argument must be >= 0.")},
+		{"XADD missing NOMKSTREAM * a 1", resp.NullBulk},
+		{"EXISTS missing", resp.Integer(0)},
+		{"XADD s 3-0 d 4", resp.BulkString("3-0")},
+		{"XLEN s", resp.Integer(4)},
+		{"XRANGE s - +", resp.Array(streamEntry("1-1", "a", "1"), streamEntry("1-2", "b", "2"), streamEntry("2-0", "c", "3"), streamEntry("3-0", "d", "4"))},
+		{"XRANGE s 1 1", resp.Array(streamEntry("1-1", "a", "1"), streamEntry("1-2", "b", "2"))},
+		{"XRANGE s (1-1 2 COUNT 1", resp.Array(streamEntry("1-2", "b", "2"))},
+		{"XRANGE s - + COUNT 0", resp.Array()},
+		{"XREVRANGE s + (2-0", resp.Array(streamEntry("3-0", "d", "4"))},
+		{"XREVRANGE s + - COUNT 2", resp.Array(streamEntry("3-0", "d", "4"), streamEntry("2-0", "c", "3"))},
+		{"XRANGE s 3 1", resp.Array()},
+		{"XADD s MAXLEN ~ 2 LIMIT 10 4-0 e 5", resp.BulkString("4-0")},
+		{"XRANGE s - +", resp.Array(streamEntry("3-0", "d", "4"), streamEntry("4-0", "e", "5"))},
+		{"XADD s MINID = 4 5-0 f 6", resp.BulkString("5-0")},
+		{"XLEN s", resp.Integer(2)},
+		{"XREAD STREAMS s 4-0", resp.Array(resp.Array(resp.BulkString("s"), resp.Array(streamEntry("5-0", "f", "6"))))},
+		{"XREAD COUNT 1 STREAMS s missing 0 0", resp.Array(resp.Array(resp.BulkString("s"), resp.Array(streamEntry("4-0", "e", "5"))))},
+		{"XREAD STREAMS s $", resp.NullArray},
+		{"XREAD COUNT 1 STREAMS s", resp.Error("ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")},
+		{"XREAD STREAMS s >", resp.Error("ERR The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option.")},
+		{"XREAD BLOCK 10 STREAMS s $", resp.NullArray},
+		{"XSETID s 4-0", resp.Error("ERR The ID specified in XSETID is smaller than the target stream top item")},
+		{"XSETID s 9-0", resp.OK},
+		{"XADD s 9-0 g 7", resp.Error("ERR The ID specified in XADD is equal or smaller than the target stream top item")},
+		{"XSETID missing 1-0", resp.Error("ERR no such key")},
+		{"SET str v", resp.OK},
+		{"XADD str * a 1", resp.Error("WRONGTYPE Operation against a key holding the wrong kind of value")},
+		{"XLEN str", resp.Error("WRONGTYPE Operation against a key holding the wrong kind of value")},
+	}
+
+	for _, tt := range tests {
+		response, _ := parser.ProcessCommand(sess, tt.command)
+
+		if !reflect.DeepEqual(response, tt.expected) {
+			t.Errorf("Command: %q, got: %+v, want: %+v", tt.command, response, tt.expected)
+		}
+	}
+
+	sess3 := NewSession(2)
+	parser.ProcessCommand(sess3, "HELLO 3")
+	response, _ := parser.ProcessCommand(sess3, "XREAD STREAMS s 4-0")
+	want := resp.Map(resp.BulkString("s"), resp.Array(streamEntry("5-0", "f", "6")))
+	if !reflect.DeepEqual(response, want) {
+		t.Errorf("XREAD over RESP3 = %+v, want %+v", response, want)
+	}
+}
+
+func TestParser_StreamPropagation(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"XADD s MAXLEN ~ 10 1-* a 1", "XADD s MAXLEN = 10 1-0 a 1"},
+		{"XADD missing NOMKSTREAM * a 1", ""},
+		{"XGROUP CREATE s g $", "XGROUP CREATE s g 1-0"},
+		{"XGROUP CREATE s g 0", ""},
+		{"XGROUP DESTROY s nope", ""},
+		{"XACK s g 1-1", ""},
+	}
+
+	for _, tt := range tests {
+		_, propagate := parser.ProcessCommand(sess, tt.command)
+		if got := propagated(propagate); got != tt.want {
+			t.Errorf("Command: %q, propagated: %q, want: %q", tt.command, got, tt.want)
+		}
+	}
+
+	_, propagate := parser.ProcessCommand(sess, "XAUTOCLAIM s g alice 0 0")
+	if propagate != nil {
+		t.Errorf("XAUTOCLAIM with nothing pending propagated %q, want nil", propagate)
+	}
+}
+
+func TestParser_StreamConsumerGroups(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	replay := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	run := func(command string) resp.Value {
+		response, propagate := parser.ProcessCommand(sess, command)
+		for _, command := range propagate {
+			replay.Execute(NewSession(0), command)
+		}
+		return response
+	}
+
+	tests := []struct {
+		command  string
+		expected resp.Value
+	}{
+		{"XGROUP CREATE s g $", resp.Error("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")},
+		{"XGROUP CREATE s g $ MKSTREAM", resp.OK},
+		{"XGROUP CREATE s g 0", resp.Error("BUSYGROUP Consumer Group name already exists")},
+		{"XADD s 1-0 a 1", resp.BulkString("1-0")},
+		{"XADD s 2-0 b 2", resp.BulkString("2-0")},
+		{"XADD t 1-0 c 3", resp.BulkString("1-0")},
+		{"XGROUP CREATE t g 0", resp.OK},
+		{"XREADGROUP GROUP nope alice STREAMS s >", resp.Error("NOGROUP No such key 's' or consumer group 'nope' in XREADGROUP with GROUP option")},
+		{"XREADGROUP GROUP g alice STREAMS s $", resp.Error("ERR The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.")},
+		{"XREADGROUP GROUP g alice COUNT 1 STREAMS s t > >", resp.Array(
+			resp.Array(resp.BulkString("s"), resp.Array(streamEntry("1-0", "a", "1"))),
+			resp.Array(resp.BulkString("t"), resp.Array(streamEntry("1-0", "c", "3"))),
+		)},
+		{"XREADGROUP GROUP g bob STREAMS s >", resp.Array(resp.Array(resp.BulkString("s"), resp.Array(streamEntry("2-0", "b", "2"))))},
+		{"XREADGROUP GROUP g bob STREAMS s >", resp.NullArray},
+		{"XREADGROUP GROUP g alice STREAMS s 0", resp.Array(resp.Array(resp.BulkString("s"), resp.Array(streamEntry("1-0", "a", "1"))))},
+		{"XPENDING s g", resp.Array(resp.Integer(2), resp.BulkString("1-0"), resp.BulkString("2-0"), resp.Array(
+			resp.Array(resp.BulkString("alice"), resp.BulkString("1")),
+			resp.Array(resp.BulkString("bob"), resp.BulkString("1")),
+		))},
+		{"XPENDING s nope", resp.Error("NOGROUP No such key 's' or consumer group 'nope'")},
+		{"XACK s g 1-0 9-0", resp.Integer(1)},
+		{"XACK s nope 1-0", resp.Integer(0)},
+		{"XCLAIM s g carol 3600000 2-0", resp.Array()},
+		{"XCLAIM s g carol 0 2-0 JUSTID", bulkStrings("2-0")},
+		{"XCLAIM s g carol 0 1-0 FORCE", resp.Array(streamEntry("1-0", "a", "1"))},
+		{"XCLAIM s g carol 0 2-0 BOGUS", resp.Error("ERR Unrecognized XCLAIM option 'BOGUS'")},
+		{"XPENDING s g - + 10 bob", resp.Array()},
+		{"XADD s MINID 2 3-0 d 4", resp.BulkString("3-0")},
+		{"XAUTOCLAIM s g dave 0 0 COUNT 1", resp.Array(resp.BulkString("0-0"), resp.Array(streamEntry("2-0", "b", "2")), bulkStrings("1-0"))},
+		{"XAUTOCLAIM s g dave 0 0 JUSTID", resp.Array(resp.BulkString("0-0"), bulkStrings("2-0"), resp.Array())},
+		{"XREADGROUP GROUP g erin NOACK STREAMS s >", resp.Array(resp.Array(resp.BulkString("s"), resp.Array(streamEntry("3-0", "d", "4"))))},
+		{"XPENDING s g", resp.Array(resp.Integer(1), resp.BulkString("2-0"), resp.BulkString("2-0"), resp.Array(
+			resp.Array(resp.BulkString("dave"), resp.BulkString("1")),
+		))},
+		{"XGROUP CREATECONSUMER s g frank", resp.Integer(1)},
+		{"XGROUP CREATECONSUMER s g frank", resp.Integer(0)},
+		{"XGROUP DELCONSUMER t g alice", resp.Integer(1)},
+		{"XGROUP SETID s nope 0", resp.Error("NOGROUP No such consumer group 'nope' for key name 's'")},
+		{"XGROUP SETID s g 0", resp.OK},
+		{"XGROUP BOGUS s g", resp.Error("ERR unknown subcommand or wrong number of arguments for 'BOGUS'. Try XGROUP HELP.")},
+		{"XREADGROUP GROUP g alice STREAMS s >", resp.Array(resp.Array(resp.BulkString("s"), resp.Array(streamEntry("2-0", "b", "2"), streamEntry("3-0", "d", "4"))))},
+		{"XPENDING s g - + 10 dave", resp.Array()},
+		{"XGROUP DESTROY t g", resp.Integer(1)},
+	}
+
+	for _, tt := range tests {
+		response := run(tt.command)
+
+		if !reflect.DeepEqual(response, tt.expected) {
+			t.Errorf("Command: %q, got: %+v, want: %+v", tt.command, response, tt.expected)
+		}
+	}
+
+	for _, command := range []string{"XRANGE s - +", "XPENDING s g", "XPENDING s g - + 10", "XREADGROUP GROUP g alice STREAMS s 0", "XLEN t"} {
+		want, _ := parser.ProcessCommand(sess, command)
+		got, _ := replay.ProcessCommand(sess, command)
+		if len(want.Array) > 0 && len(want.Array[0].Array) == 4 {
+			// Idle times depend on the clock, compare the rest of the entries.
+			for _, entries := range [][]resp.Value{want.Array, got.Array} {
+				for _, entry := range entries {
+					entry.Array[2] = resp.Integer(0)
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Replayed %q = %+v, want %+v", command, got, want)
+		}
+	}
+}
+
+func TestParser_BlockingXRead(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	parser.ProcessCommand(NewSession(1), "XADD s 1-0 a 1")
+	parser.ProcessCommand(NewSession(1), "XGROUP CREATE s g $")
+
+	type result struct {
+		response  resp.Value
+		propagate [][][]byte
+	}
+	results := make(chan result)
+	for _, command := range []string{"XREAD BLOCK 5000 STREAMS s $", "XREADGROUP GROUP g alice BLOCK 0 STREAMS s >"} {
+		go func() {
+			response, propagate := parser.ProcessCommand(NewSession(2), command)
+			results <- result{response, propagate}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	parser.ProcessCommand(NewSession(3), "XADD s 2-0 b 2")
+
+	want := resp.Array(resp.Array(resp.BulkString("s"), resp.Array(streamEntry("2-0", "b", "2"))))
+	claims := 0
+	for range 2 {
+		got := <-results
+		if !reflect.DeepEqual(got.response, want) {
+			t.Errorf("blocked read = %+v, want %+v", got.response, want)
+		}
+		for _, command := range got.propagate {
+			if string(command[0]) == "XCLAIM" {
+				claims++
+			}
+		}
+	}
+	if claims != 1 {
+		t.Errorf("blocked reads propagated %d XCLAIM commands, want 1", claims)
+	}
+}
+
+func TestParser_BitmapCommands(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	tests := []struct {
+		command  string
+		expected resp.Value
+	}{
+		{"SETBIT flags 7 1", resp.Integer(0)},
+		{"SETBIT flags 7 0", resp.Integer(1)},
+		{"GET flags", resp.BulkString("\x00")},
+		{"SETBIT flags 100 1", resp.Integer(0)},
+		{"STRLEN flags", resp.Integer(13)},
+		{"GETBIT flags 100", resp.Integer(1)},
+		{"GETBIT flags 100000", resp.Integer(0)},
+		{"SETBIT flags 1 2", resp.Error("ERR bit is not an integer or out of range")},
+		{"SETBIT flags -1 1", resp.Error("ERR bit offset is not an integer or out of range")},
+		{"SETBIT flags 4294967296 1", resp.Error("ERR bit offset is not an integer or out of range")},
+		{"SET s foobar", resp.OK},
+		{"BITCOUNT s", resp.Integer(26)},
+		{"BITCOUNT s 0 0", resp.Integer(4)},
+		{"BITCOUNT s 1 1 BYTE", resp.Integer(6)},
+		{"BITCOUNT s 5 30 BIT", resp.Integer(17)},
+		{"BITCOUNT s -2 -1", resp.Integer(7)},
+		{"BITCOUNT s 0", resp.Error("ERR syntax error")},
+		{"BITCOUNT missing", resp.Integer(0)},
+		{`SET p "\xff\xf0\x00"`, resp.OK},
+		{"BITPOS p 0", resp.Integer(12)},
+		{`SET p "\x00\xff\xf0"`, resp.OK},
+		{"BITPOS p 1 0", resp.Integer(8)},
+		{"BITPOS p 1 2", resp.Integer(16)},
+		{"BITPOS p 1 2 -1 BYTE", resp.Integer(16)},
+		{"BITPOS p 1 7 15 BIT", resp.Integer(8)},
+		{`SET p "\xff\xff"`, resp.OK},
+		{"BITPOS p 0", resp.Integer(16)},
+		{"BITPOS p 0 0 -1", resp.Integer(-1)},
+		{"BITPOS missing 0", resp.Integer(0)},
+		{"BITPOS missing 1", resp.Integer(-1)},
+		{"BITPOS p 2", resp.Error("ERR The bit argument must be 1 or 0.")},
+		{"SET a foobar", resp.OK},
+		{"SET b abcdef", resp.OK},
+		{"BITOP AND dest a b", resp.Integer(6)},
+		{"GET dest", resp.BulkString("`bc`ab")},
+		{"BITOP OR dest a missing", resp.Integer(6)},
+		{"GET dest", resp.BulkString("foobar")},
+		{"BITOP XOR dest a a", resp.Integer(6)},
+		{"GET dest", resp.BulkString("\x00\x00\x00\x00\x00\x00")},
+		{"BITOP NOT dest p", resp.Integer(2)},
+		{"GET dest", resp.BulkString("\x00\x00")},
+		{"BITOP NOT dest a b", resp.Error("ERR BITOP NOT must be called with a single source key.")},
+		{"BITOP AND dest missing", resp.Integer(0)},
+		{"EXISTS dest", resp.Integer(0)},
+		{"BITFIELD bf INCRBY i5 100 1 GET u4 0", resp.Array(resp.Integer(1), resp.Integer(0))},
+		{"BITFIELD bf SET i8 #1 127 INCRBY i8 #1 1", resp.Array(resp.Integer(0), resp.Integer(-128))},
+		{"BITFIELD bf OVERFLOW SAT INCRBY i8 #1 -1000 INCRBY i8 #1 1000", resp.Array(resp.Integer(-128), resp.Integer(127))},
+		{"BITFIELD bf OVERFLOW FAIL INCRBY u2 102 4 GET u2 102", resp.Array(resp.NullBulk, resp.Integer(0))},
+		{"BITFIELD bf OVERFLOW SAT INCRBY u2 102 4 SET u2 102 -1", resp.Array(resp.Integer(3), resp.Integer(3))},
+		{"BITFIELD bf GET u2 102", resp.Array(resp.Integer(3))},
+		{"BITFIELD bf SET i64 0 -1 INCRBY i64 0 -9223372036854775808", resp.Array(resp.Integer(127<<48), resp.Integer(9223372036854775807))},
+		{"BITFIELD bf OVERFLOW SAT SET i64 0 -1 INCRBY i64 0 -9223372036854775808", resp.Array(resp.Integer(9223372036854775807), resp.Integer(-9223372036854775808))},
+		{"BITFIELD bf GET u64 0", resp.Error("ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")},
+		{"BITFIELD bf OVERFLOW BOGUS", resp.Error("ERR Invalid OVERFLOW type specified")},
+		{"BITFIELD bf GET i8", resp.Error("ERR syntax error")},
+		{"BITFIELD_RO bf GET i8 0", resp.Array(resp.Integer(-128))},
+		{"BITFIELD_RO bf SET i8 0 1", resp.Error("ERR BITFIELD_RO only supports the GET subcommand")},
+		{"HSET h f v", resp.Integer(1)},
+		{"SETBIT h 0 1", resp.Error("WRONGTYPE Operation against a key holding the wrong kind of value")},
+		{"BITOP OR dest h", resp.Error("WRONGTYPE Operation against a key holding the wrong kind of value")},
+	}
+
+	for _, tt := range tests {
+		response, _ := parser.ProcessCommand(sess, tt.command)
+
+		if !reflect.DeepEqual(response, tt.expected) {
+			t.Errorf("Command: %q, got: %+v, want: %+v", tt.command, response, tt.expected)
+		}
+	}
+
+	if _, propagate := parser.ProcessCommand(sess, "BITFIELD bf GET u8 0"); propagate != nil {
+		t.Errorf("BITFIELD with only GET propagated %q, want nil", propagate)
+	}
+}
+
+func TestParser_HyperLogLogCommands(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	tests := []struct {
+		command  string
+		expected resp.Value
+	}{
+		{"PFADD hll a b c d e f g", resp.Integer(1)},
+		{"PFADD hll a b", resp.Integer(0)},
+		{"PFCOUNT hll", resp.Integer(7)},
+		{"PFADD other f g h i", resp.Integer(1)},
+		{"PFCOUNT hll other missing", resp.Integer(9)},
+		{"PFADD empty", resp.Integer(1)},
+		{"PFCOUNT empty", resp.Integer(0)},
+		{"PFMERGE dest hll other", resp.OK},
+		{"PFCOUNT dest", resp.Integer(9)},
+		{"PFMERGE dest", resp.OK},
+		{"PFCOUNT dest", resp.Integer(9)},
+		{"SET s foo", resp.OK},
+		{"PFADD s a", resp.Error("WRONGTYPE Key is not a valid HyperLogLog string value.")},
+		{"PFCOUNT hll s", resp.Error("WRONGTYPE Key is not a valid HyperLogLog string value.")},
+		{"HSET h f v", resp.Integer(1)},
+		{"PFMERGE h hll", resp.Error("WRONGTYPE Operation against a key holding the wrong kind of value")},
+	}
+
+	for _, tt := range tests {
+		response, _ := parser.ProcessCommand(sess, tt.command)
+
+		if !reflect.DeepEqual(response, tt.expected) {
+			t.Errorf("Command: %q, got: %+v, want: %+v", tt.command, response, tt.expected)
+		}
+	}
+
+	if _, propagate := parser.ProcessCommand(sess, "PFADD hll a"); propagate != nil {
+		t.Errorf("PFADD without changes propagated %q, want nil", propagated(propagate))
+	}
+	if _, propagate := parser.ProcessCommand(sess, "PFCOUNT hll"); propagate != nil {
+		t.Errorf("PFCOUNT propagated %q, want nil", propagated(propagate))
+	}
+
+	// A dense HLL set by hand with registers larger than a run of zeros can
+	// be, which Redis accepts.
+	dense := append([]byte("HYLL\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x80"), bytes.Repeat([]byte{0xff}, 12288)...)
+	parser.Execute(sess, [][]byte{[]byte("SET"), []byte("high"), dense})
+	for _, command := range []string{"PFCOUNT high", "PFCOUNT high hll", "PFMERGE dest high", "PFADD high a"} {
+		if response, _ := parser.ProcessCommand(sess, command); response.IsError() {
+			t.Errorf("Command: %q, got: %+v", command, response)
+		}
+	}
+}
+
+func TestParser_GeoCommands(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	tests := []struct {
+		command  string
+		expected resp.Value
+	}{
+		{"GEOADD Sicily 13.361389 38.115556 Palermo 15.087269 37.502669 Catania", resp.Integer(2)},
+		{"GEOADD Sicily NX 13 38 Palermo", resp.Integer(0)},
+		{"ZSCORE Sicily Palermo", resp.Double(3479099956230698)},
+		{"GEODIST Sicily Palermo Catania", resp.BulkString("166274.1516")},
+		{"GEODIST Sicily Palermo Catania km", resp.BulkString("166.2742")},
+		{"GEODIST Sicily Palermo Catania mi", resp.BulkString("103.3182")},
+		{"GEODIST Sicily Palermo Nowhere", resp.NullBulk},
+		{"GEODIST Sicily Palermo Catania parsecs", resp.Error("ERR unsupported unit provided. please use M, KM, FT, MI")},
+		{"GEOHASH Sicily Palermo Catania Nowhere", resp.Array(resp.BulkString("sqc8b49rny0"), resp.BulkString("sqdtr74hyu0"), resp.NullBulk)},
+		{"GEOPOS Sicily Nowhere", resp.Array(resp.NullArray)},
+		{"GEOADD Sicily 181 10 Nowhere", resp.Error("ERR invalid longitude,latitude pair 181.000000,10.000000")},
+		{"GEOADD Sicily 10 86 Nowhere", resp.Error("ERR invalid longitude,latitude pair 10.000000,86.000000")},
+		{"GEOADD Sicily 12.758489 38.788135 edge1 17.241510 38.788135 edge2", resp.Integer(2)},
+		{"GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS 200 km ASC", resp.Array(resp.BulkString("Catania"), resp.BulkString("Palermo"))},
+		{"GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS 200 km DESC WITHDIST", resp.Array(
+			resp.Array(resp.BulkString("Palermo"), resp.BulkString("190.4424")),
+			resp.Array(resp.BulkString("Catania"), resp.BulkString("56.4413")),
+		)},
+		{"GEOSEARCH Sicily FROMLONLAT 15 37 BYBOX 400 400 km ASC WITHDIST", resp.Array(
+			resp.Array(resp.BulkString("Catania"), resp.BulkString("56.4413")),
+			resp.Array(resp.BulkString("Palermo"), resp.BulkString("190.4424")),
+			resp.Array(resp.BulkString("edge2"), resp.BulkString("279.7403")),
+			resp.Array(resp.BulkString("edge1"), resp.BulkString("279.7405")),
+		)},
+		{"GEOSEARCH Sicily FROMLONLAT 15 37 BYBOX 400 400 km COUNT 1", resp.Array(resp.BulkString("Catania"))},
+		{"GEOSEARCH Sicily FROMMEMBER Palermo BYRADIUS 1 m WITHHASH", resp.Array(
+			resp.Array(resp.BulkString("Palermo"), resp.Integer(3479099956230698)),
+		)},
+		{"GEOSEARCH Sicily FROMMEMBER Nowhere BYRADIUS 1 m", resp.Error("ERR could not decode requested zset member")},
+		{"GEOSEARCH Missing FROMMEMBER Nowhere BYRADIUS 1 m", resp.Array()},
+		{"GEOSEARCH Sicily BYRADIUS 1 m ASC COUNT 1", resp.Error("ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for geosearch")},
+		{"GEOSEARCH Sicily FROMLONLAT 15 37 ASC COUNT 1", resp.Error("ERR exactly one of BYRADIUS and BYBOX can be specified for geosearch")},
+		{"GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS 1 m COUNT 0", resp.Error("ERR COUNT must be > 0")},
+		{"GEOSEARCHSTORE dest Sicily FROMLONLAT 15 37 BYRADIUS 200 km STOREDIST", resp.Integer(2)},
+		{"ZRANGE dest 0 -1 WITHSCORES", resp.Array(resp.BulkString("Catania"), resp.Double(56.441257870158054), resp.BulkString("Palermo"), resp.Double(190.44242984775798))},
+		{"GEOSEARCHSTORE dest Sicily FROMLONLAT 15 37 BYRADIUS 200 km WITHDIST", resp.Error("ERR geosearchstore is not compatible with WITHDIST, WITHHASH and WITHCOORD options")},
+		{"GEOSEARCHSTORE dest Sicily FROMLONLAT 0 0 BYRADIUS 1 km", resp.Integer(0)},
+		{"EXISTS dest", resp.Integer(0)},
+	}
+
+	for _, tt := range tests {
+		response, _ := parser.ProcessCommand(sess, tt.command)
+
+		if !reflect.DeepEqual(response, tt.expected) {
+			t.Errorf("Command: %q, got: %+v, want: %+v", tt.command, response, tt.expected)
+		}
+	}
+
+	// Positions come back as the center of their geohash cell.
+	response, _ := parser.ProcessCommand(sess, "GEOPOS Sicily Palermo")
+	pos := response.Array[0].Array
+	if math.Abs(pos[0].Float-13.361389) > 1e-5 || math.Abs(pos[1].Float-38.115556) > 1e-5 {
+		t.Errorf("GEOPOS Sicily Palermo = %v %v, want about 13.361389 38.115556", pos[0].Float, pos[1].Float)
+	}
+}
+
+func TestParser_KeyspaceCommands(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	tests := []struct {
+		command  string
+		expected resp.Value
+	}{
+		{"DBSIZE", resp.Integer(0)},
+		{"RANDOMKEY", resp.NullBulk},
+		{"SET s v", resp.OK},
+		{"RPUSH l a b", resp.Integer(2)},
+		{"TYPE s", resp.SimpleString("string")},
+		{"TYPE l", resp.SimpleString("list")},
+		{"TYPE missing", resp.SimpleString("none")},
+		{"DBSIZE", resp.Integer(2)},
+		{"TOUCH s l missing s", resp.Integer(3)},
+		{"EXPIRE s 100", resp.Integer(1)},
+		{"RENAME s s2", resp.OK},
+		{"EXISTS s", resp.Integer(0)},
+		{"TTL s2", resp.Integer(100)},
+		{"RENAME missing x", resp.Error("ERR no such key")},
+		{"RENAMENX s2 l", resp.Integer(0)},
+		{"RENAMENX s2 s", resp.Integer(1)},
+		{"RENAME s s", resp.OK},
+		{"COPY l l2", resp.Integer(1)},
+		{"RPUSH l2 c", resp.Integer(3)},
+		{"LRANGE l 0 -1", resp.Array(resp.BulkString("a"), resp.BulkString("b"))},
+		{"COPY s l2", resp.Integer(0)},
+		{"COPY s l2 REPLACE", resp.Integer(1)},
+		{"GET l2", resp.BulkString("v")},
+		{"TTL l2", resp.Integer(100)},
+		{"COPY s s", resp.Error("ERR source and destination objects are the same")},
+		{"COPY s x DB 1", resp.Error("ERR DB index is out of range")},
+		{"COPY s x BOGUS", resp.Error("ERR syntax error")},
+		{"COPY missing x", resp.Integer(0)},
+		{"DEL l l2", resp.Integer(2)},
+		{"RANDOMKEY", resp.BulkString("s")},
+	}
+
+	for _, tt := range tests {
+		response, _ := parser.ProcessCommand(sess, tt.command)
+
+		if !reflect.DeepEqual(response, tt.expected) {
+			t.Errorf("Command: %q, got: %+v, want: %+v", tt.command, response, tt.expected)
+		}
+	}
+}
+
+func TestParser_KeyspacePropagation(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	parser.ProcessCommand(sess, "SET a 1")
+	parser.ProcessCommand(sess, "SET b 2")
+	parser.ProcessCommand(sess, "SET c 3 EX 100")
 
 	tests := []struct {
 		command  string
 		expected string
 	}{
-		{"SET mykey myvalue", "OK"},
-		{"GET mykey", "myvalue"},
-		{"GET unknown", "(nil)"},
-		{"DEL mykey", "OK"},
-		{"GET mykey", "(nil)"},
-		{"SET with ttl", "OK"},
-		{"EXPIRE with 2", "1"},
-		{"TTL with", "2"},
-		{"SET without ttl", "OK"},
-		{"TTL without", "-1"},
-		{"INCR testIncr", "1"},
-		{"SET testIncr 2", "OK"},
-		{"INCR testIncr", "3"},
-		{"FLUSH", "OK"},
+		{"RENAME a b", "RENAME a b"},
+		{"RENAME c b", "DEL b; RENAME c b"},
+		{"RENAME b b", ""},
+		{"RENAMENX b a", "RENAMENX b a"},
+		{"RENAMENX a a", ""},
+		{"COPY a b", "COPY a b"},
+		{"COPY a b", ""},
+		{"COPY a b REPLACE", "DEL b; COPY a b REPLACE"},
+		{"SET x 1", "SET x 1"},
+		{"COPY x b REPLACE", "COPY x b REPLACE"},
+		{"TYPE a", ""},
+		{"TOUCH a", ""},
 	}
 
 	for _, tt := range tests {
+		_, propagate := parser.ProcessCommand(sess, tt.command)
+		if got := propagated(propagate); got != tt.expected {
+			t.Errorf("Command: %q, propagated %q, want %q", tt.command, got, tt.expected)
+		}
+	}
+}
+
+func TestParser_ScanCommands(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	sess := NewSession(1)
+
+	parser.ProcessCommand(sess, "SET user:1 a")
+	parser.ProcessCommand(sess, "HSET h f v")
+	parser.ProcessCommand(sess, "SADD s m")
+	parser.ProcessCommand(sess, "ZADD z 1.5 m")
+
+	tests := []struct {
+		command  string
+		expected resp.Value
+	}{
+		{"SCAN 0 MATCH user:*", resp.Array(resp.BulkString("0"), resp.Array(resp.BulkString("user:1")))},
+		{"SCAN 0 TYPE hash", resp.Array(resp.BulkString("0"), resp.Array(resp.BulkString("h")))},
+		{"SCAN 0 TYPE zset MATCH x*", resp.Array(resp.BulkString("0"), resp.Array())},
+		{"HSCAN h 0", resp.Array(resp.BulkString("0"), resp.Array(resp.BulkString("f"), resp.BulkString("v")))},
+		{"SSCAN s 0 COUNT 1", resp.Array(resp.BulkString("0"), resp.Array(resp.BulkString("m")))},
+		{"ZSCAN z 0", resp.Array(resp.BulkString("0"), resp.Array(resp.BulkString("m"), resp.BulkString("1.5")))},
+		{"SSCAN missing 0", resp.Array(resp.BulkString("0"), resp.Array())},
+		{"SCAN x", resp.Error("ERR invalid cursor")},
+		{"SCAN 0 TYPE foo", resp.Error("ERR unknown type name 'foo'")},
+		{"SCAN 0 COUNT 0", resp.Error("ERR syntax error")},
+		{"SCAN 0 COUNT x", resp.Error("ERR value is not an integer or out of range")},
+		{"SCAN 0 MATCH", resp.Error("ERR syntax error")},
+		{"HSCAN h 0 TYPE hash", resp.Error("ERR syntax error")},
+		{"ZSCAN h 0", resp.Error("WRONGTYPE Operation against a key holding the wrong kind of value")},
+	}
+
+	for _, tt := range tests {
+		response, _ := parser.ProcessCommand(sess, tt.command)
+
+		if !reflect.DeepEqual(response, tt.expected) {
+			t.Errorf("Command: %q, got: %+v, want: %+v", tt.command, response, tt.expected)
+		}
+	}
+
+	for i := range 50 {
+		parser.ProcessCommand(sess, fmt.Sprintf("HSET big f%d v%d", i, i))
+	}
+	fields := make(map[string]string)
+	for cursor := "0"; ; {
+		response, _ := parser.ProcessCommand(sess, "HSCAN big "+cursor+" COUNT 7")
+		cursor = response.Array[0].Str
+		page := response.Array[1].Array
+		for i := 0; i < len(page); i += 2 {
+			fields[page[i].Str] = page[i+1].Str
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(fields) != 50 || fields["f42"] != "v42" {
+		t.Errorf("HSCAN returned %v", fields)
+	}
+}
+
+func TestParser_SnapshotRewrite(t *testing.T) {
+	source := storage.NewMemoryStorage()
+	parser := NewParser(source)
+	sess := NewSession(1)
+
+	for _, command := range []string{
+		"SET str hello",
+		"SET volatile v PXAT 99999999999999",
+		"SET gone v PX 1",
+		"PFADD hll a b c",
+		"HSET h f1 v1 f2 v2",
+		"RPUSH l a b c",
+		"SADD s x y",
+		"ZADD z 1.5 a -inf b 0.1 c",
+		"GEOADD geo 13.361389 38.115556 Palermo",
+		"XADD st 1-1 a 1",
+		"XADD st 2-1 b 2",
+		"XADD st MAXLEN 2 3-1 c 3",
+		"XGROUP CREATE st g 0",
+		"XREADGROUP GROUP g alice COUNT 1 STREAMS st >",
+		"XGROUP CREATECONSUMER st g bob",
+		"XGROUP CREATE st g2 $",
+		"XADD trimmed MAXLEN 0 5-5 a 1",
+		"XGROUP CREATE empty g 0 MKSTREAM",
+		"XADD gc 1-1 a 1",
+		"XADD gc 1-2 b 2",
+		"XGROUP CREATE gc g 0",
+		"XREADGROUP GROUP g alice STREAMS gc >",
+		"XADD gc MAXLEN 0 1-3 c 3",
+	} {
+		if response, _ := parser.ProcessCommand(sess, command); response.IsError() {
+			t.Fatalf("Command: %q, got: %+v", command, response)
+		}
+	}
+	for i := range 100 {
+		parser.ProcessCommand(sess, fmt.Sprintf("RPUSH big %d", i))
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	target := storage.NewMemoryStorage()
+	replay := NewParser(target)
+	commands := 0
+	snapshot := source.Snapshot()
+	defer snapshot.Release()
+	err := snapshot.Rewrite(func(args [][]byte) error {
+		commands++
+		if response, _ := replay.Execute(sess, args); response.IsError() {
+			t.Errorf("Replaying %q: %+v", args, response)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One command per value, two for the big list, one for the TTL, and the
+	// streams need more.
+	if commands > 35 {
+		t.Errorf("Rewrite took %d commands", commands)
+	}
 
-		response, _ := parser.ProcessCommand(tt.command)
+	for _, command := range []string{
+		"GET str",
+		"PEXPIRETIME volatile",
+		"EXISTS gone",
+		"DBSIZE",
+		"PFCOUNT hll",
+		"HGET h f1", "HGET h f2", "HLEN h",
+		"LRANGE l 0 -1", "LRANGE big 0 -1",
+		"SCARD s", "SMISMEMBER s x y",
+		"ZRANGE z 0 -1 WITHSCORES",
+		"GEOPOS geo Palermo",
+		"XRANGE st - +",
+		"XPENDING st g",
+		"XPENDING st g2",
+		"XPENDING gc g",
+		"XLEN trimmed",
+		"XLEN empty",
+		"XGROUP DELCONSUMER st g bob",
+		"XGROUP DELCONSUMER st g alice",
+	} {
+		want, _ := parser.ProcessCommand(sess, command)
+		got, _ := replay.ProcessCommand(sess, command)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Command: %q, got: %+v, want: %+v", command, got, want)
+		}
+	}
 
-		if response != tt.expected {
-			t.Errorf("Command: %q, got: %q, want: %q", tt.command, response, tt.expected+"\n")
+	for _, key := range []string{"st", "trimmed", "empty", "gc"} {
+		want, _ := source.XLastID(key)
+		got, _ := target.XLastID(key)
+		if got != want {
+			t.Errorf("Last ID of %s = %v, want %v", key, got, want)
 		}
 	}
 }
+
+// recordingAppender is an Appender that keeps what is appended.
+type recordingAppender struct {
+	mu       sync.Mutex
+	commands [][][]byte
+}
+
+func (a *recordingAppender) Write(args [][]byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.commands = append(a.commands, args)
+	return nil
+}
+
+func TestParser_PauseWritesSkipsBlockedCommands(t *testing.T) {
+	parser := NewParser(storage.NewMemoryStorage())
+	aof := &recordingAppender{}
+
+	done := make(chan resp.Value)
+	go func() {
+		response, _ := parser.ExecuteAndAppend(NewSession(1), [][]byte{[]byte("BLPOP"), []byte("q"), []byte("0")}, aof)
+		done <- response
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	paused := make(chan struct{})
+	go parser.PauseWrites(func() { close(paused) })
+	select {
+	case <-paused:
+	case <-time.After(time.Second):
+		t.Fatal("PauseWrites waited for a blocked command")
+	}
+
+	parser.ExecuteAndAppend(NewSession(2), [][]byte{[]byte("RPUSH"), []byte("q"), []byte("x")}, aof)
+	if response := <-done; !reflect.DeepEqual(response, bulkStrings("q", "x")) {
+		t.Errorf("BLPOP = %+v", response)
+	}
+	if got := propagated(aof.commands); got != "RPUSH q x; LPOP q" {
+		t.Errorf("Appended %q", got)
+	}
+
+	parser.SetPersistence(pausingPersistence{parser})
+	response, _ := parser.ExecuteAndAppend(NewSession(3), [][]byte{[]byte("BGREWRITEAOF")}, aof)
+	if !reflect.DeepEqual(response, resp.SimpleString("Background append only file rewriting started")) {
+		t.Errorf("BGREWRITEAOF = %+v", response)
+	}
+	response, _ = parser.ExecuteAndAppend(NewSession(3), [][]byte{[]byte("SAVE")}, aof)
+	if !reflect.DeepEqual(response, resp.OK) {
+		t.Errorf("SAVE = %+v", response)
+	}
+	response, _ = parser.ExecuteAndAppend(NewSession(3), [][]byte{[]byte("BGSAVE")}, aof)
+	if !reflect.DeepEqual(response, resp.SimpleString("Background saving started")) {
+		t.Errorf("BGSAVE = %+v", response)
+	}
+}
+
+// pausingPersistence pauses writes to take its snapshot, like the App.
+type pausingPersistence struct {
+	parser *Parser
+}
+
+func (p pausingPersistence) RewriteAOF() error {
+	p.parser.PauseWrites(func() {})
+	return nil
+}
+
+func (p pausingPersistence) Save() error {
+	p.parser.PauseWrites(func() {})
+	return nil
+}
+
+func (p pausingPersistence) BGSave() error {
+	return p.Save()
+}
@@ -0,0 +1,38 @@
+package compute
+
+import "github.com/Novip1906/my-redis/internal/resp"
+
+var errNoPersistence = resp.Error("ERR persistence is disabled")
+
+// bgrewriteaof starts compacting the AOF in the background.
+func (p *Parser) bgrewriteaof(sess *Session, args [][]byte) resp.Value {
+	if p.persistence == nil {
+		return errNoPersistence
+	}
+	if err := p.persistence.RewriteAOF(); err != nil {
+		return errorReply(err)
+	}
+	return resp.SimpleString("Background append only file rewriting started")
+}
+
+// save writes a snapshot of the dataset, replying once it is on disk.
+func (p *Parser) save(sess *Session, args [][]byte) resp.Value {
+	if p.persistence == nil {
+		return errNoPersistence
+	}
+	if err := p.persistence.Save(); err != nil {
+		return errorReply(err)
+	}
+	return resp.OK
+}
+
+// bgsave starts writing a snapshot of the dataset in the background.
+func (p *Parser) bgsave(sess *Session, args [][]byte) resp.Value {
+	if p.persistence == nil {
+		return errNoPersistence
+	}
+	if err := p.persistence.BGSave(); err != nil {
+		return errorReply(err)
+	}
+	return resp.SimpleString("Background saving started")
+}
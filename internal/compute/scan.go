@@ -0,0 +1,118 @@
+package compute
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Novip1906/my-redis/internal/resp"
+	"github.com/Novip1906/my-redis/internal/storage"
+)
+
+// parseScan parses "cursor [MATCH pattern] [COUNT count]", and [TYPE type]
+// for SCAN itself.
+func parseScan(args [][]byte, allowType bool) (cursor uint64, opts storage.ScanOptions, errReply resp.Value, ok bool) {
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return 0, opts, resp.Error("ERR invalid cursor"), false
+	}
+
+	opts.Count = 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return 0, opts, errSyntax, false
+		}
+
+		switch option := strings.ToUpper(string(args[i])); {
+		case option == "MATCH":
+			// "*" matches everything, skip the matching altogether.
+			if string(args[i+1]) != "*" {
+				opts.Match = args[i+1]
+			}
+		case option == "COUNT":
+			count, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return 0, opts, errNotInteger, false
+			}
+			if count < 1 {
+				return 0, opts, errSyntax, false
+			}
+			opts.Count = count
+		case option == "TYPE" && allowType:
+			t, ok := storage.ParseValueType(string(args[i+1]))
+			if !ok {
+				return 0, opts, resp.Errorf("ERR unknown type name '%s'", args[i+1]), false
+			}
+			opts.Type = t
+		default:
+			return 0, opts, errSyntax, false
+		}
+	}
+	return cursor, opts, resp.Value{}, true
+}
+
+func scanReply(cursor uint64, page resp.Value) resp.Value {
+	return resp.Array(resp.BulkString(strconv.FormatUint(cursor, 10)), page)
+}
+
+// scan implements SCAN cursor [MATCH pattern] [COUNT count] [TYPE type].
+func (p *Parser) scan(sess *Session, args [][]byte) resp.Value {
+	cursor, opts, errReply, ok := parseScan(args[1:], true)
+	if !ok {
+		return errReply
+	}
+
+	next, keys := p.storage.Scan(cursor, opts)
+	page := make([]resp.Value, len(keys))
+	for i, key := range keys {
+		page[i] = resp.BulkString(key)
+	}
+	return scanReply(next, resp.Array(page...))
+}
+
+// hscan implements HSCAN key cursor [MATCH pattern] [COUNT count], replying
+// with fields and values.
+func (p *Parser) hscan(sess *Session, args [][]byte) resp.Value {
+	cursor, opts, errReply, ok := parseScan(args[2:], false)
+	if !ok {
+		return errReply
+	}
+
+	next, pairs, err := p.storage.HScan(string(args[1]), cursor, opts)
+	if err != nil {
+		return errorReply(err)
+	}
+	return scanReply(next, bulkArray(pairs))
+}
+
+func (p *Parser) sscan(sess *Session, args [][]byte) resp.Value {
+	cursor, opts, errReply, ok := parseScan(args[2:], false)
+	if !ok {
+		return errReply
+	}
+
+	next, members, err := p.storage.SScan(string(args[1]), cursor, opts)
+	if err != nil {
+		return errorReply(err)
+	}
+	return scanReply(next, bulkArray(members))
+}
+
+// zscan implements ZSCAN key cursor [MATCH pattern] [COUNT count], replying
+// with members and their scores as strings.
+func (p *Parser) zscan(sess *Session, args [][]byte) resp.Value {
+	cursor, opts, errReply, ok := parseScan(args[2:], false)
+	if !ok {
+		return errReply
+	}
+
+	next, members, err := p.storage.ZScan(string(args[1]), cursor, opts)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	page := make([]resp.Value, 0, 2*len(members))
+	for _, m := range members {
+		page = append(page, resp.BulkBytes(m.Member), resp.BulkString(resp.FormatDouble(m.Score)))
+	}
+	return scanReply(next, resp.Array(page...))
+}
@@ -0,0 +1,44 @@
+package compute
+
+// Session holds the per-connection state that commands may read or change.
+type Session struct {
+	ID       int64
+	Name     string
+	Protocol int
+
+	// WatchDisconnect is set by the connection so that blocking commands can
+	// stop waiting when the client goes away. It returns a channel that is
+	// closed on disconnect and a function to call once the wait is over.
+	WatchDisconnect func() (gone <-chan struct{}, release func())
+
+	// propagate is the command to append to the AOF for the command being
+	// executed. Write commands start with their own arguments; handlers may
+	// replace them with a replay-safe form or clear them when nothing changed.
+	propagate [][]byte
+	// alsoPropagate holds commands logged after propagate, for commands whose
+	// effect takes several commands to replay, e.g. XREADGROUP over many keys.
+	alsoPropagate [][][]byte
+	// holdsWrites is set while the command runs under the shared hold of
+	// Parser.writes, which blocking commands release while they wait.
+	holdsWrites bool
+}
+
+func NewSession(id int64) *Session {
+	return &Session{
+		ID:       id,
+		Protocol: 2,
+	}
+}
+
+func (s *Session) watchDisconnect() (<-chan struct{}, func()) {
+	if s.WatchDisconnect == nil {
+		return nil, func() {}
+	}
+	return s.WatchDisconnect()
+}
+
+// addPropagate queues one more command to append to the AOF after the
+// command being executed.
+func (s *Session) addPropagate(args ...[]byte) {
+	s.alsoPropagate = append(s.alsoPropagate, args)
+}
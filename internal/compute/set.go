@@ -0,0 +1,261 @@
+package compute
+
+import (
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+
+	"github.com/Novip1906/my-redis/internal/resp"
+	"github.com/Novip1906/my-redis/internal/storage"
+)
+
+func (p *Parser) sadd(sess *Session, args [][]byte) resp.Value {
+	added, err := p.storage.SAdd(string(args[1]), args[2:])
+	if err != nil {
+		return errorReply(err)
+	}
+	if added == 0 {
+		sess.propagate = nil
+	}
+	return resp.Integer(added)
+}
+
+func (p *Parser) srem(sess *Session, args [][]byte) resp.Value {
+	removed, err := p.storage.SRem(string(args[1]), args[2:])
+	if err != nil {
+		return errorReply(err)
+	}
+	if removed == 0 {
+		sess.propagate = nil
+	}
+	return resp.Integer(removed)
+}
+
+func (p *Parser) sismember(sess *Session, args [][]byte) resp.Value {
+	ok, err := p.storage.SIsMember(string(args[1]), args[2])
+	if err != nil {
+		return errorReply(err)
+	}
+	return boolInteger(ok)
+}
+
+func (p *Parser) smismember(sess *Session, args [][]byte) resp.Value {
+	found, err := p.storage.SMIsMember(string(args[1]), args[2:])
+	if err != nil {
+		return errorReply(err)
+	}
+
+	reply := make([]resp.Value, len(found))
+	for i, ok := range found {
+		reply[i] = boolInteger(ok)
+	}
+	return resp.Array(reply...)
+}
+
+func (p *Parser) smembers(sess *Session, args [][]byte) resp.Value {
+	members, err := p.storage.SMembers(string(args[1]))
+	if err != nil {
+		return errorReply(err)
+	}
+	return bulkSet(members)
+}
+
+func (p *Parser) scard(sess *Session, args [][]byte) resp.Value {
+	n, err := p.storage.SCard(string(args[1]))
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(n)
+}
+
+// spop implements SPOP key [count]. The members it picked are logged as SREM,
+// so replay removes the same ones.
+func (p *Parser) spop(sess *Session, args [][]byte) resp.Value {
+	if len(args) > 3 {
+		return errSyntax
+	}
+
+	count := int64(1)
+	if len(args) == 3 {
+		var err error
+		count, err = strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil || count < 0 {
+			return resp.Error("ERR value is out of range, must be positive")
+		}
+	}
+
+	members, err := p.storage.SPop(string(args[1]), count)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	sess.propagate = nil
+	if len(members) > 0 {
+		sess.propagate = append([][]byte{[]byte("SREM"), args[1]}, members...)
+	}
+
+	switch {
+	case len(args) == 3:
+		return bulkArray(members)
+	case len(members) == 0:
+		return resp.NullBulk
+	default:
+		return resp.BulkBytes(members[0])
+	}
+}
+
+// srandmember implements SRANDMEMBER key [count]. A negative count larger
+// than the set gets a reply generated as it is written out, from a copy of
+// the members, so its length is only bounded like in Redis.
+func (p *Parser) srandmember(sess *Session, args [][]byte) resp.Value {
+	if len(args) > 3 {
+		return errSyntax
+	}
+
+	count := int64(1)
+	if len(args) == 3 {
+		var err error
+		count, err = strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil {
+			return errNotInteger
+		}
+		if count < -math.MaxInt64/2 {
+			return resp.Error("ERR value is out of range")
+		}
+	}
+
+	members, err := p.storage.SRandMember(string(args[1]), count)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	switch {
+	case len(members) > 0 && int64(len(members)) < -count:
+		return resp.LazyArray(-count, func(yield func(resp.Value) bool) {
+			for range -count {
+				if !yield(resp.BulkBytes(members[rand.IntN(len(members))])) {
+					return
+				}
+			}
+		})
+	case len(args) == 3:
+		return bulkArray(members)
+	case len(members) == 0:
+		return resp.NullBulk
+	default:
+		return resp.BulkBytes(members[0])
+	}
+}
+
+func (p *Parser) smove(sess *Session, args [][]byte) resp.Value {
+	moved, err := p.storage.SMove(string(args[1]), string(args[2]), args[3])
+	if err != nil {
+		return errorReply(err)
+	}
+	if !moved {
+		sess.propagate = nil
+	}
+	return boolInteger(moved)
+}
+
+func (p *Parser) sinter(sess *Session, args [][]byte) resp.Value {
+	return p.setOp(storage.SetInter, args)
+}
+
+func (p *Parser) sunion(sess *Session, args [][]byte) resp.Value {
+	return p.setOp(storage.SetUnion, args)
+}
+
+func (p *Parser) sdiff(sess *Session, args [][]byte) resp.Value {
+	return p.setOp(storage.SetDiff, args)
+}
+
+func (p *Parser) setOp(op storage.SetOperation, args [][]byte) resp.Value {
+	members, err := p.storage.SetOp(op, keyStrings(args[1:]))
+	if err != nil {
+		return errorReply(err)
+	}
+	return bulkSet(members)
+}
+
+func (p *Parser) sinterstore(sess *Session, args [][]byte) resp.Value {
+	return p.setOpStore(storage.SetInter, args)
+}
+
+func (p *Parser) sunionstore(sess *Session, args [][]byte) resp.Value {
+	return p.setOpStore(storage.SetUnion, args)
+}
+
+func (p *Parser) sdiffstore(sess *Session, args [][]byte) resp.Value {
+	return p.setOpStore(storage.SetDiff, args)
+}
+
+func (p *Parser) setOpStore(op storage.SetOperation, args [][]byte) resp.Value {
+	n, err := p.storage.SetOpStore(op, string(args[1]), keyStrings(args[2:]))
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(n)
+}
+
+// sintercard implements SINTERCARD numkeys key [key ...] [LIMIT limit].
+func (p *Parser) sintercard(sess *Session, args [][]byte) resp.Value {
+	keys, rest, errReply, ok := parseNumKeys(args[1:])
+	if !ok {
+		return errReply
+	}
+
+	var limit int64
+	switch {
+	case len(rest) == 0:
+	case len(rest) == 2 && strings.EqualFold(string(rest[0]), "LIMIT"):
+		var err error
+		limit, err = strconv.ParseInt(string(rest[1]), 10, 64)
+		if err != nil {
+			return errNotInteger
+		}
+		if limit < 0 {
+			return resp.Error("ERR LIMIT can't be negative")
+		}
+	default:
+		return errSyntax
+	}
+
+	n, err := p.storage.SInterCard(keys, limit)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(n)
+}
+
+// parseNumKeys splits "numkeys key [key ...] rest..." into the keys and the
+// remaining arguments.
+func parseNumKeys(args [][]byte) (keys []string, rest [][]byte, errReply resp.Value, ok bool) {
+	numKeys, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return nil, nil, errNotInteger, false
+	}
+	if numKeys <= 0 {
+		return nil, nil, resp.Error("ERR numkeys should be greater than 0"), false
+	}
+	if numKeys > int64(len(args)-1) {
+		return nil, nil, resp.Error("ERR Number of keys can't be greater than number of args"), false
+	}
+	return keyStrings(args[1 : numKeys+1]), args[numKeys+1:], resp.Value{}, true
+}
+
+func boolInteger(ok bool) resp.Value {
+	if ok {
+		return resp.Integer(1)
+	}
+	return resp.Integer(0)
+}
+
+func bulkSet(members [][]byte) resp.Value {
+	reply := make([]resp.Value, len(members))
+	for i, member := range members {
+		reply[i] = resp.BulkBytes(member)
+	}
+	return resp.Set(reply...)
+}
@@ -0,0 +1,839 @@
+package compute
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Novip1906/my-redis/internal/resp"
+	"github.com/Novip1906/my-redis/internal/storage"
+)
+
+var errInvalidStreamID = resp.Error("ERR " + storage.ErrInvalidStreamID.Error())
+
+// xadd implements XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold
+// [LIMIT count]] *|id field value [field value ...]. The entry is logged
+// with its actual ID and trimming, which is always exact, with "=".
+func (p *Parser) xadd(sess *Session, args [][]byte) resp.Value {
+	var (
+		opts    storage.XAddOptions
+		approx  bool
+		limited bool
+		i       = 2
+	)
+
+loop:
+	for ; i < len(args); i++ {
+		switch option := strings.ToUpper(string(args[i])); option {
+		case "NOMKSTREAM":
+			opts.NoMkStream = true
+		case "MAXLEN", "MINID":
+			if i+1 < len(args) && (string(args[i+1]) == "=" || string(args[i+1]) == "~") {
+				approx = string(args[i+1]) == "~"
+				i++
+			}
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			i++
+			if option == "MAXLEN" {
+				maxLen, err := strconv.ParseInt(string(args[i]), 10, 64)
+				if err != nil {
+					return errNotInteger
+				}
+				if maxLen < 0 {
+					return resp.Error("ERR The MAXLEN argument must be >= 0.")
+				}
+				opts.Trim = storage.StreamTrim{Strategy: storage.TrimMaxLen, MaxLen: maxLen}
+			} else {
+				minID, errReply, ok := parseStreamID(args[i], 0)
+				if !ok {
+					return errReply
+				}
+				opts.Trim = storage.StreamTrim{Strategy: storage.TrimMinID, MinID: minID}
+			}
+		case "LIMIT":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			i++
+			limit, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				return errNotInteger
+			}
+			if limit < 0 {
+				return resp.Error("ERR The LIMIT argument must be >= 0.")
+			}
+			limited = true
+		default:
+			break loop
+		}
+	}
+
+	if limited && !approx {
+		return resp.Error("ERR syntax error, LIMIT cannot be used without the special ~ option")
+	}
+
+	rest := args[i:]
+	if len(rest) < 3 || len(rest)%2 == 0 {
+		return errWrongArgs("xadd")
+	}
+
+	switch id := string(rest[0]); {
+	case id == "*":
+		opts.AutoID = true
+	case strings.HasSuffix(id, "-*"):
+		ms, err := strconv.ParseUint(strings.TrimSuffix(id, "-*"), 10, 64)
+		if err != nil {
+			return errInvalidStreamID
+		}
+		opts.ID = storage.StreamID{Ms: ms}
+		opts.AutoSeq = true
+	default:
+		parsed, errReply, ok := parseStreamID(rest[0], 0)
+		if !ok {
+			return errReply
+		}
+		opts.ID = parsed
+	}
+
+	key := string(args[1])
+	id, ok, err := p.storage.XAdd(key, opts, rest[1:])
+	if err != nil {
+		return errorReply(err)
+	}
+	if !ok {
+		sess.propagate = nil
+		return resp.NullBulk
+	}
+
+	propagate := [][]byte{args[0], args[1]}
+	switch opts.Trim.Strategy {
+	case storage.TrimMaxLen:
+		propagate = append(propagate, []byte("MAXLEN"), []byte("="), []byte(strconv.FormatInt(opts.Trim.MaxLen, 10)))
+	case storage.TrimMinID:
+		propagate = append(propagate, []byte("MINID"), []byte("="), []byte(opts.Trim.MinID.String()))
+	}
+	sess.propagate = append(append(propagate, []byte(id.String())), rest[1:]...)
+	return resp.BulkString(id.String())
+}
+
+func (p *Parser) xlen(sess *Session, args [][]byte) resp.Value {
+	length, err := p.storage.XLen(string(args[1]))
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(length)
+}
+
+// xsetid implements XSETID key last-id, which sets the ID that new entries
+// must be greater than.
+func (p *Parser) xsetid(sess *Session, args [][]byte) resp.Value {
+	id, errReply, ok := parseStreamID(args[2], 0)
+	if !ok {
+		return errReply
+	}
+	if err := p.storage.XSetID(string(args[1]), id); err != nil {
+		return errorReply(err)
+	}
+	return resp.OK
+}
+
+func (p *Parser) xrange(sess *Session, args [][]byte) resp.Value {
+	return p.xrangeGeneric(args, false)
+}
+
+func (p *Parser) xrevrange(sess *Session, args [][]byte) resp.Value {
+	return p.xrangeGeneric(args, true)
+}
+
+// xrangeGeneric implements XRANGE key start end [COUNT count] and XREVRANGE
+// key end start [COUNT count].
+func (p *Parser) xrangeGeneric(args [][]byte, rev bool) resp.Value {
+	startArg, endArg := args[2], args[3]
+	if rev {
+		startArg, endArg = endArg, startArg
+	}
+
+	start, errReply, ok := parseRangeStart(startArg)
+	if !ok {
+		return errReply
+	}
+	end, errReply, ok := parseRangeEnd(endArg)
+	if !ok {
+		return errReply
+	}
+
+	count := int64(-1)
+	switch {
+	case len(args) == 6 && strings.EqualFold(string(args[4]), "COUNT"):
+		var err error
+		if count, err = strconv.ParseInt(string(args[5]), 10, 64); err != nil {
+			return errNotInteger
+		}
+		if count <= 0 {
+			return resp.Array()
+		}
+	case len(args) != 4:
+		return errSyntax
+	}
+
+	entries, err := p.storage.XRange(string(args[1]), start, end, count, rev)
+	if err != nil {
+		return errorReply(err)
+	}
+	return entriesReply(entries)
+}
+
+// xreadOptions are the options shared by XREAD and XREADGROUP.
+type xreadOptions struct {
+	count   int64
+	block   bool
+	timeout time.Duration
+	noAck   bool
+	keys    []string
+	ids     [][]byte
+}
+
+// parseXRead parses [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key
+// [key ...] id [id ...], NOACK being allowed for XREADGROUP only.
+func parseXRead(args [][]byte, group bool) (xreadOptions, resp.Value, bool) {
+	var opts xreadOptions
+	name := "xread"
+	if group {
+		name = "xreadgroup"
+	}
+
+	for i := 0; i < len(args); i++ {
+		switch option := strings.ToUpper(string(args[i])); {
+		case option == "COUNT" && i+1 < len(args):
+			count, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return opts, errNotInteger, false
+			}
+			opts.count = max(count, 0)
+			i++
+		case option == "BLOCK" && i+1 < len(args):
+			ms, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return opts, resp.Error("ERR timeout is not an integer or out of range"), false
+			}
+			if ms < 0 {
+				return opts, resp.Error("ERR timeout is negative"), false
+			}
+			opts.block = true
+			opts.timeout = time.Duration(ms) * time.Millisecond
+			i++
+		case option == "NOACK" && group:
+			opts.noAck = true
+		case option == "STREAMS":
+			streams := args[i+1:]
+			if len(streams) == 0 || len(streams)%2 != 0 {
+				return opts, resp.Errorf("ERR Unbalanced '%s' list of streams: for each stream key an ID or '$' must be specified.", name), false
+			}
+			opts.keys = keyStrings(streams[:len(streams)/2])
+			opts.ids = streams[len(streams)/2:]
+			return opts, resp.Value{}, true
+		default:
+			return opts, errSyntax, false
+		}
+	}
+	return opts, errSyntax, false
+}
+
+// xread implements XREAD [COUNT count] [BLOCK milliseconds] STREAMS key
+// [key ...] id [id ...]. "$" stands for the top entry at the time of the
+// call, so that a blocked client only gets entries added later.
+func (p *Parser) xread(sess *Session, args [][]byte) resp.Value {
+	opts, errReply, ok := parseXRead(args[1:], false)
+	if !ok {
+		return errReply
+	}
+
+	ids := make([]storage.StreamID, len(opts.ids))
+	for i, arg := range opts.ids {
+		switch string(arg) {
+		case "$":
+			id, err := p.storage.XLastID(opts.keys[i])
+			if err != nil {
+				return errorReply(err)
+			}
+			ids[i] = id
+		case ">":
+			return resp.Error("ERR The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option.")
+		default:
+			if ids[i], errReply, ok = parseStreamID(arg, 0); !ok {
+				return errReply
+			}
+		}
+	}
+
+	serve := func() (resp.Value, bool) {
+		reads, err := p.storage.XRead(opts.keys, ids, opts.count)
+		if err != nil {
+			return errorReply(err), true
+		}
+		if len(reads) == 0 {
+			return resp.Value{}, false
+		}
+		return readsReply(sess, reads), true
+	}
+
+	if !opts.block {
+		if reply, ok := serve(); ok {
+			return reply
+		}
+		return resp.NullArray
+	}
+	if reply, ok := p.block(sess, opts.keys, opts.timeout, serve); ok {
+		return reply
+	}
+	return resp.NullArray
+}
+
+// xreadgroup implements XREADGROUP GROUP group consumer [COUNT count]
+// [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...]. Deliveries
+// are logged as XCLAIM with FORCE, which adds the entries to the pending list
+// of the consumer and moves the group's last delivered ID, or as XGROUP SETID
+// with NOACK. Reads of a consumer's history change nothing.
+func (p *Parser) xreadgroup(sess *Session, args [][]byte) resp.Value {
+	sess.propagate = nil
+
+	if !strings.EqualFold(string(args[1]), "GROUP") {
+		return resp.Error("ERR Missing GROUP option for XREADGROUP")
+	}
+	group, consumer := args[2], args[3]
+
+	opts, errReply, ok := parseXRead(args[4:], true)
+	if !ok {
+		return errReply
+	}
+
+	reads := make([]storage.GroupRead, len(opts.keys))
+	canBlock := opts.block
+	for i, arg := range opts.ids {
+		reads[i].Key = opts.keys[i]
+		switch string(arg) {
+		case ">":
+			reads[i].New = true
+		case "$":
+			return resp.Error("ERR The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.")
+		default:
+			if reads[i].ID, errReply, ok = parseStreamID(arg, 0); !ok {
+				return errReply
+			}
+			// History is served right away, there is nothing to wait for.
+			canBlock = false
+		}
+	}
+
+	serve := func() (resp.Value, bool) {
+		now := time.Now().UnixMilli()
+		deliveries, err := p.storage.XReadGroup(string(group), string(consumer), reads, opts.count, opts.noAck, now)
+		if err != nil {
+			var noGroup *storage.NoGroupError
+			if errors.As(err, &noGroup) {
+				return resp.Errorf("NOGROUP No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option", noGroup.Key, group), true
+			}
+			return errorReply(err), true
+		}
+
+		var result []storage.StreamRead
+		for i, delivery := range deliveries {
+			key := []byte(delivery.Key)
+			switch {
+			case !reads[i].New:
+			case len(delivery.Entries) > 0 && opts.noAck:
+				sess.addPropagate([]byte("XGROUP"), []byte("SETID"), key, group, []byte(delivery.LastID.String()))
+			case len(delivery.Entries) > 0:
+				claim := [][]byte{[]byte("XCLAIM"), key, group, consumer, []byte("0")}
+				for _, entry := range delivery.Entries {
+					claim = append(claim, []byte(entry.ID.String()))
+				}
+				claim = append(claim,
+					[]byte("TIME"), []byte(strconv.FormatInt(now, 10)),
+					[]byte("RETRYCOUNT"), []byte("1"),
+					[]byte("FORCE"), []byte("JUSTID"),
+					[]byte("LASTID"), []byte(delivery.LastID.String()))
+				sess.addPropagate(claim...)
+				delivery.ConsumerCreated = false
+			}
+			if delivery.ConsumerCreated {
+				sess.addPropagate([]byte("XGROUP"), []byte("CREATECONSUMER"), key, group, consumer)
+			}
+
+			if !reads[i].New || len(delivery.Entries) > 0 {
+				result = append(result, delivery.StreamRead)
+			}
+		}
+
+		if len(result) == 0 {
+			return resp.Value{}, false
+		}
+		return readsReply(sess, result), true
+	}
+
+	if !canBlock {
+		if reply, ok := serve(); ok {
+			return reply
+		}
+		return resp.NullArray
+	}
+	if reply, ok := p.block(sess, opts.keys, opts.timeout, serve); ok {
+		return reply
+	}
+	return resp.NullArray
+}
+
+// xgroup implements the XGROUP subcommands CREATE, SETID, DESTROY,
+// CREATECONSUMER and DELCONSUMER. "$" is logged as the ID it stood for.
+func (p *Parser) xgroup(sess *Session, args [][]byte) resp.Value {
+	subcommand := strings.ToUpper(string(args[1]))
+	wrongArgs := resp.Errorf("ERR unknown subcommand or wrong number of arguments for '%s'. Try XGROUP HELP.", args[1])
+	if len(args) < 4 {
+		return wrongArgs
+	}
+	key, group := string(args[2]), string(args[3])
+
+	var err error
+	switch subcommand {
+	case "CREATE", "SETID":
+		if len(args) < 5 {
+			return wrongArgs
+		}
+		mkStream := false
+		for _, option := range args[5:] {
+			if subcommand != "CREATE" || !strings.EqualFold(string(option), "MKSTREAM") {
+				return errSyntax
+			}
+			mkStream = true
+		}
+
+		var id storage.StreamID
+		useLast := string(args[4]) == "$"
+		if !useLast {
+			var errReply resp.Value
+			var ok bool
+			if id, errReply, ok = parseStreamID(args[4], 0); !ok {
+				return errReply
+			}
+		}
+
+		if subcommand == "CREATE" {
+			id, err = p.storage.XGroupCreate(key, group, id, useLast, mkStream)
+		} else {
+			id, err = p.storage.XGroupSetID(key, group, id, useLast)
+		}
+		if err == nil {
+			sess.propagate = append([][]byte{args[0], args[1], args[2], args[3], []byte(id.String())}, args[5:]...)
+			return resp.OK
+		}
+
+	case "DESTROY":
+		if len(args) != 4 {
+			return wrongArgs
+		}
+		var destroyed bool
+		if destroyed, err = p.storage.XGroupDestroy(key, group); err == nil {
+			if !destroyed {
+				sess.propagate = nil
+			}
+			return boolInteger(destroyed)
+		}
+
+	case "CREATECONSUMER":
+		if len(args) != 5 {
+			return wrongArgs
+		}
+		var created bool
+		if created, err = p.storage.XGroupCreateConsumer(key, group, string(args[4])); err == nil {
+			if !created {
+				sess.propagate = nil
+			}
+			return boolInteger(created)
+		}
+
+	case "DELCONSUMER":
+		if len(args) != 5 {
+			return wrongArgs
+		}
+		var pending int64
+		if pending, err = p.storage.XGroupDelConsumer(key, group, string(args[4])); err == nil {
+			return resp.Integer(pending)
+		}
+
+	default:
+		return wrongArgs
+	}
+
+	if errors.Is(err, storage.ErrNoGroup) {
+		return resp.Errorf("NOGROUP No such consumer group '%s' for key name '%s'", group, key)
+	}
+	return errorReply(err)
+}
+
+// xack implements XACK key group id [id ...].
+func (p *Parser) xack(sess *Session, args [][]byte) resp.Value {
+	ids, errReply, ok := parseStreamIDs(args[3:])
+	if !ok {
+		return errReply
+	}
+
+	acked, err := p.storage.XAck(string(args[1]), string(args[2]), ids)
+	if err != nil {
+		return errorReply(err)
+	}
+	if acked == 0 {
+		sess.propagate = nil
+	}
+	return resp.Integer(acked)
+}
+
+// xpending implements XPENDING key group [[IDLE min-idle-time] start end
+// count [consumer]].
+func (p *Parser) xpending(sess *Session, args [][]byte) resp.Value {
+	key, group := string(args[1]), string(args[2])
+
+	if len(args) == 3 {
+		summary, err := p.storage.XPendingSummary(key, group)
+		if err != nil {
+			return xpendingError(err, key, group)
+		}
+		if summary.Count == 0 {
+			return resp.Array(resp.Integer(0), resp.NullBulk, resp.NullBulk, resp.NullArray)
+		}
+		consumers := make([]resp.Value, len(summary.Consumers))
+		for i, c := range summary.Consumers {
+			consumers[i] = resp.Array(resp.BulkString(c.Name), resp.BulkString(strconv.FormatInt(c.Count, 10)))
+		}
+		return resp.Array(
+			resp.Integer(summary.Count),
+			resp.BulkString(summary.Min.String()),
+			resp.BulkString(summary.Max.String()),
+			resp.Array(consumers...),
+		)
+	}
+
+	rest := args[3:]
+	var minIdle int64
+	if strings.EqualFold(string(rest[0]), "IDLE") {
+		if len(rest) < 2 {
+			return errSyntax
+		}
+		var err error
+		if minIdle, err = strconv.ParseInt(string(rest[1]), 10, 64); err != nil {
+			return errNotInteger
+		}
+		rest = rest[2:]
+	}
+	if len(rest) != 3 && len(rest) != 4 {
+		return errSyntax
+	}
+
+	start, errReply, ok := parseRangeStart(rest[0])
+	if !ok {
+		return errReply
+	}
+	end, errReply, ok := parseRangeEnd(rest[1])
+	if !ok {
+		return errReply
+	}
+	count, err := strconv.ParseInt(string(rest[2]), 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	var consumer string
+	if len(rest) == 4 {
+		consumer = string(rest[3])
+	}
+
+	entries, err := p.storage.XPending(key, group, start, end, count, consumer, minIdle, time.Now().UnixMilli())
+	if err != nil {
+		return xpendingError(err, key, group)
+	}
+
+	reply := make([]resp.Value, len(entries))
+	for i, e := range entries {
+		reply[i] = resp.Array(
+			resp.BulkString(e.ID.String()),
+			resp.BulkString(e.Consumer),
+			resp.Integer(e.Idle),
+			resp.Integer(e.DeliveryCount),
+		)
+	}
+	return resp.Array(reply...)
+}
+
+func xpendingError(err error, key, group string) resp.Value {
+	if errors.Is(err, storage.ErrNoGroup) {
+		return resp.Errorf("NOGROUP No such key '%s' or consumer group '%s'", key, group)
+	}
+	return errorReply(err)
+}
+
+// xclaim implements XCLAIM key group consumer min-idle-time id [id ...]
+// [IDLE ms] [TIME unix-time-milliseconds] [RETRYCOUNT count] [FORCE]
+// [JUSTID] [LASTID lastid]. It is logged with the IDs that were actually
+// claimed or dropped, a zero min-idle-time and the delivery time as TIME,
+// so that replay does not depend on the clock.
+func (p *Parser) xclaim(sess *Session, args [][]byte) resp.Value {
+	minIdle, err := strconv.ParseInt(string(args[4]), 10, 64)
+	if err != nil {
+		return resp.Error("ERR Invalid min-idle-time argument for XCLAIM")
+	}
+
+	i := 5
+	var ids []storage.StreamID
+	for ; i < len(args); i++ {
+		id, err := storage.ParseStreamID(args[i], 0)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return errInvalidStreamID
+	}
+
+	now := time.Now().UnixMilli()
+	opts := storage.XClaimOptions{DeliveryTime: now, RetryCount: -1}
+	var flags [][]byte
+	for ; i < len(args); i++ {
+		switch option := strings.ToUpper(string(args[i])); {
+		case option == "FORCE":
+			opts.Force = true
+			flags = append(flags, args[i])
+		case option == "JUSTID":
+			opts.JustID = true
+			flags = append(flags, args[i])
+		case option == "KEEPDELETED":
+			opts.KeepDeleted = true
+			flags = append(flags, args[i])
+		case (option == "IDLE" || option == "TIME" || option == "RETRYCOUNT") && i+1 < len(args):
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return resp.Errorf("ERR Invalid %s option argument for XCLAIM", option)
+			}
+			switch option {
+			case "IDLE":
+				opts.DeliveryTime = now - n
+			case "TIME":
+				opts.DeliveryTime = n
+			default:
+				opts.RetryCount = n
+				flags = append(flags, args[i], args[i+1])
+			}
+			i++
+		case option == "LASTID" && i+1 < len(args):
+			lastID, errReply, ok := parseStreamID(args[i+1], 0)
+			if !ok {
+				return errReply
+			}
+			opts.LastID = &lastID
+			flags = append(flags, args[i], args[i+1])
+			i++
+		default:
+			return resp.Errorf("ERR Unrecognized XCLAIM option '%s'", args[i])
+		}
+	}
+	if opts.DeliveryTime < 0 || opts.DeliveryTime > now {
+		opts.DeliveryTime = now
+	}
+
+	key, group := string(args[1]), string(args[2])
+	claimed, deleted, err := p.storage.XClaim(key, group, string(args[3]), minIdle, ids, opts, now)
+	if err != nil {
+		return xpendingError(err, key, group)
+	}
+
+	sess.propagate = claimPropagation(args[:4], claimed, deleted, opts.DeliveryTime, flags)
+	if opts.JustID {
+		return entryIDsReply(claimed)
+	}
+	return entriesReply(claimed)
+}
+
+// xautoclaim implements XAUTOCLAIM key group consumer min-idle-time start
+// [COUNT count] [JUSTID], logged as an XCLAIM of what it claimed.
+func (p *Parser) xautoclaim(sess *Session, args [][]byte) resp.Value {
+	minIdle, err := strconv.ParseInt(string(args[4]), 10, 64)
+	if err != nil {
+		return resp.Error("ERR Invalid min-idle-time argument for XAUTOCLAIM")
+	}
+	start, errReply, ok := parseRangeStart(args[5])
+	if !ok {
+		return errReply
+	}
+
+	count := int64(100)
+	var justID bool
+	for i := 6; i < len(args); i++ {
+		switch option := strings.ToUpper(string(args[i])); {
+		case option == "JUSTID":
+			justID = true
+		case option == "COUNT" && i+1 < len(args):
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return errNotInteger
+			}
+			if n < 1 || n > 1<<40 {
+				return resp.Error("ERR COUNT must be > 0")
+			}
+			count = n
+			i++
+		default:
+			return errSyntax
+		}
+	}
+
+	now := time.Now().UnixMilli()
+	key, group := string(args[1]), string(args[2])
+	next, claimed, deleted, err := p.storage.XAutoClaim(key, group, string(args[3]), minIdle, start, count, justID, now)
+	if err != nil {
+		return xpendingError(err, key, group)
+	}
+
+	var flags [][]byte
+	if justID {
+		flags = append(flags, []byte("JUSTID"))
+	}
+	sess.propagate = claimPropagation([][]byte{[]byte("XCLAIM"), args[1], args[2], args[3]}, claimed, deleted, now, flags)
+
+	entries := entriesReply(claimed)
+	if justID {
+		entries = entryIDsReply(claimed)
+	}
+	deletedReply := make([]resp.Value, len(deleted))
+	for i, id := range deleted {
+		deletedReply[i] = resp.BulkString(id.String())
+	}
+	return resp.Array(resp.BulkString(next.String()), entries, resp.Array(deletedReply...))
+}
+
+// claimPropagation builds "XCLAIM key group consumer 0 ids... TIME time
+// flags..." for the claimed and dropped entries, or nil if there are none.
+func claimPropagation(head [][]byte, claimed []storage.StreamEntry, deleted []storage.StreamID, deliveryTime int64, flags [][]byte) [][]byte {
+	if len(claimed) == 0 && len(deleted) == 0 {
+		return nil
+	}
+
+	propagate := append(head[:4:4], []byte("0"))
+	for _, entry := range claimed {
+		propagate = append(propagate, []byte(entry.ID.String()))
+	}
+	for _, id := range deleted {
+		propagate = append(propagate, []byte(id.String()))
+	}
+	propagate = append(propagate, []byte("TIME"), []byte(strconv.FormatInt(deliveryTime, 10)))
+	return append(propagate, flags...)
+}
+
+func parseStreamID(arg []byte, missingSeq uint64) (storage.StreamID, resp.Value, bool) {
+	id, err := storage.ParseStreamID(arg, missingSeq)
+	if err != nil {
+		return id, errInvalidStreamID, false
+	}
+	return id, resp.Value{}, true
+}
+
+func parseStreamIDs(args [][]byte) ([]storage.StreamID, resp.Value, bool) {
+	ids := make([]storage.StreamID, len(args))
+	for i, arg := range args {
+		var errReply resp.Value
+		var ok bool
+		if ids[i], errReply, ok = parseStreamID(arg, 0); !ok {
+			return nil, errReply, false
+		}
+	}
+	return ids, resp.Value{}, true
+}
+
+// parseRangeStart parses the start of an ID range: "-", an ID, a bare
+// millisecond time standing for its first ID, or an ID prefixed with "(" to
+// exclude it.
+func parseRangeStart(arg []byte) (storage.StreamID, resp.Value, bool) {
+	switch {
+	case string(arg) == "-":
+		return storage.StreamID{}, resp.Value{}, true
+	case string(arg) == "+":
+		return storage.MaxStreamID, resp.Value{}, true
+	case len(arg) > 0 && arg[0] == '(':
+		id, errReply, ok := parseStreamID(arg[1:], 0)
+		if !ok {
+			return id, errReply, false
+		}
+		if id, ok = id.Next(); !ok {
+			return id, resp.Error("ERR invalid start ID for the interval"), false
+		}
+		return id, resp.Value{}, true
+	default:
+		return parseStreamID(arg, 0)
+	}
+}
+
+// parseRangeEnd is parseRangeStart for the end of a range, where a bare
+// millisecond time stands for its last ID.
+func parseRangeEnd(arg []byte) (storage.StreamID, resp.Value, bool) {
+	switch {
+	case string(arg) == "-":
+		return storage.StreamID{}, resp.Value{}, true
+	case string(arg) == "+":
+		return storage.MaxStreamID, resp.Value{}, true
+	case len(arg) > 0 && arg[0] == '(':
+		id, errReply, ok := parseStreamID(arg[1:], math.MaxUint64)
+		if !ok {
+			return id, errReply, false
+		}
+		if id, ok = id.Prev(); !ok {
+			return id, resp.Error("ERR invalid end ID for the interval"), false
+		}
+		return id, resp.Value{}, true
+	default:
+		return parseStreamID(arg, math.MaxUint64)
+	}
+}
+
+// entryReply renders an entry as [id, [field, value, ...]], with a null in
+// place of the fields for a deleted entry.
+func entryReply(entry storage.StreamEntry) resp.Value {
+	if entry.Fields == nil {
+		return resp.Array(resp.BulkString(entry.ID.String()), resp.NullArray)
+	}
+	return resp.Array(resp.BulkString(entry.ID.String()), bulkArray(entry.Fields))
+}
+
+func entriesReply(entries []storage.StreamEntry) resp.Value {
+	reply := make([]resp.Value, len(entries))
+	for i, entry := range entries {
+		reply[i] = entryReply(entry)
+	}
+	return resp.Array(reply...)
+}
+
+func entryIDsReply(entries []storage.StreamEntry) resp.Value {
+	reply := make([]resp.Value, len(entries))
+	for i, entry := range entries {
+		reply[i] = resp.BulkString(entry.ID.String())
+	}
+	return resp.Array(reply...)
+}
+
+// readsReply renders the result of XREAD and XREADGROUP: a map from keys to
+// entries in RESP3 and an array of [key, entries] pairs in RESP2.
+func readsReply(sess *Session, reads []storage.StreamRead) resp.Value {
+	reply := make([]resp.Value, 0, 2*len(reads))
+	for _, read := range reads {
+		key, entries := resp.BulkString(read.Key), entriesReply(read.Entries)
+		if sess.Protocol == 3 {
+			reply = append(reply, key, entries)
+		} else {
+			reply = append(reply, resp.Array(key, entries))
+		}
+	}
+	if sess.Protocol == 3 {
+		return resp.Map(reply...)
+	}
+	return resp.Array(reply...)
+}
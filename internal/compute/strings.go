@@ -0,0 +1,361 @@
+package compute
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Novip1906/my-redis/internal/resp"
+	"github.com/Novip1906/my-redis/internal/storage"
+)
+
+// set implements SET key value [NX|XX] [GET] [EX s|PX ms|EXAT ts|PXAT ms|KEEPTTL].
+// Relative expirations are logged as PXAT, so the key gets the same deadline on replay.
+func (p *Parser) set(sess *Session, args [][]byte) resp.Value {
+	var (
+		opts      storage.SetOptions
+		expireSet bool
+	)
+
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch opt {
+		case "NX", "XX":
+			if opts.Condition != storage.SetAlways {
+				return errSyntax
+			}
+			opts.Condition = storage.SetNX
+			if opt == "XX" {
+				opts.Condition = storage.SetXX
+			}
+
+		case "GET":
+			opts.Get = true
+
+		case "KEEPTTL":
+			if expireSet {
+				return errSyntax
+			}
+			opts.KeepTTL = true
+			expireSet = true
+
+		case "EX", "PX", "EXAT", "PXAT":
+			if expireSet || i+1 == len(args) {
+				return errSyntax
+			}
+			i++
+			amount, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				return errNotInteger
+			}
+			deadline, ok := setDeadline(opt, amount)
+			if !ok {
+				return resp.Error("ERR invalid expire time in 'set' command")
+			}
+			opts.ExpiresAt = deadline
+			expireSet = true
+
+		default:
+			return errSyntax
+		}
+	}
+
+	old, existed, written, err := p.storage.SetWithOptions(string(args[1]), args[2], opts)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	sess.propagate = nil
+	if written {
+		sess.propagate = [][]byte{[]byte("SET"), args[1], args[2]}
+		switch {
+		case opts.ExpiresAt != 0:
+			sess.propagate = append(sess.propagate, []byte("PXAT"), strconv.AppendInt(nil, opts.ExpiresAt, 10))
+		case opts.KeepTTL:
+			sess.propagate = append(sess.propagate, []byte("KEEPTTL"))
+		}
+	}
+
+	switch {
+	case opts.Get && existed:
+		return resp.BulkBytes(old)
+	case opts.Get, !written:
+		return resp.NullBulk
+	default:
+		return resp.OK
+	}
+}
+
+// setDeadline converts the amount given to one of the SET expiry options into
+// an absolute deadline in Unix milliseconds.
+func setDeadline(opt string, amount int64) (int64, bool) {
+	if amount <= 0 {
+		return 0, false
+	}
+
+	now := time.Now().UnixMilli()
+	switch opt {
+	case "EX":
+		if amount > (math.MaxInt64-now)/1000 {
+			return 0, false
+		}
+		return now + amount*1000, true
+	case "PX":
+		if amount > math.MaxInt64-now {
+			return 0, false
+		}
+		return now + amount, true
+	case "EXAT":
+		if amount > math.MaxInt64/1000 {
+			return 0, false
+		}
+		return amount * 1000, true
+	default:
+		return amount, true
+	}
+}
+
+func (p *Parser) get(sess *Session, args [][]byte) resp.Value {
+	val, ok, err := p.storage.Get(string(args[1]))
+	if err != nil {
+		return errorReply(err)
+	}
+	if !ok {
+		return resp.NullBulk
+	}
+	return resp.BulkBytes(val)
+}
+
+func (p *Parser) mget(sess *Session, args [][]byte) resp.Value {
+	values := p.storage.MGet(keyStrings(args[1:])...)
+
+	reply := make([]resp.Value, len(values))
+	for i, val := range values {
+		if val == nil {
+			reply[i] = resp.NullBulk
+		} else {
+			reply[i] = resp.BulkBytes(val)
+		}
+	}
+	return resp.Array(reply...)
+}
+
+func (p *Parser) mset(sess *Session, args [][]byte) resp.Value {
+	keys, values, ok := splitPairs(args[1:])
+	if !ok {
+		return errWrongArgs("mset")
+	}
+
+	p.storage.MSet(keys, values)
+	return resp.OK
+}
+
+func (p *Parser) msetnx(sess *Session, args [][]byte) resp.Value {
+	keys, values, ok := splitPairs(args[1:])
+	if !ok {
+		return errWrongArgs("msetnx")
+	}
+
+	if !p.storage.MSetNX(keys, values) {
+		sess.propagate = nil
+		return resp.Integer(0)
+	}
+	return resp.Integer(1)
+}
+
+func splitPairs(args [][]byte) ([]string, [][]byte, bool) {
+	if len(args)%2 != 0 {
+		return nil, nil, false
+	}
+
+	keys := make([]string, 0, len(args)/2)
+	values := make([][]byte, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		keys = append(keys, string(args[i]))
+		values = append(values, args[i+1])
+	}
+	return keys, values, true
+}
+
+func (p *Parser) getset(sess *Session, args [][]byte) resp.Value {
+	old, existed, err := p.storage.GetSet(string(args[1]), args[2])
+	if err != nil {
+		return errorReply(err)
+	}
+	if !existed {
+		return resp.NullBulk
+	}
+	return resp.BulkBytes(old)
+}
+
+func (p *Parser) getdel(sess *Session, args [][]byte) resp.Value {
+	val, ok, err := p.storage.GetDel(string(args[1]))
+	if err != nil {
+		return errorReply(err)
+	}
+	if !ok {
+		sess.propagate = nil
+		return resp.NullBulk
+	}
+
+	sess.propagate = [][]byte{[]byte("DEL"), args[1]}
+	return resp.BulkBytes(val)
+}
+
+// getex implements GETEX key [EX s|PX ms|EXAT ts|PXAT ms|PERSIST]. A changed
+// TTL is logged as PEXPIREAT or PERSIST, plain reads are not logged at all.
+func (p *Parser) getex(sess *Session, args [][]byte) resp.Value {
+	var (
+		expiresAt int64
+		persist   bool
+	)
+
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch opt {
+		case "PERSIST":
+			if expiresAt != 0 || persist {
+				return errSyntax
+			}
+			persist = true
+
+		case "EX", "PX", "EXAT", "PXAT":
+			if expiresAt != 0 || persist || i+1 == len(args) {
+				return errSyntax
+			}
+			i++
+			amount, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				return errNotInteger
+			}
+			deadline, ok := setDeadline(opt, amount)
+			if !ok {
+				return resp.Error("ERR invalid expire time in 'getex' command")
+			}
+			expiresAt = deadline
+
+		default:
+			return errSyntax
+		}
+	}
+
+	val, ok, err := p.storage.GetEx(string(args[1]), expiresAt, persist)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	sess.propagate = nil
+	if !ok {
+		return resp.NullBulk
+	}
+
+	switch {
+	case expiresAt != 0:
+		sess.propagate = [][]byte{[]byte("PEXPIREAT"), args[1], strconv.AppendInt(nil, expiresAt, 10)}
+	case persist:
+		sess.propagate = [][]byte{[]byte("PERSIST"), args[1]}
+	}
+	return resp.BulkBytes(val)
+}
+
+func (p *Parser) append(sess *Session, args [][]byte) resp.Value {
+	n, err := p.storage.Append(string(args[1]), args[2])
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(n)
+}
+
+func (p *Parser) strlen(sess *Session, args [][]byte) resp.Value {
+	n, err := p.storage.Strlen(string(args[1]))
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(n)
+}
+
+func (p *Parser) getrange(sess *Session, args [][]byte) resp.Value {
+	start, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	end, err := strconv.ParseInt(string(args[3]), 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+
+	val, err := p.storage.GetRange(string(args[1]), start, end)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.BulkBytes(val)
+}
+
+func (p *Parser) setrange(sess *Session, args [][]byte) resp.Value {
+	offset, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	if offset < 0 {
+		return resp.Error("ERR offset is out of range")
+	}
+
+	n, err := p.storage.SetRange(string(args[1]), offset, args[3])
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(n)
+}
+
+func (p *Parser) incr(sess *Session, args [][]byte) resp.Value {
+	return p.incrBy(args[1], 1)
+}
+
+func (p *Parser) decr(sess *Session, args [][]byte) resp.Value {
+	return p.incrBy(args[1], -1)
+}
+
+func (p *Parser) incrby(sess *Session, args [][]byte) resp.Value {
+	delta, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	return p.incrBy(args[1], delta)
+}
+
+func (p *Parser) decrby(sess *Session, args [][]byte) resp.Value {
+	delta, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	if delta == math.MinInt64 {
+		return resp.Error("ERR decrement would overflow")
+	}
+	return p.incrBy(args[1], -delta)
+}
+
+func (p *Parser) incrBy(key []byte, delta int64) resp.Value {
+	val, err := p.storage.Increment(string(key), delta)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(val)
+}
+
+// incrbyfloat is logged as SET of the computed value, float arithmetic must not
+// be repeated on replay.
+func (p *Parser) incrbyfloat(sess *Session, args [][]byte) resp.Value {
+	delta, err := storage.ParseLongDouble(args[2])
+	if err != nil {
+		return errorReply(err)
+	}
+
+	val, err := p.storage.IncrementFloat(string(args[1]), delta)
+	if err != nil {
+		return errorReply(err)
+	}
+
+	sess.propagate = [][]byte{[]byte("SET"), args[1], val, []byte("KEEPTTL")}
+	return resp.BulkBytes(val)
+}
@@ -0,0 +1,493 @@
+package compute
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/Novip1906/my-redis/internal/resp"
+	"github.com/Novip1906/my-redis/internal/storage"
+)
+
+var errNotFloat = resp.Error("ERR value is not a valid float")
+
+// zadd implements ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...].
+func (p *Parser) zadd(sess *Session, args [][]byte) resp.Value {
+	var (
+		flags   storage.ZAddFlags
+		ch      bool
+		incr    bool
+		options = 2
+	)
+
+loop:
+	for ; options < len(args); options++ {
+		switch strings.ToUpper(string(args[options])) {
+		case "NX":
+			flags |= storage.ZAddNX
+		case "XX":
+			flags |= storage.ZAddXX
+		case "GT":
+			flags |= storage.ZAddGT
+		case "LT":
+			flags |= storage.ZAddLT
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break loop
+		}
+	}
+
+	elements := args[options:]
+	if len(elements) == 0 || len(elements)%2 != 0 {
+		return errSyntax
+	}
+	if flags&storage.ZAddNX != 0 && flags&storage.ZAddXX != 0 {
+		return resp.Error("ERR XX and NX options at the same time are not compatible")
+	}
+	if (flags&storage.ZAddGT != 0 && flags&storage.ZAddLT != 0) ||
+		(flags&storage.ZAddNX != 0 && flags&(storage.ZAddGT|storage.ZAddLT) != 0) {
+		return resp.Error("ERR GT, LT, and/or NX options at the same time are not compatible")
+	}
+	if incr && len(elements) > 2 {
+		return resp.Error("ERR INCR option supports a single increment-element pair")
+	}
+
+	scores := make([]float64, 0, len(elements)/2)
+	members := make([][]byte, 0, len(elements)/2)
+	for i := 0; i < len(elements); i += 2 {
+		score, ok := parseScore(elements[i])
+		if !ok {
+			return errNotFloat
+		}
+		scores = append(scores, score)
+		members = append(members, elements[i+1])
+	}
+
+	if incr {
+		score, ok, err := p.storage.ZIncrBy(string(args[1]), members[0], scores[0], flags)
+		if err != nil {
+			return errorReply(err)
+		}
+		if !ok {
+			sess.propagate = nil
+			return resp.NullBulk
+		}
+		return resp.Double(score)
+	}
+
+	added, updated, err := p.storage.ZAdd(string(args[1]), flags, scores, members)
+	if err != nil {
+		return errorReply(err)
+	}
+	if added+updated == 0 {
+		sess.propagate = nil
+	}
+	if ch {
+		return resp.Integer(added + updated)
+	}
+	return resp.Integer(added)
+}
+
+func (p *Parser) zincrby(sess *Session, args [][]byte) resp.Value {
+	delta, ok := parseScore(args[2])
+	if !ok {
+		return errNotFloat
+	}
+
+	score, _, err := p.storage.ZIncrBy(string(args[1]), args[3], delta, 0)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Double(score)
+}
+
+func (p *Parser) zrem(sess *Session, args [][]byte) resp.Value {
+	removed, err := p.storage.ZRem(string(args[1]), args[2:])
+	if err != nil {
+		return errorReply(err)
+	}
+	if removed == 0 {
+		sess.propagate = nil
+	}
+	return resp.Integer(removed)
+}
+
+func (p *Parser) zscore(sess *Session, args [][]byte) resp.Value {
+	score, ok, err := p.storage.ZScore(string(args[1]), args[2])
+	if err != nil {
+		return errorReply(err)
+	}
+	if !ok {
+		return resp.NullBulk
+	}
+	return resp.Double(score)
+}
+
+func (p *Parser) zcard(sess *Session, args [][]byte) resp.Value {
+	n, err := p.storage.ZCard(string(args[1]))
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(n)
+}
+
+func (p *Parser) zrank(sess *Session, args [][]byte) resp.Value {
+	return p.rank(args, false)
+}
+
+func (p *Parser) zrevrank(sess *Session, args [][]byte) resp.Value {
+	return p.rank(args, true)
+}
+
+// rank implements ZRANK and ZREVRANK key member [WITHSCORE].
+func (p *Parser) rank(args [][]byte, rev bool) resp.Value {
+	withScore := false
+	switch {
+	case len(args) == 4 && strings.EqualFold(string(args[3]), "WITHSCORE"):
+		withScore = true
+	case len(args) > 3:
+		return errSyntax
+	}
+
+	rank, score, ok, err := p.storage.ZRank(string(args[1]), args[2], rev)
+	switch {
+	case err != nil:
+		return errorReply(err)
+	case !ok && withScore:
+		return resp.NullArray
+	case !ok:
+		return resp.NullBulk
+	case withScore:
+		return resp.Array(resp.Integer(rank), resp.Double(score))
+	default:
+		return resp.Integer(rank)
+	}
+}
+
+func (p *Parser) zcount(sess *Session, args [][]byte) resp.Value {
+	r, ok := parseScoreRange(args[2], args[3])
+	if !ok {
+		return resp.Error("ERR min or max is not a float")
+	}
+
+	n, err := p.storage.ZCount(string(args[1]), r)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(n)
+}
+
+// zrange implements ZRANGE key start stop [BYSCORE|BYLEX] [REV] [LIMIT offset count] [WITHSCORES].
+func (p *Parser) zrange(sess *Session, args [][]byte) resp.Value {
+	spec, withScores, errReply, ok := parseZRange(args[1:], true)
+	if !ok {
+		return errReply
+	}
+
+	members, err := p.storage.ZRange(string(args[1]), spec)
+	if err != nil {
+		return errorReply(err)
+	}
+	return zmembersReply(sess, members, withScores)
+}
+
+// zrangestore implements ZRANGESTORE dst src start stop [BYSCORE|BYLEX] [REV] [LIMIT offset count].
+func (p *Parser) zrangestore(sess *Session, args [][]byte) resp.Value {
+	spec, _, errReply, ok := parseZRange(args[2:], false)
+	if !ok {
+		return errReply
+	}
+
+	n, err := p.storage.ZRangeStore(string(args[1]), string(args[2]), spec)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(n)
+}
+
+// parseZRange parses the arguments of ZRANGE starting with the key.
+func parseZRange(args [][]byte, allowScores bool) (spec storage.ZRangeSpec, withScores bool, errReply resp.Value, ok bool) {
+	spec.Count = -1
+	limit := false
+
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); {
+		case opt == "BYSCORE" && spec.By == storage.ZRangeByRank:
+			spec.By = storage.ZRangeByScore
+		case opt == "BYLEX" && spec.By == storage.ZRangeByRank:
+			spec.By = storage.ZRangeByLex
+		case opt == "REV":
+			spec.Rev = true
+		case opt == "WITHSCORES" && allowScores:
+			withScores = true
+		case opt == "LIMIT" && i+2 < len(args):
+			offset, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return spec, false, errNotInteger, false
+			}
+			count, err := strconv.ParseInt(string(args[i+2]), 10, 64)
+			if err != nil {
+				return spec, false, errNotInteger, false
+			}
+			spec.Offset, spec.Count = offset, count
+			limit = true
+			i += 2
+		default:
+			return spec, false, errSyntax, false
+		}
+	}
+
+	if limit && spec.By == storage.ZRangeByRank {
+		return spec, false, resp.Error("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX"), false
+	}
+	if withScores && spec.By == storage.ZRangeByLex {
+		return spec, false, resp.Error("ERR syntax error, WITHSCORES not supported in combination with BYLEX"), false
+	}
+
+	// With REV the range is given from the highest to the lowest end.
+	start, stop := args[1], args[2]
+	if spec.Rev && spec.By != storage.ZRangeByRank {
+		start, stop = stop, start
+	}
+
+	switch spec.By {
+	case storage.ZRangeByRank:
+		var err error
+		if spec.Start, err = strconv.ParseInt(string(start), 10, 64); err != nil {
+			return spec, false, errNotInteger, false
+		}
+		if spec.Stop, err = strconv.ParseInt(string(stop), 10, 64); err != nil {
+			return spec, false, errNotInteger, false
+		}
+	case storage.ZRangeByScore:
+		if spec.Score, ok = parseScoreRange(start, stop); !ok {
+			return spec, false, resp.Error("ERR min or max is not a float"), false
+		}
+	case storage.ZRangeByLex:
+		if spec.Lex, ok = parseLexRange(start, stop); !ok {
+			return spec, false, resp.Error("ERR min or max not valid string range item"), false
+		}
+	}
+	return spec, withScores, resp.Value{}, true
+}
+
+func (p *Parser) zpopmin(sess *Session, args [][]byte) resp.Value {
+	return p.zpop(sess, args, false)
+}
+
+func (p *Parser) zpopmax(sess *Session, args [][]byte) resp.Value {
+	return p.zpop(sess, args, true)
+}
+
+// zpop implements ZPOPMIN and ZPOPMAX key [count].
+func (p *Parser) zpop(sess *Session, args [][]byte, max bool) resp.Value {
+	if len(args) > 3 {
+		return errSyntax
+	}
+
+	count := int64(1)
+	if len(args) == 3 {
+		var err error
+		count, err = strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil || count < 0 {
+			return resp.Error("ERR value is out of range, must be positive")
+		}
+	}
+
+	members, err := p.storage.ZPop(string(args[1]), count, max)
+	if err != nil {
+		return errorReply(err)
+	}
+	if len(members) == 0 {
+		sess.propagate = nil
+	}
+
+	if len(args) == 3 {
+		return zmembersReply(sess, members, true)
+	}
+	if len(members) == 0 {
+		return resp.Array()
+	}
+	return resp.Array(resp.BulkBytes(members[0].Member), resp.Double(members[0].Score))
+}
+
+func (p *Parser) bzpopmin(sess *Session, args [][]byte) resp.Value {
+	return p.bzpop(sess, args, false)
+}
+
+func (p *Parser) bzpopmax(sess *Session, args [][]byte) resp.Value {
+	return p.bzpop(sess, args, true)
+}
+
+// bzpop implements BZPOPMIN and BZPOPMAX key [key ...] timeout. The member
+// that was served is logged as a ZPOPMIN or ZPOPMAX of its key.
+func (p *Parser) bzpop(sess *Session, args [][]byte, max bool) resp.Value {
+	timeout, errReply, ok := parseTimeout(args[len(args)-1])
+	if !ok {
+		return errReply
+	}
+	keys := keyStrings(args[1 : len(args)-1])
+
+	popCommand := []byte("ZPOPMIN")
+	if max {
+		popCommand = []byte("ZPOPMAX")
+	}
+
+	reply, ok := p.block(sess, keys, timeout, func() (resp.Value, bool) {
+		key, member, ok, err := p.storage.ZPopFirst(keys, max)
+		if err != nil {
+			return errorReply(err), true
+		}
+		if !ok {
+			return resp.Value{}, false
+		}
+		sess.propagate = [][]byte{popCommand, []byte(key)}
+		return resp.Array(resp.BulkString(key), resp.BulkBytes(member.Member), resp.Double(member.Score)), true
+	})
+	if !ok {
+		return resp.NullArray
+	}
+	return reply
+}
+
+func (p *Parser) zunionstore(sess *Session, args [][]byte) resp.Value {
+	return p.zstore(args, false)
+}
+
+func (p *Parser) zinterstore(sess *Session, args [][]byte) resp.Value {
+	return p.zstore(args, true)
+}
+
+// zstore implements ZUNIONSTORE and ZINTERSTORE destination numkeys key
+// [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX].
+func (p *Parser) zstore(args [][]byte, inter bool) resp.Value {
+	numKeys, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	if numKeys < 1 {
+		return resp.Errorf("ERR at least 1 input key is needed for '%s' command", strings.ToLower(string(args[0])))
+	}
+	if numKeys > int64(len(args)-3) {
+		return errSyntax
+	}
+
+	keys := keyStrings(args[3 : 3+numKeys])
+	weights := make([]float64, len(keys))
+	for i := range weights {
+		weights[i] = 1
+	}
+	aggregate := storage.AggregateSum
+
+	for i := 3 + int(numKeys); i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); {
+		case opt == "WEIGHTS" && i+len(keys) < len(args):
+			for j := range weights {
+				i++
+				weight, ok := parseScore(args[i])
+				if !ok {
+					return resp.Error("ERR weight value is not a float")
+				}
+				weights[j] = weight
+			}
+		case opt == "AGGREGATE" && i+1 < len(args):
+			i++
+			switch strings.ToUpper(string(args[i])) {
+			case "SUM":
+				aggregate = storage.AggregateSum
+			case "MIN":
+				aggregate = storage.AggregateMin
+			case "MAX":
+				aggregate = storage.AggregateMax
+			default:
+				return errSyntax
+			}
+		default:
+			return errSyntax
+		}
+	}
+
+	n, err := p.storage.ZStore(string(args[1]), keys, weights, aggregate, inter)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp.Integer(n)
+}
+
+// zmembersReply replies members with their scores as pairs in RESP3 and as
+// a flat array in RESP2.
+func zmembersReply(sess *Session, members []storage.ZMember, withScores bool) resp.Value {
+	reply := make([]resp.Value, 0, len(members))
+	for _, m := range members {
+		switch {
+		case !withScores:
+			reply = append(reply, resp.BulkBytes(m.Member))
+		case sess.Protocol == 3:
+			reply = append(reply, resp.Array(resp.BulkBytes(m.Member), resp.Double(m.Score)))
+		default:
+			reply = append(reply, resp.BulkBytes(m.Member), resp.Double(m.Score))
+		}
+	}
+	return resp.Array(reply...)
+}
+
+func parseScore(arg []byte) (float64, bool) {
+	score, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, false
+	}
+	return score, true
+}
+
+// parseScoreRange parses score bounds like 1.5, (1.5 for an exclusive bound,
+// -inf and +inf.
+func parseScoreRange(min, max []byte) (storage.ScoreRange, bool) {
+	var (
+		r   storage.ScoreRange
+		ok1 bool
+		ok2 bool
+	)
+	r.Min, r.MinExclusive, ok1 = parseScoreBound(min)
+	r.Max, r.MaxExclusive, ok2 = parseScoreBound(max)
+	return r, ok1 && ok2
+}
+
+func parseScoreBound(arg []byte) (float64, bool, bool) {
+	exclusive := len(arg) > 0 && arg[0] == '('
+	if exclusive {
+		arg = arg[1:]
+	}
+	score, ok := parseScore(arg)
+	return score, exclusive, ok
+}
+
+// parseLexRange parses member bounds: [member or (member for an inclusive or
+// exclusive bound, - and + for the ends of the set.
+func parseLexRange(min, max []byte) (storage.LexRange, bool) {
+	var (
+		r   storage.LexRange
+		ok1 bool
+		ok2 bool
+	)
+	r.Min, ok1 = parseLexBound(min)
+	r.Max, ok2 = parseLexBound(max)
+	return r, ok1 && ok2
+}
+
+func parseLexBound(arg []byte) (storage.LexBound, bool) {
+	switch {
+	case string(arg) == "-":
+		return storage.LexBound{Inf: -1}, true
+	case string(arg) == "+":
+		return storage.LexBound{Inf: 1}, true
+	case len(arg) > 0 && arg[0] == '(':
+		return storage.LexBound{Value: string(arg[1:]), Exclusive: true}, true
+	case len(arg) > 0 && arg[0] == '[':
+		return storage.LexBound{Value: string(arg[1:])}, true
+	default:
+		return storage.LexBound{}, false
+	}
+}
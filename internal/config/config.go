@@ -10,6 +10,23 @@ import (
 type Config struct {
 	Address string `yaml:"address" env-default:":6379"`
 	AOFPath string `yaml:"aof-path" env-default:"database.aof"`
+	// AppendFsync is when the AOF is flushed to disk: "always" before replying
+	// to a write, "everysec" once a second, or "no" to leave it to the OS.
+	AppendFsync string `yaml:"appendfsync" env-default:"everysec"`
+	// ActiveExpireHz is how many times per second expired keys are collected in the background.
+	ActiveExpireHz int `yaml:"active-expire-hz" env-default:"10"`
+	// The AOF is rewritten automatically once it grows by AutoAOFRewritePercentage
+	// percent since it was last rewritten, and is at least AutoAOFRewriteMinSize
+	// bytes large. A percentage of 0 disables automatic rewrites.
+	AutoAOFRewritePercentage int   `yaml:"auto-aof-rewrite-percentage" env-default:"100"`
+	AutoAOFRewriteMinSize    int64 `yaml:"auto-aof-rewrite-min-size" env-default:"67108864"`
+	// SnapshotPath is where SAVE and BGSAVE write the snapshot, which is loaded
+	// at startup along with the AOF written after it.
+	SnapshotPath string `yaml:"snapshot-path" env-default:"dump.rdb"`
+	// Save lists "<seconds> <changes>" rules, like "3600 1 300 100": a snapshot
+	// is saved in the background once any rule has at least changes writes
+	// made in seconds since the last one. Empty disables automatic saves.
+	Save string `yaml:"save"`
 }
 
 func LoadConfig() (*Config, error) {
@@ -1,17 +1,19 @@
 package network
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Novip1906/my-redis/internal/aof"
 	"github.com/Novip1906/my-redis/internal/compute"
+	"github.com/Novip1906/my-redis/internal/resp"
 )
 
 type TCPServer struct {
@@ -23,6 +25,7 @@ type TCPServer struct {
 	listener net.Listener
 	conns    map[net.Conn]struct{}
 	mu       sync.Mutex
+	nextID   atomic.Int64
 }
 
 func NewTCPServer(port string, parser *compute.Parser, aof *aof.AOF, log *slog.Logger) *TCPServer {
@@ -90,30 +93,68 @@ func (s *TCPServer) handleConnection(conn net.Conn) {
 		s.wg.Done()
 	}()
 
-	scanner := bufio.NewScanner(conn)
+	sess := compute.NewSession(s.nextID.Add(1))
+	reader := resp.NewReader(conn)
+	writer := resp.NewWriter(conn)
+	sess.WatchDisconnect = func() (<-chan struct{}, func()) {
+		return watchDisconnect(conn, reader)
+	}
 
-	for scanner.Scan() {
+	for {
 		conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
 
-		commandLine := scanner.Text()
+		args, err := reader.ReadCommand()
+		if err != nil {
+			if errors.Is(err, resp.ErrProtocol) {
+				log.Warn("Protocol error", "error", err)
+				writer.WriteValue(resp.Error("ERR " + err.Error()))
+				writer.Flush()
+			}
+			break
+		}
 
-		response, saveToAOF := s.parser.ProcessCommand(commandLine)
+		response, err := s.parser.ExecuteAndAppend(sess, args, s.aof)
+		if err != nil {
+			s.log.Error("Failed to write to AOF", "error", err)
+		}
 
-		response += "\n"
+		writer.SetProtocol(sess.Protocol)
+		writer.WriteValue(response)
 
-		if strings.HasPrefix(strings.ToUpper(commandLine), "QUIT") {
-			conn.Write([]byte(response))
+		if strings.EqualFold(string(args[0]), "QUIT") {
+			writer.Flush()
 			break
 		}
 
-		if saveToAOF {
-			if err := s.aof.Write(commandLine); err != nil {
-				s.log.Error("Failed to write to AOF", "error", err)
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				break
 			}
 		}
-
-		conn.Write([]byte(response))
 	}
 
 	log.Info("Connection closed")
 }
+
+// watchDisconnect waits for input on the connection while a blocking command
+// holds it, so that a client going away is noticed. Pipelined input is left
+// in the reader for the next command.
+func watchDisconnect(conn net.Conn, reader *resp.Reader) (<-chan struct{}, func()) {
+	gone := make(chan struct{})
+	done := make(chan struct{})
+
+	// Blocked clients are not idle, the wait is bounded by the command's own timeout.
+	conn.SetReadDeadline(time.Time{})
+
+	go func() {
+		defer close(done)
+		if err := reader.Peek(); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			close(gone)
+		}
+	}()
+
+	return gone, func() {
+		conn.SetReadDeadline(time.Now())
+		<-done
+	}
+}
@@ -22,7 +22,7 @@ func TestTCPServer_Integration(t *testing.T) {
 	tmpDir := t.TempDir()
 	aofPath := filepath.Join(tmpDir, "database_test.aof")
 
-	aof, err := aof.NewAOF(aofPath)
+	aof, err := aof.NewAOF(aofPath, aof.FsyncEverySec)
 	if err != nil {
 		t.Error("Failed to init AOF", "error", err)
 	}
@@ -51,22 +51,130 @@ func TestTCPServer_Integration(t *testing.T) {
 		command  string
 		expected string
 	}{
-		{"SET mykey myvalue", "OK"},
-		{"GET mykey", "myvalue"},
+		{"SET mykey myvalue\r\n", "+OK\r\n"},
+		{"GET mykey\n", "$7\r\nmyvalue\r\n"},
+		{"*3\r\n$3\r\nSET\r\n$5\r\nspace\r\n$11\r\nhello world\r\n", "+OK\r\n"},
+		{"*2\r\n$3\r\nGET\r\n$5\r\nspace\r\n", "$11\r\nhello world\r\n"},
+		{"GET unknown\r\n", "$-1\r\n"},
+		{"INCR counter\r\n", ":1\r\n"},
+		{"INCR space\r\n", "-ERR value is not an integer or out of range\r\n"},
 	}
 
 	reader := bufio.NewReader(conn)
 
 	for _, tt := range tests {
-		fmt.Fprint(conn, tt.command+"\n")
+		fmt.Fprint(conn, tt.command)
 
 		response, err := reader.ReadString('\n')
 		if err != nil {
 			t.Fatalf("Failed to read response: %v", err)
 		}
+		if response[0] == '$' && response != "$-1\r\n" {
+			payload, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			response += payload
+		}
+
+		if response != tt.expected {
+			t.Errorf("Command: %q, got: %q, want: %q", tt.command, response, tt.expected)
+		}
+	}
+}
+
+func TestTCPServer_BinaryValueSurvivesAOFReplay(t *testing.T) {
+	parser := compute.NewParser(storage.NewMemoryStorage())
+
+	aofPath := filepath.Join(t.TempDir(), "database_test.aof")
+	aofService, err := aof.NewAOF(aofPath, aof.FsyncEverySec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := ":4001"
+	server := NewTCPServer(port, parser, aofService, slog.Default())
+	go server.Start()
+	time.Sleep(50 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", "localhost"+port)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+
+	value := "\x1f\x8b\x00\r\nline\ttab  two spaces\xff"
+	fmt.Fprintf(conn, "*3\r\n$3\r\nSET\r\n$7\r\nbin\x00key\r\n$%d\r\n%s\r\n", len(value), value)
+
+	response, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || response != "+OK\r\n" {
+		t.Fatalf("SET response = %q, %v", response, err)
+	}
+
+	conn.Close()
+	server.Stop()
+	aofService.Close()
+
+	restored := storage.NewMemoryStorage()
+	replay := compute.NewParser(restored)
+	sess := compute.NewSession(0)
+	if err := aof.ReadAll(aofPath, func(args [][]byte) { replay.Execute(sess, args) }); err != nil {
+		t.Fatal(err)
+	}
 
-		if response != tt.expected+"\n" {
-			t.Errorf("Command: %q, got: %q, want: %q", tt.command, response, tt.expected+"\n")
+	got, ok, _ := restored.Get("bin\x00key")
+	if !ok || string(got) != value {
+		t.Errorf("restored value = %q, %v, want %q", got, ok, value)
+	}
+}
+
+func TestTCPServer_BlockingPopAcrossConnections(t *testing.T) {
+	parser := compute.NewParser(storage.NewMemoryStorage())
+
+	aofService, err := aof.NewAOF(filepath.Join(t.TempDir(), "database_test.aof"), aof.FsyncEverySec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aofService.Close()
+
+	port := ":4002"
+	server := NewTCPServer(port, parser, aofService, slog.Default())
+	go server.Start()
+	defer server.Stop()
+	time.Sleep(50 * time.Millisecond)
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", "localhost"+port)
+		if err != nil {
+			t.Fatalf("Failed to connect to server: %v", err)
 		}
+		return conn
+	}
+
+	// A client that disconnects while blocked must not take the element.
+	quitter := dial()
+	fmt.Fprint(quitter, "BLPOP jobs 0\r\n")
+	time.Sleep(50 * time.Millisecond)
+	quitter.Close()
+
+	consumer := dial()
+	defer consumer.Close()
+	fmt.Fprint(consumer, "BLPOP jobs 5\r\n")
+	time.Sleep(50 * time.Millisecond)
+
+	producer := dial()
+	defer producer.Close()
+	fmt.Fprint(producer, "RPUSH jobs job1\r\n")
+
+	reader := bufio.NewReader(consumer)
+	var response string
+	for range 5 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		response += line
+	}
+	if want := "*2\r\n$4\r\njobs\r\n$4\r\njob1\r\n"; response != want {
+		t.Errorf("BLPOP response = %q, want %q", response, want)
 	}
 }
@@ -0,0 +1,351 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	maxInlineSize    = 64 * 1024
+	maxBulkSize      = 512 * 1024 * 1024
+	maxMultibulkSize = 1024 * 1024
+)
+
+var ErrProtocol = errors.New("Protocol error")
+
+type Reader struct {
+	rd *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		rd: bufio.NewReader(r),
+	}
+}
+
+// Buffered returns the number of bytes that were already received but not
+// consumed yet, which lets callers delay flushing replies of pipelined commands.
+func (r *Reader) Buffered() int {
+	return r.rd.Buffered()
+}
+
+// Peek waits until more input arrives without consuming it, and returns the
+// error that ended the wait, e.g. when the client disconnects.
+func (r *Reader) Peek() error {
+	_, err := r.rd.Peek(1)
+	return err
+}
+
+// ReadCommand reads the next client request, either a multibulk array of bulk
+// strings or an inline command terminated by a newline. Empty requests are skipped.
+func (r *Reader) ReadCommand() ([][]byte, error) {
+	for {
+		prefix, err := r.rd.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+
+		var args [][]byte
+		if prefix[0] == byte(TypeArray) {
+			args, err = r.readMultibulk()
+		} else {
+			args, err = r.readInline()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(args) > 0 {
+			return args, nil
+		}
+	}
+}
+
+// ReadValue reads a single reply of any type. It is meant for clients and tests.
+func (r *Reader) ReadValue() (Value, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return Value{}, err
+	}
+	if len(line) == 0 {
+		return Value{}, fmt.Errorf("%w: empty reply", ErrProtocol)
+	}
+
+	t, payload := Type(line[0]), string(line[1:])
+
+	switch t {
+	case TypeSimpleString, TypeError:
+		return Value{Type: t, Str: payload}, nil
+
+	case TypeInteger:
+		n, err := strconv.ParseInt(payload, 10, 64)
+		if err != nil {
+			return Value{}, fmt.Errorf("%w: invalid integer", ErrProtocol)
+		}
+		return Integer(n), nil
+
+	case TypeBulkString:
+		n, err := strconv.ParseInt(payload, 10, 64)
+		if err != nil || n > maxBulkSize {
+			return Value{}, fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+		}
+		if n < 0 {
+			return NullBulk, nil
+		}
+		buf, err := r.readBulkPayload(n)
+		if err != nil {
+			return Value{}, err
+		}
+		return BulkBytes(buf), nil
+
+	case TypeArray, TypeSet, TypePush, TypeMap:
+		n, err := strconv.ParseInt(payload, 10, 64)
+		if err != nil || n > maxMultibulkSize {
+			return Value{}, fmt.Errorf("%w: invalid multibulk length", ErrProtocol)
+		}
+		if n < 0 {
+			return NullArray, nil
+		}
+		if t == TypeMap {
+			n *= 2
+		}
+		values := make([]Value, 0, n)
+		for i := int64(0); i < n; i++ {
+			v, err := r.ReadValue()
+			if err != nil {
+				return Value{}, err
+			}
+			values = append(values, v)
+		}
+		return Value{Type: t, Array: values}, nil
+
+	case TypeNull:
+		return Null, nil
+
+	case TypeDouble:
+		f, err := strconv.ParseFloat(payload, 64)
+		if err != nil {
+			return Value{}, fmt.Errorf("%w: invalid double", ErrProtocol)
+		}
+		return Double(f), nil
+
+	case TypeBoolean:
+		if payload != "t" && payload != "f" {
+			return Value{}, fmt.Errorf("%w: invalid boolean", ErrProtocol)
+		}
+		return Boolean(payload == "t"), nil
+
+	case TypeBigNumber:
+		return BigNumber(payload), nil
+
+	default:
+		return Value{}, fmt.Errorf("%w: unknown reply type %q", ErrProtocol, line[0])
+	}
+}
+
+func (r *Reader) readMultibulk() ([][]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+	if err != nil || n > maxMultibulkSize {
+		return nil, fmt.Errorf("%w: invalid multibulk length", ErrProtocol)
+	}
+
+	args := make([][]byte, 0, max(n, 0))
+	for i := int64(0); i < n; i++ {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != byte(TypeBulkString) {
+			return nil, fmt.Errorf("%w: expected '$', got '%s'", ErrProtocol, firstByte(line))
+		}
+
+		size, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil || size < 0 || size > maxBulkSize {
+			return nil, fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+		}
+
+		arg, err := r.readBulkPayload(size)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+
+	return args, nil
+}
+
+func (r *Reader) readInline() ([][]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	return SplitInline(line)
+}
+
+func (r *Reader) readBulkPayload(size int64) ([]byte, error) {
+	buf := make([]byte, size+2)
+	if _, err := io.ReadFull(r.rd, buf); err != nil {
+		return nil, err
+	}
+	if buf[size] != '\r' || buf[size+1] != '\n' {
+		return nil, fmt.Errorf("%w: bulk string is not terminated by CRLF", ErrProtocol)
+	}
+	return buf[:size:size], nil
+}
+
+func (r *Reader) readLine() ([]byte, error) {
+	line, err := r.rd.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		var buf []byte
+		buf = append(buf, line...)
+		for errors.Is(err, bufio.ErrBufferFull) {
+			if len(buf) > maxInlineSize {
+				return nil, fmt.Errorf("%w: too big inline request", ErrProtocol)
+			}
+			line, err = r.rd.ReadSlice('\n')
+			buf = append(buf, line...)
+		}
+		line = buf
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte{'\r'})
+	return bytes.Clone(line), nil
+}
+
+// SplitInline splits an inline command into its arguments the way redis-cli
+// does: arguments may be wrapped in double quotes, which understand \n, \r,
+// \t, \b, \a and \xHH escapes, or in single quotes, where only \' is special.
+func SplitInline(line []byte) ([][]byte, error) {
+	var args [][]byte
+
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var (
+			current = []byte{}
+			inDQ    bool
+			inSQ    bool
+			done    bool
+		)
+
+		for !done {
+			if i == len(line) {
+				if inDQ || inSQ {
+					return nil, errUnbalancedQuotes
+				}
+				break
+			}
+
+			c := line[i]
+			switch {
+			case inDQ:
+				switch {
+				case c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+					current = append(current, unhex(line[i+2])<<4|unhex(line[i+3]))
+					i += 3
+				case c == '\\' && i+1 < len(line):
+					i++
+					current = append(current, unescape(line[i]))
+				case c == '"':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errUnbalancedQuotes
+					}
+					done = true
+				default:
+					current = append(current, c)
+				}
+
+			case inSQ:
+				switch {
+				case c == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					i++
+					current = append(current, '\'')
+				case c == '\'':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errUnbalancedQuotes
+					}
+					done = true
+				default:
+					current = append(current, c)
+				}
+
+			default:
+				switch {
+				case isSpace(c):
+					done = true
+				case c == '"':
+					inDQ = true
+				case c == '\'':
+					inSQ = true
+				default:
+					current = append(current, c)
+				}
+			}
+			i++
+		}
+
+		args = append(args, current)
+	}
+}
+
+var errUnbalancedQuotes = fmt.Errorf("%w: unbalanced quotes in request", ErrProtocol)
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	default:
+		return c - '0'
+	}
+}
+
+func unescape(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	default:
+		return c
+	}
+}
+
+func firstByte(line []byte) string {
+	if len(line) == 0 {
+		return ""
+	}
+	return string(line[:1])
+}
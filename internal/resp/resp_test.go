@@ -0,0 +1,228 @@
+package resp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReader_ReadCommand(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$12\r\nhello\r\nworld\r\n" +
+		"\r\n" +
+		"GET key\r\n" +
+		"PING\n"
+
+	r := NewReader(strings.NewReader(input))
+
+	expected := [][]string{
+		{"SET", "key", "hello\r\nworld"},
+		{"GET", "key"},
+		{"PING"},
+	}
+
+	for _, want := range expected {
+		args, err := r.ReadCommand()
+		if err != nil {
+			t.Fatalf("ReadCommand() error: %v", err)
+		}
+
+		got := make([]string, len(args))
+		for i, arg := range args {
+			got[i] = string(arg)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ReadCommand() = %q, want %q", got, want)
+		}
+	}
+
+	if _, err := r.ReadCommand(); err != io.EOF {
+		t.Errorf("ReadCommand() error = %v, want EOF", err)
+	}
+}
+
+func TestReader_ProtocolErrors(t *testing.T) {
+	tests := []string{
+		"*x\r\n",
+		"*1\r\n+OK\r\n",
+		"*1\r\n$-5\r\n",
+		"*1\r\n$3\r\nabcd\r\n",
+	}
+
+	for _, input := range tests {
+		_, err := NewReader(strings.NewReader(input)).ReadCommand()
+		if !errors.Is(err, ErrProtocol) {
+			t.Errorf("ReadCommand(%q) error = %v, want protocol error", input, err)
+		}
+	}
+}
+
+func TestWriter_RoundTrip(t *testing.T) {
+	values := []Value{
+		OK,
+		Error("ERR something went wrong"),
+		Integer(-42),
+		BulkString("binary\x00\r\nsafe"),
+		BulkString(""),
+		NullBulk,
+		NullArray,
+		Array(),
+		Array(BulkString("a"), Integer(1), Array(NullBulk)),
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, v := range values {
+		if err := w.WriteValue(v); err != nil {
+			t.Fatalf("WriteValue() error: %v", err)
+		}
+	}
+	w.Flush()
+
+	r := NewReader(&buf)
+	for _, want := range values {
+		got, err := r.ReadValue()
+		if err != nil {
+			t.Fatalf("ReadValue() error: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ReadValue() = %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestWriter_Encoding(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteValue(Array(SimpleString("OK"), BulkString("hi"), NullBulk, Integer(7)))
+	w.Flush()
+
+	want := "*4\r\n+OK\r\n$2\r\nhi\r\n$-1\r\n:7\r\n"
+	if buf.String() != want {
+		t.Errorf("encoded = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestWriter_LazyArray(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteValue(LazyArray(3, func(yield func(Value) bool) {
+		for _, s := range []string{"a", "b", "c"} {
+			if !yield(BulkString(s)) {
+				return
+			}
+		}
+	}))
+	w.Flush()
+
+	want := "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n"
+	if buf.String() != want {
+		t.Errorf("encoded = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestWriter_ProtocolVersions(t *testing.T) {
+	reply := Array(
+		Map(BulkString("proto"), Integer(3)),
+		Set(BulkString("a")),
+		Double(1.5),
+		Boolean(true),
+		BigNumber("12345678901234567890"),
+		Null,
+		NullArray,
+	)
+
+	tests := []struct {
+		protocol int
+		want     string
+	}{
+		{2, "*7\r\n*2\r\n$5\r\nproto\r\n:3\r\n*1\r\n$1\r\na\r\n$3\r\n1.5\r\n:1\r\n" +
+			"$20\r\n12345678901234567890\r\n$-1\r\n*-1\r\n"},
+		{3, "*7\r\n%1\r\n$5\r\nproto\r\n:3\r\n~1\r\n$1\r\na\r\n,1.5\r\n#t\r\n" +
+			"(12345678901234567890\r\n_\r\n_\r\n"},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.SetProtocol(tt.protocol)
+		w.WriteValue(reply)
+		w.Flush()
+
+		if buf.String() != tt.want {
+			t.Errorf("RESP%d encoded = %q, want %q", tt.protocol, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestReader_ReadValueRESP3(t *testing.T) {
+	values := []Value{
+		Map(BulkString("k"), Double(-2.25)),
+		Set(Integer(1), Boolean(false)),
+		Push(BulkString("message")),
+		BigNumber("-1"),
+		Null,
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetProtocol(3)
+	for _, v := range values {
+		w.WriteValue(v)
+	}
+	w.Flush()
+
+	r := NewReader(&buf)
+	for _, want := range values {
+		got, err := r.ReadValue()
+		if err != nil {
+			t.Fatalf("ReadValue() error: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ReadValue() = %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestSplitInline(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{`SET key value`, []string{"SET", "key", "value"}},
+		{"  SET\tkey   value  ", []string{"SET", "key", "value"}},
+		{`SET greeting "hello   world"`, []string{"SET", "greeting", "hello   world"}},
+		{`SET k ""`, []string{"SET", "k", ""}},
+		{`SET k "a\nb\tc\"d\\e"`, []string{"SET", "k", "a\nb\tc\"d\\e"}},
+		{`SET k "\x00\xff\x41"`, []string{"SET", "k", "\x00\xffA"}},
+		{`SET k 'it\'s \n raw'`, []string{"SET", "k", `it's \n raw`}},
+		{`SET k ''`, []string{"SET", "k", ""}},
+		{`SET "my key" v`, []string{"SET", "my key", "v"}},
+		{`SET k pre"quoted part"`, []string{"SET", "k", "prequoted part"}},
+		{``, nil},
+	}
+
+	for _, tt := range tests {
+		args, err := SplitInline([]byte(tt.line))
+		if err != nil {
+			t.Errorf("SplitInline(%q) error: %v", tt.line, err)
+			continue
+		}
+
+		var got []string
+		for _, arg := range args {
+			got = append(got, string(arg))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitInline(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+
+	for _, line := range []string{`SET k "unterminated`, `SET k 'open`, `SET k "a"b`, `SET k 'a'b`} {
+		if _, err := SplitInline([]byte(line)); !errors.Is(err, ErrProtocol) {
+			t.Errorf("SplitInline(%q) error = %v, want protocol error", line, err)
+		}
+	}
+}
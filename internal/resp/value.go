@@ -0,0 +1,138 @@
+package resp
+
+import (
+	"fmt"
+	"iter"
+	"math"
+	"strconv"
+)
+
+type Type byte
+
+const (
+	TypeSimpleString Type = '+'
+	TypeError        Type = '-'
+	TypeInteger      Type = ':'
+	TypeBulkString   Type = '$'
+	TypeArray        Type = '*'
+
+	// RESP3 only types. When the connection speaks RESP2 they are downgraded
+	// to the closest RESP2 type by the Writer.
+	TypeNull      Type = '_'
+	TypeDouble    Type = ','
+	TypeBoolean   Type = '#'
+	TypeBigNumber Type = '('
+	TypeMap       Type = '%'
+	TypeSet       Type = '~'
+	TypePush      Type = '>'
+)
+
+type Value struct {
+	Type  Type
+	Str   string
+	Int   int64
+	Float float64
+	Bool  bool
+	// Array holds the elements of arrays, sets and pushes, and the flattened
+	// key/value pairs of maps.
+	Array []Value
+	Null  bool
+	// Elements generates the Int elements of an array instead of Array, for
+	// replies too long to be built in memory. The Writer writes them out as
+	// they are generated.
+	Elements iter.Seq[Value]
+}
+
+var (
+	OK        = SimpleString("OK")
+	Null      = Value{Type: TypeNull, Null: true}
+	NullBulk  = Value{Type: TypeBulkString, Null: true}
+	NullArray = Value{Type: TypeArray, Null: true}
+)
+
+func SimpleString(s string) Value {
+	return Value{Type: TypeSimpleString, Str: s}
+}
+
+func Error(msg string) Value {
+	return Value{Type: TypeError, Str: msg}
+}
+
+func Errorf(format string, args ...any) Value {
+	return Error(fmt.Sprintf(format, args...))
+}
+
+func Integer(n int64) Value {
+	return Value{Type: TypeInteger, Int: n}
+}
+
+func BulkString(s string) Value {
+	return Value{Type: TypeBulkString, Str: s}
+}
+
+func BulkBytes(b []byte) Value {
+	return Value{Type: TypeBulkString, Str: string(b)}
+}
+
+func Array(values ...Value) Value {
+	if values == nil {
+		values = []Value{}
+	}
+	return Value{Type: TypeArray, Array: values}
+}
+
+// LazyArray is an array of n elements generated as it is written out.
+func LazyArray(n int64, elements iter.Seq[Value]) Value {
+	return Value{Type: TypeArray, Int: n, Elements: elements}
+}
+
+func Double(f float64) Value {
+	return Value{Type: TypeDouble, Float: f}
+}
+
+func Boolean(b bool) Value {
+	return Value{Type: TypeBoolean, Bool: b}
+}
+
+func BigNumber(s string) Value {
+	return Value{Type: TypeBigNumber, Str: s}
+}
+
+// Map builds a map reply from alternating keys and values.
+func Map(pairs ...Value) Value {
+	if pairs == nil {
+		pairs = []Value{}
+	}
+	return Value{Type: TypeMap, Array: pairs}
+}
+
+func Set(values ...Value) Value {
+	if values == nil {
+		values = []Value{}
+	}
+	return Value{Type: TypeSet, Array: values}
+}
+
+func Push(values ...Value) Value {
+	if values == nil {
+		values = []Value{}
+	}
+	return Value{Type: TypePush, Array: values}
+}
+
+func (v Value) IsError() bool {
+	return v.Type == TypeError
+}
+
+// FormatDouble formats a float the way Redis does in replies and stored values.
+func FormatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
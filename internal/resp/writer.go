@@ -0,0 +1,170 @@
+package resp
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+)
+
+type Writer struct {
+	wr       *bufio.Writer
+	buf      []byte
+	protocol int
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		wr:       bufio.NewWriter(w),
+		buf:      make([]byte, 0, 32),
+		protocol: 2,
+	}
+}
+
+// SetProtocol selects between RESP2 and RESP3 encoding for subsequent replies.
+func (w *Writer) SetProtocol(version int) {
+	w.protocol = version
+}
+
+func (w *Writer) WriteValue(v Value) error {
+	switch v.Type {
+	case TypeSimpleString, TypeError:
+		return w.writeLine(v.Type, v.Str)
+
+	case TypeInteger:
+		return w.writeHeader(TypeInteger, v.Int)
+
+	case TypeBulkString:
+		if v.Null {
+			return w.writeNull(TypeBulkString)
+		}
+		return w.writeBulk(v.Str)
+
+	case TypeArray:
+		if v.Null {
+			return w.writeNull(TypeArray)
+		}
+		if v.Elements != nil {
+			return w.writeLazyArray(v)
+		}
+		return w.writeAggregate(TypeArray, v.Array, len(v.Array))
+
+	case TypeNull:
+		return w.writeNull(TypeBulkString)
+
+	case TypeDouble:
+		if w.protocol < 3 {
+			return w.writeBulk(FormatDouble(v.Float))
+		}
+		return w.writeLine(TypeDouble, FormatDouble(v.Float))
+
+	case TypeBoolean:
+		if w.protocol < 3 {
+			if v.Bool {
+				return w.writeHeader(TypeInteger, 1)
+			}
+			return w.writeHeader(TypeInteger, 0)
+		}
+		if v.Bool {
+			return w.writeLine(TypeBoolean, "t")
+		}
+		return w.writeLine(TypeBoolean, "f")
+
+	case TypeBigNumber:
+		if w.protocol < 3 {
+			return w.writeBulk(v.Str)
+		}
+		return w.writeLine(TypeBigNumber, v.Str)
+
+	case TypeMap:
+		if w.protocol < 3 {
+			return w.writeAggregate(TypeArray, v.Array, len(v.Array))
+		}
+		return w.writeAggregate(TypeMap, v.Array, len(v.Array)/2)
+
+	case TypeSet, TypePush:
+		if w.protocol < 3 {
+			return w.writeAggregate(TypeArray, v.Array, len(v.Array))
+		}
+		return w.writeAggregate(v.Type, v.Array, len(v.Array))
+
+	default:
+		return w.WriteValue(Errorf("ERR unsupported reply type %q", byte(v.Type)))
+	}
+}
+
+func (w *Writer) Flush() error {
+	return w.wr.Flush()
+}
+
+func (w *Writer) writeNull(resp2Type Type) error {
+	if w.protocol >= 3 {
+		_, err := w.wr.WriteString("_\r\n")
+		return err
+	}
+	return w.writeHeader(resp2Type, -1)
+}
+
+func (w *Writer) writeBulk(s string) error {
+	w.writeHeader(TypeBulkString, int64(len(s)))
+	w.wr.WriteString(s)
+	return w.writeCRLF()
+}
+
+func (w *Writer) writeAggregate(t Type, elems []Value, n int) error {
+	if err := w.writeHeader(t, int64(n)); err != nil {
+		return err
+	}
+	for _, elem := range elems {
+		if err := w.WriteValue(elem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Writer) writeLazyArray(v Value) error {
+	if err := w.writeHeader(TypeArray, v.Int); err != nil {
+		return err
+	}
+	for elem := range v.Elements {
+		if err := w.WriteValue(elem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Writer) writeLine(t Type, s string) error {
+	w.wr.WriteByte(byte(t))
+	w.wr.WriteString(s)
+	return w.writeCRLF()
+}
+
+func (w *Writer) writeHeader(t Type, n int64) error {
+	w.buf = append(w.buf[:0], byte(t))
+	w.buf = strconv.AppendInt(w.buf, n, 10)
+	w.buf = append(w.buf, '\r', '\n')
+	_, err := w.wr.Write(w.buf)
+	return err
+}
+
+func (w *Writer) writeCRLF() error {
+	_, err := w.wr.WriteString("\r\n")
+	return err
+}
+
+// AppendCommand appends args encoded as a RESP array of bulk strings, the form
+// in which clients send commands.
+func AppendCommand(dst []byte, args [][]byte) []byte {
+	dst = append(dst, byte(TypeArray))
+	dst = strconv.AppendInt(dst, int64(len(args)), 10)
+	dst = append(dst, '\r', '\n')
+	for _, arg := range args {
+		dst = append(dst, byte(TypeBulkString))
+		dst = strconv.AppendInt(dst, int64(len(arg)), 10)
+		dst = append(dst, '\r', '\n')
+		dst = append(dst, arg...)
+		dst = append(dst, '\r', '\n')
+	}
+	return dst
+}
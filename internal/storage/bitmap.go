@@ -0,0 +1,395 @@
+package storage
+
+import (
+	"math"
+	"math/bits"
+)
+
+// MaxBitOffset is the largest bit offset of a string, as its size is limited to
+// MaxStringSize.
+const MaxBitOffset = MaxStringSize*8 - 1
+
+// BitOperation is the operation of BITOP.
+type BitOperation int
+
+const (
+	BitAnd BitOperation = iota
+	BitOr
+	BitXor
+	BitNot
+)
+
+// BitFieldKind is the subcommand of a BITFIELD operation.
+type BitFieldKind int
+
+const (
+	BitFieldGet BitFieldKind = iota
+	BitFieldSet
+	BitFieldIncrBy
+)
+
+// BitFieldOverflow is the OVERFLOW policy of BITFIELD.
+type BitFieldOverflow int
+
+const (
+	OverflowWrap BitFieldOverflow = iota
+	OverflowSat
+	OverflowFail
+)
+
+// BitFieldOp is one GET, SET or INCRBY of BITFIELD on an integer of Bits bits
+// starting at bit Offset.
+type BitFieldOp struct {
+	Kind     BitFieldKind
+	Signed   bool
+	Bits     int
+	Offset   int64
+	Value    int64
+	Overflow BitFieldOverflow
+}
+
+// BitFieldResult is the reply to a BITFIELD operation. Failed is set when the
+// FAIL overflow policy prevented a SET or INCRBY.
+type BitFieldResult struct {
+	Value  int64
+	Failed bool
+}
+
+// SetBit sets or clears the bit at offset, growing the string with zero bytes
+// as needed, and returns the previous value of the bit. The string is changed
+// in place and keeps its TTL.
+func (s *MemoryStorage) SetBit(key string, offset int64, value bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	str, err := s.writableBits(key, offset)
+	if err != nil {
+		return false, err
+	}
+
+	old := getBit(str, offset)
+	setBit(str, offset, value)
+	return old, nil
+}
+
+func (s *MemoryStorage) GetBit(key string, offset int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	str, _, _, err := lookupValue[[]byte](s, key)
+	return getBit(str, offset), err
+}
+
+// BitCount counts the set bits between start and end inclusive, which are
+// byte offsets or, with bitUnit, bit offsets. Negative offsets count from the
+// end of the string.
+func (s *MemoryStorage) BitCount(key string, start, end int64, bitUnit bool) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	str, _, _, err := lookupValue[[]byte](s, key)
+	if err != nil {
+		return 0, err
+	}
+
+	from, to, ok := bitRange(str, start, end, bitUnit)
+	if !ok {
+		return 0, nil
+	}
+
+	var count int64
+	for from <= to && from%8 != 0 {
+		if getBit(str, from) {
+			count++
+		}
+		from++
+	}
+	for ; from+63 <= to; from += 64 {
+		i := from / 8
+		count += int64(bits.OnesCount64(uint64(str[i])<<56 | uint64(str[i+1])<<48 | uint64(str[i+2])<<40 | uint64(str[i+3])<<32 |
+			uint64(str[i+4])<<24 | uint64(str[i+5])<<16 | uint64(str[i+6])<<8 | uint64(str[i+7])))
+	}
+	for ; from+7 <= to; from += 8 {
+		count += int64(bits.OnesCount8(str[from/8]))
+	}
+	for ; from <= to; from++ {
+		if getBit(str, from) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// BitPos returns the position of the first bit set to bit between start and
+// end, like BitCount, or -1. When looking for a clear bit without an explicit
+// end the string is treated as padded with zeros, so the first bit past it
+// is returned if all bits in range are set.
+func (s *MemoryStorage) BitPos(key string, bit bool, start, end int64, endGiven, bitUnit bool) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	str, _, ok, err := lookupValue[[]byte](s, key)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		if bit {
+			return -1, nil
+		}
+		return 0, nil
+	}
+
+	from, to, ok := bitRange(str, start, end, bitUnit)
+	if !ok {
+		return -1, nil
+	}
+
+	// Whole bytes without the bit are skipped at once.
+	skip := byte(0)
+	if !bit {
+		skip = 0xff
+	}
+	for pos := from; pos <= to; pos++ {
+		if pos%8 == 0 && pos+7 <= to && str[pos/8] == skip {
+			pos += 7
+			continue
+		}
+		if getBit(str, pos) == bit {
+			return pos, nil
+		}
+	}
+
+	if !bit && !endGiven {
+		return to + 1, nil
+	}
+	return -1, nil
+}
+
+// BitOp stores at dst the result of op over the strings at keys, missing keys
+// being empty strings and shorter strings padded with zero bytes. NOT takes
+// a single key. It returns the length of the result; an empty result deletes
+// dst.
+func (s *MemoryStorage) BitOp(op BitOperation, dst string, keys []string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sources := make([][]byte, len(keys))
+	length := 0
+	for i, key := range keys {
+		str, _, _, err := lookupValue[[]byte](s, key)
+		if err != nil {
+			return 0, err
+		}
+		sources[i] = str
+		length = max(length, len(str))
+	}
+
+	result := make([]byte, length)
+	for i := range result {
+		var b byte
+		for j, src := range sources {
+			var v byte
+			if i < len(src) {
+				v = src[i]
+			}
+			switch {
+			case j == 0:
+				b = v
+			case op == BitAnd:
+				b &= v
+			case op == BitOr:
+				b |= v
+			case op == BitXor:
+				b ^= v
+			}
+		}
+		if op == BitNot {
+			b = ^b
+		}
+		result[i] = b
+	}
+
+	s.remove(dst)
+	if length > 0 {
+		s.setItem(dst, Item{Value: result, ExpiresAt: -1})
+	}
+	return int64(length), nil
+}
+
+// BitField runs the operations in order and returns their results. SET
+// replies with the previous value and INCRBY with the new one. Writes grow
+// the string to fit the highest field written, even if the FAIL overflow
+// policy then skips them.
+func (s *MemoryStorage) BitField(key string, ops []BitFieldOp) ([]BitFieldResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	highest := int64(-1)
+	for _, op := range ops {
+		if op.Kind != BitFieldGet {
+			highest = max(highest, op.Offset+int64(op.Bits)-1)
+		}
+	}
+
+	var (
+		str []byte
+		err error
+	)
+	if highest >= 0 {
+		str, err = s.writableBits(key, highest)
+	} else {
+		str, _, _, err = lookupValue[[]byte](s, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]BitFieldResult, len(ops))
+	for i, op := range ops {
+		old := getField(str, op.Offset, op.Bits, op.Signed)
+		switch op.Kind {
+		case BitFieldGet:
+			results[i].Value = old
+			continue
+		case BitFieldSet:
+			results[i].Value = old
+		}
+
+		value := op.Value
+		var (
+			limit      int64
+			overflowed bool
+		)
+		if op.Kind == BitFieldSet {
+			limit, overflowed = checkOverflow(op.Value, 0, op.Bits, op.Signed, op.Overflow)
+		} else {
+			value = old + op.Value
+			limit, overflowed = checkOverflow(old, op.Value, op.Bits, op.Signed, op.Overflow)
+		}
+
+		if overflowed {
+			if op.Overflow == OverflowFail {
+				results[i] = BitFieldResult{Failed: true}
+				continue
+			}
+			value = limit
+		}
+
+		setField(str, op.Offset, op.Bits, uint64(value))
+		if op.Kind == BitFieldIncrBy {
+			results[i].Value = value
+		}
+	}
+	return results, nil
+}
+
+// writableBits returns the string at key for in-place modification, creating
+// it or padding it with zero bytes so that it holds the bit at offset.
+// Callers must hold s.mu.
+func (s *MemoryStorage) writableBits(key string, offset int64) ([]byte, error) {
+	str, item, ok, err := lookupValue[[]byte](s, key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		item = Item{ExpiresAt: -1}
+	}
+
+	if size := int(offset/8) + 1; size > len(str) {
+		str = append(str, make([]byte, size-len(str))...)
+		item.Value = str
+		s.setItem(key, item)
+	}
+	return str, nil
+}
+
+// bitRange converts a BITCOUNT or BITPOS range into inclusive bit offsets.
+func bitRange(str []byte, start, end int64, bitUnit bool) (int64, int64, bool) {
+	length := int64(len(str))
+	if bitUnit {
+		return normalizeRange(start, end, length*8)
+	}
+	from, to, ok := normalizeRange(start, end, length)
+	return from * 8, to*8 + 7, ok
+}
+
+func getBit(str []byte, offset int64) bool {
+	i := offset / 8
+	return i < int64(len(str)) && str[i]&(0x80>>(offset%8)) != 0
+}
+
+func setBit(str []byte, offset int64, value bool) {
+	if value {
+		str[offset/8] |= 0x80 >> (offset % 8)
+	} else {
+		str[offset/8] &^= 0x80 >> (offset % 8)
+	}
+}
+
+// getField reads the big-endian integer of the given width at offset, bits
+// past the end of the string being zero.
+func getField(str []byte, offset int64, width int, signed bool) int64 {
+	var value uint64
+	for i := range int64(width) {
+		value <<= 1
+		if getBit(str, offset+i) {
+			value |= 1
+		}
+	}
+	if signed && width < 64 && value&(1<<(width-1)) != 0 {
+		value |= math.MaxUint64 << width
+	}
+	return int64(value)
+}
+
+func setField(str []byte, offset int64, width int, value uint64) {
+	for i := range int64(width) {
+		setBit(str, offset+i, value&(1<<(int64(width)-1-i)) != 0)
+	}
+}
+
+// checkOverflow reports whether value + incr does not fit an integer of the
+// given width and, unless the policy is FAIL, what to store instead: the sum
+// truncated to the width for WRAP, the closest bound for SAT.
+func checkOverflow(value, incr int64, width int, signed bool, policy BitFieldOverflow) (int64, bool) {
+	var overflow, underflow bool
+	var lower, upper int64
+
+	if signed {
+		upper = math.MaxInt64
+		if width < 64 {
+			upper = 1<<(width-1) - 1
+		}
+		lower = -upper - 1
+		// For 64-bit fields the bounds minus a value of the other sign would
+		// overflow, and such sums cannot overflow anyway.
+		overflow = value > upper || (incr > 0 && (width < 64 || value >= 0) && incr > upper-value)
+		underflow = !overflow && (value < lower || (incr < 0 && (width < 64 || value < 0) && incr < lower-value))
+	} else {
+		// Unsigned fields are at most 63 bits wide, values outside them come
+		// from SET with a negative or too large value.
+		upper = 1<<width - 1
+		overflow = uint64(value) > uint64(upper) || (incr > 0 && incr > upper-value)
+		underflow = !overflow && incr < 0 && incr < -value
+	}
+
+	switch {
+	case !overflow && !underflow:
+		return 0, false
+	case policy == OverflowWrap:
+		sum := uint64(value) + uint64(incr)
+		if width < 64 {
+			mask := uint64(math.MaxUint64) << width
+			if signed && sum&(1<<(width-1)) != 0 {
+				sum |= mask
+			} else {
+				sum &^= mask
+			}
+		}
+		return int64(sum), true
+	case overflow:
+		return upper, true
+	default:
+		return lower, true
+	}
+}
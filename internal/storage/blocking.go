@@ -0,0 +1,42 @@
+package storage
+
+// WatchKeys registers a blocked client interested in the keys. The returned
+// channel receives a notification whenever one of them may have become ready,
+// after which the client retries its command. cancel must be called once the
+// client stops waiting.
+func (s *MemoryStorage) WatchKeys(keys []string) (ready <-chan struct{}, cancel func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch := make(chan struct{}, 1)
+	for _, key := range keys {
+		if s.watchers[key] == nil {
+			s.watchers[key] = make(map[chan struct{}]struct{})
+		}
+		s.watchers[key][ch] = struct{}{}
+	}
+
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		for _, key := range keys {
+			delete(s.watchers[key], ch)
+			if len(s.watchers[key]) == 0 {
+				delete(s.watchers, key)
+			}
+		}
+	}
+}
+
+// signalKeyAsReady wakes the clients blocked on key. Every one of them is
+// woken, those that lose the race for the data go back to waiting. Callers
+// must hold s.mu.
+func (s *MemoryStorage) signalKeyAsReady(key string) {
+	for ch := range s.watchers[key] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
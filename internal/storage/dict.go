@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"hash/maphash"
+	"iter"
+	"math/bits"
+	"math/rand/v2"
+)
+
+// dict is a hash table that can be scanned with a cursor, which Go maps can
+// not as they do not expose their buckets. It indexes the keyspace and holds
+// the members of hashes, sets and sorted sets. Like the dict of Redis, it is
+// a chained hash table with a power of two number of buckets that rehashes
+// incrementally, and it uses the same reverse binary cursor: the cursor is
+// incremented from its most significant bit, so the buckets already visited
+// stay visited when the table grows or shrinks and every key present for the
+// whole scan is returned at least once. A nil dict is empty.
+type dict[V any] struct {
+	seed maphash.Seed
+	// tables[1] is only used while rehashing, when the buckets of tables[0]
+	// below rehashIdx have been moved to it.
+	tables    [2][]*dictEntry[V]
+	rehashIdx int
+	count     int
+}
+
+type dictEntry[V any] struct {
+	key   string
+	value V
+	next  *dictEntry[V]
+}
+
+const (
+	dictMinSize = 4
+	// dictRehashEmptyVisits bounds the empty buckets a rehash step skips.
+	dictRehashEmptyVisits = 10
+	// dictRandomSample is how many entries random picks one of.
+	dictRandomSample = 15
+)
+
+func newDict[V any]() *dict[V] {
+	return &dict[V]{
+		seed:      maphash.MakeSeed(),
+		tables:    [2][]*dictEntry[V]{make([]*dictEntry[V], dictMinSize)},
+		rehashIdx: -1,
+	}
+}
+
+func (d *dict[V]) hash(key string) uint64 {
+	return maphash.String(d.seed, key)
+}
+
+func (d *dict[V]) rehashing() bool {
+	return d.rehashIdx >= 0
+}
+
+func (d *dict[V]) len() int {
+	if d == nil {
+		return 0
+	}
+	return d.count
+}
+
+func (d *dict[V]) find(key string) *dictEntry[V] {
+	if d.len() == 0 {
+		return nil
+	}
+
+	h := d.hash(key)
+	for _, table := range d.tables {
+		if table == nil {
+			continue
+		}
+		for e := table[h&uint64(len(table)-1)]; e != nil; e = e.next {
+			if e.key == key {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+func (d *dict[V]) get(key string) (V, bool) {
+	if e := d.find(key); e != nil {
+		return e.value, true
+	}
+	var zero V
+	return zero, false
+}
+
+func (d *dict[V]) has(key string) bool {
+	return d.find(key) != nil
+}
+
+// set stores the value at key and reports whether the key was added.
+func (d *dict[V]) set(key string, value V) bool {
+	d.rehashStep()
+	if e := d.find(key); e != nil {
+		e.value = value
+		return false
+	}
+	d.resizeIfNeeded()
+
+	table := d.tables[0]
+	if d.rehashing() {
+		table = d.tables[1]
+	}
+	i := d.hash(key) & uint64(len(table)-1)
+	table[i] = &dictEntry[V]{key: key, value: value, next: table[i]}
+	d.count++
+	return true
+}
+
+// delete removes the key and reports whether it was present.
+func (d *dict[V]) delete(key string) bool {
+	if d.len() == 0 {
+		return false
+	}
+	d.rehashStep()
+
+	h := d.hash(key)
+	for n := range d.tables {
+		table := d.tables[n]
+		if table == nil {
+			continue
+		}
+		for link := &table[h&uint64(len(table)-1)]; *link != nil; link = &(*link).next {
+			if (*link).key == key {
+				*link = (*link).next
+				d.count--
+				d.resizeIfNeeded()
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// all iterates over the entries, which must not be added or deleted meanwhile.
+func (d *dict[V]) all() iter.Seq2[string, V] {
+	return func(yield func(string, V) bool) {
+		if d == nil {
+			return
+		}
+		for _, table := range d.tables {
+			for _, e := range table {
+				for ; e != nil; e = e.next {
+					if !yield(e.key, e.value) {
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+// keys returns the keys as byte slices.
+func (d *dict[V]) keys() [][]byte {
+	keys := make([][]byte, 0, d.len())
+	for key := range d.all() {
+		keys = append(keys, []byte(key))
+	}
+	return keys
+}
+
+// random returns a random entry of a non-empty dict. Like Redis, it picks
+// one of the entries of the buckets that follow a random one, until it has
+// dictRandomSample of them: picking within a single bucket would favour the
+// entries of the shorter chains.
+func (d *dict[V]) random() *dictEntry[V] {
+	buckets := len(d.tables[0]) + len(d.tables[1])
+	var sample []*dictEntry[V]
+	for i := rand.IntN(buckets); len(sample) < dictRandomSample; i = (i + 1) % buckets {
+		table, j := d.tables[0], i
+		if j >= len(table) {
+			table, j = d.tables[1], j-len(table)
+		}
+		for e := table[j]; e != nil; e = e.next {
+			sample = append(sample, e)
+		}
+		if len(sample) == d.count {
+			break
+		}
+	}
+	return sample[rand.IntN(len(sample))]
+}
+
+// resizeIfNeeded starts a rehash when the table is full, or mostly empty.
+func (d *dict[V]) resizeIfNeeded() {
+	if d.rehashing() {
+		return
+	}
+
+	size := len(d.tables[0])
+	switch {
+	case d.count >= size:
+		d.tables[1] = make([]*dictEntry[V], 2*size)
+	case size > dictMinSize && d.count*8 < size:
+		d.tables[1] = make([]*dictEntry[V], max(dictMinSize, 1<<bits.Len(uint(d.count))))
+	default:
+		return
+	}
+	d.rehashIdx = 0
+}
+
+// rehashStep moves one bucket to the new table, skipping a few empty ones.
+func (d *dict[V]) rehashStep() {
+	if !d.rehashing() {
+		return
+	}
+
+	old, table := d.tables[0], d.tables[1]
+	for visits := 0; d.rehashIdx < len(old); d.rehashIdx++ {
+		if old[d.rehashIdx] == nil {
+			if visits++; visits == dictRehashEmptyVisits {
+				d.rehashIdx++
+				return
+			}
+			continue
+		}
+
+		for e := old[d.rehashIdx]; e != nil; {
+			next := e.next
+			i := d.hash(e.key) & uint64(len(table)-1)
+			e.next = table[i]
+			table[i] = e
+			e = next
+		}
+		old[d.rehashIdx] = nil
+		d.rehashIdx++
+		break
+	}
+
+	if d.rehashIdx == len(old) {
+		d.tables = [2][]*dictEntry[V]{table}
+		d.rehashIdx = -1
+	}
+}
+
+// scan calls fn with the entries in the bucket at cursor and returns the next
+// cursor, zero once the whole table has been visited. While rehashing, the
+// buckets of the larger table that the bucket of the smaller one expands to
+// are visited too.
+func (d *dict[V]) scan(cursor uint64, fn func(key string, value V)) uint64 {
+	if d.len() == 0 {
+		return 0
+	}
+
+	visit := func(table []*dictEntry[V], i uint64) {
+		for e := table[i]; e != nil; e = e.next {
+			fn(e.key, e.value)
+		}
+	}
+
+	if !d.rehashing() {
+		mask := uint64(len(d.tables[0]) - 1)
+		visit(d.tables[0], cursor&mask)
+		return nextCursor(cursor, mask)
+	}
+
+	small, large := d.tables[0], d.tables[1]
+	if len(small) > len(large) {
+		small, large = large, small
+	}
+	smallMask, largeMask := uint64(len(small)-1), uint64(len(large)-1)
+
+	visit(small, cursor&smallMask)
+	for {
+		visit(large, cursor&largeMask)
+		cursor = nextCursor(cursor, largeMask)
+		if cursor&(smallMask^largeMask) == 0 {
+			return cursor
+		}
+	}
+}
+
+// nextCursor increments the bits of the cursor covered by mask in reverse
+// order.
+func nextCursor(cursor, mask uint64) uint64 {
+	cursor |= ^mask
+	return bits.Reverse64(bits.Reverse64(cursor) + 1)
+}
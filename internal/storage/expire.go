@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	// Parameters of the active expiry cycle, the same ones Redis uses: every
+	// iteration samples activeExpireSample keys with a TTL and the cycle keeps
+	// going while more than activeExpireAcceptable percent of them were expired,
+	// spending at most activeExpireTimePercent of each tick.
+	activeExpireSample      = 20
+	activeExpireAcceptable  = 25
+	activeExpireTimePercent = 25
+)
+
+// StartActiveExpire runs the active expiry cycle hz times per second in the
+// background until StopActiveExpire is called. Without it expired keys are
+// only removed when they are accessed.
+func (s *MemoryStorage) StartActiveExpire(hz int) {
+	if hz <= 0 {
+		return
+	}
+
+	s.stopExpire = make(chan struct{})
+	s.expireDone = make(chan struct{})
+
+	interval := time.Second / time.Duration(hz)
+	budget := interval * activeExpireTimePercent / 100
+
+	go func() {
+		defer close(s.expireDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.activeExpireCycle(budget)
+			case <-s.stopExpire:
+				return
+			}
+		}
+	}()
+}
+
+func (s *MemoryStorage) StopActiveExpire() {
+	if s.stopExpire == nil {
+		return
+	}
+	close(s.stopExpire)
+	<-s.expireDone
+	s.stopExpire = nil
+}
+
+// activeExpireCycle deletes expired keys found by random sampling and returns
+// how many were removed. The lock is released between iterations so clients
+// are not stalled by a large batch of expiring keys.
+func (s *MemoryStorage) activeExpireCycle(budget time.Duration) int {
+	start := time.Now()
+	total := 0
+
+	for {
+		sampled, expired := s.activeExpireIteration()
+		total += expired
+
+		if sampled == 0 || expired*100 <= sampled*activeExpireAcceptable {
+			return total
+		}
+		if time.Since(start) > budget {
+			return total
+		}
+	}
+}
+
+func (s *MemoryStorage) activeExpireIteration() (sampled, expired int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	for sampled < activeExpireSample && s.expires.len() > 0 {
+		sampled++
+
+		key := s.expires.random()
+		if s.data[key].expired(now) {
+			s.remove(key)
+			expired++
+		}
+	}
+
+	return sampled, expired
+}
+
+// keySet is a set of keys that supports picking a uniformly random member,
+// which Go maps can not do: ranging over a map only randomizes where the
+// iteration starts.
+type keySet struct {
+	keys  []string
+	index map[string]int
+}
+
+func newKeySet() *keySet {
+	return &keySet{index: make(map[string]int)}
+}
+
+func (ks *keySet) add(key string) {
+	if _, ok := ks.index[key]; ok {
+		return
+	}
+	ks.index[key] = len(ks.keys)
+	ks.keys = append(ks.keys, key)
+}
+
+func (ks *keySet) remove(key string) {
+	i, ok := ks.index[key]
+	if !ok {
+		return
+	}
+
+	last := len(ks.keys) - 1
+	ks.keys[i] = ks.keys[last]
+	ks.index[ks.keys[i]] = i
+	ks.keys = ks.keys[:last]
+	delete(ks.index, key)
+}
+
+func (ks *keySet) len() int {
+	return len(ks.keys)
+}
+
+func (ks *keySet) random() string {
+	return ks.keys[rand.IntN(len(ks.keys))]
+}
@@ -0,0 +1,367 @@
+package storage
+
+import (
+	"cmp"
+	"errors"
+	"math"
+	"slices"
+)
+
+// Positions are stored in sorted sets with a 52 bit geohash as the score, as
+// in Redis: 26 bits of latitude and 26 of longitude, interleaved so that
+// nearby points tend to have close scores. Latitudes are limited to the range
+// of Web Mercator, which is also used to encode them.
+const (
+	GeoLonMin = -180
+	GeoLonMax = 180
+	GeoLatMin = -85.05112878
+	GeoLatMax = 85.05112878
+
+	geoStep         = 26
+	geoEarthRadiusM = 6372797.560856
+)
+
+var ErrGeoMemberNotFound = errors.New("could not decode requested zset member")
+
+// GeoSort is the order of GEOSEARCH results by distance.
+type GeoSort int
+
+const (
+	GeoUnsorted GeoSort = iota
+	GeoAsc
+	GeoDesc
+)
+
+// GeoSearchSpec describes a GEOSEARCH query. The center is the position of
+// FromMember when it is set and Lon, Lat otherwise. The area is a circle of
+// Radius or, with ByBox, a Width by Height rectangle, in units of Unit meters.
+// At most Count results are returned when it is positive: the closest ones,
+// or with Any the first ones found.
+type GeoSearchSpec struct {
+	FromMember    []byte
+	Lon, Lat      float64
+	ByBox         bool
+	Radius        float64
+	Width, Height float64
+	Unit          float64
+	Sort          GeoSort
+	Count         int64
+	Any           bool
+}
+
+// GeoResult is a member found by GEOSEARCH with its score, its position and
+// its distance from the center in the unit of the query.
+type GeoResult struct {
+	Member   []byte
+	Score    float64
+	Dist     float64
+	Lon, Lat float64
+}
+
+// ValidGeoPosition reports whether a position can be encoded.
+func ValidGeoPosition(lon, lat float64) bool {
+	return lon >= GeoLonMin && lon <= GeoLonMax && lat >= GeoLatMin && lat <= GeoLatMax
+}
+
+// GeoEncode returns the score of a valid position.
+func GeoEncode(lon, lat float64) float64 {
+	return float64(geohashEncode(lon, lat, GeoLatMin, GeoLatMax, geoStep))
+}
+
+// GeoDecode returns the center of the cell a score stands for.
+func GeoDecode(score float64) (lon, lat float64) {
+	bits := uint64(score)
+	latCell, lonCell := squash(bits), squash(bits>>1)
+	cells := float64(uint64(1) << geoStep)
+
+	lonMin := GeoLonMin + float64(lonCell)/cells*(GeoLonMax-GeoLonMin)
+	lonMax := GeoLonMin + float64(lonCell+1)/cells*(GeoLonMax-GeoLonMin)
+	latMin := GeoLatMin + float64(latCell)/cells*(GeoLatMax-GeoLatMin)
+	latMax := GeoLatMin + float64(latCell+1)/cells*(GeoLatMax-GeoLatMin)
+	return min(max((lonMin+lonMax)/2, GeoLonMin), GeoLonMax), min(max((latMin+latMax)/2, GeoLatMin), GeoLatMax)
+}
+
+// GeoHashString returns the standard 11 character geohash of the position a
+// score stands for. It is encoded again with the full latitude range, and
+// the last character, for which there are no bits left, is always '0'.
+func GeoHashString(score float64) string {
+	const alphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+	lon, lat := GeoDecode(score)
+	bits := geohashEncode(lon, lat, -90, 90, geoStep)
+
+	hash := make([]byte, 11)
+	for i := range 10 {
+		hash[i] = alphabet[bits>>(52-(i+1)*5)&0x1f]
+	}
+	hash[10] = alphabet[0]
+	return string(hash)
+}
+
+// GeoDistance returns the distance in meters between two positions along the
+// surface of the Earth, using the haversine formula.
+func GeoDistance(lon1, lat1, lon2, lat2 float64) float64 {
+	v := math.Sin(degToRad(lon2-lon1) / 2)
+	if v == 0 {
+		return geoEarthRadiusM * math.Abs(degToRad(lat2)-degToRad(lat1))
+	}
+	u := math.Sin(degToRad(lat2-lat1) / 2)
+	a := u*u + math.Cos(degToRad(lat1))*math.Cos(degToRad(lat2))*v*v
+	return 2 * geoEarthRadiusM * math.Asin(math.Sqrt(a))
+}
+
+// ZMScore returns the scores of members, found reporting which exist.
+func (s *MemoryStorage) ZMScore(key string, members [][]byte) (scores []float64, found []bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	z, ok, err := lookupZset(s, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scores = make([]float64, len(members))
+	found = make([]bool, len(members))
+	if ok {
+		for i, member := range members {
+			scores[i], found[i] = z.dict.get(string(member))
+		}
+	}
+	return scores, found, nil
+}
+
+func (s *MemoryStorage) GeoSearch(key string, spec GeoSearchSpec) ([]GeoResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	z, ok, err := lookupZset(s, key)
+	if !ok {
+		return nil, err
+	}
+	return z.geoSearch(spec)
+}
+
+// GeoSearchStore stores the result of GeoSearch at dst, replacing any value
+// there, and returns its size. Members keep their scores or, with storeDist,
+// get their distance as the score. An empty result deletes dst.
+func (s *MemoryStorage) GeoSearchStore(dst, src string, spec GeoSearchSpec, storeDist bool) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	z, ok, err := lookupZset(s, src)
+	if err != nil {
+		return 0, err
+	}
+
+	var results []GeoResult
+	if ok {
+		if results, err = z.geoSearch(spec); err != nil {
+			return 0, err
+		}
+	}
+
+	result := newZset()
+	for _, r := range results {
+		if storeDist {
+			result.set(string(r.Member), r.Dist)
+		} else {
+			result.set(string(r.Member), r.Score)
+		}
+	}
+	s.storeZset(dst, result)
+	return int64(result.len()), nil
+}
+
+// geoSearch looks for members in the cells around the center that cover the
+// area and keeps those actually inside it.
+func (z *zset) geoSearch(spec GeoSearchSpec) ([]GeoResult, error) {
+	lon, lat := spec.Lon, spec.Lat
+	if spec.FromMember != nil {
+		score, ok := z.dict.get(string(spec.FromMember))
+		if !ok {
+			return nil, ErrGeoMemberNotFound
+		}
+		lon, lat = GeoDecode(score)
+	}
+
+	var results []GeoResult
+	limited := spec.Count > 0 && spec.Any
+	for _, r := range geoCoverRanges(lon, lat, spec) {
+		for node := z.zsl.firstInRange(r); node != nil && r.belowMax(node.score); node = node.level[0].forward {
+			pointLon, pointLat := GeoDecode(node.score)
+			dist, ok := geoInArea(lon, lat, pointLon, pointLat, spec)
+			if !ok {
+				continue
+			}
+
+			results = append(results, GeoResult{
+				Member: []byte(node.member),
+				Score:  node.score,
+				Dist:   dist / spec.Unit,
+				Lon:    pointLon,
+				Lat:    pointLat,
+			})
+			if limited && int64(len(results)) == spec.Count {
+				break
+			}
+		}
+		if limited && int64(len(results)) == spec.Count {
+			break
+		}
+	}
+
+	// Without ANY, COUNT returns the closest members.
+	order := spec.Sort
+	if order == GeoUnsorted && spec.Count > 0 && !spec.Any {
+		order = GeoAsc
+	}
+	switch order {
+	case GeoAsc:
+		slices.SortStableFunc(results, func(a, b GeoResult) int { return cmp.Compare(a.Dist, b.Dist) })
+	case GeoDesc:
+		slices.SortStableFunc(results, func(a, b GeoResult) int { return cmp.Compare(b.Dist, a.Dist) })
+	}
+
+	if spec.Count > 0 && int64(len(results)) > spec.Count {
+		results = results[:spec.Count]
+	}
+	return results, nil
+}
+
+// geoInArea returns the distance in meters of a point from the center and
+// whether it is inside the area. Box widths are measured along the parallel
+// of the point.
+func geoInArea(lon, lat, pointLon, pointLat float64, spec GeoSearchSpec) (float64, bool) {
+	if !spec.ByBox {
+		dist := GeoDistance(lon, lat, pointLon, pointLat)
+		return dist, dist <= spec.Radius*spec.Unit
+	}
+
+	if geoEarthRadiusM*math.Abs(degToRad(pointLat)-degToRad(lat)) > spec.Height*spec.Unit/2 {
+		return 0, false
+	}
+	if GeoDistance(pointLon, pointLat, lon, pointLat) > spec.Width*spec.Unit/2 {
+		return 0, false
+	}
+	return GeoDistance(lon, lat, pointLon, pointLat), true
+}
+
+// geoCoverRanges returns the score ranges of the cell holding the center and
+// its neighbors, at the finest step where a cell is at least as large as the
+// distance in degrees from the center to the edges of the area, so that the
+// nine cells cover it.
+func geoCoverRanges(lon, lat float64, spec GeoSearchSpec) []ScoreRange {
+	var dLat, dLon float64
+	if spec.ByBox {
+		dLat = radToDeg(spec.Height * spec.Unit / 2 / geoEarthRadiusM)
+		dLon = geoLonExtent(lat, dLat, spec.Width*spec.Unit/4/geoEarthRadiusM, true)
+	} else {
+		dLat = radToDeg(spec.Radius * spec.Unit / geoEarthRadiusM)
+		dLon = geoLonExtent(lat, dLat, spec.Radius*spec.Unit/geoEarthRadiusM, false)
+	}
+	// Leave room for rounding errors.
+	dLat, dLon = dLat*1.0001, dLon*1.0001
+
+	step := geoStep
+	for step > 0 && ((GeoLatMax-GeoLatMin)/float64(uint64(1)<<step) < dLat || (GeoLonMax-GeoLonMin)/float64(uint64(1)<<step) < dLon) {
+		step--
+	}
+	if step == 0 {
+		return []ScoreRange{{Min: 0, Max: 1 << (2 * geoStep), MaxExclusive: true}}
+	}
+
+	cells := int64(1) << step
+	bits := uint64(geohashEncode(lon, lat, GeoLatMin, GeoLatMax, step))
+	latCell, lonCell := int64(squash(bits)), int64(squash(bits>>1))
+	shift := 2 * (geoStep - step)
+
+	var ranges []ScoreRange
+	seen := make(map[uint64]bool)
+	for dy := int64(-1); dy <= 1; dy++ {
+		y := latCell + dy
+		if y < 0 || y >= cells {
+			continue
+		}
+		for dx := int64(-1); dx <= 1; dx++ {
+			x := (lonCell + dx + cells) % cells
+			cell := spread(uint32(y)) | spread(uint32(x))<<1
+			if seen[cell] {
+				continue
+			}
+			seen[cell] = true
+			ranges = append(ranges, ScoreRange{
+				Min:          float64(cell << shift),
+				Max:          float64((cell + 1) << shift),
+				MaxExclusive: true,
+			})
+		}
+	}
+	return ranges
+}
+
+// geoLonExtent returns how far in longitude degrees the area reaches from a
+// center at lat, for a circle of the given angular radius or, with box, a box
+// reaching dLat degrees north and south whose half-width along a parallel is
+// twice angle. It is the whole circle of longitudes when the area gets too
+// close to a pole.
+func geoLonExtent(lat, dLat, angle float64, box bool) float64 {
+	maxLat := math.Abs(lat) + dLat
+	if maxLat >= 90 {
+		return GeoLonMax - GeoLonMin
+	}
+
+	var extent float64
+	if box {
+		arg := math.Sin(angle) / math.Cos(degToRad(maxLat))
+		if angle >= math.Pi/2 || arg >= 1 {
+			return GeoLonMax - GeoLonMin
+		}
+		extent = 2 * math.Asin(arg)
+	} else {
+		arg := math.Sin(angle) / math.Cos(degToRad(lat))
+		if arg >= 1 {
+			return GeoLonMax - GeoLonMin
+		}
+		extent = math.Asin(arg)
+	}
+	return radToDeg(extent)
+}
+
+// geohashEncode interleaves the offsets of the position in its cell grid at
+// the given step, latitude bits in the even positions.
+func geohashEncode(lon, lat, latMin, latMax float64, step int) uint64 {
+	cells := float64(uint64(1) << step)
+	latCell := min(uint32((lat-latMin)/(latMax-latMin)*cells), uint32(cells)-1)
+	lonCell := min(uint32((lon-GeoLonMin)/(GeoLonMax-GeoLonMin)*cells), uint32(cells)-1)
+	return spread(latCell) | spread(lonCell)<<1
+}
+
+// spread moves the bits of v to the even positions of the result.
+func spread(v uint32) uint64 {
+	x := uint64(v)
+	x = (x | x<<16) & 0x0000ffff0000ffff
+	x = (x | x<<8) & 0x00ff00ff00ff00ff
+	x = (x | x<<4) & 0x0f0f0f0f0f0f0f0f
+	x = (x | x<<2) & 0x3333333333333333
+	x = (x | x<<1) & 0x5555555555555555
+	return x
+}
+
+// squash is the inverse of spread, ignoring the odd bits.
+func squash(x uint64) uint32 {
+	x &= 0x5555555555555555
+	x = (x | x>>1) & 0x3333333333333333
+	x = (x | x>>2) & 0x0f0f0f0f0f0f0f0f
+	x = (x | x>>4) & 0x00ff00ff00ff00ff
+	x = (x | x>>8) & 0x0000ffff0000ffff
+	x = (x | x>>16) & 0x00000000ffffffff
+	return uint32(x)
+}
+
+func degToRad(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func radToDeg(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
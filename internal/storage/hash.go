@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"strconv"
+)
+
+// hash is a dict of fields and their values.
+type hash = dict[[]byte]
+
+var (
+	ErrHashNotInteger = errors.New("hash value is not an integer")
+	ErrHashNotFloat   = errors.New("hash value is not a float")
+)
+
+// HSet stores the field/value pairs in the hash at key, creating it if
+// needed, and returns how many fields were added.
+func (s *MemoryStorage) HSet(key string, fields []string, values [][]byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, err := s.writableHash(key)
+	if err != nil {
+		return 0, err
+	}
+
+	var added int64
+	for i, field := range fields {
+		if h.set(field, bytes.Clone(values[i])) {
+			added++
+		}
+	}
+	return added, nil
+}
+
+// HSetNX stores the field only if it does not exist yet.
+func (s *MemoryStorage) HSetNX(key, field string, value []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok, err := lookupHash(s, key)
+	if err != nil {
+		return false, err
+	}
+	if ok && h.has(field) {
+		return false, nil
+	}
+
+	if h, err = s.writableHash(key); err != nil {
+		return false, err
+	}
+	h.set(field, bytes.Clone(value))
+	return true, nil
+}
+
+func (s *MemoryStorage) HGet(key, field string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, _, err := lookupHash(s, key)
+	if err != nil {
+		return nil, false, err
+	}
+	value, ok := h.get(field)
+	return bytes.Clone(value), ok, nil
+}
+
+// HMGet returns the values of the fields, with nil for missing ones.
+func (s *MemoryStorage) HMGet(key string, fields ...string) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, _, err := lookupHash(s, key)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([][]byte, len(fields))
+	for i, field := range fields {
+		if value, ok := h.get(field); ok {
+			values[i] = bytes.Clone(value)
+		}
+	}
+	return values, nil
+}
+
+// HDel removes the fields and returns how many existed. The key is deleted
+// together with its last field.
+func (s *MemoryStorage) HDel(key string, fields ...string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok, err := lookupHash(s, key)
+	if !ok {
+		return 0, err
+	}
+
+	var deleted int64
+	for _, field := range fields {
+		if h.delete(field) {
+			deleted++
+		}
+	}
+
+	if h.len() == 0 {
+		s.remove(key)
+	}
+	return deleted, nil
+}
+
+func (s *MemoryStorage) HExists(key, field string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, _, err := lookupHash(s, key)
+	return h.has(field), err
+}
+
+func (s *MemoryStorage) HLen(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, _, err := lookupHash(s, key)
+	return int64(h.len()), err
+}
+
+func (s *MemoryStorage) HStrLen(key, field string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, _, err := lookupHash(s, key)
+	value, _ := h.get(field)
+	return int64(len(value)), err
+}
+
+// HGetAll returns the fields and their values in matching order.
+func (s *MemoryStorage) HGetAll(key string) ([]string, [][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, _, err := lookupHash(s, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fields := make([]string, 0, h.len())
+	values := make([][]byte, 0, h.len())
+	for field, value := range h.all() {
+		fields = append(fields, field)
+		values = append(values, bytes.Clone(value))
+	}
+	return fields, values, nil
+}
+
+// HIncrBy adds delta to the integer stored in the field, treating a missing
+// field as zero.
+func (s *MemoryStorage) HIncrBy(key, field string, delta int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, _, err := lookupHash(s, key)
+	if err != nil {
+		return 0, err
+	}
+
+	var value int64
+	if current, ok := h.get(field); ok {
+		if value, err = parseInteger(current); err != nil {
+			return 0, ErrHashNotInteger
+		}
+	}
+
+	if value, err = addInteger(value, delta); err != nil {
+		return 0, err
+	}
+
+	if h, err = s.writableHash(key); err != nil {
+		return 0, err
+	}
+	h.set(field, strconv.AppendInt(nil, value, 10))
+	return value, nil
+}
+
+// HIncrByFloat is IncrementFloat for a hash field.
+func (s *MemoryStorage) HIncrByFloat(key, field string, delta *big.Float) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, _, err := lookupHash(s, key)
+	if err != nil {
+		return nil, err
+	}
+
+	current, ok := h.get(field)
+	result, err := addLongDouble(current, ok, delta)
+	if errors.Is(err, ErrNotFloat) {
+		return nil, ErrHashNotFloat
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if h, err = s.writableHash(key); err != nil {
+		return nil, err
+	}
+	h.set(field, result)
+	return bytes.Clone(result), nil
+}
+
+func lookupHash(s *MemoryStorage, key string) (*hash, bool, error) {
+	h, _, ok, err := lookupValue[*hash](s, key)
+	return h, ok, err
+}
+
+// writableHash returns the hash at key for modification, storing an empty
+// one without a TTL if the key does not exist. Callers must hold s.mu.
+func (s *MemoryStorage) writableHash(key string) (*hash, error) {
+	h, ok, err := lookupHash(s, key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		h = newDict[[]byte]()
+		s.setItem(key, Item{Value: h, ExpiresAt: -1})
+	}
+	return h, nil
+}
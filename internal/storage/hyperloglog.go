@@ -0,0 +1,418 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// HyperLogLogs are stored as strings in the format Redis uses, so that values
+// can be moved between the two with GET and SET. A 16 byte header holds the
+// "HYLL" magic, the encoding and a cached cardinality, whose most significant
+// bit marks it as stale. It is followed by 16384 registers, either packed as
+// 6 bit integers (dense) or run-length encoded with the opcodes below
+// (sparse). Small HyperLogLogs start sparse and are promoted to dense once
+// that is smaller or a register no longer fits the sparse encoding.
+const (
+	hllP             = 14
+	hllQ             = 64 - hllP
+	hllRegisters     = 1 << hllP
+	hllBits          = 6
+	hllRegisterMax   = 1<<hllBits - 1
+	hllHeaderSize    = 16
+	hllDenseSize     = hllHeaderSize + (hllRegisters*hllBits+7)/8
+	hllDense         = 0
+	hllSparse        = 1
+	hllSparseMaxSize = 3000
+	hllAlphaInf      = 0.721347520444481703680
+
+	// Sparse opcodes: ZERO 00xxxxxx is a run of up to 64 zero registers, XZERO
+	// 01xxxxxx yyyyyyyy one of up to 16384, and VAL 1vvvvvxx sets up to 4
+	// registers to a value of up to 32.
+	hllXZeroBit       = 0x40
+	hllValBit         = 0x80
+	hllZeroMaxLen     = 64
+	hllValMaxValue    = 32
+	hllValMaxLen      = 4
+	hllHashSeed       = 0xadc83b19
+	hllCacheStaleBit  = 0x80
+	hllCacheStaleByte = 15
+)
+
+var (
+	ErrNotHLL     = errors.New("WRONGTYPE Key is not a valid HyperLogLog string value.")
+	ErrCorruptHLL = errors.New("INVALIDOBJ Corrupted HLL object detected")
+)
+
+var hllMagic = []byte("HYLL")
+
+// PFAdd adds the elements to the HyperLogLog at key, creating it if needed,
+// and reports whether its registers, or the key itself, changed.
+func (s *MemoryStorage) PFAdd(key string, elements [][]byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	str, item, ok, err := lookupValue[[]byte](s, key)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		str = newSparseHLL()
+		item = Item{ExpiresAt: -1}
+	} else if err := validateHLL(str); err != nil {
+		return false, err
+	}
+
+	changed := !ok
+	if str[4] == hllDense {
+		for _, element := range elements {
+			index, count := hllPatLen(element)
+			if hllDenseGet(str[hllHeaderSize:], index) < count {
+				hllDenseSet(str[hllHeaderSize:], index, count)
+				changed = true
+			}
+		}
+	} else {
+		registers, err := hllSparseRegisters(str[hllHeaderSize:])
+		if err != nil {
+			return false, err
+		}
+		updated := false
+		for _, element := range elements {
+			index, count := hllPatLen(element)
+			if registers[index] < count {
+				registers[index] = count
+				updated = true
+			}
+		}
+		if updated {
+			str = encodeHLL(registers, true)
+			changed = true
+		}
+	}
+
+	if changed {
+		str[hllCacheStaleByte] |= hllCacheStaleBit
+		item.Value = str
+		s.setItem(key, item)
+	}
+	return changed, nil
+}
+
+// PFCount estimates the number of distinct elements added to the
+// HyperLogLogs at keys, missing keys counting as empty ones. With a single key
+// the estimate is cached in the header.
+func (s *MemoryStorage) PFCount(keys []string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(keys) == 1 {
+		str, _, ok, err := lookupValue[[]byte](s, keys[0])
+		if err != nil || !ok {
+			return 0, err
+		}
+		if err := validateHLL(str); err != nil {
+			return 0, err
+		}
+		if str[hllCacheStaleByte]&hllCacheStaleBit == 0 {
+			return int64(binary.LittleEndian.Uint64(str[8:16])), nil
+		}
+
+		registers, err := decodeHLL(str)
+		if err != nil {
+			return 0, err
+		}
+		count := hllCount(registers)
+		binary.LittleEndian.PutUint64(str[8:16], count)
+		return int64(count), nil
+	}
+
+	registers, _, err := s.mergeHLLs(keys)
+	if err != nil {
+		return 0, err
+	}
+	return int64(hllCount(registers)), nil
+}
+
+// PFMerge stores at dst the union of the HyperLogLogs at keys and at dst
+// itself. The result stays sparse if all of them were sparse and dst keeps
+// its TTL.
+func (s *MemoryStorage) PFMerge(dst string, keys []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	registers, dense, err := s.mergeHLLs(append([]string{dst}, keys...))
+	if err != nil {
+		return err
+	}
+
+	_, item, ok, _ := lookupValue[[]byte](s, dst)
+	if !ok {
+		item = Item{ExpiresAt: -1}
+	}
+	str := encodeHLL(registers, !dense)
+	str[hllCacheStaleByte] |= hllCacheStaleBit
+	item.Value = str
+	s.setItem(dst, item)
+	return nil
+}
+
+// mergeHLLs returns the registers of the union of the HyperLogLogs at keys
+// and whether any of them was dense. Callers must hold s.mu.
+func (s *MemoryStorage) mergeHLLs(keys []string) (registers []uint8, dense bool, err error) {
+	registers = make([]uint8, hllRegisters)
+	for _, key := range keys {
+		str, _, ok, err := lookupValue[[]byte](s, key)
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			continue
+		}
+		if err := validateHLL(str); err != nil {
+			return nil, false, err
+		}
+
+		current, err := decodeHLL(str)
+		if err != nil {
+			return nil, false, err
+		}
+		for i, count := range current {
+			registers[i] = max(registers[i], count)
+		}
+		dense = dense || str[4] == hllDense
+	}
+	return registers, dense, nil
+}
+
+func newSparseHLL() []byte {
+	return encodeHLL(make([]uint8, hllRegisters), true)
+}
+
+// validateHLL checks the header of a string used as a HyperLogLog.
+func validateHLL(str []byte) error {
+	if len(str) < hllHeaderSize || !bytes.Equal(str[:4], hllMagic) ||
+		(str[4] != hllDense && str[4] != hllSparse) ||
+		(str[4] == hllDense && len(str) != hllDenseSize) {
+		return ErrNotHLL
+	}
+	return nil
+}
+
+// decodeHLL decodes the registers of a valid HyperLogLog.
+func decodeHLL(str []byte) ([]uint8, error) {
+	if str[4] == hllSparse {
+		return hllSparseRegisters(str[hllHeaderSize:])
+	}
+	registers := make([]uint8, hllRegisters)
+	for i := range registers {
+		// A run of zeros is at most hllQ long, but 6 bits hold more. Redis
+		// accepts such registers, they only count as the longest run.
+		registers[i] = min(hllDenseGet(str[hllHeaderSize:], i), hllQ+1)
+	}
+	return registers, nil
+}
+
+func hllSparseRegisters(data []byte) ([]uint8, error) {
+	registers := make([]uint8, hllRegisters)
+	index := 0
+	for i := 0; i < len(data); i++ {
+		op := data[i]
+		var value uint8
+		var run int
+		switch {
+		case op&hllValBit != 0:
+			value = (op>>2)&0x1f + 1
+			run = int(op&0x3) + 1
+		case op&hllXZeroBit != 0:
+			if i+1 == len(data) {
+				return nil, ErrCorruptHLL
+			}
+			i++
+			run = (int(op&0x3f)<<8 | int(data[i])) + 1
+		default:
+			run = int(op&0x3f) + 1
+		}
+		if index+run > hllRegisters {
+			return nil, ErrCorruptHLL
+		}
+		for end := index + run; index < end; index++ {
+			registers[index] = value
+		}
+	}
+	if index != hllRegisters {
+		return nil, ErrCorruptHLL
+	}
+	return registers, nil
+}
+
+// encodeHLL builds a HyperLogLog from its registers with a cached cardinality
+// of zero, which callers mark as stale unless all registers are zero. It uses
+// the sparse encoding when asked to and possible.
+func encodeHLL(registers []uint8, sparse bool) []byte {
+	if sparse {
+		if str, ok := encodeSparseHLL(registers); ok {
+			return str
+		}
+	}
+
+	str := make([]byte, hllDenseSize)
+	copy(str, hllMagic)
+	str[4] = hllDense
+	for i, count := range registers {
+		if count > 0 {
+			hllDenseSet(str[hllHeaderSize:], i, count)
+		}
+	}
+	return str
+}
+
+func encodeSparseHLL(registers []uint8) ([]byte, bool) {
+	str := make([]byte, hllHeaderSize, 64)
+	copy(str, hllMagic)
+	str[4] = hllSparse
+
+	for i := 0; i < len(registers); {
+		value := registers[i]
+		run := 1
+		for i+run < len(registers) && registers[i+run] == value {
+			run++
+		}
+		i += run
+
+		switch {
+		case value > hllValMaxValue:
+			return nil, false
+		case value == 0 && run <= hllZeroMaxLen:
+			str = append(str, byte(run-1))
+		case value == 0:
+			str = append(str, byte((run-1)>>8)|hllXZeroBit, byte(run-1))
+		default:
+			for ; run > 0; run -= hllValMaxLen {
+				n := min(run, hllValMaxLen)
+				str = append(str, hllValBit|(value-1)<<2|byte(n-1))
+			}
+		}
+		if len(str) > hllSparseMaxSize {
+			return nil, false
+		}
+	}
+
+	return str, true
+}
+
+func hllDenseGet(registers []byte, index int) uint8 {
+	byteIndex := index * hllBits / 8
+	shift := uint(index * hllBits & 7)
+	value := uint(registers[byteIndex]) >> shift
+	if byteIndex+1 < len(registers) {
+		value |= uint(registers[byteIndex+1]) << (8 - shift)
+	}
+	return uint8(value & hllRegisterMax)
+}
+
+func hllDenseSet(registers []byte, index int, count uint8) {
+	byteIndex := index * hllBits / 8
+	shift := uint(index * hllBits & 7)
+	value := uint(count)
+	registers[byteIndex] &^= byte(hllRegisterMax << shift)
+	registers[byteIndex] |= byte(value << shift)
+	if byteIndex+1 < len(registers) {
+		registers[byteIndex+1] &^= byte(hllRegisterMax >> (8 - shift))
+		registers[byteIndex+1] |= byte(value >> (8 - shift))
+	}
+}
+
+// hllPatLen returns the register an element maps to and the length of the
+// run of zeros in the rest of its hash, plus one.
+func hllPatLen(element []byte) (int, uint8) {
+	hash := murmurHash64A(element, hllHashSeed)
+	index := int(hash & (hllRegisters - 1))
+	hash >>= hllP
+	hash |= 1 << hllQ
+	return index, uint8(bits.TrailingZeros64(hash) + 1)
+}
+
+// hllCount estimates the cardinality with the improved estimator from Otmar
+// Ertl, "New cardinality estimation algorithms for HyperLogLog sketches", as
+// Redis does.
+func hllCount(registers []uint8) uint64 {
+	var histogram [hllQ + 2]int
+	for _, count := range registers {
+		histogram[count]++
+	}
+
+	m := float64(hllRegisters)
+	z := m * hllTau((m-float64(histogram[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histogram[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histogram[0])/m)
+	return uint64(math.Round(hllAlphaInf * m * m / z))
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if prev == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if prev == z {
+			return z / 3
+		}
+	}
+}
+
+// murmurHash64A is the 64 bit MurmurHash2 by Austin Appleby, reading the input
+// in little endian order like Redis does on every platform.
+func murmurHash64A(key []byte, seed uint64) uint64 {
+	const (
+		m = 0xc6a4a7935bd1e995
+		r = 47
+	)
+
+	h := seed ^ uint64(len(key))*m
+	for ; len(key) >= 8; key = key[8:] {
+		k := binary.LittleEndian.Uint64(key)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+	}
+
+	if len(key) > 0 {
+		for i := len(key) - 1; i >= 0; i-- {
+			h ^= uint64(key[i]) << (8 * i)
+		}
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
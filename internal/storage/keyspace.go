@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"bytes"
+	"maps"
+	"slices"
+)
+
+func (s *MemoryStorage) Type(key string) ValueType {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, _ := s.peek(key)
+	return item.Type()
+}
+
+// Rename moves the value at src, with its TTL, to dst, replacing any value
+// there unless nx is set, in which case nothing happens if dst exists. It
+// also reports whether the value has a TTL, as a replayed rename may then
+// find src already expired.
+func (s *MemoryStorage) Rename(src, dst string, nx bool) (renamed, volatile bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.lookup(src)
+	if !ok {
+		return false, false, ErrNoSuchKey
+	}
+	if _, exists := s.peek(dst); exists && nx {
+		return false, false, nil
+	}
+
+	if src != dst {
+		s.remove(src)
+		s.setItem(dst, item)
+		s.signalKeyAsReady(dst)
+	}
+	return true, item.ExpiresAt > 0, nil
+}
+
+// Copy stores a copy of the value at src, with its TTL, at dst. An existing
+// dst is only replaced when replace is set. Like Rename, it reports whether
+// the value has a TTL.
+func (s *MemoryStorage) Copy(src, dst string, replace bool) (copied, volatile bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.peek(src)
+	if !ok {
+		return false, false
+	}
+	if _, exists := s.peek(dst); exists && !replace {
+		return false, false
+	}
+
+	s.setItem(dst, Item{Value: cloneValue(item.Value), ExpiresAt: item.ExpiresAt})
+	s.signalKeyAsReady(dst)
+	return true, item.ExpiresAt > 0
+}
+
+// RandomKey returns a random live key. Keys found expired on the way are
+// deleted.
+func (s *MemoryStorage) RandomKey() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.data {
+		if _, ok := s.peek(key); ok {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// DBSize returns the number of keys, including expired ones not yet deleted.
+func (s *MemoryStorage) DBSize() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return int64(len(s.data))
+}
+
+// cloneValue returns a deep copy of a value, sharing only what is never
+// modified in place.
+func cloneValue(value any) any {
+	switch v := value.(type) {
+	case []byte:
+		return bytes.Clone(v)
+	case *hash:
+		h := newDict[[]byte]()
+		for field, value := range v.all() {
+			h.set(field, bytes.Clone(value))
+		}
+		return h
+	case *list:
+		l := &list{}
+		for i := range v.size {
+			l.pushBack(bytes.Clone(v.at(i)))
+		}
+		return l
+	case *set:
+		st := newDict[struct{}]()
+		for member := range v.all() {
+			st.set(member, struct{}{})
+		}
+		return st
+	case *zset:
+		z := newZset()
+		for member, score := range v.dict.all() {
+			z.set(member, score)
+		}
+		return z
+	case *stream:
+		// Entries are never modified once added, only replaced.
+		st := &stream{
+			entries: slices.Clone(v.entries),
+			lastID:  v.lastID,
+			groups:  make(map[string]*consumerGroup, len(v.groups)),
+		}
+		for name, g := range v.groups {
+			group := newConsumerGroup(g.lastID)
+			for id, pe := range g.pending {
+				copied := *pe
+				group.pending[id] = &copied
+			}
+			maps.Copy(group.consumers, g.consumers)
+			st.groups[name] = group
+		}
+		return st
+	default:
+		return value
+	}
+}
@@ -0,0 +1,385 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+)
+
+var (
+	ErrNoSuchKey       = errors.New("no such key")
+	ErrIndexOutOfRange = errors.New("index out of range")
+)
+
+// list is a double-ended queue backed by a ring buffer, so pushes and pops
+// at both ends are O(1).
+type list struct {
+	buf  [][]byte
+	head int
+	size int
+}
+
+func (l *list) at(i int) []byte {
+	return l.buf[(l.head+i)%len(l.buf)]
+}
+
+func (l *list) set(i int, value []byte) {
+	l.buf[(l.head+i)%len(l.buf)] = value
+}
+
+func (l *list) pushFront(value []byte) {
+	l.grow()
+	l.head = (l.head - 1 + len(l.buf)) % len(l.buf)
+	l.buf[l.head] = value
+	l.size++
+}
+
+func (l *list) pushBack(value []byte) {
+	l.grow()
+	l.buf[(l.head+l.size)%len(l.buf)] = value
+	l.size++
+}
+
+func (l *list) popFront() []byte {
+	value := l.buf[l.head]
+	l.buf[l.head] = nil
+	l.head = (l.head + 1) % len(l.buf)
+	l.size--
+	return value
+}
+
+func (l *list) popBack() []byte {
+	i := (l.head + l.size - 1) % len(l.buf)
+	value := l.buf[i]
+	l.buf[i] = nil
+	l.size--
+	return value
+}
+
+// values returns the elements between from and to inclusive.
+func (l *list) values(from, to int) [][]byte {
+	out := make([][]byte, 0, to-from+1)
+	for i := from; i <= to; i++ {
+		out = append(out, l.at(i))
+	}
+	return out
+}
+
+func (l *list) reset(values [][]byte) {
+	l.buf = values
+	l.head = 0
+	l.size = len(values)
+}
+
+func (l *list) grow() {
+	if l.size < len(l.buf) {
+		return
+	}
+	buf := make([][]byte, max(2*len(l.buf), 8))
+	for i := 0; i < l.size; i++ {
+		buf[i] = l.at(i)
+	}
+	l.buf = buf
+	l.head = 0
+}
+
+// Push adds the values to the head or the tail of the list at key, creating
+// it if needed, and returns the new length.
+func (s *MemoryStorage) Push(key string, values [][]byte, left bool) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, err := s.writableList(key)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, value := range values {
+		if left {
+			l.pushFront(bytes.Clone(value))
+		} else {
+			l.pushBack(bytes.Clone(value))
+		}
+	}
+	s.signalKeyAsReady(key)
+	return int64(l.size), nil
+}
+
+// Pop removes up to count elements from the head or the tail of the list.
+// It reports false when the key does not exist.
+func (s *MemoryStorage) Pop(key string, count int64, left bool) ([][]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok, err := lookupList(s, key)
+	if !ok {
+		return nil, false, err
+	}
+
+	return s.pop(key, l, count, left), true, nil
+}
+
+// PopFirst pops one element from the first non-empty list among keys, which
+// is what BLPOP and BRPOP serve.
+func (s *MemoryStorage) PopFirst(keys []string, left bool) (string, []byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		l, ok, err := lookupList(s, key)
+		if err != nil {
+			return "", nil, false, err
+		}
+		if ok {
+			return key, s.pop(key, l, 1, left)[0], true, nil
+		}
+	}
+	return "", nil, false, nil
+}
+
+func (s *MemoryStorage) pop(key string, l *list, count int64, left bool) [][]byte {
+	values := make([][]byte, 0, min(count, int64(l.size)))
+	for int64(len(values)) < count && l.size > 0 {
+		if left {
+			values = append(values, l.popFront())
+		} else {
+			values = append(values, l.popBack())
+		}
+	}
+
+	if l.size == 0 {
+		s.remove(key)
+	}
+	return values
+}
+
+func (s *MemoryStorage) LLen(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok, err := lookupList(s, key)
+	if !ok {
+		return 0, err
+	}
+	return int64(l.size), nil
+}
+
+// LRange returns the elements between start and stop inclusive. Negative
+// offsets count from the tail.
+func (s *MemoryStorage) LRange(key string, start, stop int64) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok, err := lookupList(s, key)
+	if !ok {
+		return nil, err
+	}
+
+	from, to, ok := normalizeRange(start, stop, int64(l.size))
+	if !ok {
+		return nil, nil
+	}
+
+	values := l.values(int(from), int(to))
+	for i, value := range values {
+		values[i] = bytes.Clone(value)
+	}
+	return values, nil
+}
+
+func (s *MemoryStorage) LIndex(key string, index int64) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok, err := lookupList(s, key)
+	if !ok {
+		return nil, false, err
+	}
+
+	i, ok := listIndex(l, index)
+	if !ok {
+		return nil, false, nil
+	}
+	return bytes.Clone(l.at(i)), true, nil
+}
+
+func (s *MemoryStorage) LSet(key string, index int64, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok, err := lookupList(s, key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNoSuchKey
+	}
+
+	i, ok := listIndex(l, index)
+	if !ok {
+		return ErrIndexOutOfRange
+	}
+	l.set(i, bytes.Clone(value))
+	return nil
+}
+
+// LRem removes elements equal to value: the first count of them for a
+// positive count, the last -count for a negative one and all for zero.
+func (s *MemoryStorage) LRem(key string, count int64, value []byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok, err := lookupList(s, key)
+	if !ok {
+		return 0, err
+	}
+
+	values := l.values(0, l.size-1)
+	keep := make([]bool, len(values))
+	var removed int64
+
+	for n := range values {
+		i := n
+		if count < 0 {
+			i = len(values) - 1 - n
+		}
+		if (count == 0 || removed < max(count, -count)) && bytes.Equal(values[i], value) {
+			removed++
+			continue
+		}
+		keep[i] = true
+	}
+
+	if removed == 0 {
+		return 0, nil
+	}
+
+	kept := values[:0]
+	for i, value := range values {
+		if keep[i] {
+			kept = append(kept, value)
+		}
+	}
+	l.reset(kept)
+
+	if l.size == 0 {
+		s.remove(key)
+	}
+	return removed, nil
+}
+
+// LTrim keeps only the elements between start and stop inclusive.
+func (s *MemoryStorage) LTrim(key string, start, stop int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok, err := lookupList(s, key)
+	if !ok {
+		return err
+	}
+
+	from, to, ok := normalizeRange(start, stop, int64(l.size))
+	if !ok {
+		s.remove(key)
+		return nil
+	}
+
+	for range from {
+		l.popFront()
+	}
+	for l.size > int(to-from)+1 {
+		l.popBack()
+	}
+	return nil
+}
+
+// LInsert inserts value before or after the first element equal to pivot and
+// returns the new length, -1 when there is no pivot and 0 when there is no key.
+func (s *MemoryStorage) LInsert(key string, before bool, pivot, value []byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok, err := lookupList(s, key)
+	if !ok {
+		return 0, err
+	}
+
+	values := l.values(0, l.size-1)
+	for i, v := range values {
+		if !bytes.Equal(v, pivot) {
+			continue
+		}
+		if !before {
+			i++
+		}
+		l.reset(slices.Insert(values, i, bytes.Clone(value)))
+		return int64(l.size), nil
+	}
+	return -1, nil
+}
+
+// LMove pops an element from one end of src and pushes it to one end of dst
+// atomically. src and dst may be the same list, which rotates it.
+func (s *MemoryStorage) LMove(src, dst string, srcLeft, dstLeft bool) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	from, ok, err := lookupList(s, src)
+	if !ok {
+		return nil, false, err
+	}
+	if _, _, err := lookupList(s, dst); err != nil {
+		return nil, false, err
+	}
+
+	var value []byte
+	if srcLeft {
+		value = from.popFront()
+	} else {
+		value = from.popBack()
+	}
+
+	// When src and dst are the same key the list is still stored here, even
+	// if the pop emptied it.
+	to, _ := s.writableList(dst)
+	if dstLeft {
+		to.pushFront(value)
+	} else {
+		to.pushBack(value)
+	}
+
+	if from.size == 0 {
+		s.remove(src)
+	}
+	s.signalKeyAsReady(dst)
+	return bytes.Clone(value), true, nil
+}
+
+func listIndex(l *list, index int64) (int, bool) {
+	if index < 0 {
+		index += int64(l.size)
+	}
+	if index < 0 || index >= int64(l.size) {
+		return 0, false
+	}
+	return int(index), true
+}
+
+func lookupList(s *MemoryStorage, key string) (*list, bool, error) {
+	l, _, ok, err := lookupValue[*list](s, key)
+	return l, ok, err
+}
+
+// writableList returns the list at key for modification, storing an empty
+// one without a TTL if the key does not exist. Callers must hold s.mu.
+func (s *MemoryStorage) writableList(key string) (*list, error) {
+	l, ok, err := lookupList(s, key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		l = &list{}
+		s.setItem(key, Item{Value: l, ExpiresAt: -1})
+	}
+	return l, nil
+}
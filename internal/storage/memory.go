@@ -1,82 +1,304 @@
 package storage
 
 import (
-	"fmt"
-	"strconv"
+	"bytes"
+	"errors"
 	"sync"
 	"time"
 )
 
 type Item struct {
-	Value     string
+	// Value is []byte for strings, *hash for hashes, *list for lists, *set
+	// for sets, *zset for sorted sets and *stream for streams.
+	Value any
+	// ExpiresAt is the Unix time in milliseconds when the item expires, or -1.
 	ExpiresAt int64
+	// generation is the number of snapshots taken when the item was last
+	// written, the snapshots taken since share its value.
+	generation uint64
 }
 
+type ValueType int
+
+const (
+	TypeNone ValueType = iota
+	TypeString
+	TypeHash
+	TypeList
+	TypeSet
+	TypeZSet
+	TypeStream
+)
+
+func (t ValueType) String() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeHash:
+		return "hash"
+	case TypeList:
+		return "list"
+	case TypeSet:
+		return "set"
+	case TypeZSet:
+		return "zset"
+	case TypeStream:
+		return "stream"
+	default:
+		return "none"
+	}
+}
+
+func (i Item) Type() ValueType {
+	switch i.Value.(type) {
+	case []byte:
+		return TypeString
+	case *hash:
+		return TypeHash
+	case *list:
+		return TypeList
+	case *set:
+		return TypeSet
+	case *zset:
+		return TypeZSet
+	case *stream:
+		return TypeStream
+	default:
+		return TypeNone
+	}
+}
+
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// ExpireCondition restricts when ExpireAt replaces the current TTL. The flags
+// mirror the NX, XX, GT and LT options of the EXPIRE command family and may be
+// combined, zero means no restriction.
+type ExpireCondition int
+
+const (
+	ExpireNX ExpireCondition = 1 << iota
+	ExpireXX
+	ExpireGT
+	ExpireLT
+)
+
 type MemoryStorage struct {
 	mu   sync.RWMutex
 	data map[string]Item
+	// expires indexes the keys that have a TTL, so the active expiry cycle
+	// can sample them without walking the whole keyspace.
+	expires *keySet
+	// keys indexes the keyspace for SCAN.
+	keys *dict[struct{}]
+	// watchers holds the clients blocked on each key, see WatchKeys.
+	watchers map[string]map[chan struct{}]struct{}
+	// generation counts the snapshots taken, and snapshots holds those not
+	// released yet, oldest first.
+	generation uint64
+	snapshots  []*Snapshot
+
+	stopExpire chan struct{}
+	expireDone chan struct{}
 }
 
 func NewMemoryStorage() *MemoryStorage {
 	return &MemoryStorage{
-		data: make(map[string]Item),
+		data:     make(map[string]Item),
+		expires:  newKeySet(),
+		keys:     newDict[struct{}](),
+		watchers: make(map[string]map[chan struct{}]struct{}),
 	}
 }
 
-func (s *MemoryStorage) Set(key, value string) {
+func (s *MemoryStorage) Set(key string, value []byte) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.data[key] = Item{
-		Value:     value,
+	s.setItem(key, Item{
+		Value:     bytes.Clone(value),
 		ExpiresAt: -1,
+	})
+}
+
+type SetCondition int
+
+const (
+	SetAlways SetCondition = iota
+	SetNX
+	SetXX
+)
+
+// SetOptions mirrors the options of the SET command.
+type SetOptions struct {
+	Condition SetCondition
+	// ExpiresAt is an absolute deadline in Unix milliseconds, zero means the
+	// key is stored without a TTL unless KeepTTL is set.
+	ExpiresAt int64
+	KeepTTL   bool
+	// Get requires the previous value to be a string, as SET ... GET returns it.
+	Get bool
+}
+
+// SetWithOptions performs a conditional write in a single locked step. It
+// returns the previous value if it was a string, whether the key existed,
+// and whether the new value was written.
+func (s *MemoryStorage) SetWithOptions(key string, value []byte, opts SetOptions) (old []byte, existed bool, written bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, existed := s.peek(key)
+	if existed {
+		str, isString := item.Value.([]byte)
+		if !isString && opts.Get {
+			return nil, true, false, ErrWrongType
+		}
+		old = bytes.Clone(str)
+	}
+
+	if (opts.Condition == SetNX && existed) || (opts.Condition == SetXX && !existed) {
+		return old, existed, false, nil
 	}
+
+	expiresAt := int64(-1)
+	switch {
+	case opts.KeepTTL && existed:
+		expiresAt = item.ExpiresAt
+	case opts.ExpiresAt != 0:
+		expiresAt = opts.ExpiresAt
+	}
+
+	if expiresAt > 0 && expiresAt <= time.Now().UnixMilli() {
+		s.remove(key)
+		return old, existed, true, nil
+	}
+
+	s.setItem(key, Item{
+		Value:     bytes.Clone(value),
+		ExpiresAt: expiresAt,
+	})
+	return old, existed, true, nil
+}
+
+// GetSet stores value without a TTL and returns the previous value.
+func (s *MemoryStorage) GetSet(key string, value []byte) ([]byte, bool, error) {
+	old, existed, _, err := s.SetWithOptions(key, value, SetOptions{Get: true})
+	return old, existed, err
 }
 
-func (s *MemoryStorage) Get(key string) (string, bool) {
+func (s *MemoryStorage) Get(key string) ([]byte, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	item, ok := s.data[key]
+
+	value, _, ok, err := lookupValue[[]byte](s, key)
 	if !ok {
-		return "", false
+		return nil, false, err
 	}
 
-	if item.ExpiresAt > 0 && time.Now().Unix() >= item.ExpiresAt {
-		delete(s.data, key)
-		return "", false
-	}
+	return bytes.Clone(value), true, nil
+}
 
-	return item.Value, ok
+// Delete removes the keys and returns how many of them existed.
+func (s *MemoryStorage) Delete(keys ...string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	for _, key := range keys {
+		if _, ok := s.peek(key); ok {
+			s.remove(key)
+			deleted++
+		}
+	}
+	return deleted
 }
 
-func (s *MemoryStorage) Delete(key string) {
+// Exists returns how many of the keys exist, a key given twice is counted twice.
+func (s *MemoryStorage) Exists(keys ...string) int64 {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	delete(s.data, key)
+
+	var count int64
+	for _, key := range keys {
+		if _, ok := s.peek(key); ok {
+			count++
+		}
+	}
+	return count
 }
 
 func (s *MemoryStorage) SetTTL(key string, seconds int64) bool {
+	return s.ExpireAt(key, time.Now().Add(time.Duration(seconds)*time.Second), 0)
+}
+
+// ExpireAt sets an absolute deadline for the key if cond allows it. A deadline
+// in the past deletes the key right away, which is what replaying an old AOF
+// relies on.
+func (s *MemoryStorage) ExpireAt(key string, at time.Time, cond ExpireCondition) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	item, ok := s.data[key]
+	item, ok := s.lookup(key)
 	if !ok {
 		return false
 	}
 
-	if item.ExpiresAt > 0 && time.Now().Unix() >= item.ExpiresAt {
-		delete(s.data, key)
+	deadline := at.UnixMilli()
+	volatile := item.ExpiresAt > 0
+
+	if cond&ExpireNX != 0 && volatile {
+		return false
+	}
+	if cond&ExpireXX != 0 && !volatile {
+		return false
+	}
+	// A key without a TTL never expires, nothing is greater than that.
+	if cond&ExpireGT != 0 && (!volatile || deadline <= item.ExpiresAt) {
+		return false
+	}
+	if cond&ExpireLT != 0 && volatile && deadline >= item.ExpiresAt {
 		return false
 	}
 
-	item.ExpiresAt = time.Now().Add(time.Duration(seconds) * time.Second).Unix()
-	s.data[key] = item
+	if deadline <= time.Now().UnixMilli() {
+		s.remove(key)
+		return true
+	}
+
+	item.ExpiresAt = deadline
+	s.setItem(key, item)
 	return true
 }
+
+// Persist removes the TTL of the key and reports whether there was one.
+func (s *MemoryStorage) Persist(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.lookup(key)
+	if !ok || item.ExpiresAt == -1 {
+		return false
+	}
+
+	item.ExpiresAt = -1
+	s.setItem(key, item)
+	return true
+}
+
+// GetTTL returns the remaining time to live in seconds, -1 if the key has no
+// TTL and -2 if it does not exist.
 func (s *MemoryStorage) GetTTL(key string) int64 {
+	ttl := s.GetPTTL(key)
+	if ttl < 0 {
+		return ttl
+	}
+	return (ttl + 500) / 1000
+}
+
+// GetPTTL is GetTTL in milliseconds.
+func (s *MemoryStorage) GetPTTL(key string) int64 {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	item, ok := s.data[key]
+	item, ok := s.peek(key)
 	if !ok {
 		return -2
 	}
@@ -85,45 +307,134 @@ func (s *MemoryStorage) GetTTL(key string) int64 {
 		return -1
 	}
 
-	now := time.Now().Unix()
+	return item.ExpiresAt - time.Now().UnixMilli()
+}
+
+// GetExpireTime returns the absolute Unix time in milliseconds at which the
+// key expires, -1 if the key has no TTL and -2 if it does not exist.
+func (s *MemoryStorage) GetExpireTime(key string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if now >= item.ExpiresAt {
-		delete(s.data, key)
+	item, ok := s.peek(key)
+	if !ok {
 		return -2
 	}
 
-	return item.ExpiresAt - now
+	return item.ExpiresAt
 }
 
-func (s *MemoryStorage) Increment(key string) (int64, error) {
+func (s *MemoryStorage) Flush() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	item, ok := s.data[key]
-	if !ok || item.ExpiresAt > 0 && time.Now().Unix() >= item.ExpiresAt {
-		s.data[key] = Item{
-			Value:     "1",
-			ExpiresAt: -1,
+	s.clear()
+}
+
+// clear empties the dataset, handing its items to the snapshots still
+// collecting them first. Callers must hold s.mu.
+func (s *MemoryStorage) clear() {
+	for _, snap := range s.snapshots {
+		if !snap.collected {
+			for key, item := range s.data {
+				snap.add(key, item)
+			}
+			snap.collected = true
 		}
-		return 1, nil
 	}
 
-	value, err := strconv.ParseInt(item.Value, 10, 64)
-	if err != nil {
-		return 0, fmt.Errorf("value is not an integer or out of range")
+	s.data = make(map[string]Item)
+	s.expires = newKeySet()
+	s.keys = newDict[struct{}]()
+}
+
+// peek returns the live item stored at key, deleting it first if its TTL has
+// passed. Its value may be shared with a snapshot, so callers must neither
+// modify it nor store the item again, see lookup. Callers must hold s.mu.
+func (s *MemoryStorage) peek(key string) (Item, bool) {
+	item, ok := s.data[key]
+	if !ok {
+		return Item{}, false
+	}
+
+	if item.expired(time.Now()) {
+		s.remove(key)
+		return Item{}, false
 	}
 
-	value++
+	return item, true
+}
+
+// lookup is peek for callers that may modify the value in place or store the
+// item again: a value still shared with a snapshot is copied first, and the
+// snapshot keeps the original. Callers must hold s.mu.
+func (s *MemoryStorage) lookup(key string) (Item, bool) {
+	item, ok := s.peek(key)
+	if !ok {
+		return Item{}, false
+	}
+
+	if n := len(s.snapshots); n > 0 && item.generation < s.snapshots[n-1].generation {
+		s.preserve(key, item)
+		item.Value = cloneValue(item.Value)
+		item.generation = s.generation
+		s.data[key] = item
+	}
+	return item, true
+}
+
+// lookupValue is lookup for commands that work on a single value type. It
+// returns ErrWrongType when the key holds a value of another type.
+func lookupValue[T any](s *MemoryStorage, key string) (T, Item, bool, error) {
+	var zero T
+
+	item, ok := s.lookup(key)
+	if !ok {
+		return zero, Item{}, false, nil
+	}
+
+	value, ok := item.Value.(T)
+	if !ok {
+		return zero, Item{}, false, ErrWrongType
+	}
+	return value, item, true, nil
+}
 
-	item.Value = strconv.FormatInt(value, 10)
+func (s *MemoryStorage) setItem(key string, item Item) {
+	if old, ok := s.data[key]; ok {
+		s.preserve(key, old)
+	} else {
+		s.keys.set(key, struct{}{})
+	}
+	item.generation = s.generation
 	s.data[key] = item
+	if item.ExpiresAt > 0 {
+		s.expires.add(key)
+	} else {
+		s.expires.remove(key)
+	}
+}
 
-	return int64(value), nil
+func (s *MemoryStorage) remove(key string) bool {
+	item, ok := s.data[key]
+	if !ok {
+		return false
+	}
+	s.preserve(key, item)
+	delete(s.data, key)
+	s.expires.remove(key)
+	s.keys.delete(key)
+	return true
 }
 
-func (s *MemoryStorage) Flush() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// preserve hands an item about to be replaced or deleted to the snapshots
+// that still have to collect it. Callers must hold s.mu.
+func (s *MemoryStorage) preserve(key string, item Item) {
+	for _, snap := range s.snapshots {
+		snap.add(key, item)
+	}
+}
 
-	s.data = make(map[string]Item)
+func (i Item) expired(now time.Time) bool {
+	return i.ExpiresAt > 0 && now.UnixMilli() >= i.ExpiresAt
 }
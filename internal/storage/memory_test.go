@@ -1,6 +1,15 @@
 package storage
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -18,33 +27,47 @@ func TestMemoryStorage_SetGet(t *testing.T) {
 	}{
 		{"Simple Set", "user:1", "Alice", "Alice", true},
 		{"Empty Value", "empty", "", "", true},
+		{"Binary Value", "bin key", "a\x00b\r\n\tc  d\xff", "a\x00b\r\n\tc  d\xff", true},
 		{"Non-existent", "ghost", "", "", false},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			if tt.wantOk {
-				s.Set(tt.key, tt.value)
+				s.Set(tt.key, []byte(tt.value))
 			}
 
-			gotValue, gotOk := s.Get(tt.key)
+			gotValue, gotOk, _ := s.Get(tt.key)
 
 			if gotOk != tt.wantOk {
 				t.Errorf("Get() ok = %v, want %v", gotOk, tt.wantOk)
 			}
-			if gotOk && gotValue != tt.wantValue {
+			if gotOk && string(gotValue) != tt.wantValue {
 				t.Errorf("Get() val = %v, want %v", gotValue, tt.wantValue)
 			}
 		})
 	}
 }
 
+func TestMemoryStorage_GetReturnsCopy(t *testing.T) {
+	s := NewMemoryStorage()
+	s.Set("key", []byte("value"))
+
+	got, _, _ := s.Get("key")
+	got[0] = 'X'
+
+	again, _, _ := s.Get("key")
+	if string(again) != "value" {
+		t.Errorf("Get() val = %q after modifying a previous result, want %q", again, "value")
+	}
+}
+
 func TestMemoryStorage_Delete(t *testing.T) {
 	s := NewMemoryStorage()
-	s.Set("key", "val")
+	s.Set("key", []byte("val"))
 	s.Delete("key")
 
-	_, ok := s.Get("key")
+	_, ok, _ := s.Get("key")
 	if ok {
 		t.Error("Expected key to be deleted, but it was found")
 	}
@@ -53,8 +76,8 @@ func TestMemoryStorage_Delete(t *testing.T) {
 func TestMemoryStorage_TTL(t *testing.T) {
 	s := NewMemoryStorage()
 
-	s.Set("key", "val")
-	s.Set("without", "ttl")
+	s.Set("key", []byte("val"))
+	s.Set("without", []byte("ttl"))
 	s.SetTTL("key", 1)
 
 	seconds := s.GetTTL("key")
@@ -69,7 +92,7 @@ func TestMemoryStorage_TTL(t *testing.T) {
 
 	time.Sleep(1100 * time.Millisecond)
 
-	_, ok := s.Get("key")
+	_, ok, _ := s.Get("key")
 	if ok {
 		t.Error("GET() ok = true, want false")
 	}
@@ -83,10 +106,10 @@ func TestMemoryStorage_TTL(t *testing.T) {
 func TestMemoryStorage_Increment(t *testing.T) {
 	s := NewMemoryStorage()
 
-	s.Set("one", "0")
+	s.Set("one", []byte("0"))
 
 	for i := 0; i < 3; i++ {
-		res, err := s.Increment("one")
+		res, err := s.Increment("one", 1)
 		if err != nil {
 			t.Error("Increment error", "error", err)
 		}
@@ -95,7 +118,7 @@ func TestMemoryStorage_Increment(t *testing.T) {
 		}
 	}
 
-	res, err := s.Increment("zero")
+	res, err := s.Increment("zero", 1)
 	if err != nil {
 		t.Error("Increment error", "error", err)
 	}
@@ -103,8 +126,8 @@ func TestMemoryStorage_Increment(t *testing.T) {
 		t.Errorf("res = %v, want 1", res)
 	}
 
-	s.Set("str", "string")
-	_, err = s.Increment("str")
+	s.Set("str", []byte("string"))
+	_, err = s.Increment("str", 1)
 	if err == nil {
 		t.Error("err is null, expected parse error")
 	}
@@ -113,11 +136,11 @@ func TestMemoryStorage_Increment(t *testing.T) {
 func TestMemoryStorage_Flush(t *testing.T) {
 	s := NewMemoryStorage()
 
-	s.Set("key", "value")
+	s.Set("key", []byte("value"))
 
 	s.Flush()
 
-	_, ok := s.Get("key")
+	_, ok, _ := s.Get("key")
 	if ok {
 		t.Error("DB is not empty afret FLUSH command")
 	}
@@ -133,7 +156,7 @@ func TestMemoryStorage_ConcurrentAccess(t *testing.T) {
 	go func() {
 		defer wg.Done()
 		for i := 0; i < iterations; i++ {
-			s.Set("key", "value")
+			s.Set("key", []byte("value"))
 		}
 	}()
 
@@ -141,9 +164,1206 @@ func TestMemoryStorage_ConcurrentAccess(t *testing.T) {
 	go func() {
 		defer wg.Done()
 		for i := 0; i < iterations; i++ {
-			_, _ = s.Get("key")
+			_, _, _ = s.Get("key")
+		}
+	}()
+
+	wg.Wait()
+}
+
+func TestMemoryStorage_ActiveExpire(t *testing.T) {
+	s := NewMemoryStorage()
+
+	past := time.Now().UnixMilli() - 1
+	for i := 0; i < 1000; i++ {
+		s.setItem(fmt.Sprintf("expired:%d", i), Item{Value: []byte("v"), ExpiresAt: past})
+	}
+	for i := 0; i < 100; i++ {
+		s.Set(fmt.Sprintf("persistent:%d", i), []byte("v"))
+		s.Set(fmt.Sprintf("volatile:%d", i), []byte("v"))
+		s.SetTTL(fmt.Sprintf("volatile:%d", i), 100)
+	}
+
+	removed := s.activeExpireCycle(time.Second)
+	if removed < 800 {
+		t.Errorf("activeExpireCycle() removed %d keys, want most of the 1000 expired ones", removed)
+	}
+
+	s.StartActiveExpire(100)
+	time.Sleep(200 * time.Millisecond)
+	s.StopActiveExpire()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Sampling stops once expired keys are rare, so a few may survive.
+	leftover := len(s.data) - 200
+	if leftover > s.expires.len()/2 {
+		t.Errorf("%d expired keys left out of %d with TTL", leftover, s.expires.len())
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := s.data[fmt.Sprintf("persistent:%d", i)]; !ok {
+			t.Fatalf("persistent:%d was removed", i)
+		}
+		if _, ok := s.data[fmt.Sprintf("volatile:%d", i)]; !ok {
+			t.Fatalf("volatile:%d was removed before its TTL", i)
+		}
+	}
+}
+
+func TestMemoryStorage_ExpireConditions(t *testing.T) {
+	s := NewMemoryStorage()
+	s.Set("key", []byte("val"))
+
+	soon := time.Now().Add(time.Minute)
+	later := time.Now().Add(time.Hour)
+
+	steps := []struct {
+		name string
+		at   time.Time
+		cond ExpireCondition
+		want bool
+	}{
+		{"XX without TTL", soon, ExpireXX, false},
+		{"GT without TTL", later, ExpireGT, false},
+		{"NX without TTL", soon, ExpireNX, true},
+		{"NX with TTL", later, ExpireNX, false},
+		{"GT with smaller", soon.Add(-time.Second), ExpireGT, false},
+		{"GT with greater", later, ExpireGT, true},
+		{"LT with greater", later.Add(time.Second), ExpireLT, false},
+		{"LT XX with smaller", soon, ExpireLT | ExpireXX, true},
+		{"unconditional", later, 0, true},
+	}
+
+	for _, step := range steps {
+		if got := s.ExpireAt("key", step.at, step.cond); got != step.want {
+			t.Errorf("%s: ExpireAt() = %v, want %v", step.name, got, step.want)
+		}
+	}
+
+	if got := s.GetExpireTime("key"); got != later.UnixMilli() {
+		t.Errorf("GetExpireTime() = %d, want %d", got, later.UnixMilli())
+	}
+
+	s.Set("fresh", []byte("val"))
+	if !s.ExpireAt("fresh", time.Now().Add(time.Hour), ExpireLT) {
+		t.Error("LT on a key without TTL should set the TTL")
+	}
+}
+
+func TestMemoryStorage_MillisecondTTL(t *testing.T) {
+	s := NewMemoryStorage()
+	s.Set("lease", []byte("token"))
+	s.ExpireAt("lease", time.Now().Add(150*time.Millisecond), 0)
+
+	pttl := s.GetPTTL("lease")
+	if pttl <= 100 || pttl > 150 {
+		t.Errorf("GetPTTL() = %d, want in (100, 150]", pttl)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if _, ok, _ := s.Get("lease"); ok {
+		t.Error("Get() ok = true after the lease expired")
+	}
+	if got := s.GetPTTL("lease"); got != -2 {
+		t.Errorf("GetPTTL() = %d, want -2", got)
+	}
+
+	s.Set("past", []byte("val"))
+	if !s.ExpireAt("past", time.Now().Add(-time.Second), 0) {
+		t.Error("ExpireAt() in the past should report success")
+	}
+	if _, ok, _ := s.Get("past"); ok {
+		t.Error("ExpireAt() in the past should delete the key")
+	}
+}
+
+func TestMemoryStorage_SetNXIsAtomic(t *testing.T) {
+	s := NewMemoryStorage()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	winners := 0
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _, written, _ := s.SetWithOptions("lock", []byte(fmt.Sprint(i)), SetOptions{Condition: SetNX})
+			if written {
+				mu.Lock()
+				winners++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if winners != 1 {
+		t.Errorf("%d goroutines acquired the lock, want 1", winners)
+	}
+}
+
+func TestMemoryStorage_TTLAfterWrite(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		write    func(s *MemoryStorage)
+		wantTTL  bool
+		wantPTTL int64
+	}{
+		{"SET clears TTL", "10", func(s *MemoryStorage) { s.Set("key", []byte("new")) }, false, -1},
+		{"SET KEEPTTL keeps TTL", "10", func(s *MemoryStorage) {
+			s.SetWithOptions("key", []byte("new"), SetOptions{KeepTTL: true})
+		}, true, 0},
+		{"SET XX clears TTL", "10", func(s *MemoryStorage) {
+			s.SetWithOptions("key", []byte("new"), SetOptions{Condition: SetXX})
+		}, false, -1},
+		{"failed SET NX keeps TTL", "10", func(s *MemoryStorage) {
+			s.SetWithOptions("key", []byte("new"), SetOptions{Condition: SetNX})
+		}, true, 0},
+		{"GETSET clears TTL", "10", func(s *MemoryStorage) { s.GetSet("key", []byte("new")) }, false, -1},
+		{"INCR keeps TTL", "10", func(s *MemoryStorage) { s.Increment("key", 1) }, true, 0},
+		{"failed INCR keeps TTL", "not a number", func(s *MemoryStorage) { s.Increment("key", 1) }, true, 0},
+		{"PERSIST clears TTL", "10", func(s *MemoryStorage) {
+			if !s.Persist("key") {
+				t.Error("Persist() = false for a key with TTL")
+			}
+		}, false, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStorage()
+			s.Set("key", []byte(tt.value))
+			s.SetTTL("key", 100)
+
+			tt.write(s)
+
+			pttl := s.GetPTTL("key")
+			if tt.wantTTL && pttl <= 0 {
+				t.Errorf("GetPTTL() = %d, want the TTL to be kept", pttl)
+			}
+			if !tt.wantTTL && pttl != tt.wantPTTL {
+				t.Errorf("GetPTTL() = %d, want %d", pttl, tt.wantPTTL)
+			}
+		})
+	}
+}
+
+func TestMemoryStorage_Persist(t *testing.T) {
+	s := NewMemoryStorage()
+
+	if s.Persist("missing") {
+		t.Error("Persist() = true for a missing key")
+	}
+
+	s.Set("key", []byte("val"))
+	if s.Persist("key") {
+		t.Error("Persist() = true for a key without TTL")
+	}
+}
+
+func TestMemoryStorage_StringsKeepTTL(t *testing.T) {
+	s := NewMemoryStorage()
+	s.Set("key", []byte("hello"))
+	s.SetTTL("key", 100)
+
+	if n, _ := s.Append("key", []byte(" world")); n != 11 {
+		t.Errorf("Append() = %d, want 11", n)
+	}
+	if n, _ := s.SetRange("key", 0, []byte("HELLO")); n != 11 {
+		t.Errorf("SetRange() = %d, want 11", n)
+	}
+	if got, _ := s.GetRange("key", 0, -1); string(got) != "HELLO world" {
+		t.Errorf("GetRange() = %q, want %q", got, "HELLO world")
+	}
+	if s.GetPTTL("key") <= 0 {
+		t.Error("APPEND and SETRANGE must keep the TTL")
+	}
+
+	got, _ := s.GetRange("key", 0, 4)
+	got[0] = 'X'
+	if val, _, _ := s.Get("key"); val[0] != 'H' {
+		t.Error("GetRange() result must not alias the stored value")
+	}
+}
+
+func TestMemoryStorage_IncrementConcurrent(t *testing.T) {
+	s := NewMemoryStorage()
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.Increment("requests", 3)
+				s.Increment("requests", -1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, _, _ := s.Get("requests"); string(got) != "2000" {
+		t.Errorf("requests = %s, want 2000", got)
+	}
+}
+
+func TestMemoryStorage_MSetNXAllOrNothing(t *testing.T) {
+	s := NewMemoryStorage()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	winners := 0
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			keys := []string{"a", "b", fmt.Sprint("own:", i)}
+			values := [][]byte{[]byte(fmt.Sprint(i)), []byte(fmt.Sprint(i)), []byte("x")}
+			if s.MSetNX(keys, values) {
+				mu.Lock()
+				winners++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	values := s.MGet("a", "b")
+	if winners != 1 || string(values[0]) != string(values[1]) {
+		t.Errorf("winners = %d, a = %s, b = %s; want a single writer of both keys", winners, values[0], values[1])
+	}
+	if n := s.Exists("a", "b", "missing"); n != 2 {
+		t.Errorf("Exists() = %d, want 2", n)
+	}
+}
+
+func TestMemoryStorage_HashKeepsTTL(t *testing.T) {
+	s := NewMemoryStorage()
+
+	s.HSet("h", []string{"a"}, [][]byte{[]byte("1")})
+	s.SetTTL("h", 10)
+	s.HSet("h", []string{"b"}, [][]byte{[]byte("2")})
+	s.HIncrBy("h", "a", 1)
+
+	if ttl := s.GetTTL("h"); ttl != 10 {
+		t.Errorf("GetTTL() = %d after hash writes, want 10", ttl)
+	}
+
+	s.HDel("h", "a", "b")
+	if n := s.Exists("h"); n != 0 {
+		t.Errorf("Exists() = %d after removing every field, want 0", n)
+	}
+	if ttl := s.GetTTL("h"); ttl != -2 {
+		t.Errorf("GetTTL() = %d, want -2", ttl)
+	}
+}
+
+func TestMemoryStorage_WrongType(t *testing.T) {
+	s := NewMemoryStorage()
+	s.Set("str", []byte("value"))
+	s.HSet("hash", []string{"f"}, [][]byte{[]byte("v")})
+
+	if _, _, err := s.Get("hash"); !errors.Is(err, ErrWrongType) {
+		t.Errorf("Get() on a hash: err = %v, want ErrWrongType", err)
+	}
+	if _, err := s.HSet("str", []string{"f"}, [][]byte{[]byte("v")}); !errors.Is(err, ErrWrongType) {
+		t.Errorf("HSet() on a string: err = %v, want ErrWrongType", err)
+	}
+	if val, _, _ := s.Get("str"); string(val) != "value" {
+		t.Errorf("Get() = %q, the string must be left untouched", val)
+	}
+}
+
+func TestMemoryStorage_ListWrapsAround(t *testing.T) {
+	s := NewMemoryStorage()
+	var want []string
+
+	// Mixing pushes and pops at both ends moves the head around the ring
+	// buffer and makes it grow while wrapped.
+	for i := 0; i < 100; i++ {
+		v := fmt.Sprint(i)
+		if i%3 == 0 {
+			s.Push("l", [][]byte{[]byte(v)}, true)
+			want = append([]string{v}, want...)
+		} else {
+			s.Push("l", [][]byte{[]byte(v)}, false)
+			want = append(want, v)
+		}
+		if i%5 == 0 {
+			s.Pop("l", 1, false)
+			want = want[:len(want)-1]
+		}
+	}
+
+	values, _ := s.LRange("l", 0, -1)
+	got := make([]string, len(values))
+	for i, v := range values {
+		got[i] = string(v)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("LRange() = %v, want %v", got, want)
+	}
+}
+
+func TestMemoryStorage_WatchKeys(t *testing.T) {
+	s := NewMemoryStorage()
+
+	ready, cancel := s.WatchKeys([]string{"a", "b"})
+	defer cancel()
+
+	s.Push("b", [][]byte{[]byte("x")}, false)
+	select {
+	case <-ready:
+	default:
+		t.Fatal("push to a watched key did not signal the watcher")
+	}
+
+	s.Set("a", []byte("x"))
+	select {
+	case <-ready:
+		t.Error("SET signalled a client blocked on a list")
+	default:
+	}
+}
+
+func TestMemoryStorage_SetOpStoreReplacesDestination(t *testing.T) {
+	s := NewMemoryStorage()
+	s.SAdd("a", [][]byte{[]byte("1"), []byte("2")})
+	s.SAdd("b", [][]byte{[]byte("2"), []byte("3")})
+	s.Set("dst", []byte("string"))
+	s.SetTTL("dst", 100)
+
+	if n, err := s.SetOpStore(SetUnion, "dst", []string{"a", "b"}); n != 3 || err != nil {
+		t.Fatalf("SetOpStore() = %d, %v, want 3, nil", n, err)
+	}
+	if ttl := s.GetTTL("dst"); ttl != -1 {
+		t.Errorf("GetTTL() = %d, the stored result must not keep the old TTL", ttl)
+	}
+
+	// The destination may be one of the sources.
+	if n, _ := s.SetOpStore(SetDiff, "dst", []string{"dst", "a"}); n != 1 {
+		t.Errorf("SetOpStore() = %d, want 1", n)
+	}
+	if ok, _ := s.SIsMember("dst", []byte("3")); !ok {
+		t.Error("dst must hold the difference {3}")
+	}
+
+	// The stored result must not share members with its sources.
+	s.SAdd("a", [][]byte{[]byte("4")})
+	s.SetOpStore(SetUnion, "copy", []string{"a"})
+	s.SRem("a", [][]byte{[]byte("4")})
+	if ok, _ := s.SIsMember("copy", []byte("4")); !ok {
+		t.Error("changing a source changed the stored result")
+	}
+}
+
+func TestMemoryStorage_SetRandomMembers(t *testing.T) {
+	const size = 1000
+	s := NewMemoryStorage()
+	for i := range size {
+		s.SAdd("set", [][]byte{[]byte(strconv.Itoa(i))})
+	}
+
+	distinct := func(members [][]byte) int {
+		seen := make(map[string]bool)
+		for _, member := range members {
+			if n, err := strconv.Atoi(string(member)); err != nil || n < 0 || n >= size {
+				t.Fatalf("picked %q, which is not a member", member)
+			}
+			seen[string(member)] = true
+		}
+		return len(seen)
+	}
+
+	// Few members are picked at random, most by shuffling a copy.
+	for _, count := range []int64{1, 10, 400, size - 1, size, size + 1} {
+		members, _ := s.SRandMember("set", count)
+		if want := min(int(count), size); len(members) != want || distinct(members) != want {
+			t.Errorf("SRandMember(%d) returned %d members, %d distinct", count, len(members), distinct(members))
+		}
+	}
+	if members, _ := s.SRandMember("set", -size); len(members) != size || distinct(members) == size {
+		t.Errorf("SRandMember(%d) returned %d members, %d distinct", -size, len(members), distinct(members))
+	}
+	// Longer replies are picked from the members by the caller.
+	if members, _ := s.SRandMember("set", -3*size); len(members) != size || distinct(members) != size {
+		t.Errorf("SRandMember(%d) returned %d members, %d distinct", -3*size, len(members), distinct(members))
+	}
+
+	// Every member is as likely to be picked.
+	picks := make(map[string]int)
+	for range 20 * size {
+		members, _ := s.SRandMember("set", 1)
+		picks[string(members[0])]++
+	}
+	if len(picks) != size {
+		t.Errorf("SRandMember(1) picked %d of %d members in %d tries", len(picks), size, 20*size)
+	}
+
+	popped, _ := s.SPop("set", 10)
+	if distinct(popped) != 10 {
+		t.Errorf("SPop(10) returned %d members", len(popped))
+	}
+	for _, member := range popped {
+		if ok, _ := s.SIsMember("set", member); ok {
+			t.Errorf("SPop(10) left %q in the set", member)
+		}
+	}
+	popped, _ = s.SPop("set", size)
+	if len(popped) != size-10 || s.Exists("set") != 0 {
+		t.Errorf("SPop(%d) returned %d members, the set exists: %d", size, len(popped), s.Exists("set"))
+	}
+}
+
+func TestMemoryStorage_SortedSetOrderAndRanks(t *testing.T) {
+	s := NewMemoryStorage()
+	want := map[string]float64{}
+
+	for i := 0; i < 2000; i++ {
+		member := fmt.Sprint("m", rand.IntN(500))
+		switch rand.IntN(3) {
+		case 0:
+			s.ZRem("z", [][]byte{[]byte(member)})
+			delete(want, member)
+		default:
+			score := float64(rand.IntN(100))
+			s.ZAdd("z", 0, []float64{score}, [][]byte{[]byte(member)})
+			want[member] = score
+		}
+	}
+
+	members, _ := s.ZRange("z", ZRangeSpec{Start: 0, Stop: -1})
+	if len(members) != len(want) {
+		t.Fatalf("ZRange() returned %d members, want %d", len(members), len(want))
+	}
+	for i, m := range members {
+		if m.Score != want[string(m.Member)] {
+			t.Errorf("score of %s = %v, want %v", m.Member, m.Score, want[string(m.Member)])
+		}
+		if i > 0 {
+			prev := members[i-1]
+			if prev.Score > m.Score || (prev.Score == m.Score && string(prev.Member) >= string(m.Member)) {
+				t.Fatalf("members %d and %d are out of order: %v, %v", i-1, i, prev, m)
+			}
+		}
+		if rank, _, _, _ := s.ZRank("z", m.Member, false); rank != int64(i) {
+			t.Fatalf("ZRank(%s) = %d, want %d", m.Member, rank, i)
+		}
+	}
+
+	byScore, _ := s.ZRange("z", ZRangeSpec{By: ZRangeByScore, Score: ScoreRange{Min: 20, Max: 40, MaxExclusive: true}, Count: -1})
+	count, _ := s.ZCount("z", ScoreRange{Min: 20, Max: 40, MaxExclusive: true})
+	expected := 0
+	for _, score := range want {
+		if score >= 20 && score < 40 {
+			expected++
+		}
+	}
+	if len(byScore) != expected || count != int64(expected) {
+		t.Errorf("ZRange() by score returned %d members and ZCount() %d, want %d", len(byScore), count, expected)
+	}
+}
+
+func BenchmarkMemoryStorage_ZAdd(b *testing.B) {
+	s := NewMemoryStorage()
+	members := make([][]byte, 1<<16)
+	for i := range members {
+		members[i] = []byte(fmt.Sprint("member:", i))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.ZAdd("board", 0, []float64{float64(rand.IntN(1 << 20))}, [][]byte{members[i%len(members)]})
+	}
+}
+
+func BenchmarkMemoryStorage_ZRange(b *testing.B) {
+	for _, size := range []int{1_000, 100_000} {
+		s := NewMemoryStorage()
+		for i := 0; i < size; i++ {
+			s.ZAdd("board", 0, []float64{float64(i)}, [][]byte{[]byte(fmt.Sprint("member:", i))})
+		}
+
+		b.Run(fmt.Sprint("ByScore/", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				min := float64(rand.IntN(size))
+				s.ZRange("board", ZRangeSpec{By: ZRangeByScore, Score: ScoreRange{Min: min, Max: min + 10}, Count: -1})
+			}
+		})
+
+		b.Run(fmt.Sprint("ByRank/", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				start := int64(rand.IntN(size))
+				s.ZRange("board", ZRangeSpec{Start: start, Stop: start + 10})
+			}
+		})
+
+		b.Run(fmt.Sprint("Rank/", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s.ZRank("board", []byte(fmt.Sprint("member:", rand.IntN(size))), false)
+			}
+		})
+	}
+}
+
+func TestMemoryStorage_StreamAutoIDsAndTrim(t *testing.T) {
+	s := NewMemoryStorage()
+	field := [][]byte{[]byte("f"), []byte("v")}
+
+	var last StreamID
+	for i := 0; i < 1000; i++ {
+		id, _, err := s.XAdd("s", XAddOptions{AutoID: true, Trim: StreamTrim{Strategy: TrimMaxLen, MaxLen: 100}}, field)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id.Compare(last) <= 0 {
+			t.Fatalf("XAdd() returned %v after %v, want increasing IDs", id, last)
+		}
+		last = id
+	}
+
+	if n, _ := s.XLen("s"); n != 100 {
+		t.Errorf("XLen() = %d after trimming to 100, want 100", n)
+	}
+	entries, _ := s.XRange("s", StreamID{}, MaxStreamID, -1, true)
+	if len(entries) != 100 || entries[0].ID != last {
+		t.Fatalf("XRange() returned %d entries starting at %v, want 100 starting at %v", len(entries), entries[0].ID, last)
+	}
+
+	// Trimming everything keeps the stream and its last ID.
+	if _, _, err := s.XAdd("s", XAddOptions{ID: StreamID{Ms: last.Ms + 1}, Trim: StreamTrim{Strategy: TrimMaxLen}}, field); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.XAdd("s", XAddOptions{ID: last}, field); !errors.Is(err, ErrStreamIDTooSmall) {
+		t.Errorf("XAdd() of an old ID on an emptied stream = %v, want ErrStreamIDTooSmall", err)
+	}
+	if n, _ := s.XLen("s"); n != 0 || s.Exists("s") != 1 {
+		t.Errorf("XLen() = %d, Exists() = %d after MAXLEN 0, want an empty stream", n, s.Exists("s"))
+	}
+}
+
+func TestMemoryStorage_BitCountAndPosMatchBits(t *testing.T) {
+	s := NewMemoryStorage()
+	value := make([]byte, 100)
+	for i := range value {
+		value[i] = byte(rand.IntN(256))
+	}
+	value[40], value[41] = 0, 0xff
+	s.Set("bits", value)
+
+	for range 500 {
+		start, end := rand.Int64N(900)-50, rand.Int64N(900)-50
+
+		var want int64
+		firstSet, firstClear := int64(-1), int64(-1)
+		if from, to, ok := normalizeRange(start, end, 800); ok {
+			for i := from; i <= to; i++ {
+				set := value[i/8]&(0x80>>(i%8)) != 0
+				if set {
+					want++
+				}
+				if set && firstSet < 0 {
+					firstSet = i
+				}
+				if !set && firstClear < 0 {
+					firstClear = i
+				}
+			}
+		}
+
+		if got, _ := s.BitCount("bits", start, end, true); got != want {
+			t.Fatalf("BitCount(%d, %d) = %d, want %d", start, end, got, want)
+		}
+		if got, _ := s.BitPos("bits", true, start, end, true, true); got != firstSet {
+			t.Fatalf("BitPos(1, %d, %d) = %d, want %d", start, end, got, firstSet)
+		}
+		if got, _ := s.BitPos("bits", false, start, end, true, true); got != firstClear {
+			t.Fatalf("BitPos(0, %d, %d) = %d, want %d", start, end, got, firstClear)
+		}
+	}
+}
+
+func TestMemoryStorage_HyperLogLogErrorBound(t *testing.T) {
+	s := NewMemoryStorage()
+	added := 0
+	for _, n := range []int{10, 100, 1000, 10000, 100000, 300000} {
+		elements := make([][]byte, 0, n-added)
+		for ; added < n; added++ {
+			elements = append(elements, []byte(fmt.Sprintf("element:%d", added)))
+		}
+		if _, err := s.PFAdd("hll", elements); err != nil {
+			t.Fatalf("PFAdd: %v", err)
+		}
+
+		// The standard error with 16384 registers is 0.81%, allow three times
+		// that and an off by one for small sets.
+		got, _ := s.PFCount([]string{"hll"})
+		if diff := math.Abs(float64(got - int64(n))); diff > 1 && diff > 0.025*float64(n) {
+			t.Errorf("PFCount after %d elements = %d", n, got)
+		}
+		if cached, _ := s.PFCount([]string{"hll"}); cached != got {
+			t.Errorf("cached PFCount = %d, want %d", cached, got)
+		}
+
+		str, _, _ := s.Get("hll")
+		if sparse := n <= 1000; (str[4] == hllSparse) != sparse {
+			t.Errorf("encoding after %d elements = %d, want sparse %v", n, str[4], sparse)
+		}
+	}
+}
+
+func TestMemoryStorage_HyperLogLogMerge(t *testing.T) {
+	s := NewMemoryStorage()
+	for i := range 20000 {
+		key := "a"
+		if i%2 == 1 {
+			key = "b"
+		}
+		s.PFAdd(key, [][]byte{[]byte(strconv.Itoa(i))})
+	}
+	s.PFAdd("small", [][]byte{[]byte("1"), []byte("x")})
+
+	union, _ := s.PFCount([]string{"a", "b", "small", "missing"})
+	if diff := math.Abs(float64(union - 20001)); diff > 0.025*20001 {
+		t.Errorf("PFCount over keys = %d, want about 20001", union)
+	}
+
+	if err := s.PFMerge("small", []string{"a", "b"}); err != nil {
+		t.Fatalf("PFMerge: %v", err)
+	}
+	if merged, _ := s.PFCount([]string{"small"}); merged != union {
+		t.Errorf("PFCount after PFMerge = %d, want %d", merged, union)
+	}
+
+	// Sparse sources give a sparse result, in the same encoding Redis uses.
+	s.PFMerge("empty", []string{"missing"})
+	if str, _, _ := s.Get("empty"); string(str) != "HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x80\x7f\xff" {
+		t.Errorf("empty merge = %q", str)
+	}
+
+	s.Set("str", []byte("HYLL"))
+	if _, err := s.PFAdd("str", nil); err != ErrNotHLL {
+		t.Errorf("PFAdd on a plain string: %v, want ErrNotHLL", err)
+	}
+	s.Set("str", []byte("HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7f\xfe"))
+	if _, err := s.PFCount([]string{"str", "a"}); err != ErrCorruptHLL {
+		t.Errorf("PFCount on a truncated sparse HLL: %v, want ErrCorruptHLL", err)
+	}
+
+	// Dense registers are 6 bits wide, but runs of zeros are at most 51 long.
+	// Redis accepts larger registers, and so do we, counting them as 51.
+	a, _, _ := s.Get("a")
+	if a[4] != hllDense {
+		t.Fatal("a is not dense")
+	}
+	high, clamped := bytes.Clone(a), bytes.Clone(a)
+	for _, index := range []int{0, 1, 777, hllRegisters - 1} {
+		hllDenseSet(high[hllHeaderSize:], index, hllRegisterMax)
+		hllDenseSet(clamped[hllHeaderSize:], index, hllQ+1)
+	}
+	high[hllCacheStaleByte] |= hllCacheStaleBit
+	clamped[hllCacheStaleByte] |= hllCacheStaleBit
+	s.Set("high", high)
+	s.Set("clamped", clamped)
+
+	want, _ := s.PFCount([]string{"clamped"})
+	if got, err := s.PFCount([]string{"high"}); err != nil || got != want {
+		t.Errorf("PFCount with registers above 51 = %d, %v, want %d", got, err, want)
+	}
+	if got, err := s.PFCount([]string{"high", "b"}); err != nil || got < want {
+		t.Errorf("PFCount over registers above 51 = %d, %v, want at least %d", got, err, want)
+	}
+	if err := s.PFMerge("merged", []string{"high"}); err != nil {
+		t.Fatalf("PFMerge of registers above 51: %v", err)
+	}
+	if got, _ := s.PFCount([]string{"merged"}); got != want {
+		t.Errorf("PFCount after PFMerge of registers above 51 = %d, want %d", got, want)
+	}
+}
+
+func TestMemoryStorage_GeoSearchMatchesBruteForce(t *testing.T) {
+	s := NewMemoryStorage()
+	var members [][]byte
+	var scores []float64
+	for i := range 3000 {
+		lon := rand.Float64()*360 - 180
+		lat := rand.Float64()*2*GeoLatMax - GeoLatMax
+		if i%3 == 0 {
+			// Crowd points around the antimeridian and near the poles.
+			lon = 179 + rand.Float64()*2
+			if lon > 180 {
+				lon -= 360
+			}
+			lat = 84 - rand.Float64()*10
+		}
+		members = append(members, []byte(strconv.Itoa(i)))
+		scores = append(scores, GeoEncode(lon, lat))
+	}
+	s.ZAdd("geo", 0, scores, members)
+
+	for range 300 {
+		spec := GeoSearchSpec{Lon: rand.Float64()*360 - 180, Lat: rand.Float64()*170 - 85, Unit: 1000}
+		if rand.IntN(2) == 0 {
+			spec.Lon, spec.Lat = 180, 80
+		}
+		size := math.Pow(10, rand.Float64()*4)
+		if rand.IntN(2) == 0 {
+			spec.Radius = size
+		} else {
+			spec.ByBox, spec.Width, spec.Height = true, size, size*(0.5+rand.Float64())
+		}
+
+		want := 0
+		for _, score := range scores {
+			lon, lat := GeoDecode(score)
+			if _, ok := geoInArea(spec.Lon, spec.Lat, lon, lat, spec); ok {
+				want++
+			}
+		}
+
+		results, err := s.GeoSearch("geo", spec)
+		if err != nil {
+			t.Fatalf("GeoSearch: %v", err)
+		}
+		if len(results) != want {
+			t.Fatalf("GeoSearch(%+v) found %d members, want %d", spec, len(results), want)
+		}
+	}
+}
+
+func TestMemoryStorage_CopyIsIndependent(t *testing.T) {
+	s := NewMemoryStorage()
+	s.Set("str", []byte("abc"))
+	s.HSet("hash", []string{"f"}, [][]byte{[]byte("v")})
+	s.XAdd("stream", XAddOptions{AutoID: true}, [][]byte{[]byte("f"), []byte("v")})
+	s.XGroupCreate("stream", "g", StreamID{}, false, false)
+
+	for _, key := range []string{"str", "hash", "stream"} {
+		if copied, _ := s.Copy(key, key+"2", false); !copied {
+			t.Fatalf("Copy(%q) did not copy", key)
+		}
+	}
+
+	s.SetBit("str2", 0, true)
+	s.HSet("hash2", []string{"f"}, [][]byte{[]byte("changed")})
+	s.XAdd("stream2", XAddOptions{AutoID: true}, [][]byte{[]byte("f"), []byte("v")})
+	s.XGroupCreateConsumer("stream2", "g", "alice")
+
+	if str, _, _ := s.Get("str"); string(str) != "abc" {
+		t.Errorf("source string changed to %q", str)
+	}
+	if value, _, _ := s.HGet("hash", "f"); string(value) != "v" {
+		t.Errorf("source hash field changed to %q", value)
+	}
+	if n, _ := s.XLen("stream"); n != 1 {
+		t.Errorf("source stream has %d entries, want 1", n)
+	}
+	if created, _ := s.XGroupCreateConsumer("stream", "g", "alice"); !created {
+		t.Error("consumer created on the copy exists in the source")
+	}
+	if s.Type("stream2") != TypeStream {
+		t.Errorf("Type(stream2) = %v, want stream", s.Type("stream2"))
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, str string
+		match        bool
+	}{
+		{"*", "", true},
+		{"", "", true},
+		{"", "a", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "hllo", true},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hallo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`h[\]]llo`, "h]llo", true},
+		{"user:*:name", "user:42:name", true},
+		{"user:*:name", "user:42:email", false},
+		{"a*b*c*d", "abcd", true},
+		{"a*", "a", true},
+		{"*a*a*a*a*a*a*a*a*a*b", strings.Repeat("a", 100), false},
+		{"h[ae", "ha", true},
+	}
+
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.str); got != tt.match {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.str, got, tt.match)
+		}
+	}
+}
+
+func TestMemoryStorage_ScanWhileResizing(t *testing.T) {
+	s := NewMemoryStorage()
+	for i := range 1000 {
+		s.Set("stable:"+strconv.Itoa(i), nil)
+	}
+
+	// The table grows while the scan starts and shrinks back during its
+	// second half, rehashing in between calls.
+	seen := make(map[string]bool)
+	cursor, calls := uint64(0), 0
+	for {
+		var keys []string
+		cursor, keys = s.Scan(cursor, ScanOptions{Count: 10})
+		for _, key := range keys {
+			seen[key] = true
+		}
+		if cursor == 0 {
+			break
+		}
+
+		calls++
+		for j := range 100 {
+			key := fmt.Sprintf("churn:%d:%d", calls, j)
+			if calls < 50 {
+				s.Set(key, nil)
+			} else {
+				s.Delete(fmt.Sprintf("churn:%d:%d", calls-49, j))
+			}
+		}
+	}
+
+	for i := range 1000 {
+		if key := "stable:" + strconv.Itoa(i); !seen[key] {
+			t.Fatalf("SCAN missed %q", key)
+		}
+	}
+}
+
+func TestMemoryStorage_ScanFiltersAndCollections(t *testing.T) {
+	s := NewMemoryStorage()
+	for i := range 100 {
+		s.Set("str:"+strconv.Itoa(i), nil)
+		s.SAdd("set", [][]byte{[]byte(strconv.Itoa(i))})
+	}
+	s.SAdd("set:key", [][]byte{[]byte("x")})
+
+	var keys []string
+	for cursor := uint64(0); ; {
+		var page []string
+		cursor, page = s.Scan(cursor, ScanOptions{Count: 7, Type: TypeSet})
+		keys = append(keys, page...)
+		if cursor == 0 {
+			break
+		}
+	}
+	slices.Sort(keys)
+	if !slices.Equal(keys, []string{"set", "set:key"}) {
+		t.Errorf("SCAN TYPE set = %q", keys)
+	}
+
+	seen := make(map[string]int)
+	for cursor := uint64(0); ; {
+		var page [][]byte
+		cursor, page, _ = s.SScan("set", cursor, ScanOptions{Count: 7, Match: []byte("1*")})
+		for _, member := range page {
+			seen[string(member)]++
+		}
+		s.SAdd("set", [][]byte{[]byte(fmt.Sprintf("new:%d", cursor))})
+		if cursor == 0 {
+			break
+		}
+	}
+	// 1 and 10 to 19, each exactly once.
+	if len(seen) != 11 {
+		t.Errorf("SSCAN MATCH 1* returned %v", seen)
+	}
+	for member, n := range seen {
+		if n != 1 || !strings.HasPrefix(member, "1") {
+			t.Errorf("SSCAN returned %q %d times", member, n)
+		}
+	}
+}
+
+func TestMemoryStorage_SScanLargeSetWhileAdding(t *testing.T) {
+	const size = 100000
+	s := NewMemoryStorage()
+	for i := range size {
+		s.SAdd("large", [][]byte{[]byte("m:" + strconv.Itoa(i))})
+	}
+	for i := range size / 100 {
+		s.SAdd("small", [][]byte{[]byte("m:" + strconv.Itoa(i))})
+	}
+
+	// The set keeps growing, and rehashing, during the scan.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				s.SAdd("large", [][]byte{[]byte("new:" + strconv.Itoa(i))})
+			}
+		}
+	}()
+
+	seen := make(map[string]bool)
+	for cursor := uint64(0); ; {
+		var page [][]byte
+		cursor, page, _ = s.SScan("large", cursor, ScanOptions{Count: 100})
+		if len(page) > 200 {
+			t.Fatalf("SSCAN COUNT 100 returned %d members", len(page))
+		}
+		for _, member := range page {
+			seen[string(member)] = true
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	for i := range size {
+		if member := "m:" + strconv.Itoa(i); !seen[member] {
+			t.Fatalf("SSCAN missed %q", member)
+		}
+	}
+
+	// A call only looks at the buckets it returns, so it takes about as long
+	// on a set a hundred times larger.
+	perCall := func(key string) time.Duration {
+		best := time.Duration(math.MaxInt64)
+		for range 5 {
+			start := time.Now()
+			for cursor := range uint64(1000) {
+				s.SScan(key, bits.Reverse64(cursor), ScanOptions{Count: 10})
+			}
+			best = min(best, time.Since(start))
+		}
+		return best / 1000
+	}
+	if small, large := perCall("small"), perCall("large"); large > 10*small {
+		t.Errorf("SSCAN COUNT 10 takes %v on %d members and %v on %d", small, size/100, large, size)
+	}
+}
+
+// rewritten returns the commands that rebuild the dataset, sorted, with the
+// elements of hashes, sets and sorted sets sorted too.
+func rewritten(t *testing.T, s *MemoryStorage) []string {
+	t.Helper()
+	var commands []string
+	snap := s.Snapshot()
+	defer snap.Release()
+	err := snap.Rewrite(func(args [][]byte) error {
+		chunk := map[string]int{"HSET": 2, "SADD": 1, "ZADD": 2}[string(args[0])]
+		if chunk == 0 {
+			commands = append(commands, string(bytes.Join(args, []byte(" "))))
+			return nil
+		}
+		var elements []string
+		for i := 2; i < len(args); i += chunk {
+			elements = append(elements, string(bytes.Join(args[i:i+chunk], []byte(" "))))
+		}
+		slices.Sort(elements)
+		commands = append(commands, string(args[0])+" "+string(args[1])+" "+strings.Join(elements, " "))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(commands)
+	return commands
+}
+
+func TestMemoryStorage_RDBRoundTrip(t *testing.T) {
+	s := NewMemoryStorage()
+	s.Set("str", []byte("a\x00b\r\n"))
+	s.Set("volatile", []byte("v"))
+	s.ExpireAt("volatile", time.Now().Add(time.Hour), 0)
+	s.Set("soon", []byte("v"))
+	s.ExpireAt("soon", time.Now().Add(20*time.Millisecond), 0)
+	s.HSet("hash", []string{"f1", "f2"}, [][]byte{[]byte("v1"), []byte("")})
+	s.Push("list", [][]byte{[]byte("a"), []byte("b"), []byte("a")}, false)
+	s.SAdd("set", [][]byte{[]byte("x"), []byte("y")})
+	s.ZAdd("zset", 0, []float64{1.5, math.Inf(-1), -0.25}, [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+	s.XAdd("stream", XAddOptions{ID: StreamID{1, 1}}, [][]byte{[]byte("f"), []byte("1")})
+	s.XAdd("stream", XAddOptions{ID: StreamID{2, 0}}, [][]byte{[]byte("f"), []byte("2")})
+	s.XGroupCreate("stream", "g", StreamID{}, false, false)
+	s.XGroupCreateConsumer("stream", "g", "bob")
+	s.XReadGroup("g", "alice", []GroupRead{{Key: "stream", New: true}}, 1, false, 1000)
+	s.XGroupCreate("empty", "g", StreamID{}, false, true)
+
+	var buf bytes.Buffer
+	if err := s.Snapshot().WriteRDB(&buf, map[string]string{"aof-offset": "42"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	loaded := NewMemoryStorage()
+	loaded.Set("stale", []byte("replaced by the snapshot"))
+	aux, err := loaded.LoadRDB(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aux["aof-offset"] != "42" {
+		t.Errorf("aux = %v", aux)
+	}
+	if loaded.Exists("stale", "soon") != 0 {
+		t.Error("LoadRDB kept a key missing from the snapshot or an expired one")
+	}
+	if got, want := rewritten(t, loaded), rewritten(t, s); !slices.Equal(got, want) {
+		t.Errorf("loaded dataset:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestMemoryStorage_LoadRDBRejectsCorruption(t *testing.T) {
+	s := NewMemoryStorage()
+	s.Set("key", []byte("value"))
+	var buf bytes.Buffer
+	if err := s.Snapshot().WriteRDB(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	loaded := NewMemoryStorage()
+	loaded.Set("kept", []byte("v"))
+	for i := range data {
+		corrupt := slices.Clone(data)
+		corrupt[i] ^= 0x20
+		if _, err := loaded.LoadRDB(bytes.NewReader(corrupt)); err == nil {
+			t.Errorf("LoadRDB accepted byte %d flipped", i)
+		}
+	}
+	if _, err := loaded.LoadRDB(bytes.NewReader(data[:len(data)-1])); !errors.Is(err, ErrCorruptSnapshot) {
+		t.Errorf("LoadRDB of a truncated snapshot = %v", err)
+	}
+	if value, _, _ := loaded.Get("kept"); string(value) != "v" {
+		t.Error("a failed LoadRDB changed the dataset")
+	}
+}
+
+func TestMemoryStorage_SnapshotIsCopyOnWrite(t *testing.T) {
+	const size = 20000
+	s := NewMemoryStorage()
+	for i := range size {
+		s.Set("k:"+strconv.Itoa(i), []byte("0"))
+	}
+	s.SAdd("set", [][]byte{[]byte("a")})
+	s.HSet("hash", []string{"f"}, [][]byte{[]byte("v")})
+	want := rewritten(t, s)
+
+	// Taking the snapshot copies nothing, and the items are then collected a
+	// bounded number of buckets at a time, while commands keep running.
+	snap := s.Snapshot()
+	defer snap.Release()
+	if len(snap.items) != 0 {
+		t.Fatalf("Snapshot() copied %d items", len(snap.items))
+	}
+	s.Append("k:0", []byte("1"))
+	s.SAdd("set", [][]byte{[]byte("b")})
+	s.HSet("hash", []string{"f"}, [][]byte{[]byte("w")})
+	s.Rename("k:1", "moved", false)
+	s.Delete("k:2")
+	for step := 0; ; step++ {
+		collected := len(snap.items)
+		done := snap.collectStep()
+		if n := len(snap.items) - collected; n > 2*snapshotCollectBuckets {
+			t.Fatalf("collected %d items while holding the lock", n)
+		}
+		if done {
+			break
+		}
+		s.Set("k:"+strconv.Itoa(step*997%size), []byte("1"))
+		s.Delete("k:" + strconv.Itoa(step*499%size))
+		s.Set("new:"+strconv.Itoa(step), nil)
+	}
+	s.Flush()
+
+	var got []string
+	snap.Rewrite(func(args [][]byte) error {
+		got = append(got, string(bytes.Join(args, []byte(" "))))
+		return nil
+	})
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("the snapshot has %d commands, want %d: %q...", len(got), len(want), got[:min(len(got), 5)])
+	}
+}
+
+func TestMemoryStorage_SnapshotWhileWriting(t *testing.T) {
+	s := NewMemoryStorage()
+	for i := range 10000 {
+		s.Set("k:"+strconv.Itoa(i), []byte("0"))
+		s.SAdd("set:"+strconv.Itoa(i%1000), [][]byte{[]byte(strconv.Itoa(i))})
+	}
+	want := rewritten(t, s)
+
+	snap := s.Snapshot()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			key := strconv.Itoa(rand.IntN(10000))
+			s.Append("k:"+key, []byte("1"))
+			s.SAdd("set:"+strconv.Itoa(i%1000), [][]byte{[]byte("new:" + key)})
+			s.Delete("k:" + strconv.Itoa(rand.IntN(10000)))
 		}
 	}()
 
+	var buf bytes.Buffer
+	err := snap.WriteRDB(&buf, nil)
+	close(done)
 	wg.Wait()
+	snap.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewMemoryStorage()
+	if _, err := loaded.LoadRDB(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := rewritten(t, loaded); !slices.Equal(got, want) {
+		t.Errorf("the snapshot has %d commands, want %d", len(got), len(want))
+	}
+}
+
+func BenchmarkMemoryStorage_Snapshot(b *testing.B) {
+	s := NewMemoryStorage()
+	for i := range 100000 {
+		s.Set("k:"+strconv.Itoa(i), []byte("value"))
+	}
+
+	// Commands only wait for Snapshot, and for one step at a time while the
+	// snapshot is written out.
+	b.Run("Snapshot", func(b *testing.B) {
+		for range b.N {
+			s.Snapshot().Release()
+		}
+	})
+	b.Run("CollectStep", func(b *testing.B) {
+		snap := s.Snapshot()
+		defer snap.Release()
+		for range b.N {
+			if snap.collectStep() {
+				snap.items, snap.cursor, snap.collected = make(map[string]Item), 0, false
+			}
+		}
+	})
 }
@@ -0,0 +1,467 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc64"
+	"io"
+	"math"
+	"time"
+)
+
+// The binary snapshot format, after Redis' RDB: the magic string and the
+// version, auxiliary fields, then the keys, each as an optional expiry, the
+// type of the value, the key and the value, and finally an end marker and the
+// CRC64 of everything before it. Lengths and counts are uvarints, times and
+// scores little endian 64-bit integers and floats.
+const (
+	rdbMagic   = "MYRDB"
+	rdbVersion = 1
+
+	rdbOpAux      = 0xfa
+	rdbOpExpireMs = 0xfc
+	rdbOpEOF      = 0xff
+
+	rdbTypeString = 0
+	rdbTypeList   = 1
+	rdbTypeSet    = 2
+	rdbTypeZSet   = 3
+	rdbTypeHash   = 4
+	rdbTypeStream = 5
+
+	// rdbMaxLen bounds the lengths read, so that a corrupt one does not
+	// allocate all the memory.
+	rdbMaxLen = 512 << 20
+)
+
+var ErrCorruptSnapshot = errors.New("corrupt snapshot")
+
+var rdbCRCTable = crc64.MakeTable(crc64.ECMA)
+
+// WriteRDB writes the snapshot in the binary format, with aux as its
+// auxiliary fields.
+func (snap *Snapshot) WriteRDB(w io.Writer, aux map[string]string) error {
+	bw := bufio.NewWriter(w)
+	crc := crc64.New(rdbCRCTable)
+	out := io.MultiWriter(bw, crc)
+
+	buf := append([]byte(rdbMagic), rdbVersion)
+	for key, value := range aux {
+		buf = append(buf, rdbOpAux)
+		buf = appendRDBString(buf, []byte(key))
+		buf = appendRDBString(buf, []byte(value))
+	}
+	if _, err := out.Write(buf); err != nil {
+		return err
+	}
+
+	snap.collect()
+	for key, item := range snap.items {
+		buf = buf[:0]
+		if item.ExpiresAt > 0 {
+			buf = append(buf, rdbOpExpireMs)
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(item.ExpiresAt))
+		}
+		buf = appendRDBValue(buf, []byte(key), item.Value)
+		if _, err := out.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	if _, err := out.Write([]byte{rdbOpEOF}); err != nil {
+		return err
+	}
+	if _, err := bw.Write(binary.LittleEndian.AppendUint64(nil, crc.Sum64())); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func appendRDBString(buf, s []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendRDBStreamID(buf []byte, id StreamID) []byte {
+	buf = binary.AppendUvarint(buf, id.Ms)
+	return binary.AppendUvarint(buf, id.Seq)
+}
+
+func appendRDBValue(buf, key []byte, value any) []byte {
+	switch v := value.(type) {
+	case []byte:
+		buf = append(buf, rdbTypeString)
+		buf = appendRDBString(buf, key)
+		return appendRDBString(buf, v)
+
+	case *list:
+		buf = append(buf, rdbTypeList)
+		buf = appendRDBString(buf, key)
+		buf = binary.AppendUvarint(buf, uint64(v.size))
+		for i := range v.size {
+			buf = appendRDBString(buf, v.at(i))
+		}
+		return buf
+
+	case *set:
+		buf = append(buf, rdbTypeSet)
+		buf = appendRDBString(buf, key)
+		buf = binary.AppendUvarint(buf, uint64(v.len()))
+		for member := range v.all() {
+			buf = appendRDBString(buf, []byte(member))
+		}
+		return buf
+
+	case *zset:
+		buf = append(buf, rdbTypeZSet)
+		buf = appendRDBString(buf, key)
+		buf = binary.AppendUvarint(buf, uint64(v.len()))
+		for member, score := range v.dict.all() {
+			buf = appendRDBString(buf, []byte(member))
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(score))
+		}
+		return buf
+
+	case *hash:
+		buf = append(buf, rdbTypeHash)
+		buf = appendRDBString(buf, key)
+		buf = binary.AppendUvarint(buf, uint64(v.len()))
+		for field, value := range v.all() {
+			buf = appendRDBString(buf, []byte(field))
+			buf = appendRDBString(buf, value)
+		}
+		return buf
+
+	case *stream:
+		buf = append(buf, rdbTypeStream)
+		buf = appendRDBString(buf, key)
+		buf = appendRDBStreamID(buf, v.lastID)
+		buf = binary.AppendUvarint(buf, uint64(len(v.entries)))
+		for _, entry := range v.entries {
+			buf = appendRDBStreamID(buf, entry.ID)
+			buf = binary.AppendUvarint(buf, uint64(len(entry.Fields)))
+			for _, field := range entry.Fields {
+				buf = appendRDBString(buf, field)
+			}
+		}
+
+		buf = binary.AppendUvarint(buf, uint64(len(v.groups)))
+		for name, g := range v.groups {
+			buf = appendRDBString(buf, []byte(name))
+			buf = appendRDBStreamID(buf, g.lastID)
+			buf = binary.AppendUvarint(buf, uint64(len(g.pending)))
+			for id, pe := range g.pending {
+				buf = appendRDBStreamID(buf, id)
+				buf = appendRDBString(buf, []byte(pe.consumer))
+				buf = binary.LittleEndian.AppendUint64(buf, uint64(pe.deliveryTime))
+				buf = binary.AppendUvarint(buf, uint64(pe.deliveryCount))
+			}
+			buf = binary.AppendUvarint(buf, uint64(len(g.consumers)))
+			for consumer := range g.consumers {
+				buf = appendRDBString(buf, []byte(consumer))
+			}
+		}
+		return buf
+	}
+	return buf
+}
+
+// LoadRDB replaces the dataset with a snapshot written by WriteRDB and
+// returns its auxiliary fields. Keys that have expired since are skipped. The
+// dataset is left untouched if the snapshot is corrupt.
+func (s *MemoryStorage) LoadRDB(r io.Reader) (map[string]string, error) {
+	rr := &rdbReader{r: bufio.NewReader(r)}
+
+	header, err := rr.read(len(rdbMagic) + 1)
+	if err != nil || string(header[:len(rdbMagic)]) != rdbMagic {
+		return nil, ErrCorruptSnapshot
+	}
+	if header[len(rdbMagic)] != rdbVersion {
+		return nil, errors.New("unsupported snapshot version")
+	}
+
+	aux := make(map[string]string)
+	items := make(map[string]Item)
+	now := time.Now()
+	expiresAt := int64(-1)
+	for {
+		op, err := rr.ReadByte()
+		if err != nil {
+			return nil, ErrCorruptSnapshot
+		}
+
+		switch op {
+		case rdbOpAux:
+			key, err1 := rr.readString()
+			value, err2 := rr.readString()
+			if err1 != nil || err2 != nil {
+				return nil, ErrCorruptSnapshot
+			}
+			aux[string(key)] = string(value)
+
+		case rdbOpExpireMs:
+			at, err := rr.readUint64()
+			if err != nil {
+				return nil, ErrCorruptSnapshot
+			}
+			expiresAt = int64(at)
+
+		case rdbOpEOF:
+			want := rr.crc
+			got, err := rr.readUint64()
+			if err != nil || got != want {
+				return nil, ErrCorruptSnapshot
+			}
+
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			s.clear()
+			for key, item := range items {
+				s.setItem(key, item)
+			}
+			return aux, nil
+
+		default:
+			key, err := rr.readString()
+			if err != nil {
+				return nil, ErrCorruptSnapshot
+			}
+			value, err := rr.readValue(op)
+			if err != nil {
+				return nil, ErrCorruptSnapshot
+			}
+			item := Item{Value: value, ExpiresAt: expiresAt}
+			if !item.expired(now) {
+				items[string(key)] = item
+			}
+			expiresAt = -1
+		}
+	}
+}
+
+// rdbReader reads a snapshot, keeping the CRC64 of what it read.
+type rdbReader struct {
+	r   *bufio.Reader
+	crc uint64
+}
+
+func (rr *rdbReader) ReadByte() (byte, error) {
+	b, err := rr.r.ReadByte()
+	if err == nil {
+		rr.crc = crc64.Update(rr.crc, rdbCRCTable, []byte{b})
+	}
+	return b, err
+}
+
+func (rr *rdbReader) read(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(rr.r, buf); err != nil {
+		return nil, err
+	}
+	rr.crc = crc64.Update(rr.crc, rdbCRCTable, buf)
+	return buf, nil
+}
+
+func (rr *rdbReader) readLen() (int, error) {
+	n, err := binary.ReadUvarint(rr)
+	if err != nil {
+		return 0, err
+	}
+	if n > rdbMaxLen {
+		return 0, ErrCorruptSnapshot
+	}
+	return int(n), nil
+}
+
+func (rr *rdbReader) readString() ([]byte, error) {
+	n, err := rr.readLen()
+	if err != nil {
+		return nil, err
+	}
+	return rr.read(n)
+}
+
+func (rr *rdbReader) readUint64() (uint64, error) {
+	buf, err := rr.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf), nil
+}
+
+func (rr *rdbReader) readStreamID() (StreamID, error) {
+	ms, err := binary.ReadUvarint(rr)
+	if err != nil {
+		return StreamID{}, err
+	}
+	seq, err := binary.ReadUvarint(rr)
+	return StreamID{ms, seq}, err
+}
+
+func (rr *rdbReader) readValue(valueType byte) (any, error) {
+	if valueType == rdbTypeString {
+		return rr.readString()
+	}
+	if valueType == rdbTypeStream {
+		return rr.readStream()
+	}
+
+	n, err := rr.readLen()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		// Empty collections are never stored.
+		return nil, ErrCorruptSnapshot
+	}
+
+	switch valueType {
+	case rdbTypeList:
+		l := &list{}
+		for range n {
+			value, err := rr.readString()
+			if err != nil {
+				return nil, err
+			}
+			l.pushBack(value)
+		}
+		return l, nil
+
+	case rdbTypeSet:
+		st := newDict[struct{}]()
+		for range n {
+			member, err := rr.readString()
+			if err != nil {
+				return nil, err
+			}
+			st.set(string(member), struct{}{})
+		}
+		return st, nil
+
+	case rdbTypeZSet:
+		z := newZset()
+		for range n {
+			member, err := rr.readString()
+			if err != nil {
+				return nil, err
+			}
+			bits, err := rr.readUint64()
+			if err != nil {
+				return nil, err
+			}
+			score := math.Float64frombits(bits)
+			if math.IsNaN(score) {
+				return nil, ErrCorruptSnapshot
+			}
+			z.set(string(member), score)
+		}
+		return z, nil
+
+	case rdbTypeHash:
+		h := newDict[[]byte]()
+		for range n {
+			field, err := rr.readString()
+			if err != nil {
+				return nil, err
+			}
+			value, err := rr.readString()
+			if err != nil {
+				return nil, err
+			}
+			h.set(string(field), value)
+		}
+		return h, nil
+	}
+	return nil, ErrCorruptSnapshot
+}
+
+func (rr *rdbReader) readStream() (*stream, error) {
+	st := newStream()
+
+	var err error
+	if st.lastID, err = rr.readStreamID(); err != nil {
+		return nil, err
+	}
+	n, err := rr.readLen()
+	if err != nil {
+		return nil, err
+	}
+	for range n {
+		entry := StreamEntry{}
+		if entry.ID, err = rr.readStreamID(); err != nil {
+			return nil, err
+		}
+		fields, err := rr.readLen()
+		if err != nil {
+			return nil, err
+		}
+		for range fields {
+			field, err := rr.readString()
+			if err != nil {
+				return nil, err
+			}
+			entry.Fields = append(entry.Fields, field)
+		}
+		st.entries = append(st.entries, entry)
+	}
+
+	groups, err := rr.readLen()
+	if err != nil {
+		return nil, err
+	}
+	for range groups {
+		name, err := rr.readString()
+		if err != nil {
+			return nil, err
+		}
+		lastID, err := rr.readStreamID()
+		if err != nil {
+			return nil, err
+		}
+		g := newConsumerGroup(lastID)
+
+		pending, err := rr.readLen()
+		if err != nil {
+			return nil, err
+		}
+		for range pending {
+			id, err := rr.readStreamID()
+			if err != nil {
+				return nil, err
+			}
+			consumer, err := rr.readString()
+			if err != nil {
+				return nil, err
+			}
+			deliveryTime, err := rr.readUint64()
+			if err != nil {
+				return nil, err
+			}
+			deliveryCount, err := binary.ReadUvarint(rr)
+			if err != nil {
+				return nil, err
+			}
+			g.pending[id] = &pendingEntry{
+				consumer:      string(consumer),
+				deliveryTime:  int64(deliveryTime),
+				deliveryCount: int64(deliveryCount),
+			}
+		}
+
+		consumers, err := rr.readLen()
+		if err != nil {
+			return nil, err
+		}
+		for range consumers {
+			consumer, err := rr.readString()
+			if err != nil {
+				return nil, err
+			}
+			g.consumers[string(consumer)] = struct{}{}
+		}
+		st.groups[string(name)] = g
+	}
+	return st, nil
+}
@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"slices"
+	"strconv"
+	"time"
+)
+
+// rewriteItemsPerCommand caps the elements written by one command, so that a
+// large collection is not rebuilt by a single huge command.
+const rewriteItemsPerCommand = 64
+
+// snapshotCollectBuckets is how many buckets of the keyspace a snapshot
+// collects the items of at a time, holding the lock.
+const snapshotCollectBuckets = 1024
+
+// Snapshot is the dataset at one point in time, which can be written out
+// while the dataset keeps changing. Nothing is copied when it is taken: its
+// items are collected while it is written out, a few buckets of the keyspace
+// at a time, and an item changed or deleted before it is collected is handed
+// to the snapshot instead. Values are copied on their first access after the
+// snapshot was taken, so that the snapshot keeps the originals, until it is
+// released.
+type Snapshot struct {
+	s          *MemoryStorage
+	generation uint64
+	now        time.Time
+	// items holds the items collected so far. Once collected is set, it is
+	// only read by the writer of the snapshot.
+	items     map[string]Item
+	cursor    uint64
+	collected bool
+}
+
+// Snapshot takes a snapshot of the live keys. It only waits for the lock, and
+// the snapshot has to be released once written out.
+func (s *MemoryStorage) Snapshot() *Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.generation++
+	snap := &Snapshot{
+		s:          s,
+		generation: s.generation,
+		now:        time.Now(),
+		items:      make(map[string]Item),
+	}
+	s.snapshots = append(s.snapshots, snap)
+	return snap
+}
+
+// Release lets the dataset stop copying the values it shares with the
+// snapshot, which can not be written out anymore.
+func (snap *Snapshot) Release() {
+	snap.s.mu.Lock()
+	defer snap.s.mu.Unlock()
+
+	snap.collected = true
+	snap.s.snapshots = slices.DeleteFunc(snap.s.snapshots, func(other *Snapshot) bool { return other == snap })
+}
+
+// collect walks the keyspace for the items not collected yet.
+func (snap *Snapshot) collect() {
+	for !snap.collectStep() {
+	}
+}
+
+// collectStep collects the items of the next snapshotCollectBuckets buckets
+// of the keyspace, holding the lock, and reports whether all were collected.
+// Items written since the snapshot was taken are skipped, the snapshot got
+// the previous ones already.
+func (snap *Snapshot) collectStep() bool {
+	s := snap.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i < snapshotCollectBuckets && !snap.collected; i++ {
+		snap.cursor = s.keys.scan(snap.cursor, func(key string, _ struct{}) {
+			snap.add(key, s.data[key])
+		})
+		snap.collected = snap.cursor == 0
+	}
+	return snap.collected
+}
+
+// add collects an item unless it was written since the snapshot was taken,
+// expired by then, or collected already. Callers must hold s.mu.
+func (snap *Snapshot) add(key string, item Item) {
+	if snap.collected || item.generation >= snap.generation || item.expired(snap.now) {
+		return
+	}
+	if _, ok := snap.items[key]; !ok {
+		snap.items[key] = item
+	}
+}
+
+// Rewrite calls emit with the commands that rebuild the snapshot, the fewest
+// the commands allow: each value is written by one command, or by a command
+// per rewriteItemsPerCommand elements, followed by a PEXPIREAT if it has a
+// TTL. emit must not keep args after it returns.
+func (snap *Snapshot) Rewrite(emit func(args [][]byte) error) error {
+	snap.collect()
+	for key, item := range snap.items {
+		if err := rewriteValue([]byte(key), item.Value, emit); err != nil {
+			return err
+		}
+		if item.ExpiresAt > 0 {
+			err := emit([][]byte{[]byte("PEXPIREAT"), []byte(key), []byte(strconv.FormatInt(item.ExpiresAt, 10))})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func rewriteValue(key []byte, value any, emit func(args [][]byte) error) error {
+	switch v := value.(type) {
+	case []byte:
+		// HyperLogLogs are strings too.
+		return emit([][]byte{[]byte("SET"), key, v})
+
+	case *hash:
+		b := commandBatch{head: [][]byte{[]byte("HSET"), key}, emit: emit}
+		for field, value := range v.all() {
+			if err := b.add([]byte(field), value); err != nil {
+				return err
+			}
+		}
+		return b.flush()
+
+	case *list:
+		b := commandBatch{head: [][]byte{[]byte("RPUSH"), key}, emit: emit}
+		for i := range v.size {
+			if err := b.add(v.at(i)); err != nil {
+				return err
+			}
+		}
+		return b.flush()
+
+	case *set:
+		b := commandBatch{head: [][]byte{[]byte("SADD"), key}, emit: emit}
+		for member := range v.all() {
+			if err := b.add([]byte(member)); err != nil {
+				return err
+			}
+		}
+		return b.flush()
+
+	case *zset:
+		// Geo indexes are sorted sets too.
+		b := commandBatch{head: [][]byte{[]byte("ZADD"), key}, emit: emit}
+		for member, score := range v.dict.all() {
+			if err := b.add([]byte(strconv.FormatFloat(score, 'g', -1, 64)), []byte(member)); err != nil {
+				return err
+			}
+		}
+		return b.flush()
+
+	case *stream:
+		return rewriteStream(key, v, emit)
+	}
+	return nil
+}
+
+// rewriteStream writes a stream as its entries, its last ID, which trimming
+// may have left past the last entry, and its consumer groups, whose pending
+// entries are claimed back by their consumers, including those trimmed or
+// deleted from the stream meanwhile.
+func rewriteStream(key []byte, st *stream, emit func(args [][]byte) error) error {
+	if len(st.entries) == 0 {
+		// An empty stream is created by an entry trimmed right away.
+		err := emit([][]byte{[]byte("XADD"), key, []byte("MAXLEN"), []byte("0"), []byte("0-1"), []byte("x"), []byte("y")})
+		if err != nil {
+			return err
+		}
+	}
+	for _, entry := range st.entries {
+		if err := emit(append([][]byte{[]byte("XADD"), key, []byte(entry.ID.String())}, entry.Fields...)); err != nil {
+			return err
+		}
+	}
+	if n := len(st.entries); n == 0 || st.entries[n-1].ID != st.lastID {
+		if err := emit([][]byte{[]byte("XSETID"), key, []byte(st.lastID.String())}); err != nil {
+			return err
+		}
+	}
+
+	for name, g := range st.groups {
+		group := []byte(name)
+		if err := emit([][]byte{[]byte("XGROUP"), []byte("CREATE"), key, group, []byte(g.lastID.String())}); err != nil {
+			return err
+		}
+		for consumer := range g.consumers {
+			if err := emit([][]byte{[]byte("XGROUP"), []byte("CREATECONSUMER"), key, group, []byte(consumer)}); err != nil {
+				return err
+			}
+		}
+
+		// Entries delivered to the same consumer at the same time and as many
+		// times are claimed together.
+		ids := g.pendingIDs(StreamID{}, MaxStreamID, "")
+		for i := 0; i < len(ids); {
+			pe := g.pending[ids[i]]
+			claim := [][]byte{[]byte("XCLAIM"), key, group, []byte(pe.consumer), []byte("0")}
+			j := i
+			for ; j < len(ids) && j-i < rewriteItemsPerCommand && *g.pending[ids[j]] == *pe; j++ {
+				claim = append(claim, []byte(ids[j].String()))
+			}
+			claim = append(claim,
+				[]byte("TIME"), []byte(strconv.FormatInt(pe.deliveryTime, 10)),
+				[]byte("RETRYCOUNT"), []byte(strconv.FormatInt(pe.deliveryCount, 10)),
+				[]byte("FORCE"), []byte("JUSTID"), []byte("KEEPDELETED"))
+			if err := emit(claim); err != nil {
+				return err
+			}
+			i = j
+		}
+	}
+	return nil
+}
+
+// commandBatch emits a command per rewriteItemsPerCommand elements added.
+type commandBatch struct {
+	head [][]byte
+	args [][]byte
+	n    int
+	emit func(args [][]byte) error
+}
+
+// add adds an element, made of one or more arguments.
+func (b *commandBatch) add(element ...[]byte) error {
+	b.args = append(b.args, element...)
+	if b.n++; b.n == rewriteItemsPerCommand {
+		return b.flush()
+	}
+	return nil
+}
+
+func (b *commandBatch) flush() error {
+	if b.n == 0 {
+		return nil
+	}
+	err := b.emit(append(b.head[:len(b.head):len(b.head)], b.args...))
+	b.args, b.n = b.args[:0], 0
+	return err
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"bytes"
+	"strings"
+)
+
+// ScanOptions are the options of the SCAN family. Match is a glob pattern,
+// nil when not given, and Type restricts SCAN to keys of a type unless it is
+// TypeNone. Count is how many keys or members to look at, not how many to
+// return: those filtered out are still counted.
+type ScanOptions struct {
+	Match []byte
+	Count int64
+	Type  ValueType
+}
+
+// ParseValueType returns the type with the name TYPE replies with.
+func ParseValueType(name string) (ValueType, bool) {
+	for t := TypeString; t <= TypeStream; t++ {
+		if strings.EqualFold(name, t.String()) {
+			return t, true
+		}
+	}
+	return TypeNone, false
+}
+
+// Scan returns the keys found from cursor on and the cursor to continue
+// from, zero when the scan is complete. It looks at buckets until Count keys
+// are found, or ten times as many buckets were empty.
+func (s *MemoryStorage) Scan(cursor uint64, opts ScanOptions) (uint64, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var candidates []string
+	for emptyVisits := opts.Count * 10; ; emptyVisits-- {
+		cursor = s.keys.scan(cursor, func(key string, _ struct{}) {
+			candidates = append(candidates, key)
+		})
+		if cursor == 0 || emptyVisits == 0 || int64(len(candidates)) >= opts.Count {
+			break
+		}
+	}
+
+	keys := candidates[:0]
+	for _, key := range candidates {
+		item, ok := s.peek(key)
+		if !ok || (opts.Type != TypeNone && item.Type() != opts.Type) ||
+			(opts.Match != nil && !globMatch(string(opts.Match), key)) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return cursor, keys
+}
+
+// HScan is Scan over the fields of a hash, returned with their values.
+func (s *MemoryStorage) HScan(key string, cursor uint64, opts ScanOptions) (uint64, [][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok, err := lookupHash(s, key)
+	if !ok {
+		return 0, nil, err
+	}
+
+	var pairs [][]byte
+	next := scanDict(h, cursor, opts, func(field string, value []byte) {
+		pairs = append(pairs, []byte(field), bytes.Clone(value))
+	})
+	return next, pairs, nil
+}
+
+// SScan is Scan over the members of a set.
+func (s *MemoryStorage) SScan(key string, cursor uint64, opts ScanOptions) (uint64, [][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok, err := lookupSet(s, key)
+	if !ok {
+		return 0, nil, err
+	}
+
+	var members [][]byte
+	next := scanDict(st, cursor, opts, func(member string, _ struct{}) {
+		members = append(members, []byte(member))
+	})
+	return next, members, nil
+}
+
+// ZScan is Scan over the members of a sorted set, returned with their scores.
+func (s *MemoryStorage) ZScan(key string, cursor uint64, opts ScanOptions) (uint64, []ZMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	z, ok, err := lookupZset(s, key)
+	if !ok {
+		return 0, nil, err
+	}
+
+	var members []ZMember
+	next := scanDict(z.dict, cursor, opts, func(member string, score float64) {
+		members = append(members, ZMember{Member: []byte(member), Score: score})
+	})
+	return next, members, nil
+}
+
+// scanSmallCollection is the size up to which a collection is returned whole
+// by a single call, as Redis does for collections small enough to be encoded
+// as a listpack.
+const scanSmallCollection = 128
+
+// scanDict is Scan over the members of a collection: it calls fn with the
+// members matching opts in the buckets it visits from cursor on, and returns
+// the cursor to continue from. Only the visited buckets are looked at.
+func scanDict[V any](d *dict[V], cursor uint64, opts ScanOptions, fn func(member string, value V)) uint64 {
+	visit := func(member string, value V) {
+		if opts.Match == nil || globMatch(string(opts.Match), member) {
+			fn(member, value)
+		}
+	}
+
+	if d.len() <= scanSmallCollection {
+		for member, value := range d.all() {
+			visit(member, value)
+		}
+		return 0
+	}
+
+	var found int64
+	for emptyVisits := opts.Count * 10; ; emptyVisits-- {
+		cursor = d.scan(cursor, func(member string, value V) {
+			found++
+			visit(member, value)
+		})
+		if cursor == 0 || emptyVisits == 0 || found >= opts.Count {
+			return cursor
+		}
+	}
+}
+
+// globMatch reports whether str matches a glob-style pattern with the syntax
+// of Redis: * and ? wildcards, [...] classes with ranges and ^ negation, and
+// \ escapes.
+func globMatch(pattern, str string) bool {
+	skipLongerMatches := false
+	return globMatchNested(pattern, str, &skipLongerMatches, 0)
+}
+
+func globMatchNested(pattern, str string, skipLongerMatches *bool, nesting int) bool {
+	// Protection against patterns with too many stars.
+	if nesting > 1000 {
+		return false
+	}
+
+	for len(pattern) > 0 && len(str) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for ; len(str) > 0; str = str[1:] {
+				if globMatchNested(pattern[1:], str, skipLongerMatches, nesting+1) {
+					return true
+				}
+				if *skipLongerMatches {
+					return false
+				}
+			}
+			// The rest of the pattern matches nowhere in the rest of the
+			// string, so earlier stars need not try longer matches either.
+			*skipLongerMatches = true
+			return false
+
+		case '?':
+			pattern, str = pattern[1:], str[1:]
+
+		case '[':
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+
+			match := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) >= 2:
+					pattern = pattern[1:]
+					match = match || pattern[0] == str[0]
+				case len(pattern) >= 3 && pattern[1] == '-':
+					start, end := pattern[0], pattern[2]
+					if start > end {
+						start, end = end, start
+					}
+					match = match || (str[0] >= start && str[0] <= end)
+					pattern = pattern[2:]
+				default:
+					match = match || pattern[0] == str[0]
+				}
+				pattern = pattern[1:]
+			}
+			// An unterminated class ends with the pattern.
+			if len(pattern) > 0 {
+				pattern = pattern[1:]
+			}
+			if match == not {
+				return false
+			}
+			str = str[1:]
+
+		default:
+			if pattern[0] == '\\' && len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			if pattern[0] != str[0] {
+				return false
+			}
+			pattern, str = pattern[1:], str[1:]
+		}
+	}
+
+	// Trailing stars match the empty rest of the string.
+	if len(str) == 0 {
+		pattern = strings.TrimLeft(pattern, "*")
+	}
+	return len(pattern) == 0 && len(str) == 0
+}
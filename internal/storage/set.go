@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"math/rand/v2"
+)
+
+// set is a dict of members with no values.
+type set = dict[struct{}]
+
+// SetOperation selects the algebra SetOp computes.
+type SetOperation int
+
+const (
+	SetInter SetOperation = iota
+	SetUnion
+	SetDiff
+)
+
+// SAdd adds the members to the set at key, creating it if needed, and
+// returns how many of them were not members yet.
+func (s *MemoryStorage) SAdd(key string, members [][]byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, err := s.writableSet(key)
+	if err != nil {
+		return 0, err
+	}
+
+	var added int64
+	for _, member := range members {
+		if st.set(string(member), struct{}{}) {
+			added++
+		}
+	}
+	return added, nil
+}
+
+// SRem removes the members and returns how many existed. The key is deleted
+// together with its last member.
+func (s *MemoryStorage) SRem(key string, members [][]byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok, err := lookupSet(s, key)
+	if !ok {
+		return 0, err
+	}
+
+	var removed int64
+	for _, member := range members {
+		if st.delete(string(member)) {
+			removed++
+		}
+	}
+
+	if st.len() == 0 {
+		s.remove(key)
+	}
+	return removed, nil
+}
+
+func (s *MemoryStorage) SIsMember(key string, member []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, _, err := lookupSet(s, key)
+	return st.has(string(member)), err
+}
+
+func (s *MemoryStorage) SMIsMember(key string, members [][]byte) ([]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, _, err := lookupSet(s, key)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([]bool, len(members))
+	for i, member := range members {
+		found[i] = st.has(string(member))
+	}
+	return found, nil
+}
+
+func (s *MemoryStorage) SMembers(key string) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, _, err := lookupSet(s, key)
+	if err != nil {
+		return nil, err
+	}
+	return st.keys(), nil
+}
+
+func (s *MemoryStorage) SCard(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, _, err := lookupSet(s, key)
+	return int64(st.len()), err
+}
+
+// SPop removes up to count random members from the set and returns them.
+func (s *MemoryStorage) SPop(key string, count int64) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok, err := lookupSet(s, key)
+	if !ok {
+		return nil, err
+	}
+
+	if count >= int64(st.len()) {
+		s.remove(key)
+		return st.keys(), nil
+	}
+
+	popped := make([][]byte, count)
+	for i := range popped {
+		member := st.random().key
+		st.delete(member)
+		popped[i] = []byte(member)
+	}
+	return popped, nil
+}
+
+// SRandMember returns random members without removing them: up to count
+// distinct ones for a positive count, and exactly -count possibly repeated
+// ones for a negative count. A negative count larger than the set returns
+// every member once instead, for the caller to pick from while it writes the
+// reply out, which may then be too long to be built in memory.
+func (s *MemoryStorage) SRandMember(key string, count int64) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok, err := lookupSet(s, key)
+	if !ok || count == 0 {
+		return nil, err
+	}
+
+	if -count > int64(st.len()) {
+		return st.keys(), nil
+	}
+	if count < 0 {
+		picked := make([][]byte, -count)
+		for i := range picked {
+			picked[i] = []byte(st.random().key)
+		}
+		return picked, nil
+	}
+
+	switch size := int64(st.len()); {
+	case count >= size:
+		return st.keys(), nil
+	case count*3 > size:
+		// Most members are picked, so random picks would mostly repeat.
+		return sample(st.keys(), int(count)), nil
+	}
+
+	picked := make(map[string]struct{}, count)
+	for int64(len(picked)) < count {
+		picked[st.random().key] = struct{}{}
+	}
+	members := make([][]byte, 0, count)
+	for member := range picked {
+		members = append(members, []byte(member))
+	}
+	return members, nil
+}
+
+// SMove moves member from src to dst atomically and reports whether it was
+// a member of src.
+func (s *MemoryStorage) SMove(src, dst string, member []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	from, ok, err := lookupSet(s, src)
+	if err != nil {
+		return false, err
+	}
+	if _, _, err := lookupSet(s, dst); err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, nil
+	}
+	if !from.has(string(member)) {
+		return false, nil
+	}
+	if src == dst {
+		return true, nil
+	}
+
+	from.delete(string(member))
+	if from.len() == 0 {
+		s.remove(src)
+	}
+
+	to, _ := s.writableSet(dst)
+	to.set(string(member), struct{}{})
+	return true, nil
+}
+
+// SetOp returns the intersection, union or difference of the sets at keys.
+// Missing keys are treated as empty sets.
+func (s *MemoryStorage) SetOp(op SetOperation, keys []string) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result, err := s.setOp(op, keys)
+	if err != nil {
+		return nil, err
+	}
+	return result.keys(), nil
+}
+
+// SetOpStore stores the result of SetOp at dst, replacing any value there,
+// and returns its size. An empty result deletes dst.
+func (s *MemoryStorage) SetOpStore(op SetOperation, dst string, keys []string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result, err := s.setOp(op, keys)
+	if err != nil {
+		return 0, err
+	}
+
+	s.remove(dst)
+	if result.len() > 0 {
+		s.setItem(dst, Item{Value: result, ExpiresAt: -1})
+	}
+	return int64(result.len()), nil
+}
+
+// SInterCard returns the size of the intersection, stopping early once it
+// reaches limit. A zero limit means no limit.
+func (s *MemoryStorage) SInterCard(keys []string, limit int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sets, err := s.sets(keys)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	for member := range smallest(sets).all() {
+		if inAll(sets, member) {
+			count++
+			if count == limit {
+				break
+			}
+		}
+	}
+	return count, nil
+}
+
+func (s *MemoryStorage) setOp(op SetOperation, keys []string) (*set, error) {
+	sets, err := s.sets(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	result := newDict[struct{}]()
+	switch op {
+	case SetInter:
+		for member := range smallest(sets).all() {
+			if inAll(sets, member) {
+				result.set(member, struct{}{})
+			}
+		}
+	case SetUnion:
+		for _, st := range sets {
+			for member := range st.all() {
+				result.set(member, struct{}{})
+			}
+		}
+	case SetDiff:
+		for member := range sets[0].all() {
+			result.set(member, struct{}{})
+		}
+		for _, st := range sets[1:] {
+			for member := range st.all() {
+				result.delete(member)
+			}
+		}
+	}
+	return result, nil
+}
+
+// sets looks up the sets at keys, with nil for missing keys. Callers must
+// hold s.mu.
+func (s *MemoryStorage) sets(keys []string) ([]*set, error) {
+	sets := make([]*set, len(keys))
+	for i, key := range keys {
+		st, _, err := lookupSet(s, key)
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = st
+	}
+	return sets, nil
+}
+
+func smallest(sets []*set) *set {
+	result := sets[0]
+	for _, st := range sets[1:] {
+		if st.len() < result.len() {
+			result = st
+		}
+	}
+	return result
+}
+
+func inAll(sets []*set, member string) bool {
+	for _, st := range sets {
+		if !st.has(member) {
+			return false
+		}
+	}
+	return true
+}
+
+// sample picks n distinct random elements with a partial Fisher-Yates
+// shuffle. It reorders values.
+func sample(values [][]byte, n int) [][]byte {
+	for i := 0; i < n; i++ {
+		j := i + rand.IntN(len(values)-i)
+		values[i], values[j] = values[j], values[i]
+	}
+	return values[:n]
+}
+
+func lookupSet(s *MemoryStorage, key string) (*set, bool, error) {
+	st, _, ok, err := lookupValue[*set](s, key)
+	return st, ok, err
+}
+
+// writableSet returns the set at key for modification, storing an empty one
+// without a TTL if the key does not exist. Callers must hold s.mu.
+func (s *MemoryStorage) writableSet(key string) (*set, error) {
+	st, ok, err := lookupSet(s, key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		st = newDict[struct{}]()
+		s.setItem(key, Item{Value: st, ExpiresAt: -1})
+	}
+	return st, nil
+}
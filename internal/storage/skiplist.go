@@ -0,0 +1,324 @@
+package storage
+
+import "math/rand/v2"
+
+// The skiplist follows the one in Redis: nodes are ordered by score and then
+// by member, and every forward link stores its span so that ranks can be
+// computed in O(log n).
+const (
+	skiplistMaxLevel = 32
+	skiplistP        = 0.25
+)
+
+type skiplistNode struct {
+	member   string
+	score    float64
+	backward *skiplistNode
+	level    []skiplistLevel
+}
+
+type skiplistLevel struct {
+	forward *skiplistNode
+	span    int
+}
+
+type skiplist struct {
+	header *skiplistNode
+	tail   *skiplistNode
+	length int
+	level  int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		header: &skiplistNode{level: make([]skiplistLevel, skiplistMaxLevel)},
+		level:  1,
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+// before reports whether n sorts before the element with the given score and member.
+func (n *skiplistNode) before(score float64, member string) bool {
+	return n.score < score || (n.score == score && n.member < member)
+}
+
+// insert adds a new element, the caller makes sure the member is not present.
+func (sl *skiplist) insert(score float64, member string) *skiplistNode {
+	var (
+		update [skiplistMaxLevel]*skiplistNode
+		rank   [skiplistMaxLevel]int
+	)
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		if i < sl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = sl.header
+			update[i].level[i].span = sl.length
+		}
+		sl.level = level
+	}
+
+	x = &skiplistNode{member: member, score: score, level: make([]skiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	for i := level; i < sl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != sl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		sl.tail = x
+	}
+	sl.length++
+	return x
+}
+
+func (sl *skiplist) delete(score float64, member string) bool {
+	var update [skiplistMaxLevel]*skiplistNode
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+
+	for i := 0; i < sl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		sl.tail = x.backward
+	}
+	for sl.level > 1 && sl.header.level[sl.level-1].forward == nil {
+		sl.level--
+	}
+	sl.length--
+	return true
+}
+
+// rank returns the 1-based rank of the element, or 0 if it is not present.
+func (sl *skiplist) rank(score float64, member string) int {
+	rank := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(x.level[i].forward.before(score, member) ||
+				(x.level[i].forward.score == score && x.level[i].forward.member == member)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != sl.header && x.member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// byRank returns the element with the given 1-based rank.
+func (sl *skiplist) byRank(rank int) *skiplistNode {
+	traversed := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+// firstInRange and lastInRange return the first and the last element whose
+// score is in r, or nil when there is none.
+func (sl *skiplist) firstInRange(r ScoreRange) *skiplistNode {
+	if r.empty() {
+		return nil
+	}
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.aboveMin(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+
+	x = x.level[0].forward
+	if x == nil || !r.belowMax(x.score) {
+		return nil
+	}
+	return x
+}
+
+func (sl *skiplist) lastInRange(r ScoreRange) *skiplistNode {
+	if r.empty() {
+		return nil
+	}
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.belowMax(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+
+	if x == sl.header || !r.aboveMin(x.score) {
+		return nil
+	}
+	return x
+}
+
+// firstInLexRange and lastInLexRange are the same for member ranges, which
+// are only meaningful when all the elements have the same score.
+func (sl *skiplist) firstInLexRange(r LexRange) *skiplistNode {
+	if r.empty() {
+		return nil
+	}
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.aboveMin(x.level[i].forward.member) {
+			x = x.level[i].forward
+		}
+	}
+
+	x = x.level[0].forward
+	if x == nil || !r.belowMax(x.member) {
+		return nil
+	}
+	return x
+}
+
+func (sl *skiplist) lastInLexRange(r LexRange) *skiplistNode {
+	if r.empty() {
+		return nil
+	}
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.belowMax(x.level[i].forward.member) {
+			x = x.level[i].forward
+		}
+	}
+
+	if x == sl.header || !r.aboveMin(x.member) {
+		return nil
+	}
+	return x
+}
+
+// ScoreRange is an interval of scores, each end may be exclusive.
+type ScoreRange struct {
+	Min, Max     float64
+	MinExclusive bool
+	MaxExclusive bool
+}
+
+func (r ScoreRange) aboveMin(score float64) bool {
+	if r.MinExclusive {
+		return score > r.Min
+	}
+	return score >= r.Min
+}
+
+func (r ScoreRange) belowMax(score float64) bool {
+	if r.MaxExclusive {
+		return score < r.Max
+	}
+	return score <= r.Max
+}
+
+func (r ScoreRange) empty() bool {
+	return r.Min > r.Max || (r.Min == r.Max && (r.MinExclusive || r.MaxExclusive))
+}
+
+// LexBound is one end of a LexRange. Inf is -1 for "-", which sorts before
+// every member, and 1 for "+", which sorts after every member.
+type LexBound struct {
+	Value     string
+	Exclusive bool
+	Inf       int
+}
+
+// LexRange is an interval of members, as given to ZRANGE ... BYLEX.
+type LexRange struct {
+	Min, Max LexBound
+}
+
+func (r LexRange) aboveMin(member string) bool {
+	switch {
+	case r.Min.Inf != 0:
+		return r.Min.Inf < 0
+	case r.Min.Exclusive:
+		return member > r.Min.Value
+	default:
+		return member >= r.Min.Value
+	}
+}
+
+func (r LexRange) belowMax(member string) bool {
+	switch {
+	case r.Max.Inf != 0:
+		return r.Max.Inf > 0
+	case r.Max.Exclusive:
+		return member < r.Max.Value
+	default:
+		return member <= r.Max.Value
+	}
+}
+
+func (r LexRange) empty() bool {
+	switch {
+	case r.Min.Inf > 0 || r.Max.Inf < 0:
+		return true
+	case r.Min.Inf < 0 || r.Max.Inf > 0:
+		return false
+	default:
+		return r.Min.Value > r.Max.Value ||
+			(r.Min.Value == r.Max.Value && (r.Min.Exclusive || r.Max.Exclusive))
+	}
+}
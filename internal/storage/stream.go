@@ -0,0 +1,831 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StreamID identifies a stream entry: the creation time in milliseconds and a
+// sequence number for entries created in the same millisecond.
+type StreamID struct {
+	Ms, Seq uint64
+}
+
+var MaxStreamID = StreamID{math.MaxUint64, math.MaxUint64}
+
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+func (id StreamID) Compare(other StreamID) int {
+	switch {
+	case id.Ms != other.Ms:
+		return cmpUint(id.Ms, other.Ms)
+	default:
+		return cmpUint(id.Seq, other.Seq)
+	}
+}
+
+func cmpUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Next returns the smallest ID greater than id. It reports false for MaxStreamID.
+func (id StreamID) Next() (StreamID, bool) {
+	switch {
+	case id.Seq < math.MaxUint64:
+		return StreamID{id.Ms, id.Seq + 1}, true
+	case id.Ms < math.MaxUint64:
+		return StreamID{id.Ms + 1, 0}, true
+	default:
+		return id, false
+	}
+}
+
+// Prev returns the greatest ID smaller than id. It reports false for 0-0.
+func (id StreamID) Prev() (StreamID, bool) {
+	switch {
+	case id.Seq > 0:
+		return StreamID{id.Ms, id.Seq - 1}, true
+	case id.Ms > 0:
+		return StreamID{id.Ms - 1, math.MaxUint64}, true
+	default:
+		return id, false
+	}
+}
+
+var ErrInvalidStreamID = errors.New("Invalid stream ID specified as stream command argument")
+
+// ParseStreamID parses an ID written as "<ms>-<seq>" or just "<ms>", in which
+// case the sequence is missingSeq.
+func ParseStreamID(b []byte, missingSeq uint64) (StreamID, error) {
+	msPart, seqPart, hasSeq := strings.Cut(string(b), "-")
+
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return StreamID{}, ErrInvalidStreamID
+	}
+	if !hasSeq {
+		return StreamID{ms, missingSeq}, nil
+	}
+
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return StreamID{}, ErrInvalidStreamID
+	}
+	return StreamID{ms, seq}, nil
+}
+
+// StreamEntry is an entry of a stream. Fields holds the field names and values
+// interleaved. Entries are never modified once added, so they are shared with
+// callers without copying. A nil Fields stands for an entry that was deleted
+// while still pending in a consumer group.
+type StreamEntry struct {
+	ID     StreamID
+	Fields [][]byte
+}
+
+// stream keeps its entries sorted by ID. lastID is the greatest ID ever added,
+// which may no longer be in entries after trimming.
+type stream struct {
+	entries []StreamEntry
+	lastID  StreamID
+	groups  map[string]*consumerGroup
+}
+
+func newStream() *stream {
+	return &stream{groups: make(map[string]*consumerGroup)}
+}
+
+// search returns the index of the first entry with an ID not less than id.
+func (st *stream) search(id StreamID) int {
+	return sort.Search(len(st.entries), func(i int) bool {
+		return st.entries[i].ID.Compare(id) >= 0
+	})
+}
+
+// after returns the entries with IDs greater than id, at most count of them
+// when count is positive.
+func (st *stream) after(id StreamID, count int64) []StreamEntry {
+	from := len(st.entries)
+	if next, ok := id.Next(); ok {
+		from = st.search(next)
+	}
+	entries := st.entries[from:]
+	if count > 0 && int64(len(entries)) > count {
+		entries = entries[:count]
+	}
+	return entries
+}
+
+func (st *stream) find(id StreamID) (StreamEntry, bool) {
+	i := st.search(id)
+	if i < len(st.entries) && st.entries[i].ID == id {
+		return st.entries[i], true
+	}
+	return StreamEntry{}, false
+}
+
+// trimFront drops the first n entries, clearing them so that their memory can
+// be reclaimed.
+func (st *stream) trimFront(n int) int64 {
+	clear(st.entries[:n])
+	st.entries = st.entries[n:]
+	return int64(n)
+}
+
+func (st *stream) trim(t StreamTrim) int64 {
+	switch t.Strategy {
+	case TrimMaxLen:
+		if excess := int64(len(st.entries)) - t.MaxLen; excess > 0 {
+			return st.trimFront(int(excess))
+		}
+	case TrimMinID:
+		return st.trimFront(st.search(t.MinID))
+	}
+	return 0
+}
+
+// consumerGroup tracks what was delivered to its consumers: lastID is the last
+// entry handed out and pending holds the delivered entries not yet acknowledged.
+type consumerGroup struct {
+	lastID    StreamID
+	pending   map[StreamID]*pendingEntry
+	consumers map[string]struct{}
+}
+
+type pendingEntry struct {
+	consumer      string
+	deliveryTime  int64
+	deliveryCount int64
+}
+
+func newConsumerGroup(lastID StreamID) *consumerGroup {
+	return &consumerGroup{
+		lastID:    lastID,
+		pending:   make(map[StreamID]*pendingEntry),
+		consumers: make(map[string]struct{}),
+	}
+}
+
+// pendingIDs returns the pending IDs in [start, end] owned by consumer, or by
+// anyone when consumer is empty, in ascending order.
+func (g *consumerGroup) pendingIDs(start, end StreamID, consumer string) []StreamID {
+	ids := make([]StreamID, 0, len(g.pending))
+	for id, pe := range g.pending {
+		if id.Compare(start) >= 0 && id.Compare(end) <= 0 && (consumer == "" || pe.consumer == consumer) {
+			ids = append(ids, id)
+		}
+	}
+	slices.SortFunc(ids, StreamID.Compare)
+	return ids
+}
+
+var (
+	ErrStreamIDTooSmall = errors.New("The ID specified in XADD is equal or smaller than the target stream top item")
+	ErrStreamIDZero     = errors.New("The ID specified in XADD must be greater than 0-0")
+	ErrSetIDTooSmall    = errors.New("The ID specified in XSETID is smaller than the target stream top item")
+	ErrNoStreamKey      = errors.New("The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+	ErrBusyGroup        = errors.New("BUSYGROUP Consumer Group name already exists")
+	// ErrNoGroup is returned when the key or the consumer group does not
+	// exist. Commands word the message differently, so callers are expected
+	// to build their own.
+	ErrNoGroup = errors.New("NOGROUP No such key or consumer group")
+)
+
+// NoGroupError is the ErrNoGroup of a command reading several streams, which
+// tells the key that lacks the group.
+type NoGroupError struct {
+	Key string
+}
+
+func (e *NoGroupError) Error() string { return ErrNoGroup.Error() }
+
+func (e *NoGroupError) Unwrap() error { return ErrNoGroup }
+
+// TrimStrategy selects how StreamTrim limits the stream.
+type TrimStrategy int
+
+const (
+	TrimNone TrimStrategy = iota
+	TrimMaxLen
+	TrimMinID
+)
+
+// StreamTrim is the MAXLEN or MINID option of XADD. Trimming is always exact.
+type StreamTrim struct {
+	Strategy TrimStrategy
+	MaxLen   int64
+	MinID    StreamID
+}
+
+// XAddOptions describes the ID and the options of an XADD. With AutoID the ID
+// is generated from the clock, with AutoSeq only ID.Ms is given and the
+// sequence is picked to follow the top entry.
+type XAddOptions struct {
+	ID         StreamID
+	AutoID     bool
+	AutoSeq    bool
+	NoMkStream bool
+	Trim       StreamTrim
+}
+
+// XAdd appends an entry with the fields to the stream at key, creating the
+// stream unless NoMkStream is set, and trims it. It returns the ID of the new
+// entry and reports false when the stream did not exist and was not created.
+func (s *MemoryStorage) XAdd(key string, opts XAddOptions, fields [][]byte) (StreamID, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok, err := lookupStream(s, key)
+	if err != nil || (!ok && opts.NoMkStream) {
+		return StreamID{}, false, err
+	}
+
+	var last StreamID
+	if ok {
+		last = st.lastID
+	}
+
+	id := opts.ID
+	switch {
+	case opts.AutoID:
+		id = StreamID{uint64(time.Now().UnixMilli()), 0}
+		if id.Ms <= last.Ms {
+			if id, ok = last.Next(); !ok {
+				return StreamID{}, false, ErrStreamIDTooSmall
+			}
+		}
+	case opts.AutoSeq:
+		switch {
+		case id.Ms < last.Ms:
+			return StreamID{}, false, ErrStreamIDTooSmall
+		case id.Ms == last.Ms:
+			if last.Seq == math.MaxUint64 {
+				return StreamID{}, false, ErrStreamIDTooSmall
+			}
+			id.Seq = last.Seq + 1
+		}
+	case id == StreamID{}:
+		return StreamID{}, false, ErrStreamIDZero
+	case id.Compare(last) <= 0:
+		return StreamID{}, false, ErrStreamIDTooSmall
+	}
+
+	if st == nil {
+		st = newStream()
+		s.setItem(key, Item{Value: st, ExpiresAt: -1})
+	}
+
+	entry := StreamEntry{ID: id, Fields: make([][]byte, len(fields))}
+	for i, field := range fields {
+		entry.Fields[i] = bytes.Clone(field)
+	}
+	st.entries = append(st.entries, entry)
+	st.lastID = id
+	st.trim(opts.Trim)
+
+	s.signalKeyAsReady(key)
+	return id, true, nil
+}
+
+func (s *MemoryStorage) XLen(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, _, err := lookupStream(s, key)
+	if st == nil {
+		return 0, err
+	}
+	return int64(len(st.entries)), nil
+}
+
+// XLastID returns the greatest ID ever added to the stream, 0-0 if there is no
+// stream at key. It is what "$" stands for in XREAD and XGROUP.
+func (s *MemoryStorage) XLastID(key string) (StreamID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, _, err := lookupStream(s, key)
+	if st == nil {
+		return StreamID{}, err
+	}
+	return st.lastID, nil
+}
+
+// XSetID sets the last ID of the stream, which may not be smaller than the ID
+// of its last entry.
+func (s *MemoryStorage) XSetID(key string, id StreamID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok, err := lookupStream(s, key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNoSuchKey
+	}
+	if n := len(st.entries); n > 0 && id.Compare(st.entries[n-1].ID) < 0 {
+		return ErrSetIDTooSmall
+	}
+	st.lastID = id
+	return nil
+}
+
+// XRange returns the entries with IDs in [start, end], in descending order if
+// rev is set, at most count of them when count is positive.
+func (s *MemoryStorage) XRange(key string, start, end StreamID, count int64, rev bool) ([]StreamEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, _, err := lookupStream(s, key)
+	if st == nil || start.Compare(end) > 0 {
+		return nil, err
+	}
+
+	from := st.search(start)
+	to := len(st.entries)
+	if next, ok := end.Next(); ok {
+		to = st.search(next)
+	}
+
+	entries := slices.Clone(st.entries[from:to])
+	if rev {
+		slices.Reverse(entries)
+	}
+	if count > 0 && int64(len(entries)) > count {
+		entries = entries[:count]
+	}
+	return entries, nil
+}
+
+// StreamRead is the part of an XREAD or XREADGROUP reply for one stream.
+type StreamRead struct {
+	Key     string
+	Entries []StreamEntry
+}
+
+// XRead returns, for each key, the entries with IDs greater than the matching
+// one in ids, at most count per stream when count is positive. Streams without
+// such entries are left out.
+func (s *MemoryStorage) XRead(keys []string, ids []StreamID, count int64) ([]StreamRead, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var reads []StreamRead
+	for i, key := range keys {
+		st, ok, err := lookupStream(s, key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if entries := st.after(ids[i], count); len(entries) > 0 {
+			reads = append(reads, StreamRead{Key: key, Entries: slices.Clone(entries)})
+		}
+	}
+	return reads, nil
+}
+
+// XGroupCreate creates a consumer group that will deliver the entries after
+// id, or after the current top entry when useLast is set. mkStream creates an
+// empty stream when the key does not exist. It returns the ID the group
+// starts from.
+func (s *MemoryStorage) XGroupCreate(key, group string, id StreamID, useLast, mkStream bool) (StreamID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok, err := lookupStream(s, key)
+	if err != nil {
+		return StreamID{}, err
+	}
+	if !ok {
+		if !mkStream {
+			return StreamID{}, ErrNoStreamKey
+		}
+		st = newStream()
+		s.setItem(key, Item{Value: st, ExpiresAt: -1})
+	}
+
+	if _, exists := st.groups[group]; exists {
+		return StreamID{}, ErrBusyGroup
+	}
+	if useLast {
+		id = st.lastID
+	}
+	st.groups[group] = newConsumerGroup(id)
+	return id, nil
+}
+
+// XGroupSetID moves the last delivered ID of the group, see XGroupCreate.
+func (s *MemoryStorage) XGroupSetID(key, group string, id StreamID, useLast bool) (StreamID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, g, err := s.lookupXGroup(key, group)
+	if err != nil {
+		return StreamID{}, err
+	}
+	if useLast {
+		id = st.lastID
+	}
+	g.lastID = id
+	return id, nil
+}
+
+func (s *MemoryStorage) XGroupDestroy(key, group string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, _, err := s.lookupXGroup(key, group)
+	if errors.Is(err, ErrNoGroup) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	delete(st.groups, group)
+	// Wake the consumers blocked on the group so that they get an error.
+	s.signalKeyAsReady(key)
+	return true, nil
+}
+
+func (s *MemoryStorage) XGroupCreateConsumer(key, group, consumer string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, g, err := s.lookupXGroup(key, group)
+	if err != nil {
+		return false, err
+	}
+	if _, exists := g.consumers[consumer]; exists {
+		return false, nil
+	}
+	g.consumers[consumer] = struct{}{}
+	return true, nil
+}
+
+// XGroupDelConsumer removes the consumer and its pending entries, returning
+// how many entries were pending.
+func (s *MemoryStorage) XGroupDelConsumer(key, group, consumer string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, g, err := s.lookupXGroup(key, group)
+	if err != nil {
+		return 0, err
+	}
+	if _, exists := g.consumers[consumer]; !exists {
+		return 0, nil
+	}
+
+	var pending int64
+	for id, pe := range g.pending {
+		if pe.consumer == consumer {
+			delete(g.pending, id)
+			pending++
+		}
+	}
+	delete(g.consumers, consumer)
+	return pending, nil
+}
+
+// GroupRead is the part of an XREADGROUP for one stream: ID is the ID given
+// for the stream and New tells whether it was ">".
+type GroupRead struct {
+	Key string
+	ID  StreamID
+	New bool
+}
+
+// GroupDelivery is the outcome of XREADGROUP for one stream. Besides the
+// entries read it tells what changed in the group, as replication needs it:
+// the group's last delivered ID and whether the consumer was created.
+type GroupDelivery struct {
+	StreamRead
+	LastID          StreamID
+	ConsumerCreated bool
+}
+
+// XReadGroup reads from each stream on behalf of consumer, creating it if
+// needed. Reads of new entries hand out the entries after the group's last
+// delivered ID and, unless noAck is set, add them to the pending list with
+// delivery time now; they are left out of the result when there are no new
+// entries. Other reads return the entries pending for the consumer after the
+// given ID, deleted entries having nil Fields. count limits the entries per
+// stream when positive.
+func (s *MemoryStorage) XReadGroup(group, consumer string, reads []GroupRead, count int64, noAck bool, now int64) ([]GroupDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	streams := make([]*stream, len(reads))
+	groups := make([]*consumerGroup, len(reads))
+	for i, read := range reads {
+		st, g, err := s.lookupGroup(read.Key, group)
+		if errors.Is(err, ErrNoGroup) {
+			return nil, &NoGroupError{Key: read.Key}
+		}
+		if err != nil {
+			return nil, err
+		}
+		streams[i], groups[i] = st, g
+	}
+
+	var deliveries []GroupDelivery
+	for i, read := range reads {
+		st, g := streams[i], groups[i]
+
+		delivery := GroupDelivery{StreamRead: StreamRead{Key: read.Key}}
+		if _, exists := g.consumers[consumer]; !exists {
+			g.consumers[consumer] = struct{}{}
+			delivery.ConsumerCreated = true
+		}
+
+		if read.New {
+			delivery.Entries = slices.Clone(st.after(g.lastID, count))
+			for _, entry := range delivery.Entries {
+				g.lastID = entry.ID
+				if !noAck {
+					g.pending[entry.ID] = &pendingEntry{consumer: consumer, deliveryTime: now, deliveryCount: 1}
+				}
+			}
+		} else {
+			start, ok := read.ID.Next()
+			var ids []StreamID
+			if ok {
+				ids = g.pendingIDs(start, MaxStreamID, consumer)
+			}
+			if count > 0 && int64(len(ids)) > count {
+				ids = ids[:count]
+			}
+			delivery.Entries = make([]StreamEntry, len(ids))
+			for j, id := range ids {
+				delivery.Entries[j], _ = st.find(id)
+				delivery.Entries[j].ID = id
+			}
+		}
+
+		delivery.LastID = g.lastID
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+// XAck removes the IDs from the pending list of the group and returns how
+// many were pending.
+func (s *MemoryStorage) XAck(key, group string, ids []StreamID) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, g, err := s.lookupGroup(key, group)
+	if errors.Is(err, ErrNoGroup) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var acked int64
+	for _, id := range ids {
+		if _, ok := g.pending[id]; ok {
+			delete(g.pending, id)
+			acked++
+		}
+	}
+	return acked, nil
+}
+
+// PendingSummary is the short form of XPENDING.
+type PendingSummary struct {
+	Count     int64
+	Min, Max  StreamID
+	Consumers []ConsumerPending
+}
+
+type ConsumerPending struct {
+	Name  string
+	Count int64
+}
+
+func (s *MemoryStorage) XPendingSummary(key, group string) (PendingSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, g, err := s.lookupGroup(key, group)
+	if err != nil {
+		return PendingSummary{}, err
+	}
+
+	summary := PendingSummary{Count: int64(len(g.pending))}
+	counts := make(map[string]int64)
+	first := true
+	for id, pe := range g.pending {
+		if first || id.Compare(summary.Min) < 0 {
+			summary.Min = id
+		}
+		if first || id.Compare(summary.Max) > 0 {
+			summary.Max = id
+		}
+		first = false
+		counts[pe.consumer]++
+	}
+
+	for name, count := range counts {
+		summary.Consumers = append(summary.Consumers, ConsumerPending{name, count})
+	}
+	slices.SortFunc(summary.Consumers, func(a, b ConsumerPending) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return summary, nil
+}
+
+// PendingEntry is a line of the extended form of XPENDING.
+type PendingEntry struct {
+	ID            StreamID
+	Consumer      string
+	Idle          int64
+	DeliveryCount int64
+}
+
+// XPending lists the pending entries with IDs in [start, end], at most count
+// of them, optionally only those of consumer and idle for at least minIdle
+// milliseconds.
+func (s *MemoryStorage) XPending(key, group string, start, end StreamID, count int64, consumer string, minIdle, now int64) ([]PendingEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, g, err := s.lookupGroup(key, group)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []PendingEntry
+	for _, id := range g.pendingIDs(start, end, consumer) {
+		if int64(len(entries)) >= count {
+			break
+		}
+		pe := g.pending[id]
+		idle := max(now-pe.deliveryTime, 0)
+		if idle < minIdle {
+			continue
+		}
+		entries = append(entries, PendingEntry{id, pe.consumer, idle, pe.deliveryCount})
+	}
+	return entries, nil
+}
+
+// XClaimOptions are the options of XCLAIM. DeliveryTime is the new delivery
+// time in Unix milliseconds, RetryCount the new delivery count or -1 to count
+// the delivery, and LastID, when not nil, advances the group's last delivered
+// ID. KeepDeleted keeps pending entries that are no longer in the stream, and
+// with Force adds them too, so that AOF rewrites restore such entries.
+type XClaimOptions struct {
+	DeliveryTime int64
+	RetryCount   int64
+	Force        bool
+	JustID       bool
+	KeepDeleted  bool
+	LastID       *StreamID
+}
+
+// XClaim hands the pending entries idle for at least minIdle milliseconds
+// over to consumer and returns them. Pending entries that are no longer in
+// the stream are dropped from the pending list and returned as deleted.
+func (s *MemoryStorage) XClaim(key, group, consumer string, minIdle int64, ids []StreamID, opts XClaimOptions, now int64) (claimed []StreamEntry, deleted []StreamID, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, g, err := s.lookupGroup(key, group)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if opts.LastID != nil && opts.LastID.Compare(g.lastID) > 0 {
+		g.lastID = *opts.LastID
+	}
+
+	for _, id := range ids {
+		entry, exists := st.find(id)
+		pe, pending := g.pending[id]
+		switch {
+		case !pending && (!opts.Force || !exists && !opts.KeepDeleted):
+			continue
+		case !pending:
+			pe = &pendingEntry{}
+			g.pending[id] = pe
+		case !exists && !opts.KeepDeleted:
+			delete(g.pending, id)
+			deleted = append(deleted, id)
+			continue
+		case minIdle > 0 && now-pe.deliveryTime < minIdle:
+			continue
+		}
+
+		if !exists {
+			entry = StreamEntry{ID: id}
+		}
+		claimed = append(claimed, entry)
+		g.claim(pe, consumer, opts.DeliveryTime, opts.RetryCount, opts.JustID)
+	}
+	return claimed, deleted, nil
+}
+
+// claim assigns the pending entry to consumer. A negative retryCount counts
+// one more delivery unless justID is set, as XCLAIM JUSTID does not deliver
+// the entry.
+func (g *consumerGroup) claim(pe *pendingEntry, consumer string, deliveryTime, retryCount int64, justID bool) {
+	g.consumers[consumer] = struct{}{}
+	pe.consumer = consumer
+	pe.deliveryTime = deliveryTime
+	switch {
+	case retryCount >= 0:
+		pe.deliveryCount = retryCount
+	case !justID:
+		pe.deliveryCount++
+	}
+}
+
+// XAutoClaim claims up to count pending entries starting at start that are
+// idle for at least minIdle milliseconds, like XClaim, scanning at most ten
+// times count of them. It returns the ID to continue the scan from, 0-0 once
+// the whole pending list was scanned.
+func (s *MemoryStorage) XAutoClaim(key, group, consumer string, minIdle int64, start StreamID, count int64, justID bool, now int64) (next StreamID, claimed []StreamEntry, deleted []StreamID, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, g, err := s.lookupGroup(key, group)
+	if err != nil {
+		return StreamID{}, nil, nil, err
+	}
+
+	ids := g.pendingIDs(start, MaxStreamID, "")
+	attempts := count * 10
+	i := 0
+	for ; i < len(ids) && attempts > 0 && int64(len(claimed)) < count; i++ {
+		attempts--
+		pe := g.pending[ids[i]]
+		if now-pe.deliveryTime < minIdle {
+			continue
+		}
+		entry, exists := st.find(ids[i])
+		if !exists {
+			delete(g.pending, ids[i])
+			deleted = append(deleted, ids[i])
+			continue
+		}
+		claimed = append(claimed, entry)
+		g.claim(pe, consumer, now, -1, justID)
+	}
+
+	if i < len(ids) {
+		next = ids[i]
+	}
+	return next, claimed, deleted, nil
+}
+
+// lookupGroup returns the stream at key and its consumer group. A missing key
+// is reported as ErrNoGroup too, with a nil stream. Callers must hold s.mu.
+func (s *MemoryStorage) lookupGroup(key, group string) (*stream, *consumerGroup, error) {
+	st, _, err := lookupStream(s, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if st == nil {
+		return nil, nil, ErrNoGroup
+	}
+	g, ok := st.groups[group]
+	if !ok {
+		return st, nil, ErrNoGroup
+	}
+	return st, g, nil
+}
+
+// lookupXGroup is lookupGroup for the XGROUP subcommands, which report a
+// missing key with ErrNoStreamKey.
+func (s *MemoryStorage) lookupXGroup(key, group string) (*stream, *consumerGroup, error) {
+	st, g, err := s.lookupGroup(key, group)
+	if errors.Is(err, ErrNoGroup) && st == nil {
+		return nil, nil, ErrNoStreamKey
+	}
+	return st, g, err
+}
+
+func lookupStream(s *MemoryStorage, key string) (*stream, bool, error) {
+	st, _, ok, err := lookupValue[*stream](s, key)
+	return st, ok, err
+}
@@ -0,0 +1,362 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+// MaxStringSize is the largest value APPEND and SETRANGE may produce, the same
+// limit Redis applies through proto-max-bulk-len.
+const MaxStringSize = 512 * 1024 * 1024
+
+// longDoublePrec is the mantissa size of the x87 long double Redis uses for
+// INCRBYFLOAT. Doing the arithmetic with the same precision gives the same
+// results, e.g. 1.1 + 2.2 is 3.3 and not 3.3000000000000003.
+const longDoublePrec = 64
+
+// longDoubleMaxExp is the binary exponent of the smallest power of two a long
+// double does not reach, in the form big.Float.MantExp returns. Larger numbers
+// are infinite in Redis.
+const longDoubleMaxExp = 16384
+
+var (
+	ErrStringTooLong = errors.New("string exceeds maximum allowed size (proto-max-bulk-len)")
+	ErrNotInteger    = errors.New("value is not an integer or out of range")
+	ErrNotFloat      = errors.New("value is not a valid float")
+	ErrOverflow      = errors.New("increment or decrement would overflow")
+	ErrNaNOrInfinity = errors.New("increment would produce NaN or Infinity")
+)
+
+// MGet returns the values of the keys, with nil for missing keys and keys
+// that do not hold a string. Empty values are returned as empty, not nil.
+func (s *MemoryStorage) MGet(keys ...string) [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		if value, _, ok, _ := lookupValue[[]byte](s, key); ok {
+			values[i] = append([]byte{}, value...)
+		}
+	}
+	return values
+}
+
+// MSet stores every key with its value, clearing their TTLs.
+func (s *MemoryStorage) MSet(keys []string, values [][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mset(keys, values)
+}
+
+// MSetNX stores the keys only if none of them exists, all or nothing.
+func (s *MemoryStorage) MSetNX(keys []string, values [][]byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		if _, ok := s.peek(key); ok {
+			return false
+		}
+	}
+
+	s.mset(keys, values)
+	return true
+}
+
+func (s *MemoryStorage) mset(keys []string, values [][]byte) {
+	for i, key := range keys {
+		s.setItem(key, Item{
+			Value:     bytes.Clone(values[i]),
+			ExpiresAt: -1,
+		})
+	}
+}
+
+func (s *MemoryStorage) GetDel(key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, _, ok, err := lookupValue[[]byte](s, key)
+	if !ok {
+		return nil, false, err
+	}
+
+	s.remove(key)
+	return value, true, nil
+}
+
+// GetEx returns the value at key and optionally changes its TTL: a non-zero
+// expiresAt sets an absolute deadline in Unix milliseconds, persist removes
+// the TTL.
+func (s *MemoryStorage) GetEx(key string, expiresAt int64, persist bool) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, item, ok, err := lookupValue[[]byte](s, key)
+	if !ok {
+		return nil, false, err
+	}
+	value = bytes.Clone(value)
+
+	switch {
+	case expiresAt > 0 && expiresAt <= time.Now().UnixMilli():
+		s.remove(key)
+	case expiresAt > 0:
+		item.ExpiresAt = expiresAt
+		s.setItem(key, item)
+	case persist:
+		item.ExpiresAt = -1
+		s.setItem(key, item)
+	}
+
+	return value, true, nil
+}
+
+// Append adds value to the end of the string stored at key, creating it if
+// needed, and returns the new length. The TTL is kept.
+func (s *MemoryStorage) Append(key string, value []byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	str, item, ok, err := lookupValue[[]byte](s, key)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		str = []byte{}
+		item = Item{ExpiresAt: -1}
+	}
+
+	if len(str)+len(value) > MaxStringSize {
+		return 0, ErrStringTooLong
+	}
+
+	str = append(str, value...)
+	item.Value = str
+	s.setItem(key, item)
+	return int64(len(str)), nil
+}
+
+func (s *MemoryStorage) Strlen(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	str, _, _, err := lookupValue[[]byte](s, key)
+	return int64(len(str)), err
+}
+
+// GetRange returns the substring between start and end inclusive. Negative
+// offsets count from the end of the string.
+func (s *MemoryStorage) GetRange(key string, start, end int64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	str, _, _, err := lookupValue[[]byte](s, key)
+	if err != nil {
+		return nil, err
+	}
+
+	from, to, ok := normalizeRange(start, end, int64(len(str)))
+	if !ok {
+		return []byte{}, nil
+	}
+	return bytes.Clone(str[from : to+1]), nil
+}
+
+// SetRange overwrites part of the string at key starting at offset, padding
+// with zero bytes when the string is shorter, and returns the new length.
+func (s *MemoryStorage) SetRange(key string, offset int64, value []byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	str, item, ok, err := lookupValue[[]byte](s, key)
+	if err != nil {
+		return 0, err
+	}
+	if len(value) == 0 {
+		return int64(len(str)), nil
+	}
+	if offset > MaxStringSize-int64(len(value)) {
+		return 0, ErrStringTooLong
+	}
+	if !ok {
+		item = Item{ExpiresAt: -1}
+	}
+
+	if end := int(offset) + len(value); end > len(str) {
+		str = append(str, make([]byte, end-len(str))...)
+	}
+	copy(str[offset:], value)
+
+	item.Value = str
+	s.setItem(key, item)
+	return int64(len(str)), nil
+}
+
+// Increment adds delta to the integer stored at key, treating a missing key
+// as zero. The TTL is kept.
+func (s *MemoryStorage) Increment(key string, delta int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	str, item, ok, err := lookupValue[[]byte](s, key)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		item = Item{ExpiresAt: -1}
+	}
+
+	var value int64
+	if ok {
+		if value, err = parseInteger(str); err != nil {
+			return 0, err
+		}
+	}
+
+	if value, err = addInteger(value, delta); err != nil {
+		return 0, err
+	}
+
+	item.Value = strconv.AppendInt(nil, value, 10)
+	s.setItem(key, item)
+
+	return value, nil
+}
+
+// IncrementFloat adds delta to the number stored at key and returns the new
+// value formatted the way Redis does, which is also how it is stored.
+func (s *MemoryStorage) IncrementFloat(key string, delta *big.Float) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	str, item, ok, err := lookupValue[[]byte](s, key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		item = Item{ExpiresAt: -1}
+	}
+
+	result, err := addLongDouble(str, ok, delta)
+	if err != nil {
+		return nil, err
+	}
+
+	item.Value = result
+	s.setItem(key, item)
+
+	return bytes.Clone(result), nil
+}
+
+func addInteger(value, delta int64) (int64, error) {
+	if (delta < 0 && value < 0 && delta < math.MinInt64-value) ||
+		(delta > 0 && value > 0 && delta > math.MaxInt64-value) {
+		return 0, ErrOverflow
+	}
+	return value + delta, nil
+}
+
+// addLongDouble adds delta to the number formatted in current, or to zero
+// when there is no current value, and formats the result.
+func addLongDouble(current []byte, exists bool, delta *big.Float) ([]byte, error) {
+	value := new(big.Float).SetPrec(longDoublePrec)
+	if exists {
+		var err error
+		if value, err = ParseLongDouble(current); err != nil {
+			return nil, err
+		}
+	}
+
+	if isLongDoubleInf(value) || isLongDoubleInf(delta) {
+		return nil, ErrNaNOrInfinity
+	}
+	value.Add(value, delta)
+	if isLongDoubleInf(value) {
+		return nil, ErrNaNOrInfinity
+	}
+
+	return FormatLongDouble(value), nil
+}
+
+// isLongDoubleInf reports whether f is infinite or out of the range of a long
+// double.
+func isLongDoubleInf(f *big.Float) bool {
+	return f.IsInf() || f.MantExp(nil) > longDoubleMaxExp
+}
+
+// ParseLongDouble parses a decimal number with the precision of a long double.
+func ParseLongDouble(b []byte) (*big.Float, error) {
+	if len(b) == 0 || len(b) > 5000 || isSpace(b[0]) || isSpace(b[len(b)-1]) {
+		return nil, ErrNotFloat
+	}
+
+	f, _, err := new(big.Float).SetPrec(longDoublePrec).Parse(string(b), 10)
+	if err != nil {
+		return nil, ErrNotFloat
+	}
+	return f, nil
+}
+
+// FormatLongDouble formats f with 17 fractional digits and strips trailing
+// zeros, which is what Redis replies to INCRBYFLOAT.
+func FormatLongDouble(f *big.Float) []byte {
+	out := []byte(f.Text('f', 17))
+	if bytes.IndexByte(out, '.') >= 0 {
+		out = bytes.TrimRight(out, "0")
+		out = bytes.TrimSuffix(out, []byte{'.'})
+	}
+	if string(out) == "-0" {
+		out = []byte("0")
+	}
+	return out
+}
+
+// parseInteger accepts only the canonical form of an integer, like Redis does:
+// no sign for positive numbers, no leading zeros and no surrounding spaces.
+func parseInteger(b []byte) (int64, error) {
+	digits := bytes.TrimPrefix(b, []byte{'-'})
+	if len(digits) == 0 || len(b) > 20 || digits[0] < '0' || digits[0] > '9' ||
+		(digits[0] == '0' && len(b) > 1) {
+		return 0, ErrNotInteger
+	}
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+	return n, nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+// normalizeRange converts an inclusive range with possibly negative offsets
+// into valid indexes for a sequence of the given length.
+func normalizeRange(start, end, length int64) (int64, int64, bool) {
+	if start < 0 {
+		start += length
+	}
+	if end < 0 {
+		end += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= length {
+		end = length - 1
+	}
+	if start > end || length == 0 {
+		return 0, 0, false
+	}
+	return start, end, true
+}
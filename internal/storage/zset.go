@@ -0,0 +1,536 @@
+package storage
+
+import (
+	"errors"
+	"math"
+)
+
+// zset is a sorted set: the dict gives O(1) score lookups and the skiplist
+// keeps the members ordered for rank and range queries.
+type zset struct {
+	dict *dict[float64]
+	zsl  *skiplist
+}
+
+func newZset() *zset {
+	return &zset{
+		dict: newDict[float64](),
+		zsl:  newSkiplist(),
+	}
+}
+
+func (z *zset) len() int {
+	return z.dict.len()
+}
+
+// set adds the member or moves it to its new score.
+func (z *zset) set(member string, score float64) {
+	if current, ok := z.dict.get(member); ok {
+		if current == score {
+			return
+		}
+		z.zsl.delete(current, member)
+	}
+	z.dict.set(member, score)
+	z.zsl.insert(score, member)
+}
+
+func (z *zset) remove(member string) bool {
+	score, ok := z.dict.get(member)
+	if !ok {
+		return false
+	}
+	z.dict.delete(member)
+	z.zsl.delete(score, member)
+	return true
+}
+
+var ErrScoreNaN = errors.New("resulting score is not a number (NaN)")
+
+// ZAddFlags are the NX, XX, GT and LT options of ZADD.
+type ZAddFlags int
+
+const (
+	ZAddNX ZAddFlags = 1 << iota
+	ZAddXX
+	ZAddGT
+	ZAddLT
+)
+
+// ZMember is a member of a sorted set with its score.
+type ZMember struct {
+	Member []byte
+	Score  float64
+}
+
+// ZRangeBy selects how ZRangeSpec interprets its bounds.
+type ZRangeBy int
+
+const (
+	ZRangeByRank ZRangeBy = iota
+	ZRangeByScore
+	ZRangeByLex
+)
+
+// ZRangeSpec describes a ZRANGE query. Start and Stop are used by rank, Score
+// and Lex by the other kinds, which may also skip Offset elements and return
+// at most Count ones, a negative Count meaning all of them.
+type ZRangeSpec struct {
+	By          ZRangeBy
+	Rev         bool
+	Start, Stop int64
+	Score       ScoreRange
+	Lex         LexRange
+	Offset      int64
+	Count       int64
+}
+
+// Aggregate is how ZUNIONSTORE and ZINTERSTORE combine the scores of a member.
+type Aggregate int
+
+const (
+	AggregateSum Aggregate = iota
+	AggregateMin
+	AggregateMax
+)
+
+// ZAdd adds the members with their scores or updates the scores of existing
+// ones, as restricted by flags. It returns how many members were added and
+// how many existing ones got a different score.
+func (s *MemoryStorage) ZAdd(key string, flags ZAddFlags, scores []float64, members [][]byte) (added, updated int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	z, ok, err := lookupZset(s, key)
+	if err != nil || (!ok && flags&ZAddXX != 0) {
+		return 0, 0, err
+	}
+	if !ok {
+		z, _ = s.writableZset(key)
+	}
+
+	for i, member := range members {
+		score := scores[i]
+		current, exists := z.dict.get(string(member))
+
+		switch {
+		case exists && flags&ZAddNX != 0, !exists && flags&ZAddXX != 0:
+			continue
+		case !exists:
+			z.set(string(member), score)
+			added++
+		case flags&ZAddGT != 0 && score <= current, flags&ZAddLT != 0 && score >= current:
+			continue
+		case score != current:
+			z.set(string(member), score)
+			updated++
+		}
+	}
+
+	if added > 0 {
+		s.signalKeyAsReady(key)
+	}
+	return added, updated, nil
+}
+
+// ZIncrBy adds delta to the score of member, as ZINCRBY and ZADD INCR do, and
+// returns the new score. It reports false when flags prevented the update.
+func (s *MemoryStorage) ZIncrBy(key string, member []byte, delta float64, flags ZAddFlags) (float64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	z, ok, err := lookupZset(s, key)
+	if err != nil {
+		return 0, false, err
+	}
+
+	var current float64
+	exists := false
+	if ok {
+		current, exists = z.dict.get(string(member))
+	}
+
+	if (exists && flags&ZAddNX != 0) || (!exists && flags&ZAddXX != 0) {
+		return 0, false, nil
+	}
+
+	score := current + delta
+	if math.IsNaN(score) {
+		return 0, false, ErrScoreNaN
+	}
+	if exists && ((flags&ZAddGT != 0 && score <= current) || (flags&ZAddLT != 0 && score >= current)) {
+		return 0, false, nil
+	}
+
+	if !ok {
+		z, _ = s.writableZset(key)
+	}
+	z.set(string(member), score)
+	if !exists {
+		s.signalKeyAsReady(key)
+	}
+	return score, true, nil
+}
+
+// ZRem removes the members and returns how many existed. The key is deleted
+// together with its last member.
+func (s *MemoryStorage) ZRem(key string, members [][]byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	z, ok, err := lookupZset(s, key)
+	if !ok {
+		return 0, err
+	}
+
+	var removed int64
+	for _, member := range members {
+		if z.remove(string(member)) {
+			removed++
+		}
+	}
+
+	if z.len() == 0 {
+		s.remove(key)
+	}
+	return removed, nil
+}
+
+func (s *MemoryStorage) ZScore(key string, member []byte) (float64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	z, ok, err := lookupZset(s, key)
+	if !ok {
+		return 0, false, err
+	}
+	score, ok := z.dict.get(string(member))
+	return score, ok, nil
+}
+
+func (s *MemoryStorage) ZCard(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	z, ok, err := lookupZset(s, key)
+	if !ok {
+		return 0, err
+	}
+	return int64(z.len()), nil
+}
+
+// ZRank returns the 0-based rank of member, counted from the highest score
+// when rev is set, together with its score.
+func (s *MemoryStorage) ZRank(key string, member []byte, rev bool) (int64, float64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	z, ok, err := lookupZset(s, key)
+	if !ok {
+		return 0, 0, false, err
+	}
+
+	score, ok := z.dict.get(string(member))
+	if !ok {
+		return 0, 0, false, nil
+	}
+
+	rank := int64(z.zsl.rank(score, string(member)))
+	if rev {
+		return int64(z.len()) - rank, score, true, nil
+	}
+	return rank - 1, score, true, nil
+}
+
+// ZCount returns how many members have a score in r.
+func (s *MemoryStorage) ZCount(key string, r ScoreRange) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	z, ok, err := lookupZset(s, key)
+	if !ok {
+		return 0, err
+	}
+
+	first := z.zsl.firstInRange(r)
+	if first == nil {
+		return 0, nil
+	}
+	last := z.zsl.lastInRange(r)
+	return int64(z.zsl.rank(last.score, last.member) - z.zsl.rank(first.score, first.member) + 1), nil
+}
+
+func (s *MemoryStorage) ZRange(key string, spec ZRangeSpec) ([]ZMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	z, ok, err := lookupZset(s, key)
+	if !ok {
+		return nil, err
+	}
+	return z.rangeOf(spec), nil
+}
+
+// ZRangeStore stores the result of ZRange at dst, replacing any value there,
+// and returns its size. An empty result deletes dst.
+func (s *MemoryStorage) ZRangeStore(dst, src string, spec ZRangeSpec) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	z, ok, err := lookupZset(s, src)
+	if err != nil {
+		return 0, err
+	}
+
+	var members []ZMember
+	if ok {
+		members = z.rangeOf(spec)
+	}
+
+	result := newZset()
+	for _, m := range members {
+		result.set(string(m.Member), m.Score)
+	}
+	s.storeZset(dst, result)
+	return int64(result.len()), nil
+}
+
+func (z *zset) rangeOf(spec ZRangeSpec) []ZMember {
+	var (
+		node  *skiplistNode
+		count = int64(z.len())
+	)
+
+	switch spec.By {
+	case ZRangeByRank:
+		from, to, ok := normalizeRange(spec.Start, spec.Stop, int64(z.len()))
+		if !ok {
+			return nil
+		}
+		count = to - from + 1
+		if spec.Rev {
+			node = z.zsl.byRank(z.len() - int(from))
+		} else {
+			node = z.zsl.byRank(int(from) + 1)
+		}
+
+	case ZRangeByScore:
+		if spec.Rev {
+			node = z.zsl.lastInRange(spec.Score)
+		} else {
+			node = z.zsl.firstInRange(spec.Score)
+		}
+
+	case ZRangeByLex:
+		if spec.Rev {
+			node = z.zsl.lastInLexRange(spec.Lex)
+		} else {
+			node = z.zsl.firstInLexRange(spec.Lex)
+		}
+	}
+
+	next := func(n *skiplistNode) *skiplistNode {
+		if spec.Rev {
+			return n.backward
+		}
+		return n.level[0].forward
+	}
+	inRange := func(n *skiplistNode) bool {
+		switch spec.By {
+		case ZRangeByScore:
+			return spec.Score.aboveMin(n.score) && spec.Score.belowMax(n.score)
+		case ZRangeByLex:
+			return spec.Lex.aboveMin(n.member) && spec.Lex.belowMax(n.member)
+		default:
+			return true
+		}
+	}
+
+	if spec.By != ZRangeByRank {
+		if spec.Offset < 0 {
+			return nil
+		}
+		for i := int64(0); i < spec.Offset && node != nil; i++ {
+			node = next(node)
+		}
+		if spec.Count >= 0 {
+			count = spec.Count
+		}
+	}
+
+	var members []ZMember
+	for ; node != nil && int64(len(members)) < count && inRange(node); node = next(node) {
+		members = append(members, ZMember{Member: []byte(node.member), Score: node.score})
+	}
+	return members
+}
+
+// ZPop removes up to count members with the lowest scores, or the highest
+// ones when max is set.
+func (s *MemoryStorage) ZPop(key string, count int64, max bool) ([]ZMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	z, ok, err := lookupZset(s, key)
+	if !ok {
+		return nil, err
+	}
+	return s.zpop(key, z, count, max), nil
+}
+
+// ZPopFirst pops one member from the first non-empty sorted set among keys,
+// which is what BZPOPMIN and BZPOPMAX serve.
+func (s *MemoryStorage) ZPopFirst(keys []string, max bool) (string, ZMember, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		z, ok, err := lookupZset(s, key)
+		if err != nil {
+			return "", ZMember{}, false, err
+		}
+		if ok {
+			return key, s.zpop(key, z, 1, max)[0], true, nil
+		}
+	}
+	return "", ZMember{}, false, nil
+}
+
+func (s *MemoryStorage) zpop(key string, z *zset, count int64, max bool) []ZMember {
+	members := make([]ZMember, 0, min(count, int64(z.len())))
+	for int64(len(members)) < count && z.len() > 0 {
+		node := z.zsl.header.level[0].forward
+		if max {
+			node = z.zsl.tail
+		}
+		members = append(members, ZMember{Member: []byte(node.member), Score: node.score})
+		z.remove(node.member)
+	}
+
+	if z.len() == 0 {
+		s.remove(key)
+	}
+	return members
+}
+
+// ZStore stores the union, or the intersection when inter is set, of the
+// sorted sets at keys in dst and returns its size. Scores are multiplied by
+// the weights and combined with aggregate. Plain sets count as sorted sets
+// with all scores 1.
+func (s *MemoryStorage) ZStore(dst string, keys []string, weights []float64, aggregate Aggregate, inter bool) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sources := make([]*dict[float64], len(keys))
+	for i, key := range keys {
+		item, ok := s.peek(key)
+		if !ok {
+			continue
+		}
+		switch v := item.Value.(type) {
+		case *zset:
+			sources[i] = v.dict
+		case *set:
+			scores := newDict[float64]()
+			for member := range v.all() {
+				scores.set(member, 1)
+			}
+			sources[i] = scores
+		default:
+			return 0, ErrWrongType
+		}
+	}
+
+	result := newZset()
+	if inter {
+		smallest := 0
+		for i, src := range sources {
+			if src.len() < sources[smallest].len() {
+				smallest = i
+			}
+		}
+
+	members:
+		for member := range sources[smallest].all() {
+			var score float64
+			for i, src := range sources {
+				value, ok := src.get(member)
+				if !ok {
+					continue members
+				}
+				score = aggregateScore(aggregate, score, weightedScore(value, weights[i]), i == 0)
+			}
+			result.set(member, score)
+		}
+	} else {
+		scores := make(map[string]float64)
+		for i, src := range sources {
+			for member, value := range src.all() {
+				current, seen := scores[member]
+				scores[member] = aggregateScore(aggregate, current, weightedScore(value, weights[i]), !seen)
+			}
+		}
+		for member, score := range scores {
+			result.set(member, score)
+		}
+	}
+
+	s.storeZset(dst, result)
+	return int64(result.len()), nil
+}
+
+func weightedScore(score, weight float64) float64 {
+	score *= weight
+	// inf * 0 is NaN, Redis treats it as zero.
+	if math.IsNaN(score) {
+		return 0
+	}
+	return score
+}
+
+func aggregateScore(aggregate Aggregate, current, score float64, first bool) float64 {
+	if first {
+		return score
+	}
+	switch aggregate {
+	case AggregateMin:
+		return min(current, score)
+	case AggregateMax:
+		return max(current, score)
+	default:
+		// -inf + inf is NaN, Redis treats it as zero.
+		if sum := current + score; !math.IsNaN(sum) {
+			return sum
+		}
+		return 0
+	}
+}
+
+// storeZset replaces the value at dst with z, deleting dst when z is empty.
+// Callers must hold s.mu.
+func (s *MemoryStorage) storeZset(dst string, z *zset) {
+	s.remove(dst)
+	if z.len() > 0 {
+		s.setItem(dst, Item{Value: z, ExpiresAt: -1})
+		s.signalKeyAsReady(dst)
+	}
+}
+
+func lookupZset(s *MemoryStorage, key string) (*zset, bool, error) {
+	z, _, ok, err := lookupValue[*zset](s, key)
+	return z, ok, err
+}
+
+// writableZset returns the sorted set at key for modification, storing an
+// empty one without a TTL if the key does not exist. Callers must hold s.mu.
+func (s *MemoryStorage) writableZset(key string) (*zset, error) {
+	z, ok, err := lookupZset(s, key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		z = newZset()
+		s.setItem(key, Item{Value: z, ExpiresAt: -1})
+	}
+	return z, nil
+}